@@ -0,0 +1,17 @@
+package main
+
+import "slices"
+
+// accountStatus returns why an account must not be emailed, or "" when it
+// may be. Suspended accounts and accounts whose email address is not
+// confirmed are skipped; deleted accounts have no document in the users
+// collection anymore, the next user reload drops them.
+func (u User) accountStatus() string {
+	if slices.Contains(u.Roles, "suspended") {
+		return "account suspended"
+	}
+	if u.Public != nil && !*u.Public {
+		return "email address not confirmed"
+	}
+	return ""
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultArchiveRetention applies to email types without their own retention
+	defaultArchiveRetention = 90 * 24 * time.Hour
+	// archivePurgeInterval is how often expired archived emails are removed
+	archivePurgeInterval = time.Hour
+)
+
+// EmailArchive stores rendered emails grouped by type (the template name), so
+// retention can differ per type. Implementations must be safe for concurrent use.
+type EmailArchive interface {
+	// Store saves a rendered email (RFC 822 message) under a unique name
+	Store(emailType, name string, message []byte) error
+	// Types returns the email types that have archived emails
+	Types() ([]string, error)
+	// Purge removes the emails of a type archived before the given time
+	Purge(emailType string, before time.Time) (int, error)
+}
+
+// FileArchive stores archived emails as .eml files in <dir>/<type>/
+type FileArchive struct {
+	Dir string
+}
+
+// NewFileArchive creates a filesystem archive, creating its directory if needed
+func NewFileArchive(dir string) (*FileArchive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %v", err)
+	}
+	return &FileArchive{Dir: dir}, nil
+}
+
+// Store writes an email to <dir>/<type>/<name>.eml
+func (a *FileArchive) Store(emailType, name string, message []byte) error {
+	typeDir := filepath.Join(a.Dir, filepath.Base(emailType))
+	if err := os.MkdirAll(typeDir, 0700); err != nil {
+		return fmt.Errorf("failed to create archive directory: %v", err)
+	}
+	path := filepath.Join(typeDir, filepath.Base(name)+".eml")
+	if err := os.WriteFile(path, message, 0600); err != nil {
+		return fmt.Errorf("failed to archive email: %v", err)
+	}
+	return nil
+}
+
+// Types lists the type directories of the archive
+func (a *FileArchive) Types() ([]string, error) {
+	entries, err := os.ReadDir(a.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive directory: %v", err)
+	}
+	var types []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			types = append(types, entry.Name())
+		}
+	}
+	return types, nil
+}
+
+// Purge removes .eml files of a type last modified before the given time
+func (a *FileArchive) Purge(emailType string, before time.Time) (int, error) {
+	typeDir := filepath.Join(a.Dir, filepath.Base(emailType))
+	entries, err := os.ReadDir(typeDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read archive directory: %v", err)
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".eml") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(typeDir, entry.Name())); err != nil {
+			return purged, fmt.Errorf("failed to purge archived email: %v", err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// parseArchiveRetention parses per-type retention such as
+// "default=2160h,nostr_direct_message=720h"
+func parseArchiveRetention(value string) (map[string]time.Duration, error) {
+	retention := make(map[string]time.Duration)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		emailType, durationStr, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid retention %q, expected type=duration", entry)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(durationStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention for %s: %v", emailType, err)
+		}
+		retention[strings.TrimSpace(emailType)] = duration
+	}
+	return retention, nil
+}
+
+// retentionFor returns how long emails of a type are kept
+func retentionFor(retention map[string]time.Duration, emailType string) time.Duration {
+	if duration, exists := retention[emailType]; exists {
+		return duration
+	}
+	if duration, exists := retention["default"]; exists {
+		return duration
+	}
+	return defaultArchiveRetention
+}
+
+// purgeArchive removes all archived emails past their type's retention
+func purgeArchive(archive EmailArchive, retention map[string]time.Duration) error {
+	types, err := archive.Types()
+	if err != nil {
+		return err
+	}
+	for _, emailType := range types {
+		before := time.Now().Add(-retentionFor(retention, emailType))
+		purged, err := archive.Purge(emailType, before)
+		if err != nil {
+			return err
+		}
+		if purged > 0 {
+			fmt.Printf("🧹 Purged %d archived %s emails\n", purged, emailType)
+		}
+	}
+	return nil
+}
+
+// runArchivePurge purges the archive now and then every archivePurgeInterval
+func runArchivePurge(archive EmailArchive, retention map[string]time.Duration) {
+	for {
+		if err := purgeArchive(archive, retention); err != nil {
+			fmt.Printf("⚠️  Failed to purge email archive: %v\n", err)
+		}
+		time.Sleep(archivePurgeInterval)
+	}
+}
+
+// archiveEmail stores a sent email in the archive, if one is configured
+func (es *EmailService) archiveEmail(job EmailJob) {
+	if es.Archive == nil {
+		return
+	}
+
+	var message bytes.Buffer
+	if _, err := es.jobMessage(job).Message().WriteTo(&message); err != nil {
+		fmt.Printf("⚠️  Failed to render email for archive: %v\n", err)
+		return
+	}
+
+	emailType := job.Type
+	if emailType == "" {
+		emailType = "other"
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000Z")
+	if job.EventID != "" {
+		name += "-" + job.EventID
+	}
+	if err := es.Archive.Store(emailType, name, message.Bytes()); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// articleExcerptLength is how many characters of an article are quoted in emails
+const articleExcerptLength = 600
+
+// truncateText shortens text to about maxLength characters, preferring to cut
+// at the end of a paragraph and otherwise at a word boundary
+func truncateText(text string, maxLength int) string {
+	text = strings.TrimSpace(text)
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return text
+	}
+
+	cut := string(runes[:maxLength])
+	if i := strings.LastIndex(cut, "\n\n"); i > len(cut)/2 {
+		return strings.TrimSpace(cut[:i]) + "\n\n…"
+	}
+	if i := strings.LastIndexAny(cut, " \n"); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimSpace(cut) + "…"
+}
+
+// articleAddress returns the "kind:pubkey:d" coordinate of an addressable event
+func articleAddress(event *nostr.Event) string {
+	return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+}
+
+// articleURL returns a web link for the latest version of an article
+func articleURL(event *nostr.Event, relays []string) string {
+	naddr, err := nip19.EncodeEntity(event.PubKey, event.Kind, event.Tags.GetD(), relays)
+	if err != nil {
+		return noteURL(event.ID)
+	}
+	return fmt.Sprintf("https://njump.me/%s", naddr)
+}
+
+// processArticle notifies users mentioned in a long-form article (kind 30023).
+// Every edit of an article is a new event, so articles are deduplicated by
+// their address and only the first published version is emailed.
+func processArticle(event *nostr.Event, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	address := articleAddress(event)
+	alreadyProcessed, err := emailService.Notes.IsNoteProcessed(address)
+	if err != nil {
+		fmt.Printf("⚠️  Error checking if article is processed: %v\n", err)
+		return
+	}
+	if alreadyProcessed {
+		return
+	}
+
+	title := "Untitled article"
+	if titleTag := event.Tags.Find("title"); titleTag != nil && titleTag[1] != "" {
+		title = titleTag[1]
+	}
+	mention := Mention{
+		Context: "an article",
+		Title:   title,
+		URL:     articleURL(event, config.Relays),
+		Excerpt: truncateText(event.Content, articleExcerptLength),
+	}
+
+	matches := mentionMatches(event, hexToUser, config.MentionMatching)
+	for _, user := range usersForPubkeys(matches.Pubkeys, event.PubKey, hexToUser) {
+		mention.Match = matches.TypeFor(user)
+		notifyMention(event, user, mention, npubToUser, sqliteDB, emailService)
+		if err := emailService.Notes.MarkNoteProcessed(address, event.PubKey, "relay", user.Email); err != nil {
+			fmt.Printf("⚠️  Error marking article as processed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// avatarSize is the width and height of embedded avatars in pixels,
+	// twice the size they are shown at for high-density screens
+	avatarSize = 96
+	// avatarFilename names the embedded avatar, emails refer to it as
+	// cid:avatar.png
+	avatarFilename = "avatar.png"
+	// avatarTimeout bounds fetching a profile picture
+	avatarTimeout = 10 * time.Second
+	// avatarMaxBytes bounds the size of profile pictures we download
+	avatarMaxBytes = 5 << 20
+	// avatarMaxDimension bounds the width and height of profile pictures we
+	// decode, so small files can't expand to huge images
+	avatarMaxDimension = 4096
+	// avatarCacheTTL is how long fetched avatars, and failures to fetch
+	// them, are reused
+	avatarCacheTTL = 24 * time.Hour
+	// avatarCacheSize bounds the cached avatars, the cache starts over when
+	// it is full
+	avatarCacheSize = 1000
+)
+
+// senderAvatar is a cached avatar
+type senderAvatar struct {
+	PictureURL string // the profile picture it was made from
+	Data       []byte // PNG, nil when the picture could not be used
+	FetchedAt  time.Time
+}
+
+// SenderAvatars embeds the profile pictures of senders in emails, so
+// recipients recognize who messaged them. Pictures are fetched from the
+// picture URL of the sender's profile (kind 0), cropped to a square and
+// resized, and attached inline, so mail clients show them without loading
+// remote images.
+type SenderAvatars struct {
+	Profiles *ProfileNames
+	Client   *http.Client
+
+	mu      sync.Mutex
+	avatars map[string]senderAvatar // by hex pubkey
+}
+
+// NewSenderAvatars creates avatars for the profiles of a name resolver
+func NewSenderAvatars(profiles *ProfileNames) *SenderAvatars {
+	dialer := &net.Dialer{Timeout: avatarTimeout, Control: dialPublicOnly}
+	return &SenderAvatars{
+		Profiles: profiles,
+		Client: &http.Client{
+			Timeout:   avatarTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+		avatars: make(map[string]senderAvatar),
+	}
+}
+
+// dialPublicOnly refuses connections to loopback, private and link-local
+// addresses: picture URLs and lightning addresses are chosen by anyone on
+// nostr and must not make the daemon fetch from the network it runs in
+func dialPublicOnly(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to fetch from %s, which is not a public address", host)
+	}
+	return nil
+}
+
+// Attachment returns the avatar of a pubkey as an inline attachment, false
+// when its profile has no usable picture
+func (a *SenderAvatars) Attachment(hexPubkey string) (EmailAttachment, bool) {
+	pictureURL := a.Profiles.Picture(hexPubkey)
+	if pictureURL == "" {
+		return EmailAttachment{}, false
+	}
+
+	a.mu.Lock()
+	avatar, cached := a.avatars[hexPubkey]
+	a.mu.Unlock()
+	if !cached || avatar.PictureURL != pictureURL || time.Since(avatar.FetchedAt) > avatarCacheTTL {
+		avatar = senderAvatar{PictureURL: pictureURL, FetchedAt: time.Now()}
+		data, err := a.fetch(pictureURL)
+		if err != nil {
+			fmt.Printf("⚠️  No avatar for %s: %v\n", hexPubkey, err)
+		}
+		avatar.Data = data
+
+		a.mu.Lock()
+		if len(a.avatars) >= avatarCacheSize {
+			a.avatars = make(map[string]senderAvatar)
+		}
+		a.avatars[hexPubkey] = avatar
+		a.mu.Unlock()
+	}
+
+	if avatar.Data == nil {
+		return EmailAttachment{}, false
+	}
+	return EmailAttachment{Filename: avatarFilename, ContentType: "image/png", Data: avatar.Data, Inline: true}, true
+}
+
+// fetch downloads a profile picture and returns it as a PNG avatar; JPEG,
+// PNG and GIF pictures are supported
+func (a *SenderAvatars) fetch(pictureURL string) ([]byte, error) {
+	resp, err := a.Client.Get(pictureURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", pictureURL, resp.StatusCode)
+	}
+	picture, err := io.ReadAll(io.LimitReader(resp.Body, avatarMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(picture) > avatarMaxBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", pictureURL, avatarMaxBytes)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(picture))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pictureURL, err)
+	}
+	if config.Width > avatarMaxDimension || config.Height > avatarMaxDimension {
+		return nil, fmt.Errorf("%s is %dx%d pixels, larger than %d", pictureURL, config.Width, config.Height, avatarMaxDimension)
+	}
+	img, _, err := image.Decode(bytes.NewReader(picture))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pictureURL, err)
+	}
+
+	var avatar bytes.Buffer
+	if err := png.Encode(&avatar, resizeAvatar(img, avatarSize)); err != nil {
+		return nil, err
+	}
+	return avatar.Bytes(), nil
+}
+
+// resizeAvatar crops the center square of an image and scales it to size
+// pixels, averaging the pixels each one covers
+func resizeAvatar(src image.Image, size int) *image.RGBA64 {
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	left := bounds.Min.X + (bounds.Dx()-side)/2
+	top := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewRGBA64(image.Rect(0, 0, size, size))
+	if side == 0 {
+		return dst
+	}
+	for y := 0; y < size; y++ {
+		y0, y1 := top+y*side/size, top+(y+1)*side/size
+		y1 = max(y1, y0+1)
+		for x := 0; x < size; x++ {
+			x0, x1 := left+x*side/size, left+(x+1)*side/size
+			x1 = max(x1, x0+1)
+			var r, g, b, alpha, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, alpha, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), alpha+uint64(pa), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(alpha / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Suppression reasons of bounce and complaint webhooks
+const (
+	bounceReason    = "bounce"
+	complaintReason = "complaint"
+)
+
+// Bounce webhook providers, the last element of /webhooks/<provider>
+const (
+	bounceProviderSES      = "ses"
+	bounceProviderMailgun  = "mailgun"
+	bounceProviderSendGrid = "sendgrid"
+)
+
+// snsConfirmTimeout bounds confirming an SNS subscription
+const snsConfirmTimeout = 10 * time.Second
+
+// bounce is an address a provider reported as hard-bounced or complaining
+type bounce struct {
+	Email  string
+	Reason string // bounceReason or complaintReason
+}
+
+// parseBounces reads the hard bounces and complaints of a webhook body in the
+// format of a provider. Soft bounces are ignored, providers retry them.
+// For SES the SNS subscription confirmation URL is returned as well.
+func parseBounces(provider string, body []byte) ([]bounce, string, error) {
+	switch provider {
+	case bounceProviderSES:
+		return parseSESBounces(body)
+	case bounceProviderMailgun:
+		bounces, err := parseMailgunBounces(body)
+		return bounces, "", err
+	case bounceProviderSendGrid:
+		bounces, err := parseSendGridBounces(body)
+		return bounces, "", err
+	}
+	return nil, "", fmt.Errorf("unknown provider %q", provider)
+}
+
+// parseSESBounces reads an SES notification delivered by SNS
+func parseSESBounces(body []byte) ([]bounce, string, error) {
+	var envelope struct {
+		Type         string
+		Message      string
+		SubscribeURL string
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, "", fmt.Errorf("invalid SNS message: %v", err)
+	}
+	if envelope.Type == "SubscriptionConfirmation" {
+		return nil, envelope.SubscribeURL, nil
+	}
+	if envelope.Type != "Notification" {
+		return nil, "", nil
+	}
+
+	var notification struct {
+		NotificationType string `json:"notificationType"`
+		EventType        string `json:"eventType"` // configuration set events
+		Bounce           struct {
+			BounceType        string `json:"bounceType"`
+			BouncedRecipients []struct {
+				EmailAddress string `json:"emailAddress"`
+			} `json:"bouncedRecipients"`
+		} `json:"bounce"`
+		Complaint struct {
+			ComplainedRecipients []struct {
+				EmailAddress string `json:"emailAddress"`
+			} `json:"complainedRecipients"`
+		} `json:"complaint"`
+	}
+	if err := json.Unmarshal([]byte(envelope.Message), &notification); err != nil {
+		return nil, "", fmt.Errorf("invalid SES notification: %v", err)
+	}
+
+	var bounces []bounce
+	notificationType := notification.NotificationType
+	if notificationType == "" {
+		notificationType = notification.EventType
+	}
+	switch notificationType {
+	case "Bounce":
+		if notification.Bounce.BounceType != "Permanent" {
+			return nil, "", nil
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			bounces = append(bounces, bounce{recipient.EmailAddress, bounceReason})
+		}
+	case "Complaint":
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			bounces = append(bounces, bounce{recipient.EmailAddress, complaintReason})
+		}
+	}
+	return bounces, "", nil
+}
+
+// parseMailgunBounces reads a Mailgun webhook
+func parseMailgunBounces(body []byte) ([]bounce, error) {
+	var webhook struct {
+		EventData struct {
+			Event     string `json:"event"`
+			Severity  string `json:"severity"`
+			Recipient string `json:"recipient"`
+		} `json:"event-data"`
+	}
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid Mailgun webhook: %v", err)
+	}
+
+	event := webhook.EventData
+	switch {
+	case event.Event == "failed" && event.Severity == "permanent":
+		return []bounce{{event.Recipient, bounceReason}}, nil
+	case event.Event == "complained":
+		return []bounce{{event.Recipient, complaintReason}}, nil
+	}
+	return nil, nil
+}
+
+// parseSendGridBounces reads a batch of SendGrid events; blocks are soft
+func parseSendGridBounces(body []byte) ([]bounce, error) {
+	var events []struct {
+		Email string `json:"email"`
+		Event string `json:"event"`
+		Type  string `json:"type"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, fmt.Errorf("invalid SendGrid webhook: %v", err)
+	}
+
+	var bounces []bounce
+	for _, event := range events {
+		switch {
+		case event.Event == "bounce" && event.Type != "blocked":
+			bounces = append(bounces, bounce{event.Email, bounceReason})
+		case event.Event == "spamreport":
+			bounces = append(bounces, bounce{event.Email, complaintReason})
+		}
+	}
+	return bounces, nil
+}
+
+// confirmSNSSubscription visits the confirmation URL of an SNS subscription,
+// which must be an AWS endpoint
+func confirmSNSSubscription(subscribeURL string) error {
+	parsed, err := url.Parse(subscribeURL)
+	if err != nil || parsed.Scheme != "https" || !strings.HasSuffix(parsed.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("refusing to confirm SNS subscription at %q", subscribeURL)
+	}
+	client := &http.Client{Timeout: snsConfirmTimeout}
+	resp, err := client.Get(subscribeURL)
+	if err != nil {
+		return fmt.Errorf("failed to confirm SNS subscription: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to confirm SNS subscription: %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookAuthorized reports whether a webhook request carries the token.
+// Providers cannot send bearer tokens, so the token is part of the webhook
+// URL (?token=) or its basic auth password.
+func webhookAuthorized(r *http.Request, token string) bool {
+	given := r.URL.Query().Get("token")
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// handleBounces accepts the bounce and complaint webhooks of a provider and
+// suppresses the addresses they report, see webhookAuthorized
+func handleBounces(provider string, suppressions SuppressionList, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !webhookAuthorized(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		bounces, subscribeURL, err := parseBounces(provider, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if subscribeURL != "" {
+			if err := confirmSNSSubscription(subscribeURL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			fmt.Println("📮 Confirmed the SNS subscription for SES bounces")
+		}
+
+		for _, bounce := range bounces {
+			if bounce.Email == "" {
+				continue
+			}
+			if err := suppressions.Suppress(bounce.Email, bounce.Reason); err != nil {
+				// The provider retries the webhook
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("⛔ Suppressed %s after a %s reported by %s\n", normalizeEmail(bounce.Email), bounce.Reason, provider)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readBounceFixture reads a webhook body captured from a provider
+func readBounceFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "bounces", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseBounces(t *testing.T) {
+	tests := []struct {
+		provider, fixture string
+		want              []bounce
+		subscribeURL      string
+	}{
+		{bounceProviderSES, "ses_bounce.json", []bounce{
+			{"alice@example.org", bounceReason},
+			{"bob@example.org", bounceReason},
+		}, ""},
+		{bounceProviderSES, "ses_event_bounce.json", []bounce{{"alice@example.org", bounceReason}}, ""},
+		{bounceProviderSES, "ses_transient_bounce.json", nil, ""},
+		{bounceProviderSES, "ses_complaint.json", []bounce{{"carol@example.org", complaintReason}}, ""},
+		{bounceProviderSES, "ses_delivery.json", nil, ""},
+		{bounceProviderSES, "ses_subscription_confirmation.json", nil,
+			"https://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription&TopicArn=arn:aws:sns:eu-west-1:123456789012:ses-bounces&Token=2336412f37fb687f5d51e6e241d09c805a5a57b30d712f794cc5f6a988666d92768dd60a747ba6f3beb71854e285d6ad02428b09ceece29417f1f02d609c582afbacc99c583a916b9981dd2728f4ae6fdb82efd087cc3b7849e05798d2d2785c03b0879594eeac82c01f235d0e717736"},
+		{bounceProviderMailgun, "mailgun_permanent_failure.json", []bounce{{"alice@example.org", bounceReason}}, ""},
+		{bounceProviderMailgun, "mailgun_temporary_failure.json", nil, ""},
+		{bounceProviderMailgun, "mailgun_complained.json", []bounce{{"carol@example.org", complaintReason}}, ""},
+		{bounceProviderMailgun, "mailgun_delivered.json", nil, ""},
+		// Blocks and deferrals are soft, the batch also holds deliveries
+		{bounceProviderSendGrid, "sendgrid_events.json", []bounce{
+			{"alice@example.org", bounceReason},
+			{"carol@example.org", complaintReason},
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			bounces, subscribeURL, err := parseBounces(tt.provider, readBounceFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(bounces, tt.want) {
+				t.Errorf("bounces = %v, want %v", bounces, tt.want)
+			}
+			if subscribeURL != tt.subscribeURL {
+				t.Errorf("subscribe URL = %q, want %q", subscribeURL, tt.subscribeURL)
+			}
+		})
+	}
+}
+
+func TestParseBouncesRejectsMalformedBodies(t *testing.T) {
+	sesBounce := readBounceFixture(t, "ses_bounce.json")
+	mailgunFailure := readBounceFixture(t, "mailgun_permanent_failure.json")
+	sendGridEvents := readBounceFixture(t, "sendgrid_events.json")
+
+	tests := []struct {
+		name, provider string
+		body           []byte
+	}{
+		{"SES empty", bounceProviderSES, nil},
+		{"SES truncated", bounceProviderSES, sesBounce[:len(sesBounce)/2]},
+		{"SES not JSON", bounceProviderSES, []byte("Type=Notification")},
+		{"SES truncated notification", bounceProviderSES, readBounceFixture(t, "ses_invalid_message.json")},
+		{"Mailgun empty", bounceProviderMailgun, nil},
+		{"Mailgun truncated", bounceProviderMailgun, mailgunFailure[:len(mailgunFailure)/2]},
+		{"Mailgun form post", bounceProviderMailgun, []byte("event=failed&recipient=alice%40example.org")},
+		{"Mailgun batch", bounceProviderMailgun, sendGridEvents},
+		{"SendGrid empty", bounceProviderSendGrid, nil},
+		{"SendGrid truncated", bounceProviderSendGrid, sendGridEvents[:len(sendGridEvents)/2]},
+		{"SendGrid single event", bounceProviderSendGrid, mailgunFailure},
+		{"unknown provider", "postmark", sesBounce},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if bounces, _, err := parseBounces(tt.provider, tt.body); err == nil {
+				t.Errorf("parseBounces = %v, want an error", bounces)
+			}
+		})
+	}
+}
+
+func TestConfirmSNSSubscriptionOnlyVisitsAWS(t *testing.T) {
+	for _, subscribeURL := range []string{
+		"https://attacker.example.org/?Action=ConfirmSubscription",
+		"https://sns.eu-west-1.amazonaws.com.example.org/",
+		"http://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription",
+		"://invalid",
+	} {
+		if err := confirmSNSSubscription(subscribeURL); err == nil || !strings.Contains(err.Error(), "refusing") {
+			t.Errorf("confirmSNSSubscription(%q) = %v, want a refusal", subscribeURL, err)
+		}
+	}
+}
+
+func TestHandleBounces(t *testing.T) {
+	db, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := &SQLiteNoteStore{DB: db}
+	handler := handleBounces(bounceProviderSES, store, "secret-token")
+
+	post := func(target string, body []byte, modify func(*http.Request)) int {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(string(body)))
+		if modify != nil {
+			modify(request)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder.Code
+	}
+	suppressed := func(email string) string {
+		t.Helper()
+		suppression, err := store.Suppression(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suppression == nil {
+			return ""
+		}
+		return suppression.Reason
+	}
+
+	bounceBody := readBounceFixture(t, "ses_bounce.json")
+	for name, target := range map[string]string{
+		"no token":    "/webhooks/ses",
+		"bad token":   "/webhooks/ses?token=wrong-token",
+		"token shown": "/webhooks/ses?token=secret",
+	} {
+		if code := post(target, bounceBody, nil); code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+	if code := post("/webhooks/ses", bounceBody, func(r *http.Request) { r.SetBasicAuth("ses", "wrong-token") }); code != http.StatusUnauthorized {
+		t.Errorf("bad basic auth password: status %d", code)
+	}
+	if reason := suppressed("alice@example.org"); reason != "" {
+		t.Fatalf("unauthorized webhook suppressed alice (%s)", reason)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/webhooks/ses?token=secret-token", nil)
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", recorder.Code)
+	}
+	if code := post("/webhooks/ses?token=secret-token", bounceBody[:len(bounceBody)/2], nil); code != http.StatusBadRequest {
+		t.Errorf("malformed body: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	if code := post("/webhooks/ses?token=secret-token", bounceBody, nil); code != http.StatusNoContent {
+		t.Fatalf("bounce: status %d", code)
+	}
+	if code := post("/webhooks/ses", readBounceFixture(t, "ses_complaint.json"), func(r *http.Request) { r.SetBasicAuth("ses", "secret-token") }); code != http.StatusNoContent {
+		t.Fatalf("complaint: status %d", code)
+	}
+	if code := post("/webhooks/ses?token=secret-token", readBounceFixture(t, "ses_transient_bounce.json"), nil); code != http.StatusNoContent {
+		t.Fatalf("transient bounce: status %d", code)
+	}
+	for email, want := range map[string]string{
+		"alice@example.org": bounceReason,
+		"bob@example.org":   bounceReason,
+		"carol@example.org": complaintReason,
+	} {
+		if reason := suppressed(email); reason != want {
+			t.Errorf("%s suppressed for %q, want %q", email, reason, want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CalendarEvent is a NIP-52 calendar event, date-based (kind 31922) or
+// time-based (kind 31923)
+type CalendarEvent struct {
+	UID         string // event address, stable across updates
+	Title       string
+	Location    string
+	Description string
+	URL         string
+	Start       time.Time
+	End         time.Time // exclusive, zero when not given
+	AllDay      bool      // date-based events have no time of day
+}
+
+// parseCalendarEvent reads the tags of a calendar event
+func parseCalendarEvent(event *nostr.Event, relays []string) (*CalendarEvent, error) {
+	calendar := &CalendarEvent{
+		UID:         articleAddress(event),
+		Description: event.Content,
+		URL:         articleURL(event, relays),
+		AllDay:      event.Kind == nostr.KindDateCalendarEvent,
+	}
+
+	for _, name := range []string{"title", "name"} {
+		if tag := event.Tags.Find(name); tag != nil && tag[1] != "" {
+			calendar.Title = tag[1]
+			break
+		}
+	}
+	if calendar.Title == "" {
+		calendar.Title = "Untitled event"
+	}
+	if tag := event.Tags.Find("location"); tag != nil {
+		calendar.Location = tag[1]
+	}
+
+	parse := func(value string) (time.Time, error) {
+		if calendar.AllDay {
+			return time.Parse("2006-01-02", value)
+		}
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	startTag := event.Tags.Find("start")
+	if startTag == nil {
+		return nil, fmt.Errorf("calendar event %s has no start", event.ID)
+	}
+	start, err := parse(startTag[1])
+	if err != nil {
+		return nil, fmt.Errorf("calendar event %s has an invalid start: %v", event.ID, err)
+	}
+	calendar.Start = start
+	if endTag := event.Tags.Find("end"); endTag != nil {
+		if end, err := parse(endTag[1]); err == nil && end.After(start) {
+			calendar.End = end
+		}
+	}
+	return calendar, nil
+}
+
+// When describes the date of the event for the email
+func (c *CalendarEvent) When() string {
+	if c.AllDay {
+		if c.End.IsZero() {
+			return c.Start.Format("Monday, 2 January 2006")
+		}
+		// The end date is exclusive, like DTEND in iCalendar
+		lastDay := c.End.AddDate(0, 0, -1)
+		if !lastDay.After(c.Start) {
+			return c.Start.Format("Monday, 2 January 2006")
+		}
+		return c.Start.Format("2 January 2006") + " – " + lastDay.Format("2 January 2006")
+	}
+	when := c.Start.Format("Monday, 2 January 2006 15:04 UTC")
+	if !c.End.IsZero() {
+		when += " – " + c.End.Format("15:04 UTC")
+	}
+	return when
+}
+
+// icsEscape escapes text values for iCalendar (RFC 5545, 3.3.11)
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// icsFold folds a content line into lines of at most 75 octets, without
+// splitting UTF-8 characters (RFC 5545, 3.1)
+func icsFold(line string) string {
+	var folded strings.Builder
+	length := 0
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > 75 {
+			folded.WriteString("\r\n ")
+			length = 1
+		}
+		folded.WriteRune(r)
+		length += size
+	}
+	return folded.String()
+}
+
+// ICS renders the event as an iCalendar file that mail clients can import
+func (c *CalendarEvent) ICS(now time.Time) []byte {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Trustroots//Nostr Email Notifications//EN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		"UID:" + icsEscape(c.UID) + "@nostr",
+		"DTSTAMP:" + now.UTC().Format("20060102T150405Z"),
+	}
+	if c.AllDay {
+		lines = append(lines, "DTSTART;VALUE=DATE:"+c.Start.Format("20060102"))
+		if !c.End.IsZero() {
+			lines = append(lines, "DTEND;VALUE=DATE:"+c.End.Format("20060102"))
+		}
+	} else {
+		lines = append(lines, "DTSTART:"+c.Start.UTC().Format("20060102T150405Z"))
+		if !c.End.IsZero() {
+			lines = append(lines, "DTEND:"+c.End.UTC().Format("20060102T150405Z"))
+		}
+	}
+	lines = append(lines, "SUMMARY:"+icsEscape(c.Title))
+	if c.Location != "" {
+		lines = append(lines, "LOCATION:"+icsEscape(c.Location))
+	}
+	if c.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+icsEscape(c.Description))
+	}
+	lines = append(lines, "URL:"+c.URL, "END:VEVENT", "END:VCALENDAR")
+
+	var ics strings.Builder
+	for _, line := range lines {
+		ics.WriteString(icsFold(line))
+		ics.WriteString("\r\n")
+	}
+	return []byte(ics.String())
+}
+
+// Details describes date and location for the email excerpt
+func (c *CalendarEvent) Details() string {
+	lines := []string{"📅 " + c.When()}
+	if c.Location != "" {
+		lines = append(lines, "📍 "+c.Location)
+	}
+	if description := strings.TrimSpace(c.Description); description != "" {
+		lines = append(lines, "", truncateText(description, parentExcerptLength))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Attachment returns the event as an .ics email attachment
+func (c *CalendarEvent) Attachment() EmailAttachment {
+	return EmailAttachment{
+		Filename:    "invite.ics",
+		ContentType: "text/calendar; charset=utf-8; method=PUBLISH",
+		Data:        c.ICS(time.Now()),
+	}
+}
+
+// processCalendarEvent notifies users p-tagged in a calendar event (kind
+// 31922/31923, NIP-52), once per event address since events are edited
+func processCalendarEvent(event *nostr.Event, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	matches := mentionMatches(event, hexToUser, mentionMatchingStrict)
+	recipients := usersForPubkeys(matches.Pubkeys, event.PubKey, hexToUser)
+	if len(recipients) == 0 {
+		return
+	}
+
+	calendar, err := parseCalendarEvent(event, config.Relays)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return
+	}
+
+	for _, user := range recipients {
+		notified, err := emailService.Notes.IsNotificationProcessed(calendar.UID, user.Email)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			continue
+		}
+		if notified {
+			continue
+		}
+
+		mention := Mention{
+			Context:     "a calendar event",
+			Action:      "invited you to a calendar event",
+			Title:       calendar.Title,
+			URL:         calendar.URL,
+			Excerpt:     calendar.Details(),
+			Match:       matchPTag,
+			Attachments: []EmailAttachment{calendar.Attachment()},
+		}
+		notifyMention(event, user, mention, npubToUser, sqliteDB, emailService)
+		if err := emailService.Notes.MarkNoteProcessed(calendar.UID, event.PubKey, "relay", user.Email); err != nil {
+			fmt.Printf("⚠️  Error marking calendar event as processed: %v\n", err)
+		}
+	}
+}
+
+// rsvpActions describes RSVP statuses for the email
+var rsvpActions = map[string]string{
+	"accepted":  "accepted your calendar event",
+	"declined":  "declined your calendar event",
+	"tentative": "might come to your calendar event",
+}
+
+// processCalendarRSVP notifies the author of a calendar event about an RSVP
+// (kind 31925). The author is p-tagged and the event referenced by its a tag.
+func processCalendarRSVP(event *nostr.Event, pool *nostr.SimplePool, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	statusTag := event.Tags.Find("status")
+	if statusTag == nil {
+		return
+	}
+	action, known := rsvpActions[statusTag[1]]
+	if !known {
+		return
+	}
+
+	aTag := event.Tags.Find("a")
+	if aTag == nil {
+		return
+	}
+	pointer, err := nostr.EntityPointerFromTag(aTag)
+	if err != nil {
+		fmt.Printf("⚠️  Invalid calendar event reference in RSVP %s: %v\n", event.ID, err)
+		return
+	}
+	recipient, monitored := hexToUser[pointer.PublicKey]
+	if !monitored || pointer.PublicKey == event.PubKey {
+		return
+	}
+
+	mention := Mention{Context: "a calendar event", Action: action, Title: "your event", Match: matchThread}
+	if calendarEvent, err := fetchLatestEvent(pointer.AsFilter(), pool, config.Relays); err != nil {
+		fmt.Printf("⚠️  Failed to fetch calendar event of RSVP %s: %v\n", event.ID, err)
+	} else if calendar, err := parseCalendarEvent(calendarEvent, config.Relays); err == nil {
+		mention.Title = calendar.Title
+		mention.URL = calendar.URL
+		mention.ParentContent = calendar.Details()
+		mention.ParentLabel = "Your event"
+		mention.Attachments = []EmailAttachment{calendar.Attachment()}
+	}
+
+	notifyMention(event, recipient, mention, npubToUser, sqliteDB, emailService)
+}
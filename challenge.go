@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// npubChallengeTTL is how long the code of a challenge can be confirmed
+const npubChallengeTTL = 24 * time.Hour
+
+// npubChallengeMaxAttempts is how many wrong codes a challenge survives
+const npubChallengeMaxAttempts = 5
+
+// npubChallengeCodeDigits is the length of the code sent by DM
+const npubChallengeCodeDigits = 6
+
+// NpubChallenge proves that a user owns the npub on their Trustroots profile:
+// the code is sent by DM to the npub, the link to enter it by email to the user
+type NpubChallenge struct {
+	Token     string // in the confirmation link
+	Code      string // in the DM, only its hash is stored
+	Username  string
+	Npub      string
+	ExpiresAt time.Time
+}
+
+// newNpubChallenge creates a challenge with a random token and code
+func newNpubChallenge(user User, now time.Time) (NpubChallenge, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return NpubChallenge{}, fmt.Errorf("failed to generate token: %v", err)
+	}
+	limit := big.NewInt(1)
+	for i := 0; i < npubChallengeCodeDigits; i++ {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	code, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return NpubChallenge{}, fmt.Errorf("failed to generate code: %v", err)
+	}
+	return NpubChallenge{
+		Token:     hex.EncodeToString(token),
+		Code:      fmt.Sprintf("%0*d", npubChallengeCodeDigits, code),
+		Username:  user.Username,
+		Npub:      user.NostrNpub,
+		ExpiresAt: now.Add(npubChallengeTTL),
+	}, nil
+}
+
+// npubChallengeCodeHash hashes a code with the token of its challenge
+func npubChallengeCodeHash(token, code string) string {
+	sum := sha256.Sum256([]byte(token + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// storeNpubChallenge stores a challenge until it is confirmed or expires
+func storeNpubChallenge(db *sql.DB, challenge NpubChallenge) error {
+	_, err := db.Exec("INSERT INTO npub_challenges (token, username, npub, code_hash, expires_at) VALUES (?, ?, ?, ?, ?)",
+		challenge.Token, challenge.Username, challenge.Npub, npubChallengeCodeHash(challenge.Token, challenge.Code), challenge.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store npub challenge: %v", err)
+	}
+	return nil
+}
+
+// challengeError is why a code was not accepted, shown on the confirmation
+// page; other errors of confirmNpubChallenge are internal
+type challengeError string
+
+func (e challengeError) Error() string {
+	return string(e)
+}
+
+// confirmNpubChallenge checks the code entered for a challenge and marks the
+// npub as verified when it matches. Only errors of type challengeError are
+// meant for the user.
+func confirmNpubChallenge(db *sql.DB, token, code string, now time.Time) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var username, codeHash string
+	var attempts int
+	var expiresAt time.Time
+	var verifiedAt sql.NullTime
+	err = tx.QueryRow("SELECT username, code_hash, attempts, expires_at, verified_at FROM npub_challenges WHERE token = ?", token).
+		Scan(&username, &codeHash, &attempts, &expiresAt, &verifiedAt)
+	if err == sql.ErrNoRows {
+		return "", challengeError("this link is not valid")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load npub challenge: %v", err)
+	}
+	if verifiedAt.Valid {
+		return username, nil
+	}
+	if now.After(expiresAt) {
+		return "", challengeError("this link has expired, please ask for a new code")
+	}
+	if attempts >= npubChallengeMaxAttempts {
+		return "", challengeError("too many wrong codes, please ask for a new code")
+	}
+
+	code = strings.TrimSpace(code)
+	if subtle.ConstantTimeCompare([]byte(npubChallengeCodeHash(token, code)), []byte(codeHash)) != 1 {
+		if _, err := tx.Exec("UPDATE npub_challenges SET attempts = attempts + 1 WHERE token = ?", token); err != nil {
+			return "", fmt.Errorf("failed to record attempt: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return "", fmt.Errorf("failed to record attempt: %v", err)
+		}
+		return "", challengeError("wrong code")
+	}
+
+	if _, err := tx.Exec("UPDATE npub_challenges SET verified_at = ? WHERE token = ?", now.UTC(), token); err != nil {
+		return "", fmt.Errorf("failed to confirm npub: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to confirm npub: %v", err)
+	}
+	return username, nil
+}
+
+// isNpubVerified reports whether a user confirmed owning their current npub
+func isNpubVerified(db *sql.DB, username, npub string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM npub_challenges WHERE username = ? AND npub = ? AND verified_at IS NOT NULL",
+		username, npub).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check npub verification: %v", err)
+	}
+	return count > 0, nil
+}
+
+// npubVerified reports whether a user may be emailed, when notifications
+// require a verified npub
+func (es *EmailService) npubVerified(user User) bool {
+	if es.VerifiedNpubs == nil {
+		return true
+	}
+	verified, err := isNpubVerified(es.VerifiedNpubs, user.Username, user.NostrNpub)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return false
+	}
+	return verified
+}
+
+// challengeNpub starts the ownership challenges of a user's npubs that are not
+// confirmed yet: for each it DMs a code to the npub and emails the user the
+// link to enter it
+func challengeNpub(username string, validNpubs []User, config *Config, sqliteDB *sql.DB, emailService *EmailService) error {
+	if config.ConfirmURL == "" {
+		return fmt.Errorf("NOSTREMAIL_CONFIRM_URL is required to challenge npubs")
+	}
+	if !schemaAtLeast(sqliteDB, schemaNpubChallenges) {
+		return fmt.Errorf("npub challenges need the latest database schema, run `nostremail migrate`")
+	}
+
+	var user User
+	for _, candidate := range validNpubs {
+		if candidate.Username == username {
+			user = candidate
+			break
+		}
+	}
+	if user.Username == "" {
+		return fmt.Errorf("no user %s with a valid npub", username)
+	}
+	if status := user.accountStatus(); status != "" {
+		return fmt.Errorf("not challenging %s, %s", username, status)
+	}
+	if emailService.suppressed(user.Email) {
+		return fmt.Errorf("the email address of %s is on the suppression list", username)
+	}
+
+	for _, key := range userKeys(user) {
+		verified, err := isNpubVerified(sqliteDB, key.Username, key.NostrNpub)
+		if err != nil {
+			return err
+		}
+		if verified {
+			fmt.Printf("✅ %s already confirmed owning %s\n", key.Username, key.NostrNpub)
+			continue
+		}
+		if err := challengeKey(key, config, sqliteDB, emailService); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// challengeKey starts the ownership challenge of one npub of a user
+func challengeKey(user User, config *Config, sqliteDB *sql.DB, emailService *EmailService) error {
+	recipientHex, err := npubToHex(user.NostrNpub)
+	if err != nil {
+		return fmt.Errorf("invalid npub of %s: %v", user.Username, err)
+	}
+
+	challenge, err := newNpubChallenge(user, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := storeNpubChallenge(sqliteDB, challenge); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Your code to receive Trustroots notifications by email is %s. "+
+		"Enter it on the page linked in the email we sent to your Trustroots address. "+
+		"If you did not add this key to a Trustroots profile, ignore this message.", challenge.Code)
+	eventID, published, err := sendDirectMessage(config, recipientHex, message)
+	if err != nil {
+		return fmt.Errorf("failed to DM the code: %v", err)
+	}
+	fmt.Printf("🔑 Code DM %s published to %d/%d relays\n", eventID, published, len(config.Relays))
+
+	confirmURL := fmt.Sprintf("%s/confirm?token=%s", strings.TrimRight(config.ConfirmURL, "/"), challenge.Token)
+	email, err := emailService.GenerateNpubChallengeEmail(user, confirmURL)
+	if err != nil {
+		return fmt.Errorf("failed to generate npub challenge email template: %v", err)
+	}
+	if err := emailService.SendEmail(user.Email, email.Subject, email.HTMLContent, email.TextContent); err != nil {
+		return fmt.Errorf("failed to email the confirmation link: %v", err)
+	}
+	fmt.Printf("📧 Confirmation link sent to %s, valid until %s\n", user.Username, challenge.ExpiresAt.Format("2006-01-02 15:04 MST"))
+	return nil
+}
+
+// confirmPage asks for the code of a challenge and shows the outcome
+var confirmPage = template.Must(template.New("confirm").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width">
+    <title>Confirm your nostr key - Trustroots</title>
+    <style>
+        body { font-family: Arial, sans-serif; max-width: 480px; margin: 50px auto; padding: 20px; color: #333; }
+        h1 { color: #12b591; font-size: 24px; }
+        .error { color: #b00020; }
+        input[type=text] { font-size: 24px; letter-spacing: 4px; width: 10em; padding: 8px; }
+        button { background-color: #12b591; color: white; border: 0; border-radius: 4px; padding: 12px 24px; font-size: 16px; }
+    </style>
+</head>
+<body>
+    <h1>🔑 Confirm your nostr key</h1>
+    {{if .Username}}
+    <p>Thanks {{.Username}}, your nostr key is confirmed. You will now receive nostr notifications by email.</p>
+    {{else}}
+    <p>We sent a direct message with a code to the nostr key on your Trustroots profile. Enter it here to receive nostr notifications by email.</p>
+    {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+    <form method="post" action="/confirm">
+        <input type="hidden" name="token" value="{{.Token}}">
+        <p><input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" autofocus></p>
+        <p><button type="submit">Confirm</button></p>
+    </form>
+    {{end}}
+</body>
+</html>
+`))
+
+// confirmPageData is what confirmPage shows
+type confirmPageData struct {
+	Token    string
+	Username string // set once confirmed
+	Error    string
+}
+
+// handleConfirm shows the code form on GET and checks the code on POST. Only
+// POST changes anything, so links opened by mail scanners do no harm.
+func handleConfirm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := confirmPageData{Token: r.FormValue("token")}
+		status := http.StatusOK
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			username, err := confirmNpubChallenge(db, data.Token, r.PostFormValue("code"), time.Now())
+			var userErr challengeError
+			if errors.As(err, &userErr) {
+				data.Error = userErr.Error()
+				status = http.StatusBadRequest
+			} else if err != nil {
+				fmt.Printf("⚠️  %v\n", err)
+				data.Error = "Confirming failed, please try again later."
+				status = http.StatusInternalServerError
+			} else {
+				data.Username = username
+				fmt.Printf("🔑 %s confirmed their npub\n", username)
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := confirmPage.Execute(w, data); err != nil {
+			fmt.Printf("⚠️  Error rendering confirmation page: %v\n", err)
+		}
+	}
+}
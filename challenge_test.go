@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestChallenge stores a challenge for alice created at now
+func newTestChallenge(t *testing.T, db *sql.DB, now time.Time) NpubChallenge {
+	t.Helper()
+	challenge, err := newNpubChallenge(testUser(t, "alice", "alice@example.org", testKey("a")), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeNpubChallenge(db, challenge); err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// wrongCode returns a code of the right length that is not the challenge's
+func wrongCode(challenge NpubChallenge) string {
+	if challenge.Code == "000000" {
+		return "000001"
+	}
+	return "000000"
+}
+
+// openChallengeDB opens an in-memory database with the latest schema
+func openChallengeDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestNewNpubChallenge(t *testing.T) {
+	now := time.Date(2024, 3, 12, 10, 0, 0, 0, time.UTC)
+	challenge, err := newNpubChallenge(testUser(t, "alice", "alice@example.org", testKey("a")), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9]{6}$`).MatchString(challenge.Code) {
+		t.Errorf("code = %q, want six digits", challenge.Code)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(challenge.Token) {
+		t.Errorf("token = %q, want 32 random bytes in hex", challenge.Token)
+	}
+	if !challenge.ExpiresAt.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("expires at %s, want a day later", challenge.ExpiresAt)
+	}
+
+	other, _ := newNpubChallenge(testUser(t, "alice", "alice@example.org", testKey("a")), now)
+	if other.Token == challenge.Token {
+		t.Error("two challenges got the same token")
+	}
+}
+
+func TestStoreNpubChallengeHashesCode(t *testing.T) {
+	db := openChallengeDB(t)
+	challenge := newTestChallenge(t, db, time.Now())
+
+	var username, npub, codeHash string
+	err := db.QueryRow("SELECT username, npub, code_hash FROM npub_challenges WHERE token = ?", challenge.Token).
+		Scan(&username, &npub, &codeHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(codeHash, challenge.Code) || username == challenge.Code || npub == challenge.Code {
+		t.Error("the code is stored in the clear")
+	}
+	if codeHash != npubChallengeCodeHash(challenge.Token, challenge.Code) {
+		t.Errorf("code hash = %s", codeHash)
+	}
+	// The same code hashes differently with another token
+	if npubChallengeCodeHash(strings.Repeat("0", 64), challenge.Code) == codeHash {
+		t.Error("the code hash does not depend on the token")
+	}
+}
+
+func TestConfirmNpubChallenge(t *testing.T) {
+	db := openChallengeDB(t)
+	now := time.Now()
+	challenge := newTestChallenge(t, db, now)
+
+	if _, err := confirmNpubChallenge(db, strings.Repeat("0", 64), challenge.Code, now); err == nil {
+		t.Error("confirmed a challenge that does not exist")
+	}
+	for i := 0; i < npubChallengeMaxAttempts-1; i++ {
+		if _, err := confirmNpubChallenge(db, challenge.Token, wrongCode(challenge), now); err == nil {
+			t.Fatal("confirmed a wrong code")
+		}
+	}
+	// Surrounding whitespace of pasted codes is ignored
+	username, err := confirmNpubChallenge(db, challenge.Token, " "+challenge.Code+"\n", now)
+	if err != nil || username != "alice" {
+		t.Fatalf("confirmNpubChallenge = %q, %v after %d wrong codes", username, err, npubChallengeMaxAttempts-1)
+	}
+	if verified, err := isNpubVerified(db, "alice", challenge.Npub); err != nil || !verified {
+		t.Errorf("isNpubVerified = %v, %v", verified, err)
+	}
+	// Opening the link again shows the confirmation
+	if username, err := confirmNpubChallenge(db, challenge.Token, "", now.Add(48*time.Hour)); err != nil || username != "alice" {
+		t.Errorf("confirming again = %q, %v", username, err)
+	}
+}
+
+func TestConfirmNpubChallengeAttemptLimit(t *testing.T) {
+	db := openChallengeDB(t)
+	now := time.Now()
+	challenge := newTestChallenge(t, db, now)
+
+	for i := 0; i < npubChallengeMaxAttempts; i++ {
+		if _, err := confirmNpubChallenge(db, challenge.Token, wrongCode(challenge), now); err == nil || err.Error() != "wrong code" {
+			t.Fatalf("attempt %d: %v, want a wrong code", i+1, err)
+		}
+	}
+	_, err := confirmNpubChallenge(db, challenge.Token, challenge.Code, now)
+	if err == nil || !strings.Contains(err.Error(), "too many wrong codes") {
+		t.Errorf("right code after %d wrong ones: %v, want too many wrong codes", npubChallengeMaxAttempts, err)
+	}
+	if verified, _ := isNpubVerified(db, "alice", challenge.Npub); verified {
+		t.Error("npub verified after too many wrong codes")
+	}
+}
+
+func TestConfirmNpubChallengeExpiry(t *testing.T) {
+	db := openChallengeDB(t)
+	now := time.Now()
+	expired := newTestChallenge(t, db, now)
+	_, err := confirmNpubChallenge(db, expired.Token, expired.Code, now.Add(npubChallengeTTL+time.Second))
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("confirming after %s: %v, want expired", npubChallengeTTL, err)
+	}
+	if verified, _ := isNpubVerified(db, "alice", expired.Npub); verified {
+		t.Error("npub verified by an expired challenge")
+	}
+
+	current := newTestChallenge(t, db, now)
+	if _, err := confirmNpubChallenge(db, current.Token, current.Code, now.Add(npubChallengeTTL-time.Minute)); err != nil {
+		t.Errorf("confirming just before the expiry: %v", err)
+	}
+}
+
+func TestHandleConfirm(t *testing.T) {
+	db := openChallengeDB(t)
+	challenge := newTestChallenge(t, db, time.Now())
+	handler := handleConfirm(db)
+
+	request := func(method, token, code string) (int, string) {
+		t.Helper()
+		form := url.Values{"token": {token}, "code": {code}}
+		var r *http.Request
+		if method == http.MethodPost {
+			r = httptest.NewRequest(method, "/confirm", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, "/confirm?"+form.Encode(), nil)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Code, string(body)
+	}
+	verified := func() bool {
+		verified, err := isNpubVerified(db, "alice", challenge.Npub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verified
+	}
+
+	// Links opened by mail scanners, even with the code, confirm nothing
+	code, body := request(http.MethodGet, challenge.Token, challenge.Code)
+	if code != http.StatusOK || !strings.Contains(body, `value="`+challenge.Token+`"`) {
+		t.Errorf("GET returned %d without the form", code)
+	}
+	if verified() {
+		t.Error("GET confirmed the npub")
+	}
+	if code, _ := request(http.MethodPut, challenge.Token, challenge.Code); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT returned %d, want 405", code)
+	}
+
+	code, body = request(http.MethodPost, challenge.Token, wrongCode(challenge))
+	if code != http.StatusBadRequest || !strings.Contains(body, "wrong code") {
+		t.Errorf("POST with a wrong code returned %d: %s", code, body)
+	}
+	code, body = request(http.MethodPost, challenge.Token, challenge.Code)
+	if code != http.StatusOK || !strings.Contains(body, "Thanks alice") || !verified() {
+		t.Errorf("POST with the code returned %d: %s", code, body)
+	}
+
+	// Database errors are logged, not shown
+	if _, err := db.Exec("DROP TABLE npub_challenges"); err != nil {
+		t.Fatal(err)
+	}
+	code, body = request(http.MethodPost, challenge.Token, challenge.Code)
+	if code != http.StatusInternalServerError || !strings.Contains(body, "please try again later") {
+		t.Errorf("POST without a database returned %d: %s", code, body)
+	}
+	if strings.Contains(body, "npub_challenges") || strings.Contains(body, "no such table") {
+		t.Errorf("the page shows the database error: %s", body)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// channelMetadata is the content of a channel creation (kind 40) or metadata
+// (kind 41) event, see NIP-28
+type channelMetadata struct {
+	Name  string `json:"name"`
+	About string `json:"about"`
+}
+
+// channelID returns the ID of the channel creation event a channel message
+// (kind 42) belongs to: the e tag marked "root", else the first e tag
+func channelID(event *nostr.Event) string {
+	var first string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+		if len(tag) >= 4 && tag[3] == "root" {
+			return tag[1]
+		}
+		if first == "" {
+			first = tag[1]
+		}
+	}
+	return first
+}
+
+// fetchChannel fetches a channel creation event and returns it with the
+// channel name, preferring the latest metadata (kind 41) of its creator
+func fetchChannel(id string, pool *nostr.SimplePool, relays []string) (*nostr.Event, string, error) {
+	creation, err := fetchEventByID(id, pool, relays)
+	if err != nil {
+		return nil, "", err
+	}
+	if creation.Kind != nostr.KindChannelCreation {
+		return nil, "", fmt.Errorf("event %s is kind %d, not a channel", id, creation.Kind)
+	}
+
+	var metadata channelMetadata
+	json.Unmarshal([]byte(creation.Content), &metadata)
+
+	filter := nostr.Filter{
+		Kinds:   []int{nostr.KindChannelMetadata},
+		Authors: []string{creation.PubKey},
+		Tags:    nostr.TagMap{"e": []string{id}},
+	}
+	if update, err := fetchLatestEvent(filter, pool, relays); err == nil {
+		var updated channelMetadata
+		if json.Unmarshal([]byte(update.Content), &updated) == nil && updated.Name != "" {
+			metadata = updated
+		}
+	}
+
+	return creation, strings.TrimSpace(metadata.Name), nil
+}
+
+// channelURL returns a web link for a channel
+func channelURL(creation *nostr.Event, relays []string) string {
+	nevent, err := nip19.EncodeEvent(creation.ID, relays, creation.PubKey)
+	if err != nil {
+		return noteURL(creation.ID)
+	}
+	return fmt.Sprintf("https://njump.me/%s", nevent)
+}
+
+// processChannelMessage notifies users mentioned in a public channel message
+// (kind 42, NIP-28), naming and linking the channel
+func processChannelMessage(event *nostr.Event, pool *nostr.SimplePool, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	matches := mentionMatches(event, hexToUser, config.MentionMatching)
+	recipients := usersForPubkeys(matches.Pubkeys, event.PubKey, hexToUser)
+	if len(recipients) == 0 {
+		return
+	}
+
+	mention := Mention{Context: "a channel", Title: "Unnamed channel"}
+	if id := channelID(event); id != "" {
+		creation, name, err := fetchChannel(id, pool, config.Relays)
+		if err != nil {
+			fmt.Printf("⚠️  Failed to fetch channel of %s: %v\n", event.ID, err)
+		} else {
+			if name != "" {
+				mention.Title = name
+			}
+			mention.TitleURL = channelURL(creation, config.Relays)
+		}
+	}
+
+	for _, user := range recipients {
+		mention.Match = matches.TypeFor(user)
+		notifyMention(event, user, mention, npubToUser, sqliteDB, emailService)
+	}
+}
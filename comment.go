@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// commentMatches returns the pubkeys a NIP-22 comment refers to: the root and
+// parent authors (P/p tags), the authors hinted in E/e and A/a tags and users
+// mentioned in the content
+func commentMatches(event *nostr.Event, hexToUser map[string]User, matching string) *MentionMatches {
+	matches := mentionMatches(event, hexToUser, matching)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "P":
+			matches.Add(tag[1], matchThread)
+		case "E", "e":
+			// ["e", <id>, <relay>, <pubkey>]
+			if len(tag) >= 4 {
+				matches.Add(tag[3], matchThread)
+			}
+		case "A", "a":
+			// ["a", "<kind>:<pubkey>:<d>", ...]
+			if parts := strings.SplitN(tag[1], ":", 3); len(parts) == 3 {
+				matches.Add(parts[1], matchThread)
+			}
+		}
+	}
+	return matches
+}
+
+// commentParent resolves what a comment replies to: the parent event (e tag) or,
+// for comments on external content, the parent URL (i tag)
+func commentParent(event *nostr.Event, pool *nostr.SimplePool, relays []string) (content string, url string) {
+	if eTag := event.Tags.Find("e"); eTag != nil {
+		if hint := eTag.Relay(); hint != "" {
+			relays = append([]string{hint}, relays...)
+		}
+		parent, err := fetchEventByID(eTag[1], pool, relays)
+		if err != nil {
+			fmt.Printf("⚠️  Failed to fetch parent of comment %s: %v\n", event.ID, err)
+			return "", noteURL(eTag[1])
+		}
+		return truncateText(parent.Content, parentExcerptLength), noteURL(parent.ID)
+	}
+
+	if iTag := event.Tags.Find("i"); iTag != nil && strings.HasPrefix(iTag[1], "http") {
+		return "", iTag[1]
+	}
+	return "", ""
+}
+
+// processComment routes NIP-22 comments (kind 1111) through the mention emails
+func processComment(event *nostr.Event, pool *nostr.SimplePool, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	matches := commentMatches(event, hexToUser, config.MentionMatching)
+	recipients := usersForPubkeys(matches.Pubkeys, event.PubKey, hexToUser)
+	if len(recipients) == 0 {
+		return
+	}
+
+	parentContent, parentURL := commentParent(event, pool, config.Relays)
+	mention := Mention{
+		Context:       "a comment",
+		ParentContent: parentContent,
+		ParentURL:     parentURL,
+	}
+
+	for _, user := range recipients {
+		mention.Match = matches.TypeFor(user)
+		notifyMention(event, user, mention, npubToUser, sqliteDB, emailService)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// recordDeletion annotates the notification history of an event deleted by its
+// author (NIP-09). Only the author may delete an event, so history rows without
+// a recorded author (from before schema version 3) are left alone.
+func recordDeletion(db *sql.DB, eventID, authorPubkey, deletionEventID string) (int64, error) {
+	result, err := db.Exec(`UPDATE processed_notes SET deleted_at = CURRENT_TIMESTAMP, deletion_event_id = ?
+		WHERE event_id = ? AND author_pubkey = ? AND deleted_at IS NULL`,
+		deletionEventID, eventID, authorPubkey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record deletion: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// earlyDeletionRelay marks processed_notes rows recording the deletion of an
+// event we had not seen yet
+const earlyDeletionRelay = "deletion"
+
+// recordEarlyDeletion remembers the deletion of an event that did not reach us
+// yet, so it is not emailed when relays send it later
+func recordEarlyDeletion(db *sql.DB, eventID, authorPubkey, deletionEventID string) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < schemaDeletions {
+		return nil // no author and deletion columns yet
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO processed_notes (event_id, author_pubkey, relay_url, user_email, deleted_at, deletion_event_id)
+		VALUES (?, ?, ?, '', CURRENT_TIMESTAMP, ?)`,
+		eventID, authorPubkey, earlyDeletionRelay, deletionEventID)
+	if err != nil {
+		return fmt.Errorf("failed to record early deletion: %v", err)
+	}
+	return nil
+}
+
+// deletedBeforeArrival reports whether the author of an event deleted it before
+// it reached us. Only the author may delete an event, early deletions by anyone
+// else are forgotten so they cannot suppress the event.
+func deletedBeforeArrival(db *sql.DB, event *nostr.Event) (bool, error) {
+	var authorPubkey string
+	err := db.QueryRow("SELECT author_pubkey FROM processed_notes WHERE event_id = ? AND user_email = '' AND relay_url = ?",
+		event.ID, earlyDeletionRelay).Scan(&authorPubkey)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check for early deletion: %v", err)
+	}
+	if authorPubkey == event.PubKey {
+		return true, nil
+	}
+
+	_, err = db.Exec("DELETE FROM processed_notes WHERE event_id = ? AND user_email = '' AND relay_url = ?",
+		event.ID, earlyDeletionRelay)
+	if err != nil {
+		return false, fmt.Errorf("failed to forget early deletion: %v", err)
+	}
+	return false, nil
+}
+
+// suppressDeletedDigestItems drops pending digest items about a deleted event
+func suppressDeletedDigestItems(notes NoteStore, eventID, authorNpub string) (int, error) {
+	items, err := notes.DigestItems("")
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted []DigestItem
+	for _, item := range items {
+		if item.EventID == eventID && item.SenderNpub == authorNpub {
+			deleted = append(deleted, item)
+		}
+	}
+	if err := notes.DeleteDigestItems(deleted); err != nil {
+		return 0, err
+	}
+	return len(deleted), nil
+}
+
+// processDeletion handles kind 5 deletion requests by our users: emails still
+// held back are cancelled, emailed events are annotated and events that did not
+// reach us yet are remembered, so retracted content is not surfaced again
+func processDeletion(event *nostr.Event, emailService *EmailService) {
+	authorNpub, err := hexToNpub(event.PubKey)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert event pubkey to npub: %v\n", err)
+		authorNpub = event.PubKey // fallback to hex
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+		eventID := tag[1]
+
+		cancelled := emailService.CancelPending(eventID, event.PubKey)
+
+		processed, err := emailService.Notes.IsNoteProcessed(eventID)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			continue
+		}
+		if !processed {
+			if err := emailService.Notes.RecordEarlyDeletion(eventID, event.PubKey, event.ID); err != nil {
+				fmt.Printf("⚠️  %v\n", err)
+			} else {
+				fmt.Printf("🗑️  %s deleted event %s before it reached us\n", authorNpub, eventID)
+			}
+			continue
+		}
+
+		annotated, err := emailService.Notes.RecordDeletion(eventID, event.PubKey, event.ID)
+		if err != nil {
+			fmt.Printf("⚠️  Error recording deletion of %s: %v\n", eventID, err)
+			continue
+		}
+		suppressed, err := suppressDeletedDigestItems(emailService.Notes, eventID, authorNpub)
+		if err != nil {
+			fmt.Printf("⚠️  Error suppressing digest items for %s: %v\n", eventID, err)
+		}
+
+		if annotated > 0 || suppressed > 0 || cancelled > 0 {
+			fmt.Printf("🗑️  %s deleted event %s: cancelled %d pending emails, annotated %d notifications, suppressed %d digest items\n",
+				authorNpub, eventID, cancelled, annotated, suppressed)
+		}
+	}
+}
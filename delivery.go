@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Delivery statuses of emails
+const (
+	deliverySent       = "sent"
+	deliveryFailed     = "failed"
+	deliverySuppressed = "suppressed" // on the suppression list
+	deliveryCancelled  = "cancelled"  // the event was deleted before sending
+	deliveryHeld       = "held"       // over the rate limit, summarized later
+	deliveryDigest     = "digest"     // folded into the recipient's digest
+	deliverySkipped    = "skipped"    // not emailed, Detail says why
+)
+
+// Delivery is one entry in the delivery history of a recipient
+type Delivery struct {
+	Email      string
+	EventID    string // empty for emails not about one event, e.g. summaries
+	Type       string // template name
+	Status     string
+	Detail     string // error or reason
+	RecordedAt time.Time
+}
+
+// DeliveryHistory records what happened to every email, so support can
+// answer "why didn't I get an email about X?". The note stores implement it.
+type DeliveryHistory interface {
+	// RecordDelivery adds an entry to the history
+	RecordDelivery(delivery Delivery) error
+	// Deliveries returns the newest entries of a recipient and/or about an
+	// event, empty filters match everything
+	Deliveries(email, eventID string, limit int) ([]Delivery, error)
+}
+
+// queryDeliveries reads the deliveries selected by a query for email,
+// event_id, type, status, detail and recorded_at
+func queryDeliveries(db *sql.DB, query string, args ...interface{}) ([]Delivery, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var delivery Delivery
+		if err := rows.Scan(&delivery.Email, &delivery.EventID, &delivery.Type, &delivery.Status, &delivery.Detail, &delivery.RecordedAt); err != nil {
+			return nil, fmt.Errorf("failed to read delivery: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// recordDelivery adds an email to the delivery history when it is kept
+func (es *EmailService) recordDelivery(to, eventID, emailType, status, detail string) {
+	if es.Deliveries == nil {
+		return
+	}
+	delivery := Delivery{
+		Email:   normalizeEmail(to),
+		EventID: eventID,
+		Type:    emailType,
+		Status:  status,
+		Detail:  detail,
+	}
+	if err := es.Deliveries.RecordDelivery(delivery); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
+
+// skipNotification records a notification that is not emailed
+func (es *EmailService) skipNotification(event *nostr.Event, recipientUser User, template *EmailTemplate, status, reason string) {
+	es.recordDelivery(recipientUser.Email, event.ID, template.Type, status, reason)
+}
+
+// runDeliveries implements `nostremail deliveries [--db path] [--postgres url] [--event id] [--limit n] [email]`
+func runDeliveries(args []string) error {
+	fs := flag.NewFlagSet("deliveries", flag.ExitOnError)
+	dbPath := fs.String("db", processedNotesDBPath, "Path of the processed notes database")
+	postgresURL := fs.String("postgres", "", "Read from the PostgreSQL note store at this URL instead")
+	eventID := fs.String("event", "", "Only show emails about this event ID")
+	limit := fs.Int("limit", 50, "Show at most this many entries, newest first")
+	fs.Parse(args)
+	if fs.NArg() > 1 || (fs.NArg() == 0 && *eventID == "") {
+		return fmt.Errorf("usage: nostremail deliveries [--db path] [--postgres url] [--event id] [--limit n] <email>")
+	}
+
+	notes, closeNotes, err := openNoteStore(*dbPath, *postgresURL)
+	if err != nil {
+		return err
+	}
+	defer closeNotes()
+
+	deliveries, err := notes.Deliveries(fs.Arg(0), *eventID, *limit)
+	if err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		event := delivery.EventID
+		if event == "" {
+			event = "-"
+		}
+		fmt.Printf("%s | %s | %s | %s | %s | %s\n", delivery.RecordedAt.UTC().Format("2006-01-02 15:04:05"),
+			delivery.Email, delivery.Status, delivery.Type, event, delivery.Detail)
+	}
+	fmt.Fprintf(os.Stderr, "%d deliveries\n", len(deliveries))
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DevMailConfig configures the dev email provider: a local test SMTP server
+// such as MailHog or maildev, which catches emails to show them in its web UI
+type DevMailConfig struct {
+	Host string
+	Port int
+}
+
+// loadDevMailConfig reads NOSTREMAIL_DEV_SMTP, host:port of the test SMTP
+// server (default localhost:1025, where MailHog and maildev listen)
+func loadDevMailConfig() (DevMailConfig, error) {
+	host, port, err := net.SplitHostPort(getEnvOrDefault("NOSTREMAIL_DEV_SMTP", "localhost:1025"))
+	if err != nil {
+		return DevMailConfig{}, fmt.Errorf("NOSTREMAIL_DEV_SMTP: %v", err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return DevMailConfig{}, fmt.Errorf("NOSTREMAIL_DEV_SMTP: invalid port %q", port)
+	}
+	return DevMailConfig{Host: host, Port: portNumber}, nil
+}
+
+// isLocalHost reports whether a host (with or without port) is on this
+// machine or a container next to it: a loopback address, localhost, or a
+// name without dots such as the service name "mongo" of a compose file
+func isLocalHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return host != "" && !strings.Contains(host, ".")
+}
+
+// checkDevMongo refuses the dev email provider against a MongoDB that may be
+// production: emails to real users would end up in a test inbox, or, with a
+// wrong NOSTREMAIL_DEV_SMTP, be delivered from a development setup. Only
+// MongoDB on local hosts (see isLocalHost) passes; SRV URIs never do.
+func checkDevMongo(config MongoDBConfig) error {
+	// Seed lists like mongodb://a:27017,b:27017 are no valid URLs
+	hosts, found := strings.CutPrefix(config.URI, "mongodb://")
+	if !found {
+		scheme, _, _ := strings.Cut(config.URI, "://")
+		return fmt.Errorf("the dev email provider refuses to run against a %s URI, it needs a local MongoDB", scheme)
+	}
+	hosts, _, _ = strings.Cut(hosts, "/")
+	hosts, _, _ = strings.Cut(hosts, "?")
+	if at := strings.LastIndex(hosts, "@"); at >= 0 {
+		hosts = hosts[at+1:]
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if !isLocalHost(host) {
+			return fmt.Errorf("the dev email provider refuses to run against MongoDB at %s, it needs a local MongoDB", host)
+		}
+	}
+	return nil
+}
+
+// checkDevMail checks the dev email provider: the test SMTP server must be
+// local, and so must MongoDB when users come from it
+func checkDevMail(config *Config) error {
+	if config.UserSource == "mongodb" {
+		if err := checkDevMongo(config.MongoDB); err != nil {
+			return err
+		}
+	}
+	if !isLocalHost(config.DevMail.Host) {
+		return fmt.Errorf("the dev email provider needs NOSTREMAIL_DEV_SMTP on a local host, not %s", config.DevMail.Host)
+	}
+	return nil
+}
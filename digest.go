@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Digest windows, users choose theirs with nostrDigest
+const (
+	digestOff    = "off"    // email every notification
+	digestHourly = "hourly" // at most one digest an hour
+	digestDaily  = "daily"  // at most one digest a day
+)
+
+// digestCheckInterval is how often due digests are sent
+const digestCheckInterval = 5 * time.Minute
+
+// digestKindLabels describe the digest items of each kind (see DigestItem)
+var digestKindLabels = map[string]string{
+	"direct_message": "✉️ sent you a message",
+	"mention":        "💬 mentioned you",
+	"reply":          "↩️ replied to your note",
+	"repost":         "🔁 reposted your note",
+	"reaction":       "❤️ reacted to your note",
+	"zap":            "⚡ zapped you",
+	"watched_note":   "🔭 posted a watched note",
+}
+
+// parseDigestWindow parses NOSTREMAIL_DIGEST, empty means off
+func parseDigestWindow(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "":
+		return digestOff, nil
+	case digestOff, digestHourly, digestDaily:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid digest window %q, expected off, hourly or daily", value)
+}
+
+// digestInterval is how long items collect before their digest is sent;
+// items held by other policies (e.g. the web of trust) are sent daily when
+// the recipient gets no digest otherwise
+func digestInterval(window string) time.Duration {
+	if window == digestHourly {
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// digestWindow returns the digest window of a user: their nostrDigest, or
+// DigestWindow for users who chose none
+func (es *EmailService) digestWindow(user User) string {
+	switch window := strings.ToLower(strings.TrimSpace(user.Digest)); window {
+	case digestOff, digestHourly, digestDaily:
+		return window
+	}
+	if es.DigestWindow == "" {
+		return digestOff
+	}
+	return es.DigestWindow
+}
+
+// digestEntry is one notification in a digest email
+type digestEntry struct {
+	Label     string
+	Content   string
+	CreatedAt string
+	URL       string
+}
+
+// digestThread groups the entries of one nostr conversation
+type digestThread struct {
+	URL     string
+	Entries []digestEntry
+}
+
+// digestSender groups the threads of one sender
+type digestSender struct {
+	Name       string
+	ProfileURL string
+	Threads    []digestThread
+}
+
+// groupDigestItems groups digest items by sender and then by thread, in the
+// order they arrived
+func groupDigestItems(items []DigestItem) []digestSender {
+	var senders []digestSender
+	senderIndex := make(map[string]int)
+	threadIndex := make(map[string]map[string]int)
+	for _, item := range items {
+		senderKey := item.SenderNpub
+		s, exists := senderIndex[senderKey]
+		if !exists {
+			name := item.SenderNIP5
+			if name == "" {
+				name = shortNpub(item.SenderNpub)
+			}
+			s = len(senders)
+			senderIndex[senderKey] = s
+			threadIndex[senderKey] = make(map[string]int)
+			senders = append(senders, digestSender{
+				Name:       name,
+				ProfileURL: senderProfileURL(item.SenderNIP5, item.SenderNpub),
+			})
+		}
+
+		thread := item.ThreadID
+		if thread == "" {
+			thread = item.EventID
+		}
+		t, exists := threadIndex[senderKey][thread]
+		if !exists {
+			t = len(senders[s].Threads)
+			threadIndex[senderKey][thread] = t
+			senders[s].Threads = append(senders[s].Threads, digestThread{URL: noteURL(thread)})
+		}
+
+		label, exists := digestKindLabels[item.Kind]
+		if !exists {
+			label = "🔔 notified you"
+		}
+		senders[s].Threads[t].Entries = append(senders[s].Threads[t].Entries, digestEntry{
+			Label:     label,
+			Content:   item.Content,
+			CreatedAt: time.Unix(item.EventCreatedAt, 0).UTC().Format("2006-01-02 15:04 UTC"),
+			URL:       noteURL(item.EventID),
+		})
+	}
+	return senders
+}
+
+// GenerateNostrDigestEmail creates the digest of a recipient's held items
+func (es *EmailService) GenerateNostrDigestEmail(recipient User, items []DigestItem) (*EmailTemplate, error) {
+	// Items hold raw event content, render it like the emails they replace
+	rendered := make([]DigestItem, len(items))
+	for i, item := range items {
+		item.Content = sanitizeText(renderMentions(item.Content, es.Names))
+		item.SenderNIP5 = sanitizeLine(item.SenderNIP5)
+		rendered[i] = item
+	}
+
+	data := EmailTemplateData{
+		Username:      recipient.Username,
+		Name:          recipient.Username,
+		FirstName:     recipient.Username,
+		Email:         recipient.Email,
+		Locale:        recipient.Locale,
+		RecipientNpub: recipient.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL: "https://trustroots.org/support",
+		FooterURL:  "https://trustroots.org",
+		ProfileURL: fmt.Sprintf("https://www.trustroots.org/profile/%s", recipient.Username),
+		Content: map[string]interface{}{
+			"senders":    groupDigestItems(rendered),
+			"count":      len(items),
+			"buttonURL":  fmt.Sprintf("https://njump.me/%s", recipient.NostrNpub),
+			"buttonText": "View your profile on nostr",
+		},
+	}
+
+	return es.renderNotification(notificationDigest, data)
+}
+
+// digestRecipient returns the user a digest goes to: the user the items were
+// held for, or for items without one (e.g. watched notes) a recipient with
+// only the email address of the items
+func digestRecipient(item DigestItem, hexToUser map[string]User) (User, bool) {
+	if hexPubkey, err := npubToHex(item.RecipientNpub); err == nil {
+		usersMu.RLock()
+		user, exists := hexToUser[hexPubkey]
+		usersMu.RUnlock()
+		return user, exists
+	}
+	return User{Username: item.RecipientUsername, Email: item.RecipientEmail}, true
+}
+
+// sendDigests emails every recipient whose oldest digest item waited for
+// their digest window one digest of all their items
+func sendDigests(hexToUser map[string]User, emailService *EmailService, now time.Time) error {
+	items, err := emailService.Digest.DigestItems("")
+	if err != nil {
+		return err
+	}
+	var recipients []string
+	byRecipient := make(map[string][]DigestItem)
+	for _, item := range items {
+		if _, exists := byRecipient[item.RecipientEmail]; !exists {
+			recipients = append(recipients, item.RecipientEmail)
+		}
+		byRecipient[item.RecipientEmail] = append(byRecipient[item.RecipientEmail], item)
+	}
+
+	for _, email := range recipients {
+		pending := byRecipient[email]
+		recipient, exists := digestRecipient(pending[0], hexToUser)
+		if exists && now.Sub(pending[0].QueuedAt) < digestInterval(emailService.digestWindow(recipient)) {
+			continue
+		}
+
+		claimed, err := emailService.Digest.ClaimDigestItems(pending)
+		if err != nil {
+			return err
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+		if !exists {
+			fmt.Printf("ℹ️  Dropping %d digest items for %s, no longer a user\n", len(claimed), email)
+			continue
+		}
+		if status := recipient.accountStatus(); status != "" {
+			fmt.Printf("🚫 Dropping %d digest items for %s, %s\n", len(claimed), recipient.Username, status)
+			emailService.recordDelivery(email, "", "nostr_digest", deliverySkipped, status)
+			continue
+		}
+
+		template, err := emailService.GenerateNostrDigestEmail(recipient, claimed)
+		if err != nil {
+			// Keep the items for the next attempt
+			for _, item := range claimed {
+				if err := emailService.Digest.AddDigestItem(item); err != nil {
+					fmt.Printf("⚠️  %v\n", err)
+				}
+			}
+			return fmt.Errorf("failed to generate digest for %s: %v", email, err)
+		}
+		emailService.QueueEmailJob(EmailJob{
+			To:      email,
+			Subject: template.Subject,
+			HTML:    template.HTMLContent,
+			Text:    template.TextContent,
+			Type:    template.Type,
+		})
+		fmt.Printf("📬 Sent %s a digest of %d notifications\n", recipient.Username, len(claimed))
+	}
+	return nil
+}
+
+// runDigests sends due digests every digestCheckInterval
+func runDigests(hexToUser map[string]User, emailService *EmailService) {
+	for {
+		if err := sendDigests(hexToUser, emailService, time.Now()); err != nil {
+			fmt.Printf("⚠️  Failed to send digests: %v\n", err)
+		}
+		time.Sleep(digestCheckInterval)
+	}
+}
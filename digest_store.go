@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// digestItemVersion is the current version of the stored DigestItem payload.
+// Bump it when DigestItem changes and add a shim to digestItemUpgrades.
+const digestItemVersion = 2
+
+// DigestItem is a notification waiting to be sent as part of a digest.
+// It holds the facts about the event rather than rendered HTML or template
+// data, so items accumulated before a deploy still render with new templates.
+type DigestItem struct {
+	ID                int64             `json:"-"` // row ID, set when loaded
+	QueuedAt          time.Time         `json:"-"` // set when loaded
+	Version           int               `json:"version"`
+	Kind              string            `json:"kind"` // e.g. "direct_message", "repost"
+	EventID           string            `json:"eventId"`
+	EventCreatedAt    int64             `json:"eventCreatedAt"`
+	SenderNpub        string            `json:"senderNpub"`
+	SenderNIP5        string            `json:"senderNip5"`
+	RecipientUsername string            `json:"recipientUsername"`
+	RecipientEmail    string            `json:"recipientEmail"`
+	RecipientNpub     string            `json:"recipientNpub"`
+	Content           string            `json:"content"`
+	ThreadID          string            `json:"threadId"`        // see threadID
+	Extra             map[string]string `json:"extra,omitempty"` // kind specific values
+}
+
+// digestItemUpgrades converts a stored payload of version N to version N+1.
+// Payloads are upgraded as generic JSON objects so old field names can still be read.
+var digestItemUpgrades = map[int]func(payload map[string]interface{}) map[string]interface{}{
+	// Version 2 adds the thread, older items count as threads of their own
+	1: func(payload map[string]interface{}) map[string]interface{} {
+		payload["threadId"] = payload["eventId"]
+		return payload
+	},
+}
+
+// encodeDigestItem returns the stored payload of an item and its version
+func encodeDigestItem(item DigestItem) (string, int, error) {
+	item.Version = digestItemVersion
+	payload, err := json.Marshal(item)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to encode digest item: %v", err)
+	}
+	return string(payload), item.Version, nil
+}
+
+// addDigestItem stores an item for the next digest of its recipient
+func addDigestItem(db *sql.DB, item DigestItem) error {
+	payload, version, err := encodeDigestItem(item)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO digest_items (recipient_email, version, payload) VALUES (?, ?, ?)",
+		item.RecipientEmail, version, payload)
+	if err != nil {
+		return fmt.Errorf("failed to store digest item: %v", err)
+	}
+	return nil
+}
+
+// loadDigestItems returns the pending digest items of a recipient, upgraded to
+// the current version. Items that cannot be decoded are skipped and reported
+// instead of breaking the whole digest.
+func loadDigestItems(db *sql.DB, recipientEmail string) ([]DigestItem, error) {
+	return queryDigestItems(db, "SELECT id, version, payload, created_at FROM digest_items WHERE recipient_email = ? ORDER BY id", recipientEmail)
+}
+
+// queryDigestItems decodes the digest items selected by query (id, version,
+// payload, created_at)
+func queryDigestItems(db *sql.DB, query string, args ...interface{}) ([]DigestItem, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load digest items: %v", err)
+	}
+	defer rows.Close()
+
+	var items []DigestItem
+	for rows.Next() {
+		var id int64
+		var version int
+		var payload string
+		var queuedAt time.Time
+		if err := rows.Scan(&id, &version, &payload, &queuedAt); err != nil {
+			return nil, fmt.Errorf("failed to read digest item: %v", err)
+		}
+
+		item, err := decodeDigestItem(version, payload)
+		if err != nil {
+			fmt.Printf("⚠️  Skipping digest item %d: %v\n", id, err)
+			continue
+		}
+		item.ID = id
+		item.QueuedAt = queuedAt
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// decodeDigestItem upgrades a stored payload to the current version and decodes it
+func decodeDigestItem(version int, payload string) (DigestItem, error) {
+	if version > digestItemVersion {
+		return DigestItem{}, fmt.Errorf("item version %d is newer than supported version %d", version, digestItemVersion)
+	}
+
+	var generic map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &generic); err != nil {
+		return DigestItem{}, fmt.Errorf("invalid payload: %v", err)
+	}
+
+	for v := version; v < digestItemVersion; v++ {
+		upgrade, exists := digestItemUpgrades[v]
+		if !exists {
+			return DigestItem{}, fmt.Errorf("no upgrade from item version %d", v)
+		}
+		generic = upgrade(generic)
+	}
+	generic["version"] = digestItemVersion
+
+	upgraded, err := json.Marshal(generic)
+	if err != nil {
+		return DigestItem{}, fmt.Errorf("failed to re-encode payload: %v", err)
+	}
+	var item DigestItem
+	if err := json.Unmarshal(upgraded, &item); err != nil {
+		return DigestItem{}, fmt.Errorf("invalid upgraded payload: %v", err)
+	}
+	return item, nil
+}
+
+// deleteDigestItems removes digest items once their digest was sent. Items that
+// were skipped while loading (e.g. written by a newer release) are kept.
+func deleteDigestItems(db *sql.DB, items []DigestItem) error {
+	for _, item := range items {
+		if _, err := db.Exec("DELETE FROM digest_items WHERE id = ?", item.ID); err != nil {
+			return fmt.Errorf("failed to delete digest item %d: %v", item.ID, err)
+		}
+	}
+	return nil
+}
+
+// claimDigestItems deletes digest items and returns those this call deleted,
+// so replicas sharing the items do not both send them
+func claimDigestItems(db *sql.DB, query string, items []DigestItem) ([]DigestItem, error) {
+	var claimed []DigestItem
+	for _, item := range items {
+		result, err := db.Exec(query, item.ID)
+		if err != nil {
+			return claimed, fmt.Errorf("failed to claim digest item %d: %v", item.ID, err)
+		}
+		if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+			claimed = append(claimed, item)
+		}
+	}
+	return claimed, nil
+}
+
+// digestItemFromTemplate stores the facts of a rendered notification as a digest item
+func digestItemFromTemplate(event *nostr.Event, template *EmailTemplate) DigestItem {
+	data := template.Data
+	item := DigestItem{
+		Kind:              strings.TrimPrefix(template.Type, "nostr_"),
+		EventID:           data.EventID,
+		EventCreatedAt:    int64(event.CreatedAt),
+		SenderNpub:        data.SenderNpub,
+		SenderNIP5:        data.SenderNIP5,
+		RecipientUsername: data.Username,
+		RecipientEmail:    data.Email,
+		RecipientNpub:     data.RecipientNpub,
+		Content:           data.EventContent,
+		ThreadID:          threadID(event),
+		Extra:             make(map[string]string),
+	}
+	// Lists such as media are not kept, templates render them optionally
+	for key, value := range data.Content {
+		switch value.(type) {
+		case string, int, int64, bool:
+			item.Extra[key] = fmt.Sprint(value)
+		}
+	}
+	return item
+}
+
+// templateData converts a digest item to template data at render time, so the
+// current templates decide how stored items look
+func (item DigestItem) templateData() EmailTemplateData {
+	data := EmailTemplateData{
+		Username:         item.RecipientUsername,
+		Name:             item.RecipientUsername,
+		FirstName:        item.RecipientUsername,
+		Email:            item.RecipientEmail,
+		SenderNIP5:       item.SenderNIP5,
+		SenderNpub:       item.SenderNpub,
+		RecipientNpub:    item.RecipientNpub,
+		EventContent:     item.Content,
+		EventID:          item.EventID,
+		CreatedAt:        time.Unix(item.EventCreatedAt, 0).UTC().Format("2006-01-02 15:04:05 UTC"),
+		SupportURL:       "https://trustroots.org/support",
+		FooterURL:        "https://trustroots.org",
+		ProfileURL:       fmt.Sprintf("https://www.trustroots.org/profile/%s", item.RecipientUsername),
+		SenderProfileURL: senderProfileURL(item.SenderNIP5, item.SenderNpub),
+		Content:          map[string]interface{}{},
+	}
+	for key, value := range item.Extra {
+		data.Content[key] = value
+	}
+	return data
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// dmRelayListFetchTimeout bounds how long we wait for relays when loading DM relay lists
+const dmRelayListFetchTimeout = 30 * time.Second
+
+// loadDMRelayLists fetches the NIP-17 DM relay lists (kind 10050) of the given
+// users and returns their inbox relays by hex pubkey
+func loadDMRelayLists(pool *nostr.SimplePool, relays []string, hexPubkeys []string) map[string][]string {
+	ctx, cancel := context.WithTimeout(context.Background(), dmRelayListFetchTimeout)
+	defer cancel()
+
+	latest := make(map[string]*nostr.Event)
+	filter := nostr.Filter{Kinds: []int{nostr.KindDMRelayList}, Authors: hexPubkeys}
+	for evt := range pool.SubManyEose(ctx, relays, nostr.Filters{filter}) {
+		if current, exists := latest[evt.Event.PubKey]; !exists || current.CreatedAt < evt.Event.CreatedAt {
+			latest[evt.Event.PubKey] = evt.Event
+		}
+	}
+
+	lists := make(map[string][]string, len(latest))
+	for pubkey, event := range latest {
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "relay" && nostr.IsValidRelayURL(tag[1]) {
+				lists[pubkey] = append(lists[pubkey], nostr.NormalizeURL(tag[1]))
+			}
+		}
+	}
+
+	fmt.Printf("📬 Loaded DM relay lists of %d users\n", len(lists))
+	return lists
+}
+
+// dmRelayFilters groups DM subscriptions by inbox relay: NIP-04 DMs to the users
+// listing a relay and, when the daemon lists it, gift wraps to the daemon key.
+// Relays in skipRelays are already subscribed to with all filters.
+func dmRelayFilters(lists map[string][]string, daemonHexPubkey string, skipRelays []string, since nostr.Timestamp) map[string]nostr.Filters {
+	skip := make(map[string]bool)
+	for _, relay := range skipRelays {
+		skip[nostr.NormalizeURL(relay)] = true
+	}
+
+	usersByRelay := make(map[string][]string)
+	for pubkey, relays := range lists {
+		for _, relay := range relays {
+			if !skip[relay] {
+				usersByRelay[relay] = append(usersByRelay[relay], pubkey)
+			}
+		}
+	}
+
+	giftWrapSince := since - giftWrapMaxSkew
+	relayFilters := make(map[string]nostr.Filters, len(usersByRelay))
+	for relay, pubkeys := range usersByRelay {
+		var filters nostr.Filters
+		var recipients []string
+		for _, pubkey := range pubkeys {
+			if pubkey == daemonHexPubkey {
+				filters = append(filters, nostr.Filter{
+					Kinds: []int{nostr.KindGiftWrap},
+					Tags:  nostr.TagMap{"p": []string{daemonHexPubkey}},
+					Since: &giftWrapSince,
+				})
+			} else {
+				recipients = append(recipients, pubkey)
+			}
+		}
+		if len(recipients) > 0 {
+			filters = append(filters, nostr.Filter{
+				Kinds: []int{nostr.KindEncryptedDirectMessage},
+				Tags:  nostr.TagMap{"p": recipients},
+				Since: &since,
+			})
+		}
+		relayFilters[relay] = filters
+	}
+	return relayFilters
+}
+
+// subscribeDMRelays subscribes to every DM inbox relay with its own filters and
+// merges the events into one channel
+func subscribeDMRelays(ctx context.Context, pool *nostr.SimplePool, relayFilters map[string]nostr.Filters) chan nostr.RelayEvent {
+	events := make(chan nostr.RelayEvent)
+
+	var wg sync.WaitGroup
+	for relay, filters := range relayFilters {
+		wg.Add(1)
+		go func(relay string, filters nostr.Filters) {
+			defer wg.Done()
+			for evt := range pool.SubMany(ctx, []string{relay}, filters) {
+				events <- evt
+			}
+		}(relay, filters)
+	}
+
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+	return events
+}
@@ -2,78 +2,270 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"log"
+	"path"
 	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/vanng822/go-premailer/premailer"
-	"gopkg.in/gomail.v2"
 )
 
-// EmailTemplateData represents the data structure for email templates
+// EmailTemplateData represents the data structure for email templates.
+// The doc tags are rendered by the template variable reference (see template_docs.go).
 type EmailTemplateData struct {
 	// User data
-	Name      string
-	FirstName string
-	Email     string
-	Username  string
+	Name      string `doc:"Display name of the recipient"`
+	FirstName string `doc:"First name of the recipient, used in greetings"`
+	Email     string `doc:"Email address of the recipient"`
+	Username  string `doc:"Trustroots username of the recipient"`
+	Locale    string `doc:"Trustroots locale of the recipient, e.g. de or pt-BR"`
 
 	// URLs
-	HeaderURL        string
-	FooterURL        string
-	SupportURL       string
-	ProfileURL       string
-	SenderProfileURL string
+	HeaderURL        string `doc:"Link target of the email header logo"`
+	FooterURL        string `doc:"Link target of the footer"`
+	SupportURL       string `doc:"Trustroots support page"`
+	ProfileURL       string `doc:"Trustroots profile of the recipient"`
+	SenderProfileURL string `doc:"Trustroots profile of the sender"`
+	// SenderAvatarURL is a template.URL since html/template filters cid: URLs
+	SenderAvatarURL template.URL `doc:"cid: URL of the sender's profile picture embedded in the email when sender avatars are enabled, empty otherwise"`
 
 	// Email content
-	Subject   string
-	Title     string
-	MailTitle string
+	Subject   string `doc:"Email subject line"`
+	Title     string `doc:"Title shown in the email body and HTML <title>"`
+	MailTitle string `doc:"Optional alternative title"`
 
 	// Sender info
-	From EmailSender
+	From EmailSender `doc:"Sender shown in the From header"`
 
 	// Campaign tracking
-	UTMCampaign       string
-	SparkpostCampaign string
+	UTMCampaign       string `doc:"UTM campaign name for tracked links"`
+	SparkpostCampaign string `doc:"Sparkpost campaign identifier"`
 
 	// Custom content
-	Content map[string]interface{}
+	Content map[string]interface{} `doc:"Free-form values, e.g. buttonURL and buttonText for the action button"`
 
 	// Nostr specific fields
-	EventContent  string
-	EventID       string
-	CreatedAt     string
-	SenderNIP5    string
-	SenderNpub    string
-	RecipientNpub string
+	EventContent  string `doc:"Content of the nostr event (placeholder text for encrypted DMs)"`
+	EventID       string `doc:"Hex ID of the nostr event"`
+	CreatedAt     string `doc:"Event creation time formatted as 2006-01-02 15:04:05 UTC"`
+	SenderNIP5    string `doc:"NIP-5 identifier of the sender, e.g. alice@trustroots.org"`
+	SenderNpub    string `doc:"Sender public key in npub format"`
+	RecipientNpub string `doc:"Recipient public key in npub format"`
+	Decrypted     bool   `doc:"True when EventContent holds the decrypted message text"`
+
+	// Language
+	Language        string `doc:"Language the email is rendered in, with a localized template or a translation catalog; empty for English"`
+	ContentLanguage string `doc:"Detected language of EventContent when it differs from the email's and language annotation is enabled"`
+
+	// Truncation
+	ReadMoreURL string `doc:"Link to the whole event when EventContent was shortened to the maximum content length, empty otherwise"`
+
+	// Custom emoji
+	Emoji map[string]string `doc:"Custom emoji (NIP-30) of EventContent, shortcode to image URL; use {{emojify .EventContent .Emoji}} in HTML"`
+
+	catalog *TranslationCatalog // translates .T and FormatDate, nil for English
 }
 
 // EmailSender represents sender information
 type EmailSender struct {
-	Name    string
-	Address string
+	Name    string `doc:"Sender display name"`
+	Address string `doc:"Sender email address"`
+}
+
+// templateFuncs holds the helper functions available to all email templates
+var templateFuncs = template.FuncMap{
+	"shortNpub":    shortNpub,
+	"languageName": languageName,
+	"emojify":      emojify,
+}
+
+// templateFuncDocs describes the helpers in templateFuncs and the methods of
+// EmailTemplateData for the variable reference
+var templateFuncDocs = map[string]string{
+	"shortNpub":    "Abbreviates an npub to its first and last characters, e.g. npub1abcd…wxyz",
+	"languageName": "Names a language code in that language, e.g. Deutsch for de",
+	"emojify":      "Escapes text for HTML and shows its :shortcode: custom emoji as images, e.g. emojify .EventContent .Emoji",
+	".T":           "Translates a text into the language of the email and formats it like fmt.Sprintf, e.g. {{.T \"Hello %s!\" .FirstName}}",
+	".FormatDate":  "Formats a date like .CreatedAt in the date format of the email's language",
+}
+
+// shortNpub abbreviates an npub for display
+func shortNpub(npub string) string {
+	if len(npub) <= 20 {
+		return npub
+	}
+	return npub[:10] + "…" + npub[len(npub)-4:]
 }
 
 // EmailService handles email composition and sending
 type EmailService struct {
-	SMTPHost      string
-	SMTPPort      int
-	SMTPUsername  string
-	SMTPPassword  string
-	FromEmail     string
-	FromName      string
-	htmlTemplates *template.Template
-	textTemplates *template.Template
+	// Transport delivers the emails, SMTP unless another email provider is
+	// configured (see transport.go)
+	Transport   MailTransport
+	FromEmail   string
+	FromName    string
+	templatesMu sync.RWMutex
+	templates   *templateSet // replaced as a whole on reload, see templates.go
+
+	// DryRun records jobs in DryRunJobs instead of sending them
+	DryRun     bool
+	DryRunJobs []EmailJob
+
+	// SendDelay holds emails about events back for a while, so deletions
+	// (NIP-09) arriving in the meantime can cancel them
+	SendDelay time.Duration
+	// Queue keeps emails until they are sent when set, see queue.go;
+	// without it emails are sent from goroutines and held in pending
+	Queue     *EmailQueue
+	pendingMu sync.Mutex
+	pending   map[string][]*pendingEmail // by event ID
+
+	// Archive keeps a copy of every sent email when set
+	Archive EmailArchive
+
+	// Mutes suppresses notifications the recipient muted on nostr when set
+	Mutes *MuteLists
+
+	// SenderAllowlist limits notifications to events from these hex pubkeys
+	// when set, for piloting with real users
+	SenderAllowlist map[string]bool
+
+	// Notes keeps which events were processed for whom, see store.go
+	Notes NoteStore
+
+	// Suppressions holds addresses no email is queued for when set, see
+	// suppression.go
+	Suppressions SuppressionList
+
+	// Preferences holds the plain text preferences chosen on the unsubscribe
+	// page when set, Users those of Trustroots users (see plaintext.go);
+	// Users is by hex pubkey and read under usersMu
+	Preferences EmailPreferences
+	Users       map[string]User
+
+	// Deliveries records what happened to every email when set, see delivery.go
+	Deliveries DeliveryHistory
+
+	// ShadowBans holds senders whose events are never emailed when set, see
+	// shadowban.go
+	ShadowBans ShadowBanList
+
+	// TrustrootsThreads links DMs between Trustroots users to their
+	// Trustroots thread in ThreadLinks when set, see trustroots_threads.go
+	TrustrootsThreads *TrustrootsThreads
+	ThreadLinks       ThreadLinks
+
+	// StoreEvents keeps the signed events notifications are about in Notes,
+	// encoded as json or gzip, when set; see eventstore.go
+	StoreEvents string
+
+	// Cache shares processed events, profiles and NIP-05 results with other
+	// instances in Redis when set, see redis.go
+	Cache *RedisCache
+
+	// Labels suppresses events and authors that moderators labeled as spam
+	// or abuse (NIP-32) when set
+	Labels *ModerationLabels
+
+	// Trust routes notifications by web-of-trust distance when set; the
+	// digest action stores them in Digest
+	Trust *WebOfTrust
+
+	// Digest collects notifications for the digests of their recipients when
+	// set, see digest.go; DigestWindow is the window of users without
+	// nostrDigest
+	Digest       NoteStore
+	DigestWindow string
+
+	// Names resolves nostr: profile references in event content to @names;
+	// without it they are shown as abbreviated npubs
+	Names *ProfileNames
+
+	// Avatars embeds the profile pictures of senders in HTML emails when set
+	Avatars *SenderAvatars
+
+	// ZapProviders looks up the LNURL servers that sign the zap receipts of
+	// users, see zap.go
+	ZapProviders *ZapProviders
+
+	// AttachEvents attaches the signed event to the emails about it, see
+	// signedevent.go
+	AttachEvents bool
+
+	// Senders verifies the authors of events, see verify.go; NIP05 is the
+	// NIP-05 verifier among them when enabled, its policy may digest senders
+	Senders SenderVerifier
+	NIP05   *NIP05Verifier
+
+	// SubjectStrategies chooses generic or summary subjects per template
+	// (or "default"), summary when not set
+	SubjectStrategies map[string]string
+
+	// AnnotateLanguage shows the detected language of event content when it
+	// differs from the language of the email
+	AnnotateLanguage bool
+
+	// MaxContentLength shortens longer event content to about that many
+	// characters, with a link to the whole event; 0 shows all of it
+	MaxContentLength int
+
+	// QuietHours holds notifications to users until their quiet hours end,
+	// or folds them into their digest, see quiet.go
+	QuietHours QuietHoursPolicy
+
+	// SendLimit spaces out all outgoing emails when set, see ratelimit.go
+	SendLimit *SendLimiter
+
+	// RateLimit caps the notification emails per recipient when set, those
+	// over the limit are summarized later, see ratelimit.go
+	RateLimit *UserRateLimiter
+
+	// Signer signs emails about events with the daemon's key when set, see signature.go
+	Signer *NotificationSigner
+
+	// Unsubscribe adds one-click unsubscribe headers to queued emails when
+	// set, see unsubscribe.go
+	Unsubscribe *Unsubscriber
+
+	// Replies gives notifications that can be answered a Reply-To address
+	// when set, see replyto.go
+	Replies *ReplyAddresses
+
+	// Reputation records the history of senders and throttles those our
+	// users complained about when set, see reputation.go
+	Reputation *SenderReputation
+
+	// VerifiedNpubs holds the npub challenges (see challenge.go) when only
+	// users who confirmed owning their npub are emailed
+	VerifiedNpubs *sql.DB
 }
 
 // EmailTemplate represents an email template
 type EmailTemplate struct {
+	Type        string // template name
 	Subject     string
 	HTMLContent string
 	TextContent string
+	Data        EmailTemplateData // the data the email was rendered from
+	Attachments []EmailAttachment
+}
+
+// EmailAttachment is a file attached to an email, e.g. an iCalendar invite
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	// Inline attachments are shown in the HTML, which refers to them as
+	// cid:<Filename>, instead of being listed as files
+	Inline bool
 }
 
 // EmailJob represents an email to be sent
@@ -82,6 +274,18 @@ type EmailJob struct {
 	Subject string
 	HTML    string
 	Text    string
+	EventID string
+	Type    string // template name, used for archive retention
+
+	// EventAuthor signed the event, only they can delete it and cancel the email
+	EventAuthor string
+	// ThreadID is the nostr conversation the event belongs to, see threadID
+	ThreadID string
+	// NotBefore holds the email back until then, e.g. the end of the
+	// recipient's quiet hours
+	NotBefore time.Time
+
+	Attachments []EmailAttachment
 }
 
 // extractUsernameFromNIP5 extracts the username from a NIP-5 identifier
@@ -107,41 +311,95 @@ func getRecipientNpub(user User) string {
 
 // NewEmailService creates a new email service
 func NewEmailService(smtpHost string, smtpPort int, smtpUsername, smtpPassword, fromEmail, fromName string) *EmailService {
-	// Load HTML templates
-	htmlTemplates, err := template.ParseGlob("templates/html/*.html")
+	templates, err := parseTemplateSet(templateFiles)
 	if err != nil {
-		log.Printf("Warning: Failed to load HTML templates: %v", err)
-		htmlTemplates = template.New("html")
+		log.Printf("Warning: Failed to load templates: %v", err)
+		templates = &templateSet{
+			html:     map[string]*template.Template{},
+			text:     texttemplate.New("text"),
+			headings: texttemplate.New("headings"),
+		}
+	}
+
+	return &EmailService{
+		Transport: &SMTPTransport{
+			Host:     smtpHost,
+			Port:     smtpPort,
+			Username: smtpUsername,
+			Password: smtpPassword,
+		},
+		FromEmail: fromEmail,
+		FromName:  fromName,
+		templates: templates,
 	}
+}
+
+// htmlLayoutFiles are the HTML files shared by every email, they are not emails themselves
+var htmlLayoutFiles = map[string]bool{
+	"base.html":      true,
+	"container.html": true,
+}
 
-	// Load text templates
-	textTemplates, err := template.ParseGlob("templates/text/*.txt")
+// parseHTMLTemplates parses each HTML email together with the base layout and partials.
+// Every email defines its own "content" block, so each one needs a separate template set.
+func parseHTMLTemplates(fsys fs.FS) (map[string]*template.Template, error) {
+	files, err := fs.Glob(fsys, "html/*.html")
 	if err != nil {
-		log.Printf("Warning: Failed to load text templates: %v", err)
-		textTemplates = template.New("text")
+		return nil, err
+	}
+	partials, err := fs.Glob(fsys, "html/partials/*.html")
+	if err != nil {
+		return nil, err
 	}
 
-	return &EmailService{
-		SMTPHost:      smtpHost,
-		SMTPPort:      smtpPort,
-		SMTPUsername:  smtpUsername,
-		SMTPPassword:  smtpPassword,
-		FromEmail:     fromEmail,
-		FromName:      fromName,
-		htmlTemplates: htmlTemplates,
-		textTemplates: textTemplates,
+	templates := make(map[string]*template.Template)
+	for _, file := range files {
+		name := path.Base(file)
+		if htmlLayoutFiles[name] {
+			continue
+		}
+
+		setFiles := append([]string{"html/base.html"}, partials...)
+		setFiles = append(setFiles, file)
+		set, err := template.New(name).Funcs(templateFuncs).ParseFS(fsys, setFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		templates[name] = set
 	}
+
+	return templates, nil
 }
 
-// renderHTMLTemplate renders the HTML email template
-func (es *EmailService) renderHTMLTemplate(templateName string, data EmailTemplateData) (string, error) {
+// parseTextTemplates parses the plain text emails. They use text/template, the
+// content is sanitized but must not be HTML-escaped.
+func parseTextTemplates(fsys fs.FS) (*texttemplate.Template, error) {
+	return texttemplate.New("text").Funcs(texttemplate.FuncMap(templateFuncs)).ParseFS(fsys, "text/*.txt")
+}
+
+// executeHTMLTemplate executes an email from a set created by parseHTMLTemplates
+func executeHTMLTemplate(templates map[string]*template.Template, templateName string, data EmailTemplateData) (string, error) {
+	set, exists := templates[templateName+".html"]
+	if !exists {
+		return "", fmt.Errorf("HTML template %s not found", templateName)
+	}
+
 	var buf bytes.Buffer
-	if err := es.htmlTemplates.ExecuteTemplate(&buf, templateName+".html", data); err != nil {
+	if err := set.ExecuteTemplate(&buf, templateName+".html", data); err != nil {
 		return "", fmt.Errorf("failed to execute HTML template %s: %v", templateName, err)
 	}
+	return buf.String(), nil
+}
+
+// renderHTMLTemplate renders the HTML email template
+func (es *EmailService) renderHTMLTemplate(templateName string, data EmailTemplateData) (string, error) {
+	body, err := executeHTMLTemplate(es.currentTemplates().html, templateName, data)
+	if err != nil {
+		return "", err
+	}
 
 	// Inline CSS for better email client compatibility
-	prem, err := premailer.NewPremailerFromString(buf.String(), premailer.NewOptions())
+	prem, err := premailer.NewPremailerFromString(body, premailer.NewOptions())
 	if err != nil {
 		return "", fmt.Errorf("failed to create premailer: %v", err)
 	}
@@ -157,83 +415,478 @@ func (es *EmailService) renderHTMLTemplate(templateName string, data EmailTempla
 // renderTextTemplate renders the plain text email template
 func (es *EmailService) renderTextTemplate(templateName string, data EmailTemplateData) (string, error) {
 	var buf bytes.Buffer
-	if err := es.textTemplates.ExecuteTemplate(&buf, templateName+".txt", data); err != nil {
+	if err := es.currentTemplates().text.ExecuteTemplate(&buf, templateName+".txt", data); err != nil {
 		return "", fmt.Errorf("failed to execute text template %s: %v", templateName, err)
 	}
 
 	return buf.String(), nil
 }
 
-// SendEmail sends an email using the configured SMTP settings
-func (es *EmailService) SendEmail(to, subject, htmlContent, textContent string) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", m.FormatAddress(es.FromEmail, es.FromName))
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/plain", textContent)
-	m.AddAlternative("text/html", htmlContent)
+// autoSubmittedHeaders mark every email as sent automatically, so vacation
+// autoresponders and ticketing systems do not answer it (RFC 3834, and
+// X-Auto-Response-Suppress for Exchange) and loop with the daemon
+var autoSubmittedHeaders = map[string]string{
+	"Auto-Submitted":           "auto-generated",
+	"Precedence":               "bulk",
+	"X-Auto-Response-Suppress": "All",
+}
 
-	d := gomail.NewDialer(es.SMTPHost, es.SMTPPort, es.SMTPUsername, es.SMTPPassword)
+// buildMessage creates an email from the daemon's address
+func (es *EmailService) buildMessage(to, subject, htmlContent, textContent string, attachments ...EmailAttachment) *OutgoingEmail {
+	headers := make(map[string]string)
+	for name, value := range autoSubmittedHeaders {
+		headers[name] = value
+	}
+	return &OutgoingEmail{
+		From:        es.FromEmail,
+		FromName:    es.FromName,
+		To:          to,
+		Subject:     subject,
+		HTML:        htmlContent,
+		Text:        textContent,
+		Headers:     headers,
+		Attachments: attachments,
+	}
+}
 
-	if err := d.DialAndSend(m); err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+// jobMessage creates the email of a queued job; emails are plain text for
+// recipients who asked for it, carry unsubscribe headers when an
+// unsubscriber is set, notifications that can be answered a
+// reply address when reply addresses are set, and emails about events the
+// event ID and the daemon's signature when a signer is set
+func (es *EmailService) jobMessage(job EmailJob) *OutgoingEmail {
+	email := es.buildMessage(job.To, job.Subject, job.HTML, job.Text, job.Attachments...)
+	email.Type = job.Type
+	if es.plainTextOnly(job.To) {
+		plainTextEmail(email)
+	}
+	if es.Replies != nil {
+		email.ReplyTo = es.Replies.jobAddress(job)
+	}
+	if es.Unsubscribe != nil {
+		for name, value := range es.Unsubscribe.Headers(job.To) {
+			email.Headers[name] = value
+		}
+	}
+	if es.Signer == nil || job.EventID == "" {
+		return email
+	}
+	headers, err := es.Signer.Headers(job.EventID, job.To)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return email
 	}
+	for name, value := range headers {
+		email.Headers[name] = value
+	}
+	return email
+}
 
-	return nil
+// SendEmail sends an email with the configured transport
+func (es *EmailService) SendEmail(to, subject, htmlContent, textContent string, attachments ...EmailAttachment) error {
+	_, err := es.send(es.buildMessage(to, subject, htmlContent, textContent, attachments...))
+	return err
+}
+
+// send delivers an email with the transport and returns the provider's
+// message ID, if any
+func (es *EmailService) send(email *OutgoingEmail) (string, error) {
+	if es.SendLimit != nil {
+		if wait := es.SendLimit.Reserve(time.Now()); wait > 0 {
+			fmt.Printf("🚦 Sending to %s in %s, outbound rate limit reached\n", email.To, wait.Round(time.Second))
+			time.Sleep(wait)
+		}
+	}
+
+	messageID, err := es.Transport.Send(email)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %v", err)
+	}
+
+	return messageID, nil
+}
+
+// pendingEmail is an email held back by SendDelay
+type pendingEmail struct {
+	job   EmailJob
+	timer *time.Timer
+}
+
+// sendTime returns when a job queued at now is sent: at its NotBefore, and
+// emails about events not before SendDelay passed
+func (es *EmailService) sendTime(job EmailJob, now time.Time) time.Time {
+	sendAt := now
+	if job.NotBefore.After(sendAt) {
+		sendAt = job.NotBefore
+	}
+	if job.EventID != "" && now.Add(es.SendDelay).After(sendAt) {
+		sendAt = now.Add(es.SendDelay)
+	}
+	return sendAt
 }
 
 // QueueEmailJob queues an email for background processing
 func (es *EmailService) QueueEmailJob(job EmailJob) {
-	// For now, we'll process emails synchronously
-	// In a production system, you'd use a proper job queue like asynq
-	go func() {
-		if err := es.SendEmail(job.To, job.Subject, job.HTML, job.Text); err != nil {
-			log.Printf("❌ Failed to send email to %s: %v", job.To, err)
-		} else {
-			log.Printf("✅ Email sent to %s", job.To)
+	if es.suppressed(job.To) {
+		es.recordDelivery(job.To, job.EventID, job.Type, deliverySuppressed, "")
+		return
+	}
+	if es.DryRun {
+		es.DryRunJobs = append(es.DryRunJobs, job)
+		return
+	}
+
+	delay := time.Until(es.sendTime(job, time.Now()))
+	if es.Queue != nil {
+		if err := es.Queue.Enqueue(job, time.Now().Add(delay)); err != nil {
+			log.Printf("❌ %v", err)
+			es.recordDelivery(job.To, job.EventID, job.Type, deliveryFailed, err.Error())
 		}
-	}()
+		return
+	}
+	if delay > 0 {
+		es.holdEmailJob(job, delay)
+		return
+	}
+
+	go es.sendEmailJob(job)
 }
 
-// ProcessNostrDirectMessage processes a Nostr direct message and sends an email
-func (es *EmailService) ProcessNostrDirectMessage(event *nostr.Event, recipientUser User, senderNIP5 string, senderNpub string) error {
-	// Generate email template for direct message
-	template, err := es.GenerateNostrDirectMessageEmail(event, recipientUser, senderNIP5, senderNpub)
+// sendEmailJob sends an email without retrying
+func (es *EmailService) sendEmailJob(job EmailJob) {
+	if err := es.deliverEmailJob(job); err != nil {
+		es.emailFailed(job, err)
+	}
+}
+
+// deliverEmailJob sends an email, recording and archiving it when sent; the
+// delivery history keeps the provider's message ID
+func (es *EmailService) deliverEmailJob(job EmailJob) error {
+	messageID, err := es.send(es.jobMessage(job))
 	if err != nil {
-		return fmt.Errorf("failed to generate DM email template: %v", err)
+		return err
+	}
+	log.Printf("✅ Email sent to %s", job.To)
+	es.recordDelivery(job.To, job.EventID, job.Type, deliverySent, messageID)
+	es.archiveEmail(job)
+	return nil
+}
+
+// emailFailed records an email that will not be sent
+func (es *EmailService) emailFailed(job EmailJob, err error) {
+	log.Printf("❌ Failed to send email to %s: %v", job.To, err)
+	es.recordDelivery(job.To, job.EventID, job.Type, deliveryFailed, err.Error())
+}
+
+// holdEmailJob sends an email after a delay unless CancelPending cancels it first
+func (es *EmailService) holdEmailJob(job EmailJob, delay time.Duration) {
+	es.pendingMu.Lock()
+	defer es.pendingMu.Unlock()
+	if es.pending == nil {
+		es.pending = make(map[string][]*pendingEmail)
+	}
+
+	held := &pendingEmail{job: job}
+	held.timer = time.AfterFunc(delay, func() {
+		es.pendingMu.Lock()
+		es.removePending(held)
+		es.pendingMu.Unlock()
+		es.sendEmailJob(job)
+	})
+	es.pending[job.EventID] = append(es.pending[job.EventID], held)
+}
+
+// removePending forgets a held email, pendingMu must be held
+func (es *EmailService) removePending(held *pendingEmail) {
+	remaining := es.pending[held.job.EventID][:0]
+	for _, other := range es.pending[held.job.EventID] {
+		if other != held {
+			remaining = append(remaining, other)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(es.pending, held.job.EventID)
+	} else {
+		es.pending[held.job.EventID] = remaining
+	}
+}
+
+// CancelPending cancels the held emails about an event its author deleted and
+// returns how many were cancelled
+func (es *EmailService) CancelPending(eventID, authorPubkey string) int {
+	es.pendingMu.Lock()
+	defer es.pendingMu.Unlock()
+
+	cancelled := 0
+	if es.Queue != nil {
+		jobs, err := es.Queue.Cancel(eventID, authorPubkey)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+		for _, job := range jobs {
+			es.recordDelivery(job.To, job.EventID, job.Type, deliveryCancelled, "")
+			cancelled++
+		}
+	}
+	for _, held := range append([]*pendingEmail(nil), es.pending[eventID]...) {
+		if held.job.EventAuthor != authorPubkey {
+			continue
+		}
+		if held.timer.Stop() {
+			es.removePending(held)
+			es.recordDelivery(held.job.To, held.job.EventID, held.job.Type, deliveryCancelled, "")
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// notificationAuthor returns who a notification is from: the event author, or
+// for zap receipts (signed by the lightning service) the zapper
+func notificationAuthor(event *nostr.Event) string {
+	if event.Kind == nostr.KindZap {
+		if receipt, err := parseZapReceipt(event); err == nil {
+			return receipt.ZapperPubkey
+		}
+	}
+	return event.PubKey
+}
+
+// queueNotification queues a rendered notification email about an event
+func (es *EmailService) queueNotification(event *nostr.Event, recipientUser User, template *EmailTemplate) {
+	recipientHex, _ := npubToHex(recipientUser.NostrNpub)
+
+	if status := recipientUser.accountStatus(); status != "" {
+		fmt.Printf("🚫 Not emailing %s about %s, %s\n", recipientUser.Username, event.ID, status)
+		es.skipNotification(event, recipientUser, template, deliverySkipped, status)
+		return
+	}
+
+	if !es.npubVerified(recipientUser) {
+		fmt.Printf("🔑 Not emailing %s about %s, npub not confirmed\n", recipientUser.Username, event.ID)
+		es.skipNotification(event, recipientUser, template, deliverySkipped, "npub not confirmed")
+		return
+	}
+
+	// Zap receipts and gift wraps are not signed by the sender, so these are
+	// only caught here
+	if es.shadowBanned(notificationAuthor(event)) {
+		fmt.Printf("🤫 Not emailing %s about %s, sender shadow-banned\n", recipientUser.Username, event.ID)
+		es.skipNotification(event, recipientUser, template, deliverySkipped, "sender shadow-banned")
+		return
 	}
 
-	// Queue email job
-	job := EmailJob{
+	if es.SenderAllowlist != nil && !es.SenderAllowlist[notificationAuthor(event)] {
+		fmt.Printf("🧪 Not emailing %s about %s, sender not on the allowlist\n", recipientUser.Username, event.ID)
+		es.skipNotification(event, recipientUser, template, deliverySkipped, "sender not on the allowlist")
+		return
+	}
+
+	if es.Mutes != nil && es.Mutes.Mutes(recipientHex, event) {
+		fmt.Printf("🔇 Not emailing %s about %s, muted on nostr\n", recipientUser.Username, event.ID)
+		es.skipNotification(event, recipientUser, template, deliverySkipped, "muted on nostr")
+		return
+	}
+
+	if es.Reputation != nil {
+		throttled, err := es.Reputation.Throttled(notificationAuthor(event))
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+		if throttled {
+			fmt.Printf("📉 Not emailing %s about %s, sender throttled after complaints\n", recipientUser.Username, event.ID)
+			es.skipNotification(event, recipientUser, template, deliverySkipped, "sender throttled after complaints")
+			return
+		}
+	}
+
+	if es.Trust != nil {
+		switch es.Trust.Action(recipientHex, notificationAuthor(event)) {
+		case trustActionDrop:
+			fmt.Printf("🕸️  Not emailing %s about %s, author outside their web of trust\n", recipientUser.Username, event.ID)
+			es.skipNotification(event, recipientUser, template, deliverySkipped, "author outside their web of trust")
+			return
+		case trustActionDigest:
+			if es.Digest != nil {
+				es.holdForDigest(event, recipientUser, template)
+				es.recordNotification(event)
+				return
+			}
+		}
+	}
+
+	// Trusted senders of other NIP-05 domains may go to the digest
+	if es.NIP05 != nil && es.Digest != nil && es.NIP05.Digest(notificationAuthor(event)) {
+		es.holdForDigest(event, recipientUser, template)
+		es.recordNotification(event)
+		return
+	}
+
+	// Users who chose digests get their notifications, except DMs, in them
+	if es.Digest != nil && template.Type != "nostr_direct_message" && es.digestWindow(recipientUser) != digestOff {
+		es.holdForDigest(event, recipientUser, template)
+		es.recordNotification(event)
+		return
+	}
+
+	// Notifications during quiet hours wait for their end, or for the digest
+	quietUntil := es.QuietHours.Until(recipientUser, time.Now())
+	if !quietUntil.IsZero() && es.QuietHours.Delivery == quietDeliveryDigest && es.Digest != nil {
+		es.holdForDigest(event, recipientUser, template)
+		es.recordNotification(event)
+		return
+	}
+	if es.RateLimit != nil && !es.RateLimit.Allow(recipientUser, template.Subject, time.Now()) {
+		fmt.Printf("🚦 Holding %s for %s's summary, rate limit reached\n", event.ID, recipientUser.Username)
+		es.skipNotification(event, recipientUser, template, deliveryHeld, "rate limit reached")
+		es.recordNotification(event)
+		return
+	}
+	if !quietUntil.IsZero() {
+		fmt.Printf("🌙 Holding %s for %s until their quiet hours end at %s\n", event.ID, recipientUser.Username, quietUntil.Format("15:04 MST"))
+	}
+
+	es.recordNotification(event)
+
+	es.QueueEmailJob(EmailJob{
 		To:      recipientUser.Email,
 		Subject: template.Subject,
 		HTML:    template.HTMLContent,
 		Text:    template.TextContent,
+		EventID: event.ID,
+		Type:    template.Type,
+
+		EventAuthor: event.PubKey,
+		ThreadID:    threadID(event),
+		NotBefore:   quietUntil,
+		Attachments: es.eventAttachments(event, template),
+	})
+}
+
+// recordNotification counts a notification in the reputation of its sender
+// and keeps its event when StoreEvents is set
+func (es *EmailService) recordNotification(event *nostr.Event) {
+	es.storeEvent(event)
+	if es.Reputation == nil {
+		return
+	}
+	if err := es.Reputation.RecordNotification(notificationAuthor(event)); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
 	}
+}
 
-	es.QueueEmailJob(job)
-	return nil
+// holdForDigest stores a notification in the digest queue instead of emailing it
+func (es *EmailService) holdForDigest(event *nostr.Event, recipientUser User, template *EmailTemplate) {
+	item := digestItemFromTemplate(event, template)
+	if err := es.Digest.AddDigestItem(item); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return
+	}
+	fmt.Printf("🕸️  Holding %s for %s's digest\n", event.ID, recipientUser.Username)
+	es.skipNotification(event, recipientUser, template, deliveryDigest, "")
 }
 
-// GenerateNostrDirectMessageEmail creates an email for a Nostr direct message
-func (es *EmailService) GenerateNostrDirectMessageEmail(event *nostr.Event, recipientUser User, senderNIP5 string, senderNpub string) (*EmailTemplate, error) {
-	// Extract sender username from NIP-5 identifier
-	senderUsername := extractUsernameFromNIP5(senderNIP5)
+// renderEmail renders the HTML and text versions of an email template
+func (es *EmailService) renderEmail(templateName string, data EmailTemplateData) (*EmailTemplate, error) {
+	data.EventContent = renderMentions(data.EventContent, es.Names)
+	if parentContent, ok := data.Content["parentContent"].(string); ok {
+		data.Content["parentContent"] = renderMentions(parentContent, es.Names)
+	}
+	if subjectStrategyFor(es.SubjectStrategies, templateName) == subjectSummary {
+		data.Subject = summarySubject(templateName, data)
+	}
+	data = sanitizeTemplateData(data)
+	data = truncateContent(templateName, data, es.MaxContentLength)
+	var attachments []EmailAttachment
+	if avatar, ok := es.senderAvatar(data.SenderNpub); ok {
+		data.SenderAvatarURL = template.URL("cid:" + avatar.Filename)
+		attachments = append(attachments, avatar)
+	}
+
+	// Localized templates are named like nostr_mention.de.html, without one
+	// the default template is translated by the language's catalog
+	renderName := templateName
+	contentLanguage := detectLanguage(data.EventContent)
+	data.Language = es.emailLanguage(templateName, data.Locale, contentLanguage)
+	if es.hasLocalizedTemplate(templateName, data.Language) {
+		renderName = templateName + "." + data.Language
+	}
+	data.catalog = es.currentTemplates().translations[data.Language]
+	data.CreatedAt = data.FormatDate(data.CreatedAt)
+	emailLanguage := data.Language
+	if emailLanguage == "" {
+		emailLanguage = "en"
+	}
+	if es.AnnotateLanguage && contentLanguage != emailLanguage {
+		data.ContentLanguage = contentLanguage
+	}
+
+	htmlContent, err := es.renderHTMLTemplate(renderName, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render HTML template: %v", err)
+	}
+
+	// Plain text shows custom emoji by name
+	textData := data
+	textData.EventContent = emojiText(data.EventContent, data.Emoji)
+	textContent, err := es.renderTextTemplate(renderName, textData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render text template: %v", err)
+	}
+
+	return &EmailTemplate{
+		Type:        templateName,
+		Subject:     data.Subject,
+		HTMLContent: htmlContent,
+		TextContent: textContent,
+		Data:        data,
+		Attachments: attachments,
+	}, nil
+}
+
+// senderAvatar returns the avatar of the sender of an email, false when
+// avatars are off or the sender has none
+func (es *EmailService) senderAvatar(senderNpub string) (EmailAttachment, bool) {
+	if es.Avatars == nil || senderNpub == "" {
+		return EmailAttachment{}, false
+	}
+	hexPubkey, err := npubToHex(senderNpub)
+	if err != nil {
+		return EmailAttachment{}, false
+	}
+	return es.Avatars.Attachment(hexPubkey)
+}
+
+// ProcessNostrDirectMessage processes a Nostr direct message and sends an email
+func (es *EmailService) ProcessNostrDirectMessage(event *nostr.Event, recipientUser User, senderNIP5 string, senderNpub string, decrypted bool) error {
+	// Generate email template for direct message
+	template, err := es.GenerateNostrDirectMessageEmail(event, recipientUser, senderNIP5, senderNpub, decrypted)
+	if err != nil {
+		return fmt.Errorf("failed to generate DM email template: %v", err)
+	}
+
+	es.queueNotification(event, recipientUser, template)
+	return nil
+}
 
+// GenerateNostrDirectMessageEmail creates an email for a Nostr direct message.
+// When decrypted is true the event content holds the plaintext message.
+func (es *EmailService) GenerateNostrDirectMessageEmail(event *nostr.Event, recipientUser User, senderNIP5 string, senderNpub string, decrypted bool) (*EmailTemplate, error) {
 	// Create email data
 	data := EmailTemplateData{
 		Username:      recipientUser.Username,
 		Name:          recipientUser.Username,
 		FirstName:     recipientUser.Username,
 		Email:         recipientUser.Email,
+		Locale:        recipientUser.Locale,
 		SenderNIP5:    senderNIP5,
 		EventContent:  event.Content,
+		Emoji:         customEmoji(event),
 		EventID:       event.ID,
 		CreatedAt:     event.CreatedAt.Time().Format("2006-01-02 15:04:05 UTC"),
 		SenderNpub:    senderNpub,
 		RecipientNpub: recipientUser.NostrNpub,
-		Title:         "🔒 New Encrypted Direct Message",
-		Subject:       fmt.Sprintf("🔒 Encrypted DM from %s", senderNIP5),
+		Decrypted:     decrypted,
 		From: EmailSender{
 			Name:    "Trustroots Nostr",
 			Address: es.FromEmail,
@@ -241,28 +894,588 @@ func (es *EmailService) GenerateNostrDirectMessageEmail(event *nostr.Event, reci
 		SupportURL:       "https://trustroots.org/support",
 		FooterURL:        "https://trustroots.org",
 		ProfileURL:       fmt.Sprintf("https://www.trustroots.org/profile/%s", recipientUser.Username),
-		SenderProfileURL: fmt.Sprintf("https://www.trustroots.org/profile/%s", senderUsername),
+		SenderProfileURL: senderProfileURL(senderNIP5, senderNpub),
 		Content: map[string]interface{}{
 			"buttonURL":  fmt.Sprintf("https://tripch.at/#dm:%s", senderNpub),
 			"buttonText": "View on TRipch.at",
 		},
 	}
 
-	// Generate HTML content
-	htmlContent, err := es.renderHTMLTemplate("nostr_direct_message", data)
+	return es.renderNotification(notificationDirectMessage, data)
+}
+
+// defaultMaxContentLength is how many characters of event content emails
+// show by default, see truncateContent
+const defaultMaxContentLength = 2000
+
+// truncateContent shortens event content longer than maxLength characters
+// and links the whole event from the email: DMs on tripch.at, notes on
+// njump. A maxLength of 0 keeps all content.
+func truncateContent(templateName string, data EmailTemplateData, maxLength int) EmailTemplateData {
+	if maxLength <= 0 || len([]rune(strings.TrimSpace(data.EventContent))) <= maxLength {
+		return data
+	}
+	switch {
+	case templateName == "nostr_direct_message" && data.SenderNpub != "":
+		data.ReadMoreURL = fmt.Sprintf("https://tripch.at/#dm:%s", data.SenderNpub)
+	case data.EventID != "":
+		data.ReadMoreURL = noteURL(data.EventID)
+	}
+	data.EventContent = truncateText(data.EventContent, maxLength)
+	return data
+}
+
+// noteURL returns a web link for a nostr note
+func noteURL(eventID string) string {
+	note, err := nip19.EncodeNote(eventID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to render HTML template: %v", err)
+		return fmt.Sprintf("https://njump.me/%s", eventID)
 	}
+	return fmt.Sprintf("https://njump.me/%s", note)
+}
 
-	// Generate text content
-	textContent, err := es.renderTextTemplate("nostr_direct_message", data)
+// ProcessNostrRepost processes a repost of a user's note and sends an email
+func (es *EmailService) ProcessNostrRepost(event *nostr.Event, note *nostr.Event, recipientUser User, reposterNIP5 string, reposterNpub string) error {
+	template, err := es.GenerateNostrRepostEmail(event, note, recipientUser, reposterNIP5, reposterNpub)
 	if err != nil {
-		return nil, fmt.Errorf("failed to render text template: %v", err)
+		return fmt.Errorf("failed to generate repost email template: %v", err)
 	}
 
-	return &EmailTemplate{
-		Subject:     data.Subject,
-		HTMLContent: htmlContent,
-		TextContent: textContent,
-	}, nil
+	es.queueNotification(event, recipientUser, template)
+	return nil
+}
+
+// GenerateNostrRepostEmail creates an email telling a user their note was reposted
+func (es *EmailService) GenerateNostrRepostEmail(event *nostr.Event, note *nostr.Event, recipientUser User, reposterNIP5 string, reposterNpub string) (*EmailTemplate, error) {
+	// Sender fields describe the reposter, event fields the reposted note
+	data := EmailTemplateData{
+		Username:      recipientUser.Username,
+		Name:          recipientUser.Username,
+		FirstName:     recipientUser.Username,
+		Email:         recipientUser.Email,
+		Locale:        recipientUser.Locale,
+		SenderNIP5:    reposterNIP5,
+		EventContent:  note.Content,
+		Emoji:         customEmoji(note),
+		EventID:       note.ID,
+		CreatedAt:     event.CreatedAt.Time().Format("2006-01-02 15:04:05 UTC"),
+		SenderNpub:    reposterNpub,
+		RecipientNpub: recipientUser.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL:       "https://trustroots.org/support",
+		FooterURL:        "https://trustroots.org",
+		ProfileURL:       fmt.Sprintf("https://www.trustroots.org/profile/%s", recipientUser.Username),
+		SenderProfileURL: senderProfileURL(reposterNIP5, reposterNpub),
+		Content: map[string]interface{}{
+			"media":      eventMedia(note),
+			"buttonURL":  noteURL(note.ID),
+			"buttonText": "View your note",
+		},
+	}
+
+	return es.renderNotification(notificationRepost, data)
+}
+
+// ProcessNostrReaction processes a reaction to a user's note and sends an email
+func (es *EmailService) ProcessNostrReaction(event *nostr.Event, note *nostr.Event, recipientUser User, reactorNIP5 string, reactorNpub string) error {
+	template, err := es.GenerateNostrReactionEmail(event, note, recipientUser, reactorNIP5, reactorNpub)
+	if err != nil {
+		return fmt.Errorf("failed to generate reaction email template: %v", err)
+	}
+
+	es.queueNotification(event, recipientUser, template)
+	return nil
+}
+
+// GenerateNostrReactionEmail creates an email telling a user someone reacted
+// to their note
+func (es *EmailService) GenerateNostrReactionEmail(event *nostr.Event, note *nostr.Event, recipientUser User, reactorNIP5 string, reactorNpub string) (*EmailTemplate, error) {
+	// Custom emoji of the reaction are shown next to those of the note
+	emoji := customEmoji(note)
+	for shortcode, imageURL := range customEmoji(event) {
+		if emoji == nil {
+			emoji = make(map[string]string)
+		}
+		emoji[shortcode] = imageURL
+	}
+
+	// Sender fields describe the reactor, event fields the note reacted to
+	data := EmailTemplateData{
+		Username:      recipientUser.Username,
+		Name:          recipientUser.Username,
+		FirstName:     recipientUser.Username,
+		Email:         recipientUser.Email,
+		Locale:        recipientUser.Locale,
+		SenderNIP5:    reactorNIP5,
+		EventContent:  note.Content,
+		Emoji:         emoji,
+		EventID:       note.ID,
+		CreatedAt:     event.CreatedAt.Time().Format("2006-01-02 15:04:05 UTC"),
+		SenderNpub:    reactorNpub,
+		RecipientNpub: recipientUser.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL:       "https://trustroots.org/support",
+		FooterURL:        "https://trustroots.org",
+		ProfileURL:       fmt.Sprintf("https://www.trustroots.org/profile/%s", recipientUser.Username),
+		SenderProfileURL: senderProfileURL(reactorNIP5, reactorNpub),
+		Content: map[string]interface{}{
+			"reaction":   reactionEmoji(event.Content),
+			"media":      eventMedia(note),
+			"buttonURL":  noteURL(note.ID),
+			"buttonText": "View your note",
+		},
+	}
+
+	return es.renderNotification(notificationReaction, data)
+}
+
+// ProcessNostrZap processes a zap receipt and sends an email to the zapped user
+func (es *EmailService) ProcessNostrZap(event *nostr.Event, receipt *ZapReceipt, recipientUser User, zapperNIP5 string, zapperNpub string) error {
+	template, err := es.GenerateNostrZapEmail(event, receipt, recipientUser, zapperNIP5, zapperNpub)
+	if err != nil {
+		return fmt.Errorf("failed to generate zap email template: %v", err)
+	}
+
+	es.queueNotification(event, recipientUser, template)
+	return nil
+}
+
+// GenerateNostrZapEmail creates a "you received a zap" email. Unverified
+// zappers are shown by their npub.
+func (es *EmailService) GenerateNostrZapEmail(event *nostr.Event, receipt *ZapReceipt, recipientUser User, zapperNIP5 string, zapperNpub string) (*EmailTemplate, error) {
+	sats := receipt.AmountMsats / 1000
+
+	zapperName := zapperNIP5
+	if zapperNIP5 == "" {
+		zapperName = shortNpub(zapperNpub)
+	}
+	zapperProfileURL := senderProfileURL(zapperNIP5, zapperNpub)
+
+	buttonURL := fmt.Sprintf("https://njump.me/%s", zapperNpub)
+	if receipt.ZappedNoteID != "" {
+		buttonURL = noteURL(receipt.ZappedNoteID)
+	}
+
+	data := EmailTemplateData{
+		Username:      recipientUser.Username,
+		Name:          recipientUser.Username,
+		FirstName:     recipientUser.Username,
+		Email:         recipientUser.Email,
+		Locale:        recipientUser.Locale,
+		SenderNIP5:    zapperName,
+		EventContent:  receipt.Comment,
+		Emoji:         receipt.Emoji,
+		EventID:       event.ID,
+		CreatedAt:     event.CreatedAt.Time().Format("2006-01-02 15:04:05 UTC"),
+		SenderNpub:    zapperNpub,
+		RecipientNpub: recipientUser.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL:       "https://trustroots.org/support",
+		FooterURL:        "https://trustroots.org",
+		ProfileURL:       fmt.Sprintf("https://www.trustroots.org/profile/%s", recipientUser.Username),
+		SenderProfileURL: zapperProfileURL,
+		Content: map[string]interface{}{
+			"amountSats": sats,
+			"buttonURL":  buttonURL,
+			"buttonText": "View on nostr",
+		},
+	}
+
+	return es.renderNotification(notificationZap, data)
+}
+
+// ProcessNostrNewFollowers sends a user one email about their new followers
+func (es *EmailService) ProcessNostrNewFollowers(recipientUser User, followers []Follower) error {
+	if status := recipientUser.accountStatus(); status != "" {
+		fmt.Printf("🚫 Not emailing %s about new followers, %s\n", recipientUser.Username, status)
+		return nil
+	}
+	if !es.npubVerified(recipientUser) {
+		fmt.Printf("🔑 Not emailing %s about new followers, npub not confirmed\n", recipientUser.Username)
+		return nil
+	}
+
+	template, err := es.GenerateNostrNewFollowersEmail(recipientUser, followers)
+	if err != nil {
+		return fmt.Errorf("failed to generate new followers email template: %v", err)
+	}
+
+	es.QueueEmailJob(EmailJob{
+		To:        recipientUser.Email,
+		Subject:   template.Subject,
+		HTML:      template.HTMLContent,
+		Text:      template.TextContent,
+		Type:      template.Type,
+		NotBefore: es.QuietHours.Until(recipientUser, time.Now()),
+	})
+	return nil
+}
+
+// GenerateNostrNewFollowersEmail creates a summary of the pubkeys that started
+// following a user, named like profile references in content
+func (es *EmailService) GenerateNostrNewFollowersEmail(recipientUser User, followers []Follower) (*EmailTemplate, error) {
+	var followerList []map[string]string
+	for _, follower := range followers {
+		npub, err := hexToNpub(follower.Pubkey)
+		if err != nil {
+			continue
+		}
+		name := ""
+		if es.Names != nil {
+			name = sanitizeLine(es.Names.Name(follower.Pubkey))
+		}
+		if name == "" {
+			name = shortNpub(npub)
+		}
+		followerList = append(followerList, map[string]string{
+			"name": name,
+			"url":  fmt.Sprintf("https://njump.me/%s", npub),
+		})
+	}
+
+	data := EmailTemplateData{
+		Username:      recipientUser.Username,
+		Name:          recipientUser.Username,
+		FirstName:     recipientUser.Username,
+		Email:         recipientUser.Email,
+		Locale:        recipientUser.Locale,
+		RecipientNpub: recipientUser.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL: "https://trustroots.org/support",
+		FooterURL:  "https://trustroots.org",
+		ProfileURL: fmt.Sprintf("https://www.trustroots.org/profile/%s", recipientUser.Username),
+		Content: map[string]interface{}{
+			"followers":  followerList,
+			"count":      len(followerList),
+			"buttonURL":  fmt.Sprintf("https://njump.me/%s", recipientUser.NostrNpub),
+			"buttonText": "View your profile on nostr",
+		},
+	}
+
+	return es.renderHeadedEmail(emailNewFollowers, data)
+}
+
+// ProcessNostrRateLimitSummary sends a user one email about the notifications
+// held back by the rate limit
+func (es *EmailService) ProcessNostrRateLimitSummary(held rateOverflow) error {
+	template, err := es.GenerateNostrRateLimitSummaryEmail(held)
+	if err != nil {
+		return fmt.Errorf("failed to generate notification summary email template: %v", err)
+	}
+
+	es.QueueEmailJob(EmailJob{
+		To:        held.User.Email,
+		Subject:   template.Subject,
+		HTML:      template.HTMLContent,
+		Text:      template.TextContent,
+		Type:      template.Type,
+		NotBefore: es.QuietHours.Until(held.User, time.Now()),
+	})
+	return nil
+}
+
+// GenerateNostrRateLimitSummaryEmail creates a summary of the notifications
+// held back by the rate limit, listing their subjects
+func (es *EmailService) GenerateNostrRateLimitSummaryEmail(held rateOverflow) (*EmailTemplate, error) {
+	data := EmailTemplateData{
+		Username:      held.User.Username,
+		Name:          held.User.Username,
+		FirstName:     held.User.Username,
+		Email:         held.User.Email,
+		Locale:        held.User.Locale,
+		RecipientNpub: held.User.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL: "https://trustroots.org/support",
+		FooterURL:  "https://trustroots.org",
+		ProfileURL: fmt.Sprintf("https://www.trustroots.org/profile/%s", held.User.Username),
+		Content: map[string]interface{}{
+			"subjects":   held.Subjects,
+			"count":      held.Count,
+			"unlisted":   held.Count - len(held.Subjects),
+			"buttonURL":  fmt.Sprintf("https://njump.me/%s", held.User.NostrNpub),
+			"buttonText": "View your profile on nostr",
+		},
+	}
+
+	return es.renderHeadedEmail(emailRateLimited, data)
+}
+
+// GenerateNpubChallengeEmail creates the email with the link where a user
+// enters the code that was sent by DM to their npub
+func (es *EmailService) GenerateNpubChallengeEmail(recipientUser User, confirmURL string) (*EmailTemplate, error) {
+	data := EmailTemplateData{
+		Username:      recipientUser.Username,
+		Name:          recipientUser.Username,
+		FirstName:     recipientUser.Username,
+		Email:         recipientUser.Email,
+		Locale:        recipientUser.Locale,
+		RecipientNpub: recipientUser.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL: "https://trustroots.org/support",
+		FooterURL:  "https://trustroots.org",
+		ProfileURL: fmt.Sprintf("https://www.trustroots.org/profile/%s", recipientUser.Username),
+		Content: map[string]interface{}{
+			"validHours": int(npubChallengeTTL.Hours()),
+			"buttonURL":  confirmURL,
+			"buttonText": "Enter your code",
+		},
+	}
+
+	return es.renderHeadedEmail(emailNpubChallenge, data)
+}
+
+// ProcessNostrAbuseReport sends the moderators an email about a report against users
+func (es *EmailService) ProcessNostrAbuseReport(event *nostr.Event, reported []ReportedUser, npubToUser map[string]User, moderatorEmail string) error {
+	template, err := es.GenerateNostrAbuseReportEmail(event, reported, npubToUser, moderatorEmail)
+	if err != nil {
+		return fmt.Errorf("failed to generate abuse report email template: %v", err)
+	}
+	es.storeEvent(event)
+
+	es.QueueEmailJob(EmailJob{
+		To:      moderatorEmail,
+		Subject: template.Subject,
+		HTML:    template.HTMLContent,
+		Text:    template.TextContent,
+		EventID: event.ID,
+		Type:    template.Type,
+
+		EventAuthor: event.PubKey,
+		ThreadID:    threadID(event),
+		Attachments: es.eventAttachments(event, template),
+	})
+	return nil
+}
+
+// GenerateNostrAbuseReportEmail creates an email telling the moderators who
+// reported which Trustroots users on nostr, and why
+func (es *EmailService) GenerateNostrAbuseReportEmail(event *nostr.Event, reported []ReportedUser, npubToUser map[string]User, moderatorEmail string) (*EmailTemplate, error) {
+	var reportedList []map[string]string
+	var usernames []string
+	for _, user := range reported {
+		reportType := user.ReportType
+		if reportType == "" {
+			reportType = "other"
+		}
+		reportedList = append(reportedList, map[string]string{
+			"username":   user.Username,
+			"profileURL": fmt.Sprintf("https://www.trustroots.org/profile/%s", user.Username),
+			"npubURL":    fmt.Sprintf("https://njump.me/%s", user.NostrNpub),
+			"reportType": reportType,
+		})
+		usernames = append(usernames, user.Username)
+	}
+
+	// Reporters are usually not Trustroots users
+	reporterNpub, reporterName, reporterURL := es.nostrProfile(event.PubKey, npubToUser)
+
+	// The report may be about a specific note
+	reportedNoteURL := ""
+	if eTag := event.Tags.Find("e"); eTag != nil {
+		reportedNoteURL = noteURL(eTag[1])
+	}
+
+	data := EmailTemplateData{
+		Name:         "Trustroots safety team",
+		FirstName:    "safety team",
+		Email:        moderatorEmail,
+		EventContent: event.Content,
+		Emoji:        customEmoji(event),
+		EventID:      event.ID,
+		CreatedAt:    event.CreatedAt.Time().Format("2006-01-02 15:04:05 UTC"),
+		SenderNpub:   reporterNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL:       "https://trustroots.org/support",
+		FooterURL:        "https://trustroots.org",
+		SenderProfileURL: reporterURL,
+		Content: map[string]interface{}{
+			"reported":        reportedList,
+			"usernames":       strings.Join(usernames, ", "),
+			"reporterName":    reporterName,
+			"reportedNoteURL": reportedNoteURL,
+			"buttonURL":       noteURL(event.ID),
+			"buttonText":      "View the report on nostr",
+		},
+	}
+
+	return es.renderHeadedEmail(emailAbuseReport, data)
+}
+
+// nostrProfile names the author of an event who need not be a Trustroots user,
+// like profile references: the npub, a display name and a profile URL
+func (es *EmailService) nostrProfile(hexPubkey string, npubToUser map[string]User) (npub, name, profileURL string) {
+	npub, err := hexToNpub(hexPubkey)
+	if err != nil {
+		npub = hexPubkey
+	}
+	name = shortNpub(npub)
+	profileURL = fmt.Sprintf("https://njump.me/%s", npub)
+	if user, exists := npubToUser[npub]; exists {
+		name = user.Username + "@trustroots.org"
+		profileURL = fmt.Sprintf("https://www.trustroots.org/profile/%s", user.Username)
+	} else if es.Names != nil {
+		if profileName := sanitizeLine(es.Names.Name(hexPubkey)); profileName != "" {
+			name = profileName
+		}
+	}
+	return npub, name, profileURL
+}
+
+// ProcessNostrWatchedNote emails a note with watched hashtags or keywords to
+// the monitoring address, or holds it for its digest
+func (es *EmailService) ProcessNostrWatchedNote(event *nostr.Event, matches []string, npubToUser map[string]User, watch WatchConfig) error {
+	template, err := es.GenerateNostrWatchedNoteEmail(event, matches, npubToUser, watch.Email)
+	if err != nil {
+		return fmt.Errorf("failed to generate watched note email template: %v", err)
+	}
+	es.storeEvent(event)
+
+	if watch.Delivery == watchDeliveryDigest {
+		if es.Digest == nil {
+			return fmt.Errorf("no digest queue for watched note %s", event.ID)
+		}
+		return es.Digest.AddDigestItem(digestItemFromTemplate(event, template))
+	}
+
+	es.QueueEmailJob(EmailJob{
+		To:      watch.Email,
+		Subject: template.Subject,
+		HTML:    template.HTMLContent,
+		Text:    template.TextContent,
+		EventID: event.ID,
+		Type:    template.Type,
+
+		EventAuthor: event.PubKey,
+		ThreadID:    threadID(event),
+		Attachments: es.eventAttachments(event, template),
+	})
+	return nil
+}
+
+// GenerateNostrWatchedNoteEmail creates an email showing a note and the watched
+// hashtags and keywords it matched
+func (es *EmailService) GenerateNostrWatchedNoteEmail(event *nostr.Event, matches []string, npubToUser map[string]User, watchEmail string) (*EmailTemplate, error) {
+	authorNpub, authorName, authorURL := es.nostrProfile(event.PubKey, npubToUser)
+
+	data := EmailTemplateData{
+		Name:         "Trustroots community team",
+		FirstName:    "community team",
+		Email:        watchEmail,
+		EventContent: event.Content,
+		Emoji:        customEmoji(event),
+		EventID:      event.ID,
+		CreatedAt:    event.CreatedAt.Time().Format("2006-01-02 15:04:05 UTC"),
+		SenderNpub:   authorNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL:       "https://trustroots.org/support",
+		FooterURL:        "https://trustroots.org",
+		SenderProfileURL: authorURL,
+		Content: map[string]interface{}{
+			"matches":    strings.Join(matches, ", "),
+			"authorName": authorName,
+			"media":      eventMedia(event),
+			"buttonURL":  noteURL(event.ID),
+			"buttonText": "View the note on nostr",
+		},
+	}
+
+	return es.renderHeadedEmail(emailWatchedNote, data)
+}
+
+// ProcessNostrMention processes an event mentioning a user and sends an email
+func (es *EmailService) ProcessNostrMention(event *nostr.Event, recipientUser User, senderNIP5 string, senderNpub string, mention Mention) error {
+	template, err := es.GenerateNostrMentionEmail(event, recipientUser, senderNIP5, senderNpub, mention)
+	if err != nil {
+		return fmt.Errorf("failed to generate mention email template: %v", err)
+	}
+
+	es.queueNotification(event, recipientUser, template)
+	return nil
+}
+
+// GenerateNostrMentionEmail creates an email telling a user they were mentioned,
+// with the content the mentioning event replies to when known
+func (es *EmailService) GenerateNostrMentionEmail(event *nostr.Event, recipientUser User, senderNIP5 string, senderNpub string, mention Mention) (*EmailTemplate, error) {
+	content := event.Content
+	if mention.Excerpt != "" {
+		content = mention.Excerpt
+	}
+	action := mention.Action
+	if action == "" {
+		action = "mentioned you in " + mention.Context
+	}
+	parentLabel := mention.ParentLabel
+	if parentLabel == "" {
+		parentLabel = "In reply to"
+	}
+
+	data := EmailTemplateData{
+		Username:      recipientUser.Username,
+		Name:          recipientUser.Username,
+		FirstName:     recipientUser.Username,
+		Email:         recipientUser.Email,
+		Locale:        recipientUser.Locale,
+		SenderNIP5:    senderNIP5,
+		EventContent:  content,
+		Emoji:         customEmoji(event),
+		EventID:       event.ID,
+		CreatedAt:     event.CreatedAt.Time().Format("2006-01-02 15:04:05 UTC"),
+		SenderNpub:    senderNpub,
+		RecipientNpub: recipientUser.NostrNpub,
+		From: EmailSender{
+			Name:    "Trustroots Nostr",
+			Address: es.FromEmail,
+		},
+		SupportURL:       "https://trustroots.org/support",
+		FooterURL:        "https://trustroots.org",
+		ProfileURL:       fmt.Sprintf("https://www.trustroots.org/profile/%s", recipientUser.Username),
+		SenderProfileURL: senderProfileURL(senderNIP5, senderNpub),
+		Content: map[string]interface{}{
+			"context":       mention.Context,
+			"action":        action,
+			"title":         mention.Title,
+			"titleURL":      mention.TitleURL,
+			"parentContent": mention.ParentContent,
+			"parentURL":     mention.ParentURL,
+			"parentLabel":   parentLabel,
+			"media":         eventMedia(event),
+			"buttonURL":     mention.URL,
+			"buttonText":    "View on nostr",
+		},
+	}
+
+	notification := notificationMention
+	if mention.Reply {
+		notification = notificationReply
+	}
+	template, err := es.renderNotification(notification, data)
+	if err != nil {
+		return nil, err
+	}
+	template.Attachments = append(template.Attachments, mention.Attachments...)
+	return template, nil
 }
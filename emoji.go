@@ -0,0 +1,64 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// emojiShortcodePattern matches :shortcode: references, shortcodes are
+// alphanumeric characters and underscores (NIP-30)
+var emojiShortcodePattern = regexp.MustCompile(`:([a-zA-Z0-9_]+):`)
+
+// customEmoji returns the custom emoji an event defines in its
+// ["emoji", <shortcode>, <image URL>] tags, by shortcode
+func customEmoji(event *nostr.Event) map[string]string {
+	var emoji map[string]string
+	for _, tag := range event.Tags {
+		if len(tag) < 3 || tag[0] != "emoji" {
+			continue
+		}
+		if !emojiShortcodePattern.MatchString(":" + tag[1] + ":") {
+			continue
+		}
+		imageURL, err := url.Parse(tag[2])
+		if err != nil || (imageURL.Scheme != "https" && imageURL.Scheme != "http") || imageURL.Host == "" {
+			continue
+		}
+		if emoji == nil {
+			emoji = make(map[string]string)
+		}
+		emoji[tag[1]] = tag[2]
+	}
+	return emoji
+}
+
+// replaceEmoji replaces the known :shortcode: references in text
+func replaceEmoji(text string, emoji map[string]string, replace func(shortcode, imageURL string) string) string {
+	return emojiShortcodePattern.ReplaceAllStringFunc(text, func(match string) string {
+		shortcode := strings.Trim(match, ":")
+		if imageURL, exists := emoji[shortcode]; exists {
+			return replace(shortcode, imageURL)
+		}
+		return match
+	})
+}
+
+// emojify escapes text for HTML and shows its custom emoji as inline images
+func emojify(text string, emoji map[string]string) template.HTML {
+	escaped := template.HTMLEscapeString(text)
+	return template.HTML(replaceEmoji(escaped, emoji, func(shortcode, imageURL string) string {
+		return `<img src="` + template.HTMLEscapeString(imageURL) + `" alt=":` + shortcode + `:" title=":` + shortcode +
+			`:" height="20" style="height: 20px; width: auto; vertical-align: middle;">`
+	}))
+}
+
+// emojiText shows custom emoji in plain text as their name, e.g. [soapbox]
+func emojiText(text string, emoji map[string]string) string {
+	return replaceEmoji(text, emoji, func(shortcode, imageURL string) string {
+		return "[" + shortcode + "]"
+	})
+}
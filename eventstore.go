@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Encodings of stored events
+const (
+	storedEventJSON = "json" // the event JSON as is
+	storedEventGzip = "gzip" // gzip-compressed event JSON
+)
+
+// parseStoreEvents parses NOSTREMAIL_STORE_EVENTS: json (or true), gzip, or
+// empty (or false) to not store events
+func parseStoreEvents(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "", "false":
+		return "", nil
+	case "true", storedEventJSON:
+		return storedEventJSON, nil
+	case storedEventGzip:
+		return storedEventGzip, nil
+	}
+	return "", fmt.Errorf("invalid value %q, expected json or gzip", value)
+}
+
+// encodeStoredEvent encodes an event for the stored_events table
+func encodeStoredEvent(event *nostr.Event, encoding string) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event %s: %v", event.ID, err)
+	}
+	if encoding != storedEventGzip {
+		return data, nil
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress event %s: %v", event.ID, err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress event %s: %v", event.ID, err)
+	}
+	return compressed.Bytes(), nil
+}
+
+// decodeStoredEvent decodes an event from the stored_events table
+func decodeStoredEvent(encoding string, data []byte) (*nostr.Event, error) {
+	switch encoding {
+	case storedEventJSON:
+	case storedEventGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress stored event: %v", err)
+		}
+		data, err = io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress stored event: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown stored event encoding %q", encoding)
+	}
+
+	var event nostr.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("failed to decode stored event: %v", err)
+	}
+	return &event, nil
+}
+
+// storeEvent keeps the JSON of an event, the first copy wins
+func storeEvent(db *sql.DB, event *nostr.Event, encoding string) error {
+	data, err := encodeStoredEvent(event, encoding)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO stored_events (event_id, created_at, encoding, data) VALUES (?, ?, ?, ?)",
+		event.ID, int64(event.CreatedAt), encoding, data)
+	if err != nil {
+		return fmt.Errorf("failed to store event %s: %v", event.ID, err)
+	}
+	return nil
+}
+
+// queryStoredEvents decodes the events selected by a query for encoding and data
+func queryStoredEvents(db *sql.DB, query string, args ...interface{}) ([]*nostr.Event, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stored events: %v", err)
+	}
+	defer rows.Close()
+
+	var events []*nostr.Event
+	for rows.Next() {
+		var encoding string
+		var data []byte
+		if err := rows.Scan(&encoding, &data); err != nil {
+			return nil, fmt.Errorf("failed to read stored event: %v", err)
+		}
+		event, err := decodeStoredEvent(encoding, data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// storeEvent keeps an event a notification is about when StoreEvents is set.
+// Only events as their authors signed them are kept: DMs shown with
+// placeholder or decrypted content and unwrapped rumors are skipped, their
+// handlers store the events they received instead.
+func (es *EmailService) storeEvent(event *nostr.Event) {
+	if es.StoreEvents == "" {
+		return
+	}
+	if valid, _ := event.CheckSignature(); !valid {
+		return
+	}
+	if err := es.Notes.StoreEvent(event, es.StoreEvents); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
+
+// runShowEvent implements `nostremail show-event [--db path] [--postgres url] <event id>`
+func runShowEvent(args []string) error {
+	fs := flag.NewFlagSet("show-event", flag.ExitOnError)
+	dbPath := fs.String("db", processedNotesDBPath, "Path of the processed notes database")
+	postgresURL := fs.String("postgres", "", "Read from the PostgreSQL note store at this URL instead")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: nostremail show-event [--db path] [--postgres url] <event id>")
+	}
+
+	notes, closeNotes, err := openNoteStore(*dbPath, *postgresURL)
+	if err != nil {
+		return err
+	}
+	defer closeNotes()
+
+	event, err := notes.StoredEvent(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return fmt.Errorf("event %s is not stored", fs.Arg(0))
+	}
+	valid, _ := event.CheckSignature()
+	fmt.Fprintf(os.Stderr, "Signature valid: %t\n", valid)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(event)
+}
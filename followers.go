@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// followerSummaryInterval is the minimum time between two new-follower emails to a user
+const followerSummaryInterval = 24 * time.Hour
+
+// followerSummaryCheckInterval is how often pending followers are looked at
+const followerSummaryCheckInterval = time.Hour
+
+// Follower is a pubkey that started following a user
+type Follower struct {
+	Pubkey     string
+	FollowedAt time.Time
+}
+
+// recordFollower stores that follower follows followed and reports whether
+// this is a new follower
+func recordFollower(db *sql.DB, followedHex, followerHex string, followedAt nostr.Timestamp) (bool, error) {
+	result, err := db.Exec("INSERT OR IGNORE INTO followers (followed_pubkey, follower_pubkey, followed_at) VALUES (?, ?, ?)",
+		followedHex, followerHex, followedAt.Time().UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to record follower: %v", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record follower: %v", err)
+	}
+	return inserted > 0, nil
+}
+
+// processFollowList records the monitored users a contact list (kind 3) follows.
+// Followers we have not seen before wait for the user's next follower summary.
+func processFollowList(event *nostr.Event, hexToUser map[string]User, sqliteDB *sql.DB, emailService *EmailService) {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" || tag[1] == event.PubKey {
+			continue
+		}
+		user, monitored := hexToUser[tag[1]]
+		if !monitored {
+			continue
+		}
+		if emailService.Mutes != nil && emailService.Mutes.Mutes(tag[1], event) {
+			continue
+		}
+		if emailService.SenderAllowlist != nil && !emailService.SenderAllowlist[event.PubKey] {
+			continue
+		}
+
+		isNew, err := recordFollower(sqliteDB, tag[1], event.PubKey, event.CreatedAt)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			continue
+		}
+		if isNew {
+			fmt.Printf("👥 %s has a new follower: %s\n", user.Username, event.PubKey)
+		}
+	}
+}
+
+// pendingFollowers returns the followers that were not emailed yet, by followed
+// user, leaving out users who got a summary within followerSummaryInterval
+func pendingFollowers(db *sql.DB, now time.Time) (map[string][]Follower, error) {
+	rows, err := db.Query(`SELECT followed_pubkey, follower_pubkey, followed_at FROM followers
+		WHERE notified_at IS NULL AND followed_pubkey NOT IN (
+			SELECT followed_pubkey FROM followers WHERE notified_at > ?)
+		ORDER BY followed_at`, now.Add(-followerSummaryInterval).UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pending followers: %v", err)
+	}
+	defer rows.Close()
+
+	pending := make(map[string][]Follower)
+	for rows.Next() {
+		var followed string
+		var follower Follower
+		if err := rows.Scan(&followed, &follower.Pubkey, &follower.FollowedAt); err != nil {
+			return nil, fmt.Errorf("failed to read follower: %v", err)
+		}
+		pending[followed] = append(pending[followed], follower)
+	}
+	return pending, rows.Err()
+}
+
+// markFollowersNotified records that a user was emailed about the given followers
+func markFollowersNotified(db *sql.DB, followedHex string, followers []Follower, now time.Time) error {
+	for _, follower := range followers {
+		_, err := db.Exec("UPDATE followers SET notified_at = ? WHERE followed_pubkey = ? AND follower_pubkey = ?",
+			now.UTC(), followedHex, follower.Pubkey)
+		if err != nil {
+			return fmt.Errorf("failed to mark follower as notified: %v", err)
+		}
+	}
+	return nil
+}
+
+// sendFollowerSummaries emails every user with pending followers one summary
+func sendFollowerSummaries(db *sql.DB, hexToUser map[string]User, emailService *EmailService) error {
+	now := time.Now()
+	pending, err := pendingFollowers(db, now)
+	if err != nil {
+		return err
+	}
+
+	for followedHex, followers := range pending {
+		usersMu.RLock()
+		user, exists := hexToUser[followedHex]
+		usersMu.RUnlock()
+		if !exists {
+			continue
+		}
+		if err := emailService.ProcessNostrNewFollowers(user, followers); err != nil {
+			fmt.Printf("❌ Failed to send follower summary to %s: %v\n", user.Username, err)
+			continue
+		}
+		if err := markFollowersNotified(db, followedHex, followers, now); err != nil {
+			return err
+		}
+		fmt.Printf("👥 Sent %s a summary of %d new followers\n", user.Username, len(followers))
+	}
+	return nil
+}
+
+// runFollowerSummaries sends follower summaries every followerSummaryCheckInterval
+func runFollowerSummaries(db *sql.DB, hexToUser map[string]User, emailService *EmailService) {
+	for {
+		if err := sendFollowerSummaries(db, hexToUser, emailService); err != nil {
+			fmt.Printf("⚠️  Failed to send follower summaries: %v\n", err)
+		}
+		time.Sleep(followerSummaryCheckInterval)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip59"
+)
+
+// giftWrapMaxSkew is how far NIP-59 allows gift wrap timestamps to be randomized into the past
+const giftWrapMaxSkew = 2 * 24 * 60 * 60
+
+// kindFileMessage is the NIP-17 file message kind (not defined by the nostr library)
+const kindFileMessage = 15
+
+// unwrapGiftWrap unwraps a NIP-59 gift wrap addressed to the daemon key and
+// returns the rumor with its pubkey set to the (verified) seal author
+func unwrapGiftWrap(event *nostr.Event, nsec string) (nostr.Event, error) {
+	privateKeyHex, err := nsecToHex(nsec)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to decode sender nsec: %v", err)
+	}
+
+	decrypt := func(otherPubkey, ciphertext string) (string, error) {
+		conversationKey, err := nip44.GenerateConversationKey(otherPubkey, privateKeyHex)
+		if err != nil {
+			return "", err
+		}
+		return nip44.Decrypt(ciphertext, conversationKey)
+	}
+
+	rumor, err := nip59.GiftUnwrap(*event, decrypt)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to unwrap gift wrap: %v", err)
+	}
+	return rumor, nil
+}
+
+// daemonKeyUser returns the Trustroots user who linked the daemon key
+// (NOSTREMAIL_SENDER_NPUB), as nostrNpub or one of nostrNpubs
+func daemonKeyUser(hexToUser map[string]User, config *Config) (User, bool) {
+	daemonHexPubkey, err := npubToHex(config.SenderNpub)
+	if err != nil {
+		return User{}, false
+	}
+	user, exists := hexToUser[daemonHexPubkey]
+	return user, exists
+}
+
+// processGiftWrap handles NIP-17 private messages (kind 14/15 rumors inside kind 1059 gift wraps)
+// addressed to the daemon key. Only the daemon's own key can be unwrapped, so the email goes
+// to the Trustroots user that owns NOSTREMAIL_SENDER_NPUB, see daemonKeyUser.
+func processGiftWrap(event *nostr.Event, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	recipientUser, exists := daemonKeyUser(hexToUser, config)
+	if !exists {
+		fmt.Printf("ℹ️  Gift wrap %s received but daemon npub is not linked to a user\n", event.ID)
+		return
+	}
+
+	rumor, err := unwrapGiftWrap(event, config.SenderNsec)
+	if err != nil {
+		fmt.Printf("⚠️  Failed to unwrap gift wrap %s: %v\n", event.ID, err)
+		return
+	}
+
+	// Mark the wrap as processed whatever the outcome, unwrapping will not succeed later either
+	defer func() {
+		if err := emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", recipientUser.Email); err != nil {
+			fmt.Printf("⚠️  Error marking gift wrap as processed: %v\n", err)
+		}
+		// The wrap is random, the conversation is that of the rumor
+		if err := emailService.Notes.RecordThreadID(event.ID, recipientUser.Email, threadID(&rumor)); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+	}()
+
+	if rumor.Kind != nostr.KindDirectMessage && rumor.Kind != kindFileMessage {
+		fmt.Printf("ℹ️  Ignoring gift-wrapped kind %d from %s\n", rumor.Kind, rumor.PubKey)
+		return
+	}
+
+	// The seal is signed by the real author, so the rumor pubkey is the sender
+	senderNpub, err := hexToNpub(rumor.PubKey)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert rumor pubkey to npub: %v\n", err)
+		return
+	}
+
+	senderNIP5, verified := emailService.verifySender(rumor.PubKey)
+	if !verified {
+		fmt.Printf("⚠️  Skipping private message from unverified user: %s\n", senderNpub)
+		return
+	}
+
+	fmt.Printf("📨 Private message for %s from %s\n", recipientUser.Username, senderNIP5)
+
+	// File messages carry the file URL as content
+	if rumor.Kind == kindFileMessage {
+		rumor.Content = fmt.Sprintf("[File] %s", rumor.Content)
+	}
+
+	// Rumors are unsigned, keep the gift wrap as received
+	emailService.storeEvent(event)
+
+	// Trustroots emails about messages also sent there
+	if sender, exists := hexToUser[rumor.PubKey]; exists && emailService.crossReferenceThread(&rumor, sender, recipientUser) {
+		return
+	}
+
+	err = emailService.ProcessNostrDirectMessage(&rumor, recipientUser, senderNIP5, senderNpub, true)
+	if err != nil {
+		fmt.Printf("❌ Failed to send email to %s: %v\n", recipientUser.Username, err)
+	} else {
+		fmt.Printf("📧 Email sent to %s\n", recipientUser.Username)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip59"
+)
+
+// testKeys returns a new key pair as nsec and hex pubkey
+func testKeys(t *testing.T) (nsec, hexPubkey string) {
+	t.Helper()
+	secret := nostr.GeneratePrivateKey()
+	hexPubkey, err := nostr.GetPublicKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsec, err = nip19.EncodePrivateKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nsec, hexPubkey
+}
+
+func TestDaemonKeyUser(t *testing.T) {
+	_, daemonHexPubkey := testKeys(t)
+	daemonNpub, _ := nip19.EncodePublicKey(daemonHexPubkey)
+	config := &Config{SenderNpub: daemonNpub}
+
+	// The operator linked the daemon key as a further npub
+	operator := testUser(t, "operator", "operator@example.org", testKey("a"), daemonHexPubkey)
+	other := testUser(t, "other", "other@example.org", testKey("b"))
+	index := NewUserIndex([]User{operator, other})
+
+	user, exists := daemonKeyUser(index.HexToUser, config)
+	if !exists || user.Email != operator.Email {
+		t.Fatalf("daemonKeyUser = %+v, %v, want the operator", user, exists)
+	}
+	if user.NostrNpub != daemonNpub {
+		t.Errorf("recipient npub = %s, want the daemon npub", user.NostrNpub)
+	}
+
+	if user, exists := daemonKeyUser(NewUserIndex([]User{other}).HexToUser, config); exists {
+		t.Errorf("daemonKeyUser = %+v without a user linking the daemon key", user)
+	}
+	if user, exists := daemonKeyUser(index.HexToUser, &Config{SenderNpub: "npub1invalid"}); exists {
+		t.Errorf("daemonKeyUser = %+v for an invalid daemon npub", user)
+	}
+}
+
+func TestUnwrapGiftWrap(t *testing.T) {
+	daemonNsec, daemonHexPubkey := testKeys(t)
+	senderNsec, senderHexPubkey := testKeys(t)
+	senderSecret, _ := nsecToHex(senderNsec)
+
+	rumor := nostr.Event{
+		Kind:      nostr.KindDirectMessage,
+		PubKey:    senderHexPubkey,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", daemonHexPubkey}},
+		Content:   "Hello daemon",
+	}
+	conversationKey, err := nip44.GenerateConversationKey(daemonHexPubkey, senderSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrap, err := nip59.GiftWrap(rumor, daemonHexPubkey,
+		func(plaintext string) (string, error) { return nip44.Encrypt(plaintext, conversationKey) },
+		func(seal *nostr.Event) error { return seal.Sign(senderSecret) },
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := unwrapGiftWrap(&wrap, daemonNsec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped.Content != rumor.Content || unwrapped.PubKey != senderHexPubkey || unwrapped.Kind != nostr.KindDirectMessage {
+		t.Errorf("unwrapped %+v, want the rumor of %s", unwrapped, senderHexPubkey)
+	}
+
+	// Only the daemon key opens it
+	otherNsec, _ := testKeys(t)
+	if _, err := unwrapGiftWrap(&wrap, otherNsec); err == nil {
+		t.Error("unwrapped a gift wrap to another key")
+	}
+}
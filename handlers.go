@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// handlerContext is what event handlers work with
+type handlerContext struct {
+	Pool       *nostr.SimplePool
+	NpubToUser map[string]User
+	HexToUser  map[string]User
+	Client     *mongo.Client
+	Config     *Config
+	DB         *sql.DB
+	Email      *EmailService
+}
+
+// EventHandler turns one type of nostr event into notifications
+type EventHandler struct {
+	Name  string // enables or disables the handler in NOSTREMAIL_HANDLERS
+	Kinds []int
+	// Tags are the tags relay filters match against our users' pubkeys,
+	// ["p"] when empty
+	Tags []string
+	// Filters builds the relay filters instead of Tags when set
+	Filters func(kinds []int, hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter
+	Handle  func(event *nostr.Event, hc *handlerContext)
+}
+
+// eventHandlers is the registry of notification handlers
+var eventHandlers = []EventHandler{
+	{
+		Name:  "dm",
+		Kinds: []int{nostr.KindEncryptedDirectMessage},
+		// DMs to our users, and to the daemon key whoever it belongs to
+		Filters: directMessageFilters,
+		Handle:  handleDirectMessage,
+	},
+	{
+		Name:  "private_message",
+		Kinds: []int{nostr.KindGiftWrap},
+		// Gift wraps (NIP-59) are addressed to the daemon key
+		Filters: giftWrapFilters,
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processGiftWrap(event, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "repost",
+		Kinds: []int{nostr.KindRepost, nostr.KindGenericRepost},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processRepost(event, hc.Pool, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "reaction",
+		Kinds: []int{nostr.KindReaction},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processReaction(event, hc.Pool, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "zap",
+		Kinds: []int{nostr.KindZap},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processZapReceipt(event, hc.NpubToUser, hc.HexToUser, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "mention",
+		Kinds: []int{nostr.KindTextNote},
+		// Notes tagging our users, and with search those naming them in content
+		Filters: mentionFilters,
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processTextNote(event, hc.Pool, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "comment",
+		Kinds: []int{nostr.KindComment},
+		// P tags the root author, p the parent author (NIP-22)
+		Tags: []string{"p", "P"},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processComment(event, hc.Pool, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "article",
+		Kinds: []int{nostr.KindArticle},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processArticle(event, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "live",
+		Kinds: []int{nostr.KindLiveEvent},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processLiveEvent(event, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "calendar",
+		Kinds: []int{nostr.KindDateCalendarEvent, nostr.KindTimeCalendarEvent, nostr.KindCalendarEventRSVP},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			if event.Kind == nostr.KindCalendarEventRSVP {
+				processCalendarRSVP(event, hc.Pool, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+				return
+			}
+			processCalendarEvent(event, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "channel",
+		Kinds: []int{nostr.KindChannelMessage},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processChannelMessage(event, hc.Pool, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "report",
+		Kinds: []int{nostr.KindReporting},
+		// Reports only go to the moderators, when there are any
+		Filters: func(kinds []int, hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter {
+			if config.ModeratorEmail == "" {
+				return nil
+			}
+			return []nostr.Filter{{Kinds: kinds, Tags: nostr.TagMap{"p": hexPubkeys}, Since: &since, Until: until}}
+		},
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processReport(event, hc.NpubToUser, hc.HexToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+	{
+		Name:  "watch",
+		Kinds: []int{nostr.KindTextNote},
+		// Watched hashtags and keywords, not our users' pubkeys
+		Filters: watchFilters,
+		Handle: func(event *nostr.Event, hc *handlerContext) {
+			processWatchedNote(event, hc.NpubToUser, hc.Config, hc.DB, hc.Email)
+		},
+	},
+}
+
+// handleDirectMessage emails the recipients of a NIP-4 direct message
+func handleDirectMessage(event *nostr.Event, hc *handlerContext) {
+	// Convert event pubkey to npub for display
+	eventNpub, err := hexToNpub(event.PubKey)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert event pubkey to npub: %v\n", err)
+		eventNpub = event.PubKey // fallback to hex
+	}
+
+	recipients := directMessageRecipients(event, hc.HexToUser)
+	for _, user := range recipients {
+		fmt.Printf("📨 DM for %s from %s\n", user.Username, eventNpub)
+		processDirectMessage(event, user, hc.NpubToUser, hc.Client, hc.Config, hc.DB, hc.Email)
+	}
+	if len(recipients) == 0 {
+		fmt.Printf("ℹ️  No matching recipient for DM from %s\n", eventNpub)
+	}
+}
+
+// directMessageFilters matches NIP-04 DMs to our users and to the daemon key,
+// which the daemon can decrypt
+func directMessageFilters(kinds []int, hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter {
+	recipients := hexPubkeys
+	if daemonHexPubkey, err := npubToHex(config.SenderNpub); err == nil && !slices.Contains(hexPubkeys, daemonHexPubkey) {
+		recipients = append([]string{daemonHexPubkey}, hexPubkeys...)
+	}
+	return []nostr.Filter{{
+		Kinds: kinds,
+		Tags:  nostr.TagMap{"p": recipients},
+		Since: &since,
+		Until: until,
+	}}
+}
+
+// giftWrapFilters matches gift wraps to the daemon key; their timestamps are
+// randomized up to two days into the past, so it looks back further
+func giftWrapFilters(kinds []int, hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter {
+	daemonHexPubkey, err := npubToHex(config.SenderNpub)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert sender npub to hex, not listening for gift wraps: %v\n", err)
+		return nil
+	}
+	giftWrapSince := since - giftWrapMaxSkew
+	return []nostr.Filter{{
+		Kinds: kinds,
+		Tags:  nostr.TagMap{"p": []string{daemonHexPubkey}},
+		Since: &giftWrapSince,
+		Until: until,
+	}}
+}
+
+// HandlerSettings turns event handlers, or single kinds of them, on and off.
+// Keys are handler names or kind numbers; handlers not named are enabled.
+type HandlerSettings map[string]bool
+
+// parseHandlerSettings parses settings such as "dm=off,zap=on,31925=off"
+func parseHandlerSettings(value string) (HandlerSettings, error) {
+	known := make(map[string]bool)
+	for _, handler := range eventHandlers {
+		known[handler.Name] = true
+		for _, kind := range handler.Kinds {
+			known[strconv.Itoa(kind)] = true
+		}
+	}
+
+	settings := make(HandlerSettings)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, state, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid entry %q, expected <handler or kind>=on|off", entry)
+		}
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, fmt.Errorf("unknown handler or kind %q", name)
+		}
+		switch strings.ToLower(strings.TrimSpace(state)) {
+		case "on", "true", "1":
+			settings[name] = true
+		case "off", "false", "0":
+			settings[name] = false
+		default:
+			return nil, fmt.Errorf("invalid state %q for %s, expected on or off", state, name)
+		}
+	}
+	return settings, nil
+}
+
+// kindEnabled reports whether a handler handles a kind; a kind setting takes
+// precedence over the setting of its handler
+func (s HandlerSettings) kindEnabled(handler EventHandler, kind int) bool {
+	if enabled, set := s[strconv.Itoa(kind)]; set {
+		return enabled
+	}
+	if enabled, set := s[handler.Name]; set {
+		return enabled
+	}
+	return true
+}
+
+// enabledKinds returns the kinds a handler is enabled for
+func (s HandlerSettings) enabledKinds(handler EventHandler) []int {
+	var kinds []int
+	for _, kind := range handler.Kinds {
+		if s.kindEnabled(handler, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// Enabled reports whether the named handler is enabled for any of its kinds
+func (s HandlerSettings) Enabled(name string) bool {
+	for _, handler := range eventHandlers {
+		if handler.Name == name {
+			return len(s.enabledKinds(handler)) > 0
+		}
+	}
+	return false
+}
+
+// handlerFilters creates the relay filters of the enabled handlers
+func handlerFilters(hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter {
+	var filters []nostr.Filter
+	for _, handler := range eventHandlers {
+		kinds := config.Handlers.enabledKinds(handler)
+		if len(kinds) == 0 {
+			continue
+		}
+		if handler.Filters != nil {
+			filters = append(filters, handler.Filters(kinds, hexPubkeys, hexToUser, config, since, until)...)
+			continue
+		}
+		tags := handler.Tags
+		if len(tags) == 0 {
+			tags = []string{"p"}
+		}
+		for _, tag := range tags {
+			filters = append(filters, nostr.Filter{
+				Kinds: kinds,
+				Tags:  nostr.TagMap{tag: hexPubkeys},
+				Since: &since,
+				Until: until,
+			})
+		}
+	}
+	return filters
+}
+
+// dispatchEvent passes an event to the enabled handlers of its kind
+func dispatchEvent(event *nostr.Event, hc *handlerContext) {
+	for _, handler := range eventHandlers {
+		for _, kind := range handler.Kinds {
+			if kind == event.Kind && hc.Config.Handlers.kindEnabled(handler, kind) {
+				handler.Handle(event, hc)
+			}
+		}
+	}
+}
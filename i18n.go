@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// translationsDir holds a translation catalog per language, named after the
+// language code, e.g. templates/i18n/de.json; relative to templates/
+const translationsDir = "i18n"
+
+// dateLayouts are the layouts dates reach the templates in, see FormatDate
+var dateLayouts = []string{"2006-01-02 15:04:05 UTC", "2006-01-02 15:04 UTC"}
+
+// TranslationCatalog translates the default templates into one language.
+// Emails with a localized template of the language use that template instead,
+// the catalog still translates their subject and dates.
+type TranslationCatalog struct {
+	// DateFormat is the Go layout of dates, e.g. "02.01.2006 15:04 UTC"
+	DateFormat string `json:"date_format"`
+	// Titles and Subjects replace the headings of headings.txt, by
+	// notification type or name of another email
+	Titles   map[string]string `json:"titles"`
+	Subjects map[string]string `json:"subjects"`
+	// Messages translate the texts templates pass to .T, by their English
+	// text; fmt verbs like %s are kept
+	Messages map[string]string `json:"messages"`
+
+	headings *texttemplate.Template // parsed Titles and Subjects
+}
+
+// loadTranslations reads the translation catalogs by language, none when
+// translationsDir does not exist
+func loadTranslations(fsys fs.FS) (map[string]*TranslationCatalog, error) {
+	files, err := fs.Glob(fsys, path.Join(translationsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	catalogs := make(map[string]*TranslationCatalog)
+	for _, file := range files {
+		language := strings.TrimSuffix(path.Base(file), ".json")
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		catalog := &TranslationCatalog{}
+		if err := json.Unmarshal(content, catalog); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		if err := catalog.parseHeadings(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		catalogs[language] = catalog
+	}
+	return catalogs, nil
+}
+
+// parseHeadings parses the translated titles and subjects, named like the
+// headings of headings.txt
+func (c *TranslationCatalog) parseHeadings() error {
+	c.headings = texttemplate.New("headings")
+	for suffix, headings := range map[string]map[string]string{".title": c.Titles, ".subject": c.Subjects} {
+		for notification, text := range headings {
+			if _, exists := headingTemplate(notification); !exists {
+				return fmt.Errorf("unknown email %s", notification)
+			}
+			if _, err := c.headings.New(notification + suffix).Parse(text); err != nil {
+				return fmt.Errorf("failed to parse %s%s: %v", notification, suffix, err)
+			}
+		}
+	}
+	return nil
+}
+
+// T translates a text of a template into the language of the email and
+// formats it like fmt.Sprintf, e.g. {{.T "Hello %s!" .FirstName}}. Texts
+// without a translation stay English.
+func (data EmailTemplateData) T(text string, args ...interface{}) string {
+	if data.catalog != nil {
+		if translated := data.catalog.Messages[text]; translated != "" {
+			text = translated
+		}
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// FormatDate formats a date like CreatedAt in the date format of the
+// email's language, e.g. {{$.FormatDate .CreatedAt}}
+func (data EmailTemplateData) FormatDate(date string) string {
+	if data.catalog == nil || data.catalog.DateFormat == "" {
+		return date
+	}
+	for _, layout := range dateLayouts {
+		if parsed, err := time.Parse(layout, date); err == nil {
+			return parsed.Format(data.catalog.DateFormat)
+		}
+	}
+	return date
+}
+
+// hasLanguage reports whether an email can be rendered in a language, by a
+// localized template or a translation catalog
+func (es *EmailService) hasLanguage(templateName, language string) bool {
+	if _, exists := es.currentTemplates().translations[language]; exists && language != "" {
+		return true
+	}
+	return es.hasLocalizedTemplate(templateName, language)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Inbound email providers, the last element of /webhooks/inbound/<provider>
+const (
+	inboundProviderMailgun  = "mailgun"
+	inboundProviderSendGrid = "sendgrid"
+	inboundProviderPostmark = "postmark"
+)
+
+const (
+	// inboundMaxSize bounds the webhook requests of received emails,
+	// attachments included
+	inboundMaxSize = 10 << 20
+	// inboundReplyMaxLength bounds the text posted to nostr, in characters
+	inboundReplyMaxLength = 4000
+)
+
+// inboundEmail is a received email
+type inboundEmail struct {
+	From string   // address of the sender
+	To   []string // addresses of the recipients
+	Text string   // plain text body
+	// AutoReply is set for emails sent automatically, e.g. by vacation
+	// autoresponders, see isAutoReply
+	AutoReply bool
+}
+
+// isAutoReply reports whether the headers of a received email mark it as
+// sent automatically (RFC 3834 Auto-Submitted, Precedence, or the headers of
+// common autoresponders)
+func isAutoReply(header mail.Header) bool {
+	if submitted := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); submitted != "" && submitted != "no" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "junk", "list", "auto_reply":
+		return true
+	}
+	return header.Get("X-Autoreply") != "" || header.Get("X-Autorespond") != ""
+}
+
+// parseInboundEmail reads a received email from the webhook request of a
+// provider: Mailgun routes and SendGrid Inbound Parse post forms, Postmark
+// posts JSON
+func parseInboundEmail(provider string, r *http.Request) (inboundEmail, error) {
+	var email inboundEmail
+	var from, to string
+	switch provider {
+	case inboundProviderMailgun, inboundProviderSendGrid:
+		if err := r.ParseMultipartForm(inboundMaxSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return email, fmt.Errorf("invalid %s webhook: %v", provider, err)
+		}
+		header := mail.Header{}
+		if provider == inboundProviderMailgun {
+			from, to, email.Text = r.PostFormValue("from"), r.PostFormValue("recipient"), r.PostFormValue("body-plain")
+			var pairs [][2]string
+			json.Unmarshal([]byte(r.PostFormValue("message-headers")), &pairs)
+			for _, pair := range pairs {
+				name := textproto.CanonicalMIMEHeaderKey(pair[0])
+				header[name] = append(header[name], pair[1])
+			}
+		} else {
+			from, to, email.Text = r.PostFormValue("from"), r.PostFormValue("to"), r.PostFormValue("text")
+			if message, err := mail.ReadMessage(strings.NewReader(strings.TrimSpace(r.PostFormValue("headers")) + "\r\n\r\n")); err == nil {
+				header = message.Header
+			}
+		}
+		email.AutoReply = isAutoReply(header)
+	case inboundProviderPostmark:
+		var message struct {
+			FromFull struct {
+				Email string
+			}
+			OriginalRecipient string
+			To                string
+			TextBody          string
+			Headers           []struct {
+				Name  string
+				Value string
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			return email, fmt.Errorf("invalid Postmark webhook: %v", err)
+		}
+		from, email.Text = message.FromFull.Email, message.TextBody
+		header := mail.Header{}
+		for _, field := range message.Headers {
+			name := textproto.CanonicalMIMEHeaderKey(field.Name)
+			header[name] = append(header[name], field.Value)
+		}
+		email.AutoReply = isAutoReply(header)
+		to = message.To
+		if message.OriginalRecipient != "" {
+			to = message.OriginalRecipient
+		}
+	default:
+		return email, fmt.Errorf("unknown provider %q", provider)
+	}
+
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return email, fmt.Errorf("invalid sender %q: %v", from, err)
+	}
+	email.From = address.Address
+	recipients, err := mail.ParseAddressList(to)
+	if err != nil {
+		return email, fmt.Errorf("invalid recipients %q: %v", to, err)
+	}
+	for _, recipient := range recipients {
+		email.To = append(email.To, recipient.Address)
+	}
+	return email, nil
+}
+
+// quoteHeaderPattern matches the line mail clients put above the quoted
+// email, e.g. "On Tue, 14 Nov 2023 Alice <a@example.org> wrote:"
+var quoteHeaderPattern = regexp.MustCompile(`(?i)^(on\s.*wrote:|am\s.*schrieb.*:|le\s.*a écrit\s?:|el\s.*escribió:|-+\s*original message\s*-+|_{10,}|from:\s.*|sent from my .*)$`)
+
+// replyText returns the new text of a reply by email: the lines above the
+// quoted email and the signature, without quoted lines
+func replyText(text string) string {
+	all := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var lines []string
+	for i, line := range all {
+		if line == "-- " || line == "--" || quoteHeaderPattern.MatchString(strings.TrimSpace(line)) {
+			break
+		}
+		// Clients wrap long quote headers over two lines
+		if i+1 < len(all) && quoteHeaderPattern.MatchString(strings.TrimSpace(line)+" "+strings.TrimSpace(all[i+1])) {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		lines = append(lines, strings.TrimRight(line, " \t"))
+	}
+
+	reply := strings.TrimSpace(strings.Join(lines, "\n"))
+	if runes := []rune(reply); len(runes) > inboundReplyMaxLength {
+		reply = string(runes[:inboundReplyMaxLength]) + "…"
+	}
+	return reply
+}
+
+// InboundReplies posts replies to notifications received by email to nostr,
+// signed by the daemon: DMs to the sender of a direct message, replies to
+// notes otherwise. Only the recipient a reply address was made for can use
+// it, and they need to be a Trustroots user.
+type InboundReplies struct {
+	Replies   *ReplyAddresses
+	Config    *Config
+	Users     map[string]User // by hex pubkey, read under usersMu
+	Pool      *nostr.SimplePool
+	Publisher *RelayPublisher
+}
+
+// userByEmail returns the Trustroots user with an email address
+func (in *InboundReplies) userByEmail(email string) (User, bool) {
+	return userByEmail(in.Users, email)
+}
+
+// resolve returns what a received email replies to, who sent it and the
+// text to post; errors mean the email is no valid reply
+func (in *InboundReplies) resolve(email inboundEmail) (ReplyTarget, User, string, error) {
+	var target ReplyTarget
+	if email.AutoReply {
+		return target, User{}, "", fmt.Errorf("automatic replies are not posted")
+	}
+	err := fmt.Errorf("no reply address among %s", strings.Join(email.To, ", "))
+	for _, to := range email.To {
+		if target, err = in.Replies.Verify(to, email.From); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return target, User{}, "", err
+	}
+
+	user, exists := in.userByEmail(email.From)
+	if !exists {
+		return target, User{}, "", fmt.Errorf("%s is not a Trustroots user", email.From)
+	}
+	if daemonHex, err := npubToHex(in.Config.SenderNpub); err == nil && target.Pubkey == daemonHex {
+		return target, User{}, "", fmt.Errorf("replies to the daemon's own messages are not posted")
+	}
+	text := replyText(email.Text)
+	if text == "" {
+		return target, User{}, "", fmt.Errorf("the reply of %s is empty", email.From)
+	}
+	return target, user, text, nil
+}
+
+// Post publishes a reply by email and returns the ID of the event
+func (in *InboundReplies) Post(target ReplyTarget, user User, text string) (string, error) {
+	signature := fmt.Sprintf("%s (nostr:%s) replied by email", user.Username, user.NostrNpub)
+	if target.Kind == replyKindDirectMessage {
+		eventID, _, err := sendDirectMessage(in.Config, target.Pubkey, signature+":\n\n"+text)
+		return eventID, err
+	}
+
+	note, err := fetchEventByID(target.EventID, in.Pool, in.Config.Relays)
+	if err != nil {
+		return "", err
+	}
+	if note.Kind != nostr.KindTextNote {
+		return "", fmt.Errorf("replies to kind %d by email are not supported", note.Kind)
+	}
+	privateKeyHex, err := nsecToHex(in.Config.SenderNsec)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode sender nsec: %v", err)
+	}
+
+	// NIP-10 marked e tags
+	tags := nostr.Tags{{"e", note.ID, "", "root"}}
+	if root := threadID(note); root != note.ID {
+		tags = nostr.Tags{{"e", root, "", "root"}, {"e", note.ID, "", "reply"}}
+	}
+	tags = append(tags, nostr.Tag{"p", note.PubKey})
+	reply := nostr.Event{
+		Kind:      nostr.KindTextNote,
+		CreatedAt: nostr.Now(),
+		Content:   text + "\n\n— " + signature,
+		Tags:      tags,
+	}
+	if err := reply.Sign(privateKeyHex); err != nil {
+		return "", fmt.Errorf("failed to sign reply: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if published := in.Publisher.Publish(ctx, in.Config.Relays, reply); published == 0 {
+		return "", fmt.Errorf("no relay accepted the reply to %s", note.ID)
+	}
+	return reply.ID, nil
+}
+
+// handleInboundReplies accepts the received emails of a provider and posts
+// the replies among them. Emails that are no valid reply are dropped with a
+// success status, failures to post fail the request so the provider retries.
+func handleInboundReplies(provider string, in *InboundReplies, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !webhookAuthorized(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, inboundMaxSize)
+		email, err := parseInboundEmail(provider, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target, user, text, err := in.resolve(email)
+		if err != nil {
+			fmt.Printf("📭 Dropping email from %s: %v\n", email.From, err)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		eventID, err := in.Post(target, user, text)
+		if err != nil {
+			fmt.Printf("❌ Failed to post the email reply of %s to nostr: %v\n", user.Username, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Printf("↩️  Posted the email reply of %s to %s as %s\n", user.Username, target.EventID, eventID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
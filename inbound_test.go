@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestReplyText(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"plain", "Thanks, see you there!\n", "Thanks, see you there!"},
+		{"crlf", "Thanks,\r\nAlice\r\n", "Thanks,\nAlice"},
+		{
+			"quote header",
+			"Sounds good.\n\nOn Tue, 14 Nov 2023 Bob <b@example.org> wrote:\n> Shall we meet?\n",
+			"Sounds good.",
+		},
+		{
+			"wrapped quote header",
+			"Sounds good.\n\nOn Tue, 14 Nov 2023 at 10:00, Nostr Notifications\n<reply+abc@example.org> wrote:\n> Shall we meet?\n",
+			"Sounds good.",
+		},
+		{
+			"german quote header",
+			"Gerne!\n\nAm 14.11.2023 um 10:00 schrieb Bob <b@example.org>:\n> Treffen wir uns?\n",
+			"Gerne!",
+		},
+		{"outlook", "Yes.\n\n-----Original Message-----\nFrom: Bob\nShall we meet?", "Yes."},
+		{"signature", "Yes.\n-- \nAlice\nhttps://example.org", "Yes."},
+		{"mobile signature", "Yes.\n\nSent from my phone", "Yes."},
+		{"inline quotes", "> Shall we meet?\nYes.\n> At noon?\nBetter at one.", "Yes.\nBetter at one."},
+		{"only quotes", "> Shall we meet?\n> At noon?", ""},
+		{"trailing spaces", "Yes.   \nAt one.\t\n", "Yes.\nAt one."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyText(tt.text); got != tt.want {
+				t.Errorf("replyText(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyTextTruncates(t *testing.T) {
+	reply := replyText(strings.Repeat("ü", inboundReplyMaxLength+10))
+	if runes := []rune(reply); len(runes) != inboundReplyMaxLength+1 || runes[len(runes)-1] != '…' {
+		t.Errorf("reply of %d characters, want %d and an ellipsis", len(runes), inboundReplyMaxLength)
+	}
+}
+
+func TestIsAutoReply(t *testing.T) {
+	tests := []struct {
+		name   string
+		header mail.Header
+		want   bool
+	}{
+		{"none", mail.Header{}, false},
+		{"sent by a person", mail.Header{"Auto-Submitted": {"no"}}, false},
+		{"auto-replied", mail.Header{"Auto-Submitted": {"auto-replied"}}, true},
+		{"auto-generated", mail.Header{"Auto-Submitted": {" Auto-Generated "}}, true},
+		{"bulk", mail.Header{"Precedence": {"bulk"}}, true},
+		{"list", mail.Header{"Precedence": {"List"}}, true},
+		{"auto_reply", mail.Header{"Precedence": {"auto_reply"}}, true},
+		{"first class", mail.Header{"Precedence": {"first-class"}}, false},
+		{"x-autoreply", mail.Header{"X-Autoreply": {"yes"}}, true},
+		{"x-autorespond", mail.Header{"X-Autorespond": {"Out of office"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAutoReply(tt.header); got != tt.want {
+				t.Errorf("isAutoReply(%v) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInboundEmailAutoReply(t *testing.T) {
+	r := httptest.NewRequest("POST", "/inbound/postmark", strings.NewReader(`{
+		"FromFull": {"Email": "alice@example.org"},
+		"To": "reply+abc@example.org",
+		"TextBody": "I am on vacation",
+		"Headers": [{"Name": "auto-submitted", "Value": "auto-replied"}]
+	}`))
+	email, err := parseInboundEmail(inboundProviderPostmark, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !email.AutoReply {
+		t.Error("vacation reply not detected")
+	}
+	if email.From != "alice@example.org" || len(email.To) != 1 || email.To[0] != "reply+abc@example.org" {
+		t.Errorf("email from %q to %v", email.From, email.To)
+	}
+}
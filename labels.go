@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// quarantineLabelNamespace is the NIP-32 namespace of the labels we publish
+const quarantineLabelNamespace = "org.trustroots.moderation"
+
+// moderationLabelValues are the label values that suppress notifications
+var moderationLabelValues = map[string]bool{
+	"spam":  true,
+	"abuse": true,
+}
+
+// ModerationLabels holds the NIP-32 labels (kind 1985) by which trusted
+// moderators marked events or authors as spam or abuse
+type ModerationLabels struct {
+	moderators map[string]bool
+
+	mu      sync.RWMutex
+	events  map[string]string // labeled event ID -> label
+	authors map[string]string // labeled hex pubkey -> label
+}
+
+// NewModerationLabels creates an empty label store trusting the given moderators
+func NewModerationLabels(moderators []string) *ModerationLabels {
+	labels := &ModerationLabels{
+		moderators: make(map[string]bool),
+		events:     make(map[string]string),
+		authors:    make(map[string]string),
+	}
+	for _, moderator := range moderators {
+		labels.moderators[moderator] = true
+	}
+	return labels
+}
+
+// Update stores the targets of a label event by a trusted moderator
+func (m *ModerationLabels) Update(event *nostr.Event) {
+	if event.Kind != nostr.KindLabel || !m.moderators[event.PubKey] {
+		return
+	}
+
+	// ["l", "spam", "<namespace>"], the namespace does not matter to us
+	var label string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "l" && moderationLabelValues[strings.ToLower(tag[1])] {
+			label = strings.ToLower(tag[1])
+			break
+		}
+	}
+	if label == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Labels of events p-tag their authors too; only labels without e tags
+	// are about the authors themselves
+	labelsEvents := false
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			m.events[tag[1]] = label
+			labelsEvents = true
+		}
+	}
+	if labelsEvents {
+		return
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			m.authors[strings.ToLower(tag[1])] = label
+		}
+	}
+}
+
+// Label returns how moderators labeled an event or its author, or ""
+func (m *ModerationLabels) Label(event *nostr.Event) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if label, exists := m.events[event.ID]; exists {
+		return label
+	}
+	return m.authors[notificationAuthor(event)]
+}
+
+// loadModerationLabels fetches the labels the moderators published so far
+func loadModerationLabels(pool *nostr.SimplePool, relays []string, moderators []string) *ModerationLabels {
+	labels := NewModerationLabels(moderators)
+
+	ctx, cancel := context.WithTimeout(context.Background(), muteListFetchTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{Kinds: []int{nostr.KindLabel}, Authors: moderators}
+	for evt := range pool.SubManyEose(ctx, relays, nostr.Filters{filter}) {
+		labels.Update(evt.Event)
+	}
+
+	fmt.Printf("🏷️  Loaded %d labeled events and %d labeled authors from %d moderators\n",
+		len(labels.events), len(labels.authors), len(moderators))
+	return labels
+}
+
+// filterLabeled reports whether moderators labeled an event or its author, and
+// marks such events as processed so they are not looked at again
+func filterLabeled(event *nostr.Event, labels *ModerationLabels, notes NoteStore) bool {
+	if labels == nil {
+		return false
+	}
+	label := labels.Label(event)
+	if label == "" {
+		return false
+	}
+
+	fmt.Printf("🏷️  Dropped event %s, labeled %s by a moderator\n", event.ID, label)
+	if err := notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", ""); err != nil {
+		fmt.Printf("⚠️  Error marking labeled event as processed: %v\n", err)
+	}
+	return true
+}
+
+// QuarantineLabeler publishes a spam label (NIP-32) signed by the daemon for
+// every event the spam filter quarantines, for other clients and moderators
+type QuarantineLabeler struct {
+	Nsec      string
+	Relays    []string
+	Publisher *RelayPublisher
+}
+
+// quarantineLabel creates the unsigned label event for a quarantined event
+func quarantineLabel(event *nostr.Event, rule string) nostr.Event {
+	return nostr.Event{
+		Kind:      nostr.KindLabel,
+		CreatedAt: nostr.Now(),
+		Content:   fmt.Sprintf("Quarantined by spam rule %s", rule),
+		Tags: nostr.Tags{
+			{"L", quarantineLabelNamespace},
+			{"l", "spam", quarantineLabelNamespace},
+			{"e", event.ID},
+			{"p", event.PubKey},
+		},
+	}
+}
+
+// Publish signs and publishes the label of a quarantined event
+func (l *QuarantineLabeler) Publish(event *nostr.Event, rule string) error {
+	privateKeyHex, err := nsecToHex(l.Nsec)
+	if err != nil {
+		return fmt.Errorf("failed to decode sender nsec: %v", err)
+	}
+
+	label := quarantineLabel(event, rule)
+	if err := label.Sign(privateKeyHex); err != nil {
+		return fmt.Errorf("failed to sign label: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if published := l.Publisher.Publish(ctx, l.Relays, label); published == 0 {
+		return fmt.Errorf("no relay accepted the label of %s", event.ID)
+	}
+	fmt.Printf("🏷️  Published spam label %s for %s\n", label.ID, event.ID)
+	return nil
+}
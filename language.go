@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// languageStopwords are frequent short words of the Latin-script languages
+// most Trustroots members write in, enough to tell them apart in a short note
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "to", "of", "in", "for", "with", "this", "that", "it", "have", "was", "be", "on", "not", "what", "my"},
+	"de": {"der", "die", "das", "und", "ist", "ich", "nicht", "ein", "eine", "mit", "auf", "für", "auch", "du", "wir", "sie", "zu", "den", "dem", "von"},
+	"fr": {"le", "la", "les", "et", "est", "je", "vous", "une", "des", "pour", "avec", "dans", "pas", "que", "qui", "sur", "du", "nous", "ce", "au"},
+	"es": {"el", "la", "los", "las", "y", "es", "que", "una", "por", "para", "con", "del", "pero", "muy", "está", "yo", "se", "lo", "como", "en"},
+	"it": {"il", "la", "che", "e", "di", "un", "una", "per", "con", "non", "sono", "del", "della", "io", "gli", "è", "ma", "anche", "come", "ci"},
+	"pt": {"o", "os", "a", "as", "e", "que", "um", "uma", "para", "com", "não", "do", "da", "dos", "em", "eu", "você", "mas", "muito", "está"},
+	"nl": {"de", "het", "een", "en", "is", "ik", "niet", "van", "op", "met", "voor", "je", "dat", "die", "zijn", "we", "ook", "maar", "naar", "er"},
+}
+
+// languageNames are the names of the languages we detect, in that language
+var languageNames = map[string]string{
+	"en": "English",
+	"de": "Deutsch",
+	"fr": "Français",
+	"es": "Español",
+	"it": "Italiano",
+	"pt": "Português",
+	"nl": "Nederlands",
+	"ru": "Русский",
+	"el": "Ελληνικά",
+	"ar": "العربية",
+	"he": "עברית",
+	"ja": "日本語",
+	"ko": "한국어",
+	"zh": "中文",
+}
+
+// languageScripts maps scripts to the language written in them, checked in
+// order since Japanese mixes Han with kana
+var languageScripts = []struct {
+	Language string
+	Scripts  []*unicode.RangeTable
+}{
+	{"ja", []*unicode.RangeTable{unicode.Hiragana, unicode.Katakana}},
+	{"ko", []*unicode.RangeTable{unicode.Hangul}},
+	{"zh", []*unicode.RangeTable{unicode.Han}},
+	{"ru", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"el", []*unicode.RangeTable{unicode.Greek}},
+	{"ar", []*unicode.RangeTable{unicode.Arabic}},
+	{"he", []*unicode.RangeTable{unicode.Hebrew}},
+}
+
+// minLanguageHits is how many stopwords a text needs before we trust a guess
+const minLanguageHits = 2
+
+// detectLanguage guesses the ISO 639-1 code of the language of a text, or
+// returns "" when the text is too short or ambiguous to tell
+func detectLanguage(text string) string {
+	text = subjectNoisePattern.ReplaceAllString(text, " ")
+
+	// Scripts other than Latin mostly give the language away
+	letters := 0
+	scriptLetters := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, script := range languageScripts {
+			if unicode.In(r, script.Scripts...) {
+				scriptLetters[script.Language]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	for _, script := range languageScripts {
+		// A few kana make Han text Japanese
+		if script.Language == "ja" && scriptLetters["ja"] > 0 && scriptLetters["ja"]+scriptLetters["zh"] > letters/2 {
+			return "ja"
+		}
+		if scriptLetters[script.Language] > letters/2 {
+			return script.Language
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	hits := make(map[string]int)
+	for _, word := range words {
+		for language, stopwords := range languageStopwords {
+			for _, stopword := range stopwords {
+				if word == stopword {
+					hits[language]++
+					break
+				}
+			}
+		}
+	}
+
+	best, bestHits, secondHits := "", 0, 0
+	for language, count := range hits {
+		switch {
+		case count > bestHits:
+			best, bestHits, secondHits = language, count, bestHits
+		case count > secondHits:
+			secondHits = count
+		}
+	}
+	if bestHits < minLanguageHits || bestHits == secondHits {
+		return ""
+	}
+	return best
+}
+
+// localeLanguage returns the language of a Trustroots locale, e.g. "pt" for "pt-BR"
+func localeLanguage(locale string) string {
+	language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(locale)), "-")
+	language, _, _ = strings.Cut(language, "_")
+	return language
+}
+
+// languageName returns the name of a language code, or the code itself
+func languageName(code string) string {
+	if name, exists := languageNames[code]; exists {
+		return name
+	}
+	return code
+}
+
+// hasLocalizedTemplate reports whether an email has HTML and text templates in a language
+func (es *EmailService) hasLocalizedTemplate(templateName, language string) bool {
+	if language == "" {
+		return false
+	}
+	localized := templateName + "." + language
+	templates := es.currentTemplates()
+	_, hasHTML := templates.html[localized+".html"]
+	return hasHTML && templates.text.Lookup(localized+".txt") != nil
+}
+
+// emailLanguage picks the language of an email: the recipient's Trustroots
+// locale, or without one the language the content is written in, when the
+// email has templates or a translation catalog in it. "" selects English.
+func (es *EmailService) emailLanguage(templateName, locale, contentLanguage string) string {
+	if language := localeLanguage(locale); language != "" {
+		if es.hasLanguage(templateName, language) {
+			return language
+		}
+		return ""
+	}
+	if es.hasLanguage(templateName, contentLanguage) {
+		return contentLanguage
+	}
+	return ""
+}
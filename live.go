@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// liveEventRole returns the role a pubkey has in a live event (kind 30311),
+// e.g. "Speaker", and whether it is a participant at all. Participants are
+// tagged ["p", <pubkey>, <relay>, <role>, <proof>].
+func liveEventRole(event *nostr.Event, hexPubkey string) (string, bool) {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && strings.ToLower(tag[1]) == hexPubkey {
+			if len(tag) >= 4 {
+				return strings.TrimSpace(tag[3]), true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// liveEventDetails describes when a live event starts and where to watch it,
+// for the excerpt of the email
+func liveEventDetails(event *nostr.Event) string {
+	var lines []string
+	if startsTag := event.Tags.Find("starts"); startsTag != nil {
+		if starts, err := strconv.ParseInt(startsTag[1], 10, 64); err == nil {
+			lines = append(lines, "Starts "+time.Unix(starts, 0).UTC().Format("2006-01-02 15:04 UTC"))
+		}
+	}
+	if streamingTag := event.Tags.Find("streaming"); streamingTag != nil {
+		lines = append(lines, "Stream: "+streamingTag[1])
+	}
+	if summaryTag := event.Tags.Find("summary"); summaryTag != nil && summaryTag[1] != "" {
+		lines = append(lines, "", truncateText(summaryTag[1], parentExcerptLength))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// processLiveEvent notifies users tagged as participants of a live event
+// (kind 30311, NIP-53). Live events are updated often, so every participant is
+// emailed once per event address; ended events are not emailed.
+func processLiveEvent(event *nostr.Event, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	if statusTag := event.Tags.Find("status"); statusTag != nil && statusTag[1] == "ended" {
+		return
+	}
+
+	address := articleAddress(event)
+	title := "Untitled live event"
+	if titleTag := event.Tags.Find("title"); titleTag != nil && titleTag[1] != "" {
+		title = titleTag[1]
+	}
+
+	// Look up the tagged participants instead of scanning every user
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		hexPubkey := strings.ToLower(tag[1])
+		user, monitored := hexToUser[hexPubkey]
+		if !monitored || seen[hexPubkey] || hexPubkey == event.PubKey {
+			continue
+		}
+		seen[hexPubkey] = true
+		role, _ := liveEventRole(event, hexPubkey)
+		notified, err := emailService.Notes.IsNotificationProcessed(address, user.Email)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			continue
+		}
+		if notified {
+			continue
+		}
+
+		action := "added you to a live event"
+		if role != "" {
+			action = fmt.Sprintf("added you as %s to a live event", strings.ToLower(role))
+		}
+		mention := Mention{
+			Context: "a live event",
+			Action:  action,
+			Title:   title,
+			URL:     articleURL(event, config.Relays),
+			Excerpt: liveEventDetails(event),
+			Match:   matchPTag,
+		}
+		if streamingTag := event.Tags.Find("streaming"); streamingTag != nil && strings.HasPrefix(streamingTag[1], "http") {
+			mention.TitleURL = streamingTag[1]
+		}
+
+		notifyMention(event, user, mention, npubToUser, sqliteDB, emailService)
+		if err := emailService.Notes.MarkNoteProcessed(address, event.PubKey, "relay", user.Email); err != nil {
+			fmt.Printf("⚠️  Error marking live event as processed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// lnurlTimeout bounds a request to an LNURL pay endpoint
+const lnurlTimeout = 10 * time.Second
+
+// lnurlCacheTTL is how long the zap key of an LNURL pay endpoint is trusted
+const lnurlCacheTTL = time.Hour
+
+// lnurlMaxResponseSize bounds the LNURL pay responses we read
+const lnurlMaxResponseSize = 64 * 1024
+
+// lnurlPayURL returns the LNURL pay endpoint of a lightning address (LUD-16)
+// or, without one, of a bech32-encoded LNURL (LUD-06)
+func lnurlPayURL(lud16, lud06 string) (string, error) {
+	if lud16 = strings.ToLower(strings.TrimSpace(lud16)); lud16 != "" {
+		name, domain, found := strings.Cut(lud16, "@")
+		if !found || !nip05NamePattern.MatchString(name) || domain == "" || strings.ContainsAny(domain, "/?#@\\") {
+			return "", fmt.Errorf("invalid lightning address %q", lud16)
+		}
+		return "https://" + domain + "/.well-known/lnurlp/" + name, nil
+	}
+	if lud06 = strings.ToLower(strings.TrimSpace(lud06)); lud06 != "" {
+		hrp, data, err := bech32.DecodeNoLimit(lud06)
+		if err != nil || hrp != "lnurl" {
+			return "", fmt.Errorf("invalid LNURL %q", lud06)
+		}
+		decoded, err := bech32.ConvertBits(data, 5, 8, false)
+		if err != nil {
+			return "", fmt.Errorf("invalid LNURL %q: %v", lud06, err)
+		}
+		endpoint, err := url.Parse(string(decoded))
+		if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+			return "", fmt.Errorf("LNURL %q is no https URL", lud06)
+		}
+		return endpoint.String(), nil
+	}
+	return "", fmt.Errorf("no lightning address in the profile")
+}
+
+// zapProvider is the cached zap key of an LNURL pay endpoint
+type zapProvider struct {
+	Pubkey    string // "" when the endpoint does not support zaps
+	FetchedAt time.Time
+}
+
+// ZapProviders looks up the key zap receipts of a recipient must be signed
+// with: the nostrPubkey of the LNURL pay endpoint of the lightning address in
+// their profile (NIP-57). Only that server knows whether an invoice was paid,
+// receipts signed by other keys may be made up.
+type ZapProviders struct {
+	Profiles *ProfileNames
+	Client   *http.Client
+
+	mu        sync.Mutex
+	providers map[string]zapProvider // by LNURL pay endpoint
+}
+
+// NewZapProviders creates a lookup of the LNURL servers of the profiles of
+// a name resolver
+func NewZapProviders(profiles *ProfileNames) *ZapProviders {
+	dialer := &net.Dialer{Timeout: lnurlTimeout, Control: dialPublicOnly}
+	return &ZapProviders{
+		Profiles: profiles,
+		Client: &http.Client{
+			Timeout:   lnurlTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+		providers: make(map[string]zapProvider),
+	}
+}
+
+// Pubkey returns the hex pubkey the LNURL server of a recipient signs zap
+// receipts with
+func (z *ZapProviders) Pubkey(recipientHex string) (string, error) {
+	profile := z.Profiles.profile(recipientHex)
+	endpoint, err := lnurlPayURL(profile.LUD16, profile.LUD06)
+	if err != nil {
+		return "", err
+	}
+
+	z.mu.Lock()
+	provider, cached := z.providers[endpoint]
+	z.mu.Unlock()
+	if !cached || time.Since(provider.FetchedAt) > lnurlCacheTTL {
+		// Failed requests are not cached, the next zap asks again
+		provider, err = z.fetch(endpoint)
+		if err != nil {
+			return "", err
+		}
+		z.mu.Lock()
+		z.providers[endpoint] = provider
+		z.mu.Unlock()
+	}
+	if provider.Pubkey == "" {
+		return "", fmt.Errorf("%s does not support zaps", endpoint)
+	}
+	return provider.Pubkey, nil
+}
+
+// fetch asks an LNURL pay endpoint for its zap key
+func (z *ZapProviders) fetch(endpoint string) (zapProvider, error) {
+	response, err := z.Client.Get(endpoint)
+	if err != nil {
+		return zapProvider{}, fmt.Errorf("failed to fetch %s: %v", endpoint, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return zapProvider{}, fmt.Errorf("%s returned %s", endpoint, response.Status)
+	}
+
+	var params struct {
+		AllowsNostr bool   `json:"allowsNostr"`
+		NostrPubkey string `json:"nostrPubkey"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, lnurlMaxResponseSize)).Decode(&params); err != nil {
+		return zapProvider{}, fmt.Errorf("invalid response from %s: %v", endpoint, err)
+	}
+	provider := zapProvider{FetchedAt: time.Now()}
+	if params.AllowsNostr && nostr.IsValidPublicKey(params.NostrPubkey) {
+		provider.Pubkey = strings.ToLower(params.NostrPubkey)
+	}
+	return provider, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// mailgunTimeout bounds one call of the Mailgun API
+const mailgunTimeout = 30 * time.Second
+
+// mailgunMaxTags is how many tags Mailgun keeps per message
+const mailgunMaxTags = 3
+
+// Mailgun API endpoints of the regions of NOSTREMAIL_MAILGUN_REGION
+var mailgunEndpoints = map[string]string{
+	"us": "https://api.mailgun.net",
+	"eu": "https://api.eu.mailgun.net",
+}
+
+// MailgunConfig configures the Mailgun API provider
+type MailgunConfig struct {
+	Domain string // sending domain, e.g. mg.trustroots.org
+	APIKey string
+	Region string // us or eu, where the domain was created
+	// Tags tag every email after the template name; Mailgun keeps the
+	// first mailgunMaxTags tags of a message
+	Tags []string
+}
+
+// loadMailgunConfig reads NOSTREMAIL_MAILGUN_DOMAIN, NOSTREMAIL_MAILGUN_API_KEY,
+// NOSTREMAIL_MAILGUN_REGION (default us) and NOSTREMAIL_MAILGUN_TAGS
+func loadMailgunConfig() (MailgunConfig, error) {
+	config := MailgunConfig{
+		Domain: os.Getenv("NOSTREMAIL_MAILGUN_DOMAIN"),
+		APIKey: os.Getenv("NOSTREMAIL_MAILGUN_API_KEY"),
+		Region: strings.ToLower(getEnvOrDefault("NOSTREMAIL_MAILGUN_REGION", "us")),
+	}
+	if _, exists := mailgunEndpoints[config.Region]; !exists {
+		return config, fmt.Errorf("NOSTREMAIL_MAILGUN_REGION: unknown region %q, expected us or eu", config.Region)
+	}
+	for _, tag := range strings.Split(os.Getenv("NOSTREMAIL_MAILGUN_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			config.Tags = append(config.Tags, tag)
+		}
+	}
+	return config, nil
+}
+
+// MailgunTransport delivers emails with the MIME message API of Mailgun
+type MailgunTransport struct {
+	Config   MailgunConfig
+	Endpoint string
+	Client   *http.Client
+}
+
+// NewMailgunTransport creates a transport for the Mailgun API of the region
+func NewMailgunTransport(config MailgunConfig) *MailgunTransport {
+	return &MailgunTransport{
+		Config:   config,
+		Endpoint: mailgunEndpoints[config.Region],
+		Client:   &http.Client{Timeout: mailgunTimeout},
+	}
+}
+
+// mailgunTags are the tags of an email: its template name and the
+// configured tags
+func (t *MailgunTransport) mailgunTags(email *OutgoingEmail) []string {
+	var tags []string
+	if email.Type != "" {
+		tags = append(tags, email.Type)
+	}
+	tags = append(tags, t.Config.Tags...)
+	if len(tags) > mailgunMaxTags {
+		tags = tags[:mailgunMaxTags]
+	}
+	return tags
+}
+
+// Send sends the MIME message and returns the ID Mailgun gave it, which its
+// webhooks refer to
+func (t *MailgunTransport) Send(email *OutgoingEmail) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("to", email.To)
+	for _, tag := range t.mailgunTags(email) {
+		form.WriteField("o:tag", tag)
+	}
+	message, err := form.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return "", err
+	}
+	if _, err := email.Message().WriteTo(message); err != nil {
+		return "", fmt.Errorf("failed to encode message: %v", err)
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/v3/%s/messages.mime", strings.TrimRight(t.Endpoint, "/"), t.Config.Domain)
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("api", t.Config.APIKey)
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Mailgun request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read Mailgun response: %v", err)
+	}
+	var result struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(response, &result)
+	if resp.StatusCode != http.StatusOK {
+		if result.Message == "" {
+			result.Message = strings.TrimSpace(string(response))
+		}
+		return "", fmt.Errorf("Mailgun returned %s: %s", resp.Status, result.Message)
+	}
+	return result.ID, nil
+}
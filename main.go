@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"encoding/base64"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
@@ -14,13 +13,13 @@ import (
 	"strings"
 	"time"
 
-	"github.com/btcsuite/btcd/btcutil/bech32"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // User represents a user document from the database
@@ -29,19 +28,161 @@ type User struct {
 	Username  string `bson:"username,omitempty"`
 	Email     string `bson:"email,omitempty"`
 	NostrNpub string `bson:"nostrNpub,omitempty"`
+	Locale    string `bson:"locale,omitempty"` // interface language chosen on Trustroots
+	// MentionAliases are optional names a user is also mentioned by in plain
+	// text, e.g. a nickname, matched as whole words
+	MentionAliases []string `bson:"nostrMentionAliases,omitempty"`
+	// NostrNpubs are further npubs of the user, e.g. the keys of other devices
+	// or an old key; notifications addressed to any of them are emailed
+	NostrNpubs []string `bson:"nostrNpubs,omitempty"`
+	// QuietHours is a daily window like "22:00-07:00" in which the user is not
+	// emailed, in their Timezone (an IANA name such as "Europe/Berlin")
+	QuietHours string `bson:"nostrQuietHours,omitempty"`
+	Timezone   string `bson:"nostrTimezone,omitempty"`
+	// Digest is how the user is emailed: "off" for every notification, or
+	// "hourly" or "daily" for digests; see digest.go
+	Digest string `bson:"nostrDigest,omitempty"`
+	// PlainText asks for plain text emails without HTML, see plaintext.go
+	PlainText bool `bson:"nostrPlainText,omitempty"`
+	// Roles and Public are the account status on Trustroots, see
+	// accountStatus; Public is false until the email address is confirmed
+	// and nil for user sources without it
+	Roles  []string `bson:"roles,omitempty"`
+	Public *bool    `bson:"public,omitempty"`
 }
 
 // Config represents the configuration structure
 type Config struct {
-	MongoDB struct {
-		URI      string
-		Database string
-	}
+	MongoDB     MongoDBConfig
 	SenderNpub  string
 	SenderNsec  string
 	SenderEmail string
 	Relays      []string
-	SMTP        struct {
+	// RecordDeletions annotates notification history when senders delete events (NIP-09)
+	RecordDeletions bool
+	// SendDelay holds notification emails back so deletions can still cancel them
+	SendDelay time.Duration
+	// PostgresURL keeps processed notes and digest items in PostgreSQL instead
+	// of processed_notes.db, for replicas sharing them
+	PostgresURL string
+	// RedisURL shares processed event IDs, profiles and NIP-05 results between
+	// instances in Redis
+	RedisURL string
+	// NoteRetention prunes processed notes older than this, zero keeps them forever
+	NoteRetention time.Duration
+	// UserRateLimit caps the notification emails per recipient and hour or day
+	UserRateLimit UserRateLimit
+	// SendRateLimit caps all outgoing emails per second, minute or hour, excess emails wait
+	SendRateLimit SendRateLimit
+	// UserSource is where users are loaded from: mongodb, a .json or .csv
+	// file or an http(s) URL, fetched with UserSourceToken as bearer token
+	UserSource      string
+	UserSourceToken string
+	// TrustrootsThreads links DMs between Trustroots users to their
+	// Trustroots message thread and skips those also sent on Trustroots
+	TrustrootsThreads bool
+	// QueueWorkers send the emails of the queue in parallel, an email is dead
+	// after QueueMaxAttempts failed attempts (see queue.go)
+	QueueWorkers     int
+	QueueMaxAttempts int
+	// Digest is the digest window of users without nostrDigest, see digest.go
+	Digest string
+	// UnsubscribeURL is the public URL of Listen for one-click unsubscribe
+	// links, signed with UnsubscribeSecret (see unsubscribe.go)
+	UnsubscribeURL    string
+	UnsubscribeSecret string
+	// EmailProvider delivers the emails: SMTP, the API of SES, SendGrid,
+	// Mailgun or Postmark, or a local test SMTP server (dev, see devmail.go)
+	// configured below (see transport.go);
+	// EmailFallback, if set, takes over when it fails; RateLimits throttle
+	// the providers that have one
+	EmailProvider string
+	EmailFallback string
+	RateLimits    map[string]SendRateLimit
+	SES           SESConfig
+	SendGrid      SendGridConfig
+	Mailgun       MailgunConfig
+	Postmark      PostmarkConfig
+	DevMail       DevMailConfig
+	// TemplateDir holds templates overriding the ones built into the binary,
+	// see templates.go
+	TemplateDir string
+	// EMLDir receives the emails as .eml files instead of the email
+	// provider, see EMLTransport
+	EMLDir string
+	// ReplyDomain receives replies to notifications at reply addresses
+	// signed with ReplySecret, see replyto.go
+	ReplyDomain string
+	ReplySecret string
+	// WebhookToken enables the bounce and complaint webhooks on Listen for
+	// URLs with the token, see bounces.go
+	WebhookToken string
+	// AdminToken enables the admin API on Listen for bearers of the token,
+	// see shadowban.go
+	AdminToken string
+	// StoreEvents keeps the signed events notifications are about, json or
+	// gzip, empty keeps none
+	StoreEvents string
+	// UserRefreshInterval is how often users are reloaded when MongoDB has no
+	// change streams, zero disables reloading
+	UserRefreshInterval time.Duration
+	// ArchiveDir keeps sent emails as .eml files when set, ArchiveRetention
+	// maps email types (or "default") to how long they are kept
+	ArchiveDir       string
+	ArchiveRetention map[string]time.Duration
+	// TrustPolicy routes notifications by web-of-trust distance, empty emails everything
+	TrustPolicy TrustPolicy
+	// SpamRulesPath is the JSON file configuring the spam filter, empty disables it
+	SpamRulesPath string
+	// MentionMatching is how mentions are recognized: strict, standard or loose
+	MentionMatching string
+	// MentionSearch also subscribes to notes mentioning users only in their
+	// content, through NIP-50 search, see mentionFilters
+	MentionSearch bool
+	// Timestamps bounds how far in the future or past event timestamps may be
+	Timestamps TimestampLimits
+	// NotifyFollowers sends users a daily summary of their new nostr followers
+	NotifyFollowers bool
+	// Moderators are hex pubkeys whose spam and abuse labels (NIP-32) suppress notifications
+	Moderators []string
+	// PublishLabels publishes a spam label for every event the spam filter quarantines
+	PublishLabels bool
+	// Handlers turns event handlers (see handlers.go) or single kinds on and off
+	Handlers HandlerSettings
+	// SenderAllowlist limits emails to events from these hex pubkeys, empty allows everyone
+	SenderAllowlist []string
+	// Watch routes notes with watched hashtags or keywords to a monitoring address
+	Watch WatchConfig
+	// Subjects chooses generic or summary email subjects per template
+	Subjects map[string]string
+	// AnnotateLanguage notes the detected language of notes in emails
+	AnnotateLanguage bool
+	// SenderAvatars embeds the profile pictures of senders in emails
+	SenderAvatars bool
+	// AttachEvents attaches the signed nostr event to the emails about it
+	AttachEvents bool
+	// MaxContentLength caps the event content shown in emails, see
+	// truncateContent
+	MaxContentLength int
+	// VerifyNIP05 accepts senders without a Trustroots account whose NIP-05
+	// identifier their domain confirms, as far as NIP05Policy trusts the domain
+	VerifyNIP05 bool
+	NIP05Policy NIP05Policy
+	// SenderThrottle limits notifications from senders our users complained about
+	SenderThrottle SenderThrottle
+	// VerifyNpubs only emails users who confirmed owning their npub (see
+	// challenge.go) on the page at ConfirmURL
+	VerifyNpubs bool
+	ConfirmURL  string
+	// Listen is the address of the public HTTP endpoints (see server.go),
+	// ServeNostrJSON adds /.well-known/nostr.json for Trustroots users
+	Listen         string
+	ServeNostrJSON bool
+	// QuietHours holds notifications to users during their quiet hours
+	QuietHours QuietHoursPolicy
+	// ModeratorEmail receives abuse reports (NIP-56) against users, empty disables them
+	ModeratorEmail string
+	SMTP           struct {
 		Host     string
 		Port     int
 		Username string
@@ -60,53 +201,249 @@ type NIP5Response struct {
 // Use the library's message types instead of custom implementation
 
 func main() {
+	// Parse command line arguments
+	listUsersFlag := flag.Bool("list-users", false, "List all users in 3 categories")
+	formatFlag := flag.String("format", userListTable, "Output format of --list-users: table, json or csv")
+	nostrListenFlag := flag.Bool("nostr-listen", false, "Listen to nostr relays for direct messages to valid npubs")
+	templateDocsFlag := flag.Bool("template-docs", false, "Print the reference of variables and helpers available to email templates")
+	testFlag := flag.Bool("test", false, "Send a test direct message from the sender key (use with --send-to-npub and --msg)")
+	sendToNpubFlag := flag.String("send-to-npub", "", "Recipient npub for --test")
+	msgFlag := flag.String("msg", "", "Message text for --test")
+	simulateUserFlag := flag.String("simulate-user", "", "Dry-run recent relay history for a username and report which notifications it would get")
+	simulateSinceFlag := flag.Duration("simulate-since", 24*time.Hour, "How far back --simulate-user replays relay history")
+	simulateUntilFlag := flag.Duration("simulate-until", 0, "How long ago the --simulate-user replay window ends")
+	simulateStoredFlag := flag.Bool("simulate-stored", false, "Replay the events kept with NOSTREMAIL_STORE_EVENTS instead of relay history, e.g. to try new templates")
+	emlDirFlag := flag.String("eml-dir", "", "Write emails as .eml files to this directory instead of sending them (overrides NOSTREMAIL_EML_DIR)")
+	challengeUserFlag := flag.String("challenge-user", "", "DM a one-time code to a username's npub and email them the link to confirm it")
+	flag.Parse()
+
+	// Machine-readable user lists get stdout to themselves, the log goes to stderr
+	listFormat, err := parseUserListFormat(*formatFlag)
+	if err != nil {
+		log.Fatal("❌ ", err)
+	}
+	listOutput := os.Stdout
+	if *listUsersFlag && listFormat != userListTable {
+		os.Stdout = os.Stderr
+	}
+
 	// Display git commit information
 	commitHash, commitDate := getGitCommitInfo()
 	fmt.Printf("🚀 Starting nostr-email-notification-daemon [%s %s]\n", commitHash, commitDate)
 	fmt.Println()
 
-	// Parse command line arguments
-	listUsersFlag := flag.Bool("list-users", false, "List all users in 3 categories")
-	nostrListenFlag := flag.Bool("nostr-listen", false, "Listen to nostr relays for direct messages to valid npubs")
-	flag.Parse()
+	// Subcommands, they need no config (the preview server only renders sample data)
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ Migration failed: ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "prune" {
+		if err := runPrune(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ Pruning failed: ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "show-event" {
+		if err := runShowEvent(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "suppress" {
+		if err := runSuppress(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "deliveries" {
+		if err := runDeliveries(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "shadowban" {
+		if err := runShadowBan(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "queue" {
+		if err := runQueue(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "preview" {
+		runPreview(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "verify-email" {
+		if err := runVerifyEmail(flag.Args()[1:]); err != nil {
+			log.Fatal("❌ Verification failed: ", err)
+		}
+		return
+	}
 
-	// Load configuration from environment variables
+	// Template docs are generated from Go types and need no config or database
+	if *templateDocsFlag {
+		writeTemplateDocsText(os.Stdout)
+		return
+	}
+
+	// Load configuration from environment variables; --eml-dir overrides
+	// NOSTREMAIL_EML_DIR, which spares configuring an email provider
+	if *emlDirFlag != "" {
+		os.Setenv("NOSTREMAIL_EML_DIR", *emlDirFlag)
+	}
 	config, err := loadConfigFromEnv()
 	if err != nil {
 		log.Fatal("Failed to load config:", err)
 	}
+	useTemplateDir(config.TemplateDir)
+	if config.EMLDir != "" {
+		if err := os.MkdirAll(config.EMLDir, 0o755); err != nil {
+			log.Fatal("Failed to create the .eml directory:", err)
+		}
+	}
 
-	// Check MongoDB connectivity first before any other operations
-	fmt.Println("🔍 Checking MongoDB connectivity...")
-	client, err := connectToMongoDB(config)
-	if err != nil {
-		log.Fatal("❌ MongoDB is not reachable:", err)
+	// Test messages only need the sender key and relays
+	if *testFlag {
+		if err := sendTestDirectMessage(config, *sendToNpubFlag, *msgFlag); err != nil {
+			log.Fatal("Failed to send test message:", err)
+		}
+		return
 	}
-	defer func() {
-		if err = client.Disconnect(context.TODO()); err != nil {
-			log.Fatal("Failed to disconnect from MongoDB:", err)
+
+	// Check MongoDB connectivity first before any other operations; other
+	// user sources run without MongoDB
+	var client *mongo.Client
+	if config.UserSource == "mongodb" {
+		fmt.Println("🔍 Checking MongoDB connectivity...")
+		client, err = connectToMongoDB(config)
+		if err != nil {
+			log.Fatal("❌ MongoDB is not reachable:", err)
 		}
-	}()
+		defer func() {
+			if err = client.Disconnect(context.TODO()); err != nil {
+				log.Fatal("Failed to disconnect from MongoDB:", err)
+			}
+		}()
+	} else {
+		fmt.Printf("👥 Loading users from %s\n", config.UserSource)
+	}
+	userSource := newUserSource(config, client)
 
 	// Initialize SQLite database for tracking processed notes
-	sqliteDB, err := initSQLiteDB()
+	sqliteDB, err := initSQLiteDB(processedNotesDBPath)
 	if err != nil {
 		log.Fatal("Failed to initialize SQLite database:", err)
 	}
 	defer sqliteDB.Close()
 
 	// Initialize email service
-	emailService := NewEmailService(
-		config.SMTP.Host,
-		config.SMTP.Port,
-		config.SMTP.Username,
-		config.SMTP.Password,
-		config.SenderEmail,
-		config.SMTP.FromName,
-	)
+	emailService, err := newConfiguredEmailService(config)
+	if err != nil {
+		log.Fatal("Failed to load the notification signing key:", err)
+	}
+	emailService.Notes = &SQLiteNoteStore{DB: sqliteDB}
+	if config.PostgresURL != "" {
+		notes, err := NewPostgresNoteStore(config.PostgresURL)
+		if err != nil {
+			log.Fatal("Failed to open the PostgreSQL note store:", err)
+		}
+		defer notes.DB.Close()
+		emailService.Notes = notes
+		fmt.Println("🐘 Keeping processed notes and digest items in PostgreSQL")
+	}
+	if config.RedisURL != "" {
+		cache, err := NewRedisCache(config.RedisURL)
+		if err != nil {
+			log.Fatal("Failed to connect to Redis:", err)
+		}
+		defer cache.Close()
+		emailService.Cache = cache
+		emailService.Notes = &CachedNoteStore{NoteStore: emailService.Notes, Cache: cache}
+		fmt.Println("🧰 Sharing processed events, profiles and NIP-05 results in Redis")
+	}
+	if emailService.RateLimit != nil {
+		go runRateLimitSummaries(emailService)
+	}
+	if emailService.SenderAllowlist != nil {
+		fmt.Printf("🧪 Only emailing about events from %d allowlisted senders\n", len(emailService.SenderAllowlist))
+	}
+	if config.ArchiveDir != "" {
+		archive, err := NewFileArchive(config.ArchiveDir)
+		if err != nil {
+			log.Fatal("Failed to open email archive:", err)
+		}
+		emailService.Archive = archive
+		go runArchivePurge(archive, config.ArchiveRetention)
+	}
+	if !noteStoreAtLeast(sqliteDB, config, schemaSuppressions) {
+		fmt.Println("⚠️  The suppression list needs the latest database schema, run `nostremail migrate`")
+	} else {
+		emailService.Suppressions = emailService.Notes
+	}
+	if !noteStoreAtLeast(sqliteDB, config, schemaPreferences) {
+		fmt.Println("⚠️  Choosing plain text emails on the unsubscribe page needs the latest database schema, run `nostremail migrate`")
+	} else {
+		emailService.Preferences = emailService.Notes
+	}
+	if config.UnsubscribeURL != "" {
+		if emailService.Suppressions == nil {
+			fmt.Println("⚠️  Unsubscribe links need the suppression list, emails are sent without them")
+		} else {
+			emailService.Unsubscribe = &Unsubscriber{
+				BaseURL:      config.UnsubscribeURL,
+				Secret:       []byte(config.UnsubscribeSecret),
+				Suppressions: emailService.Suppressions,
+				Preferences:  emailService.Preferences,
+			}
+		}
+	}
+	if config.ReplyDomain != "" {
+		fmt.Printf("↩️  Replies to notifications go to reply addresses @%s\n", config.ReplyDomain)
+		emailService.Replies = &ReplyAddresses{
+			Domain: config.ReplyDomain,
+			Secret: []byte(config.ReplySecret),
+		}
+	}
+	if !noteStoreAtLeast(sqliteDB, config, schemaDeliveries) {
+		fmt.Println("⚠️  The delivery history needs the latest database schema, run `nostremail migrate`")
+	} else {
+		emailService.Deliveries = emailService.Notes
+	}
+	if !noteStoreAtLeast(sqliteDB, config, schemaShadowBans) {
+		fmt.Println("⚠️  The shadow-ban list needs the latest database schema, run `nostremail migrate`")
+	} else {
+		emailService.ShadowBans = emailService.Notes
+	}
+	if !schemaAtLeast(sqliteDB, schemaEmailQueue) {
+		fmt.Println("⚠️  The email queue needs the latest database schema, run `nostremail migrate`; emails failing to send are lost until then")
+	} else {
+		emailService.Queue, err = NewEmailQueue(sqliteDB, config.QueueWorkers, config.QueueMaxAttempts)
+		if err != nil {
+			log.Fatal("Failed to open the email queue:", err)
+		}
+	}
+	if config.TrustrootsThreads {
+		if !noteStoreAtLeast(sqliteDB, config, schemaTrustrootsThreads) {
+			fmt.Println("⚠️  Linking Trustroots threads needs the latest database schema, run `nostremail migrate`")
+		} else {
+			fmt.Println("🔗 Linking DMs between Trustroots users to their Trustroots threads")
+			emailService.TrustrootsThreads = &TrustrootsThreads{Client: client, Database: config.MongoDB.Database}
+			emailService.ThreadLinks = emailService.Notes
+		}
+	}
+	if config.NoteRetention > 0 {
+		fmt.Printf("🧹 Pruning processed notes older than %s\n", config.NoteRetention)
+		go runNotePrune(emailService.Notes, config.NoteRetention)
+	}
 
-	// Get users from database
-	users, err := getUsersFromDB(client, config)
+	// Get users from the user source
+	users, err := userSource.Users()
 	if err != nil {
 		log.Fatal("Failed to get users from database:", err)
 	}
@@ -115,12 +452,48 @@ func main() {
 	validNpubs, invalidNpubs, emptyNpubs := categorizeUsers(users)
 
 	if *listUsersFlag {
+		if listFormat != userListTable {
+			if err := writeUserList(listOutput, listFormat, validNpubs, invalidNpubs, emptyNpubs); err != nil {
+				log.Fatal("Failed to write the user list:", err)
+			}
+			return
+		}
 		displayUserList(validNpubs, invalidNpubs, emptyNpubs)
 		return
 	}
 
+	if *simulateUserFlag != "" {
+		var stored NoteStore
+		if *simulateStoredFlag {
+			stored = emailService.Notes
+		}
+		err = simulateUserNotifications(*simulateUserFlag, *simulateSinceFlag, *simulateUntilFlag, stored, validNpubs, client, config)
+		if err != nil {
+			log.Fatal("Failed to simulate notifications:", err)
+		}
+		return
+	}
+
+	if *challengeUserFlag != "" {
+		err = challengeNpub(*challengeUserFlag, validNpubs, config, sqliteDB, emailService)
+		if err != nil {
+			log.Fatal("Failed to challenge npub:", err)
+		}
+		return
+	}
+
 	if *nostrListenFlag {
-		err = listenToNostrRelays(validNpubs, config.Relays, client, config, sqliteDB, emailService)
+		// Only the daemon sends the queued emails, also those left by earlier runs
+		if emailService.Queue != nil {
+			fmt.Printf("📬 Sending queued emails with %d workers\n", config.QueueWorkers)
+			emailService.Queue.Run(emailService.deliverEmailJob, emailService.emailFailed)
+		}
+		// Template edits are picked up without dropping the relay connections
+		if config.TemplateDir != "" {
+			fmt.Printf("👀 Watching %s for template changes\n", config.TemplateDir)
+			go emailService.watchTemplateDir(config.TemplateDir)
+		}
+		err = listenToNostrRelays(validNpubs, config.Relays, userSource, client, config, sqliteDB, emailService)
 		if err != nil {
 			log.Fatal("Failed to listen to nostr relays:", err)
 		}
@@ -155,18 +528,225 @@ func loadConfigFromEnv() (*Config, error) {
 		}
 	}
 
+	recordDeletions, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_RECORD_DELETIONS"))
+	notifyFollowers, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_NOTIFY_FOLLOWERS"))
+	publishLabels, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_PUBLISH_LABELS"))
+	annotateLanguage, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_ANNOTATE_LANGUAGE"))
+	senderAvatars, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_SENDER_AVATARS"))
+	attachEvents, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_ATTACH_EVENTS"))
+	verifyNIP05, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_VERIFY_NIP05"))
+	verifyNpubs, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_VERIFY_NPUBS"))
+	serveNostrJSON, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_SERVE_NOSTR_JSON"))
+	trustrootsThreads, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_TRUSTROOTS_THREADS"))
+
+	// Parse archive retention, e.g. "default=2160h,nostr_direct_message=720h"
+	archiveRetention, err := parseArchiveRetention(os.Getenv("NOSTREMAIL_ARCHIVE_RETENTION"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_ARCHIVE_RETENTION: %v", err)
+	}
+
+	// Parse web-of-trust policy, e.g. "1=email,2=digest,unknown=drop"
+	trustPolicy, err := parseTrustPolicy(os.Getenv("NOSTREMAIL_WOT_POLICY"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_WOT_POLICY: %v", err)
+	}
+
+	mentionMatching, err := parseMentionMatching(os.Getenv("NOSTREMAIL_MENTION_MATCHING"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_MENTION_MATCHING: %v", err)
+	}
+	mentionSearch, _ := strconv.ParseBool(os.Getenv("NOSTREMAIL_MENTION_SEARCH"))
+
+	senderAllowlist, err := parsePubkeyList(os.Getenv("NOSTREMAIL_SENDER_ALLOWLIST"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_SENDER_ALLOWLIST: %v", err)
+	}
+
+	handlers, err := parseHandlerSettings(os.Getenv("NOSTREMAIL_HANDLERS"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_HANDLERS: %v", err)
+	}
+
+	moderators, err := parsePubkeyList(os.Getenv("NOSTREMAIL_MODERATORS"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_MODERATORS: %v", err)
+	}
+
+	watchDelivery, err := parseWatchDelivery(os.Getenv("NOSTREMAIL_WATCH_DELIVERY"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_WATCH_DELIVERY: %v", err)
+	}
+	watch := WatchConfig{
+		Hashtags: parseWatchList(os.Getenv("NOSTREMAIL_WATCH_HASHTAGS")),
+		Keywords: parseWatchList(os.Getenv("NOSTREMAIL_WATCH_KEYWORDS")),
+		Email:    getEnvOrDefault("NOSTREMAIL_WATCH_EMAIL", os.Getenv("NOSTREMAIL_MODERATOR_EMAIL")),
+		Delivery: watchDelivery,
+	}
+
+	subjects, err := parseSubjectStrategies(os.Getenv("NOSTREMAIL_SUBJECTS"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_SUBJECTS: %v", err)
+	}
+
+	nip05Policy, err := parseNIP05Policy(os.Getenv("NOSTREMAIL_NIP05_TRUST"), os.Getenv("NOSTREMAIL_NIP05_DOMAINS"), os.Getenv("NOSTREMAIL_NIP05_DELIVERY"))
+	if err != nil {
+		return nil, fmt.Errorf("NIP-05 policy: %v", err)
+	}
+
+	senderThrottle, err := parseSenderThrottle(os.Getenv("NOSTREMAIL_SENDER_THROTTLE"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_SENDER_THROTTLE: %v", err)
+	}
+
+	quietHours, err := parseQuietHoursPolicy(os.Getenv("NOSTREMAIL_QUIET_HOURS"), os.Getenv("NOSTREMAIL_TIMEZONE"), os.Getenv("NOSTREMAIL_QUIET_HOURS_DELIVERY"))
+	if err != nil {
+		return nil, fmt.Errorf("quiet hours: %v", err)
+	}
+
+	var sendDelay time.Duration
+	if value := os.Getenv("NOSTREMAIL_SEND_DELAY"); value != "" {
+		sendDelay, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("NOSTREMAIL_SEND_DELAY: %v", err)
+		}
+	}
+
+	userRefreshInterval := defaultUserRefreshInterval
+	if value := os.Getenv("NOSTREMAIL_USER_REFRESH_INTERVAL"); value != "" {
+		userRefreshInterval, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("NOSTREMAIL_USER_REFRESH_INTERVAL: %v", err)
+		}
+	}
+
+	timestampLimits, err := parseTimestampLimits(os.Getenv("NOSTREMAIL_MAX_FUTURE_SKEW"), os.Getenv("NOSTREMAIL_MAX_EVENT_AGE"), os.Getenv("NOSTREMAIL_TIMESTAMP_ACTION"))
+	if err != nil {
+		return nil, fmt.Errorf("timestamp limits: %v", err)
+	}
+
+	var noteRetention time.Duration
+	if value := os.Getenv("NOSTREMAIL_NOTE_RETENTION"); value != "" {
+		noteRetention, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("NOSTREMAIL_NOTE_RETENTION: %v", err)
+		}
+	}
+	if err := checkNoteRetention(noteRetention, timestampLimits); err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_NOTE_RETENTION: %v", err)
+	}
+
+	// Email queue workers and attempts before an email is dead
+	queueWorkers, queueMaxAttempts := 2, 8
+	if value := os.Getenv("NOSTREMAIL_QUEUE_WORKERS"); value != "" {
+		if queueWorkers, err = strconv.Atoi(value); err != nil || queueWorkers < 1 {
+			return nil, fmt.Errorf("NOSTREMAIL_QUEUE_WORKERS: expected a positive number, got %q", value)
+		}
+	}
+	if value := os.Getenv("NOSTREMAIL_QUEUE_MAX_ATTEMPTS"); value != "" {
+		if queueMaxAttempts, err = strconv.Atoi(value); err != nil || queueMaxAttempts < 1 {
+			return nil, fmt.Errorf("NOSTREMAIL_QUEUE_MAX_ATTEMPTS: expected a positive number, got %q", value)
+		}
+	}
+
+	// Characters of event content shown in emails, 0 shows all
+	maxContentLength := defaultMaxContentLength
+	if value := os.Getenv("NOSTREMAIL_MAX_CONTENT_LENGTH"); value != "" {
+		if maxContentLength, err = strconv.Atoi(value); err != nil || maxContentLength < 0 {
+			return nil, fmt.Errorf("NOSTREMAIL_MAX_CONTENT_LENGTH: expected a number of characters, got %q", value)
+		}
+	}
+
+	emailProvider, err := parseEmailProvider(os.Getenv("NOSTREMAIL_EMAIL_PROVIDER"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_EMAIL_PROVIDER: %v", err)
+	}
+
+	emailFallback := ""
+	if value := os.Getenv("NOSTREMAIL_EMAIL_FALLBACK_PROVIDER"); value != "" {
+		if emailFallback, err = parseEmailProvider(value); err != nil {
+			return nil, fmt.Errorf("NOSTREMAIL_EMAIL_FALLBACK_PROVIDER: %v", err)
+		}
+	}
+
+	devMail, err := loadDevMailConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	mailgun, err := loadMailgunConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	providerRateLimits, err := loadProviderRateLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := parseDigestWindow(os.Getenv("NOSTREMAIL_DIGEST"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_DIGEST: %v", err)
+	}
+
+	userRateLimit, err := parseUserRateLimit(os.Getenv("NOSTREMAIL_USER_RATE_LIMIT"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_USER_RATE_LIMIT: %v", err)
+	}
+
+	sendRateLimit, err := parseSendRateLimit(os.Getenv("NOSTREMAIL_SEND_RATE_LIMIT"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_SEND_RATE_LIMIT: %v", err)
+	}
+
+	storeEvents, err := parseStoreEvents(os.Getenv("NOSTREMAIL_STORE_EVENTS"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_STORE_EVENTS: %v", err)
+	}
+
+	userSource, err := parseUserSource(os.Getenv("NOSTREMAIL_USER_SOURCE"))
+	if err != nil {
+		return nil, fmt.Errorf("NOSTREMAIL_USER_SOURCE: %v", err)
+	}
+
+	mongoDB, err := loadMongoDBConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	config := &Config{
-		MongoDB: struct {
-			URI      string
-			Database string
-		}{
-			URI:      getEnvOrDefault("MONGO_URI", "mongodb://localhost:27017"),
-			Database: getEnvOrDefault("MONGO_DB", "trust-roots"),
-		},
-		SenderNpub:  os.Getenv("NOSTREMAIL_SENDER_NPUB"),
-		SenderNsec:  os.Getenv("NOSTREMAIL_SENDER_NSEC"),
-		SenderEmail: os.Getenv("NOSTREMAIL_SENDER_EMAIL"),
-		Relays:      relays,
+		MongoDB:          mongoDB,
+		SenderNpub:       os.Getenv("NOSTREMAIL_SENDER_NPUB"),
+		SenderNsec:       os.Getenv("NOSTREMAIL_SENDER_NSEC"),
+		SenderEmail:      os.Getenv("NOSTREMAIL_SENDER_EMAIL"),
+		Relays:           relays,
+		RecordDeletions:  recordDeletions,
+		SendDelay:        sendDelay,
+		ArchiveDir:       os.Getenv("NOSTREMAIL_ARCHIVE_DIR"),
+		ArchiveRetention: archiveRetention,
+		TrustPolicy:      trustPolicy,
+		SpamRulesPath:    os.Getenv("NOSTREMAIL_SPAM_RULES"),
+		MentionMatching:  mentionMatching,
+		MentionSearch:    mentionSearch,
+		Timestamps:       timestampLimits,
+		NotifyFollowers:  notifyFollowers,
+		Moderators:       moderators,
+		PublishLabels:    publishLabels,
+		ModeratorEmail:   os.Getenv("NOSTREMAIL_MODERATOR_EMAIL"),
+		Handlers:         handlers,
+		SenderAllowlist:  senderAllowlist,
+		Watch:            watch,
+		Subjects:         subjects,
+		AnnotateLanguage: annotateLanguage,
+		MaxContentLength: maxContentLength,
+		SenderAvatars:    senderAvatars,
+		AttachEvents:     attachEvents,
+		VerifyNIP05:      verifyNIP05,
+		NIP05Policy:      nip05Policy,
+		VerifyNpubs:      verifyNpubs,
+		ConfirmURL:       os.Getenv("NOSTREMAIL_CONFIRM_URL"),
+		Listen:           os.Getenv("NOSTREMAIL_LISTEN"),
+		ServeNostrJSON:   serveNostrJSON,
+		SenderThrottle:   senderThrottle,
 		SMTP: struct {
 			Host     string
 			Port     int
@@ -180,6 +760,36 @@ func loadConfigFromEnv() (*Config, error) {
 			Password: os.Getenv("NOSTREMAIL_SMTP_PASSWORD"),
 			FromName: os.Getenv("NOSTREMAIL_SMTP_FROM_NAME"),
 		},
+		UserRefreshInterval: userRefreshInterval,
+		QuietHours:          quietHours,
+		PostgresURL:         os.Getenv("NOSTREMAIL_POSTGRES_URL"),
+		RedisURL:            os.Getenv("NOSTREMAIL_REDIS_URL"),
+		NoteRetention:       noteRetention,
+		StoreEvents:         storeEvents,
+		UserRateLimit:       userRateLimit,
+		SendRateLimit:       sendRateLimit,
+		UserSource:          userSource,
+		UserSourceToken:     os.Getenv("NOSTREMAIL_USER_SOURCE_TOKEN"),
+		AdminToken:          os.Getenv("NOSTREMAIL_ADMIN_TOKEN"),
+		TrustrootsThreads:   trustrootsThreads,
+		QueueWorkers:        queueWorkers,
+		QueueMaxAttempts:    queueMaxAttempts,
+		Digest:              digest,
+		UnsubscribeURL:      os.Getenv("NOSTREMAIL_UNSUBSCRIBE_URL"),
+		UnsubscribeSecret:   os.Getenv("NOSTREMAIL_UNSUBSCRIBE_SECRET"),
+		WebhookToken:        os.Getenv("NOSTREMAIL_WEBHOOK_TOKEN"),
+		EmailProvider:       emailProvider,
+		EmailFallback:       emailFallback,
+		RateLimits:          providerRateLimits,
+		SES:                 loadSESConfig(),
+		SendGrid:            loadSendGridConfig(),
+		Mailgun:             mailgun,
+		Postmark:            loadPostmarkConfig(),
+		DevMail:             devMail,
+		TemplateDir:         os.Getenv("NOSTREMAIL_TEMPLATE_DIR"),
+		EMLDir:              os.Getenv("NOSTREMAIL_EML_DIR"),
+		ReplyDomain:         os.Getenv("NOSTREMAIL_REPLY_DOMAIN"),
+		ReplySecret:         os.Getenv("NOSTREMAIL_REPLY_SECRET"),
 	}
 
 	// Validate required fields
@@ -195,14 +805,42 @@ func loadConfigFromEnv() (*Config, error) {
 	if len(config.Relays) == 0 {
 		return nil, fmt.Errorf("NOSTREMAIL_RELAYS environment variable is required")
 	}
-	if config.SMTP.Host == "" {
-		return nil, fmt.Errorf("NOSTREMAIL_SMTP_HOST environment variable is required")
+	if err := checkEmailProvider(config.EmailProvider, config); err != nil && config.EMLDir == "" {
+		return nil, err
+	}
+	if config.EmailFallback != "" && config.EMLDir == "" {
+		if config.EmailFallback == config.EmailProvider {
+			return nil, fmt.Errorf("NOSTREMAIL_EMAIL_FALLBACK_PROVIDER must differ from NOSTREMAIL_EMAIL_PROVIDER")
+		}
+		if err := checkEmailProvider(config.EmailFallback, config); err != nil {
+			return nil, err
+		}
+	}
+	if config.TemplateDir != "" {
+		if err := checkTemplateDir(config.TemplateDir); err != nil {
+			return nil, fmt.Errorf("NOSTREMAIL_TEMPLATE_DIR: %v", err)
+		}
+	}
+	if config.ServeNostrJSON && config.Listen == "" {
+		return nil, fmt.Errorf("NOSTREMAIL_SERVE_NOSTR_JSON needs NOSTREMAIL_LISTEN")
 	}
-	if config.SMTP.Username == "" {
-		return nil, fmt.Errorf("NOSTREMAIL_SMTP_USERNAME environment variable is required")
+	if config.AdminToken != "" && config.Listen == "" {
+		return nil, fmt.Errorf("NOSTREMAIL_ADMIN_TOKEN needs NOSTREMAIL_LISTEN")
 	}
-	if config.SMTP.Password == "" {
-		return nil, fmt.Errorf("NOSTREMAIL_SMTP_PASSWORD environment variable is required")
+	if config.UnsubscribeURL != "" && config.Listen == "" {
+		return nil, fmt.Errorf("NOSTREMAIL_UNSUBSCRIBE_URL needs NOSTREMAIL_LISTEN")
+	}
+	if config.UnsubscribeURL != "" && len(config.UnsubscribeSecret) < 32 {
+		return nil, fmt.Errorf("NOSTREMAIL_UNSUBSCRIBE_URL needs NOSTREMAIL_UNSUBSCRIBE_SECRET of at least 32 characters")
+	}
+	if config.ReplyDomain != "" && len(config.ReplySecret) < 32 {
+		return nil, fmt.Errorf("NOSTREMAIL_REPLY_DOMAIN needs NOSTREMAIL_REPLY_SECRET of at least 32 characters")
+	}
+	if config.WebhookToken != "" && config.Listen == "" {
+		return nil, fmt.Errorf("NOSTREMAIL_WEBHOOK_TOKEN needs NOSTREMAIL_LISTEN")
+	}
+	if config.TrustrootsThreads && config.UserSource != "mongodb" {
+		return nil, fmt.Errorf("NOSTREMAIL_TRUSTROOTS_THREADS needs the mongodb user source")
 	}
 
 	return config, nil
@@ -268,14 +906,19 @@ func getGitCommitInfo() (string, string) {
 }
 
 func connectToMongoDB(config *Config) (*mongo.Client, error) {
-	clientOptions := options.Client().ApplyURI(config.MongoDB.URI)
+	clientOptions, err := config.MongoDB.clientOptions()
+	if err != nil {
+		return nil, fmt.Errorf("invalid MongoDB options: %v", err)
+	}
 	client, err := mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MongoDB client: %v", err)
 	}
 
-	// Ping the database to verify connection
-	err = client.Ping(context.TODO(), nil)
+	// Ping the database to verify connection, waiting out transient errors
+	err = retryMongo("reach MongoDB", func() error {
+		return client.Ping(context.TODO(), nil)
+	})
 	if err != nil {
 		client.Disconnect(context.TODO())
 		return nil, fmt.Errorf("failed to ping MongoDB at %s: %v", config.MongoDB.URI, err)
@@ -288,38 +931,48 @@ func getUsersFromDB(client *mongo.Client, config *Config) ([]User, error) {
 	db := client.Database(config.MongoDB.Database)
 	collection := db.Collection("users")
 
-	// Query for users that have nostrNpub set
-	filter := bson.M{"nostrNpub": bson.M{"$exists": true}}
+	// Query for users that have nostrNpub or nostrNpubs set
+	filter := bson.M{"$or": bson.A{
+		bson.M{"nostrNpub": bson.M{"$exists": true}},
+		bson.M{"nostrNpubs.0": bson.M{"$exists": true}},
+	}}
 
-	// Count total documents matching the filter
-	count, err := collection.CountDocuments(context.TODO(), filter)
-	if err != nil {
-		return nil, err
-	}
-	fmt.Printf("Found %d users with nostrNpub set\n", count)
+	// Transient errors, e.g. during a replica set election, are retried
+	var users []User
+	err := retryMongo("load users", func() error {
+		// Count total documents matching the filter
+		count, err := collection.CountDocuments(context.TODO(), filter)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Found %d users with nostrNpub set\n", count)
 
-	// Find all users with nostrNpub
-	cursor, err := collection.Find(context.TODO(), filter)
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(context.TODO())
+		// Find all users with nostrNpub
+		cursor, err := collection.Find(context.TODO(), filter)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(context.TODO())
 
-	// Process results
-	var users []User
-	if err = cursor.All(context.TODO(), &users); err != nil {
+		// Process results
+		users = nil
+		return cursor.All(context.TODO(), &users)
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	return users, nil
 }
 
+// categorizeUsers sorts users into those with at least one valid npub, those
+// with only invalid npubs and those without any
 func categorizeUsers(users []User) ([]User, []User, []User) {
 	var validNpubs, invalidNpubs, emptyNpubs []User
 	for _, user := range users {
-		if user.NostrNpub == "" {
+		if len(user.Npubs()) == 0 {
 			emptyNpubs = append(emptyNpubs, user)
-		} else if isValidNpub(user.NostrNpub) {
+		} else if len(userKeys(user)) > 0 {
 			validNpubs = append(validNpubs, user)
 		} else {
 			invalidNpubs = append(invalidNpubs, user)
@@ -328,25 +981,47 @@ func categorizeUsers(users []User) ([]User, []User, []User) {
 	return validNpubs, invalidNpubs, emptyNpubs
 }
 
-// isValidNpub validates that an npub is properly formatted using the nostr library
-func isValidNpub(npub string) bool {
-	// Basic format check
-	if npub == "" || !strings.HasPrefix(npub, "npub1") || len(npub) <= 50 {
-		return false
+// Npubs returns all npubs of a user, nostrNpub first
+func (u User) Npubs() []string {
+	var npubs []string
+	seen := make(map[string]bool)
+	for _, npub := range append([]string{u.NostrNpub}, u.NostrNpubs...) {
+		npub = strings.TrimSpace(npub)
+		if npub == "" || seen[npub] {
+			continue
+		}
+		seen[npub] = true
+		npubs = append(npubs, npub)
 	}
+	return npubs
+}
 
-	// Try to create an event with this npub as pubkey to test if it's valid
-	// This is a bit of a hack, but it will validate the npub format
-	event := &nostr.Event{
-		Kind:      nostr.KindTextNote,
-		Content:   "test",
-		CreatedAt: nostr.Now(),
-		PubKey:    npub,
+// userKeys returns a user once for every valid npub, with NostrNpub set to
+// that npub, so notifications name the key they were addressed to
+func userKeys(user User) []User {
+	var keys []User
+	for _, npub := range user.Npubs() {
+		if !isValidNpub(npub) {
+			continue
+		}
+		key := user
+		key.NostrNpub = npub
+		keys = append(keys, key)
 	}
+	return keys
+}
 
-	// Try to calculate the event ID - this will fail if the pubkey is invalid
-	eventID := event.GetID()
-	return eventID != ""
+// sameUser reports whether two users, possibly different keys of one user,
+// are the same Trustroots user
+func sameUser(a, b User) bool {
+	return a.Username == b.Username && a.Email == b.Email
+}
+
+// isValidNpub reports whether an npub decodes as bech32 with a valid checksum,
+// the npub prefix and a 32-byte pubkey, so typos are never subscribed to
+func isValidNpub(npub string) bool {
+	_, err := npubToHex(npub)
+	return err == nil
 }
 
 func displayUserList(validNpubs, invalidNpubs, emptyNpubs []User) {
@@ -355,7 +1030,7 @@ func displayUserList(validNpubs, invalidNpubs, emptyNpubs []User) {
 	fmt.Println("Username | Email | Nostr Npub")
 	fmt.Println(strings.Repeat("-", 100))
 	for _, user := range validNpubs {
-		fmt.Printf("%s | %s | %s\n", user.Username, user.Email, user.NostrNpub)
+		fmt.Printf("%s | %s | %s\n", user.Username, user.Email, strings.Join(user.Npubs(), ", "))
 	}
 
 	fmt.Println("\n=== INVALID/OTHER NPUBS ===")
@@ -363,7 +1038,7 @@ func displayUserList(validNpubs, invalidNpubs, emptyNpubs []User) {
 	fmt.Println("Username | Email | Nostr Npub")
 	fmt.Println(strings.Repeat("-", 100))
 	for _, user := range invalidNpubs {
-		fmt.Printf("%s | %s | %s\n", user.Username, user.Email, user.NostrNpub)
+		fmt.Printf("%s | %s | %s\n", user.Username, user.Email, strings.Join(user.Npubs(), ", "))
 	}
 
 	fmt.Println("\n=== EMPTY NPUBS ===")
@@ -381,53 +1056,267 @@ func displayUserList(validNpubs, invalidNpubs, emptyNpubs []User) {
 	fmt.Printf("Empty npubs: %d\n", len(emptyNpubs))
 }
 
-func listenToNostrRelays(validNpubs []User, relays []string, client *mongo.Client, config *Config, sqliteDB *sql.DB, emailService *EmailService) error {
+func listenToNostrRelays(validNpubs []User, relays []string, userSource UserSource, client *mongo.Client, config *Config, sqliteDB *sql.DB, emailService *EmailService) error {
 	fmt.Println("🔍 Listening to nostr relays for direct messages...")
 	fmt.Printf("Connecting to %d relays: %v\n", len(relays), relays)
 
-	// Create a map of npubs to users for quick lookup
-	npubToUser := make(map[string]User)
-	hexToUser := make(map[string]User) // Map hex pubkeys to users
-	for _, user := range validNpubs {
-		npubToUser[user.NostrNpub] = user
-
-		// Also create hex mapping for event processing
-		hexPubkey, err := npubToHex(user.NostrNpub)
-		if err != nil {
-			fmt.Printf("⚠️  Warning: Failed to convert npub %s to hex: %v\n", user.NostrNpub, err)
-			continue
-		}
-		hexToUser[hexPubkey] = user
-	}
+	// Index the users by npub and hex pubkey for quick lookup, updated in
+	// place when users change
+	index := NewUserIndex(validNpubs)
+	npubToUser := index.NpubToUser
+	hexToUser := index.HexToUser
 
-	fmt.Printf("\nMonitoring %d valid npubs for direct messages...\n", len(validNpubs))
+	fmt.Printf("\nMonitoring %d valid npubs of %d users for direct messages...\n", len(npubToUser), len(validNpubs))
 	fmt.Println("Press Ctrl+C to stop listening")
 	fmt.Println()
 
+	spamFilter, err := newSpamFilterFromConfig(config)
+	if err != nil {
+		return err
+	}
+
 	// Create relay pool
 	pool := nostr.NewSimplePool(context.Background())
 
-	// Create filter for direct messages only
-	since := nostr.Timestamp(time.Now().Add(-1 * time.Hour).Unix())
-	filter := nostr.Filter{
-		Kinds: []int{4}, // NIP-4 encrypted direct messages only
-		Tags:  nostr.TagMap{"p": getHexPubkeysFromUsers(npubToUser)},
-		Since: &since,
+	// Respect what users muted on nostr, the subscription below keeps the lists current
+	hexPubkeys := getHexPubkeysFromUsers(npubToUser)
+	emailService.Mutes = loadMuteLists(pool, relays, hexPubkeys)
+
+	// Suppress what moderators labeled as spam or abuse, the subscription below keeps the labels current
+	if len(config.Moderators) > 0 {
+		emailService.Labels = loadModerationLabels(pool, relays, config.Moderators)
+	}
+	if spamFilter != nil && config.PublishLabels {
+		spamFilter.Labeler = &QuarantineLabeler{Nsec: config.SenderNsec, Relays: relays, Publisher: NewRelayPublisher()}
+	}
+
+	configureUserServices(emailService, config, pool, relays, npubToUser, hexToUser, client)
+	if emailService.Avatars != nil {
+		fmt.Printf("🖼️  Embedding the profile pictures of senders in emails\n")
+	}
+	if emailService.NIP05 != nil {
+		go runNIP05Reverification(emailService.NIP05)
+	}
+	if config.Watch.Enabled() {
+		fmt.Printf("🔭 Watching %d hashtags and %d keywords for %s (%s)\n",
+			len(config.Watch.Hashtags), len(config.Watch.Keywords), config.Watch.Email, config.Watch.Delivery)
+	}
+
+	if config.Digest != digestOff {
+		fmt.Printf("📬 Sending %s digests to users without a digest setting\n", config.Digest)
 	}
+	go runDigests(hexToUser, emailService)
 
-	// Subscribe to events
-	sub := pool.SubMany(context.Background(), relays, []nostr.Filter{filter})
+	// Users confirm owning their npub on the confirmation page
+	if config.VerifyNpubs || config.Listen != "" {
+		if !schemaAtLeast(sqliteDB, schemaNpubChallenges) {
+			return fmt.Errorf("npub verification needs the latest database schema, run `nostremail migrate`")
+		}
+	}
+	if config.VerifyNpubs {
+		fmt.Println("🔑 Only emailing users who confirmed owning their npub")
+		emailService.VerifiedNpubs = sqliteDB
+	}
+	if config.Listen != "" {
+		// Replies by email come in through the webhooks of the inbound mail provider
+		var inbound *InboundReplies
+		if emailService.Replies != nil && config.WebhookToken != "" {
+			fmt.Println("↩️  Posting replies by email to nostr, received at /webhooks/inbound/<provider>")
+			inbound = &InboundReplies{
+				Replies:   emailService.Replies,
+				Config:    config,
+				Users:     hexToUser,
+				Pool:      pool,
+				Publisher: NewRelayPublisher(),
+			}
+		}
+		go runHTTPServer(config.Listen, daemonMux(config, userSource, sqliteDB, emailService.VerifiedNpubs, emailService.ShadowBans, emailService.Suppressions, emailService.Unsubscribe, inbound))
+	}
+
+	// Signed events of notifications, for audits and replays
+	if config.StoreEvents != "" {
+		if !noteStoreAtLeast(sqliteDB, config, schemaStoredEvents) {
+			return fmt.Errorf("storing events needs the latest database schema, run `nostremail migrate`")
+		}
+		fmt.Printf("🗃️  Storing the events of notifications (%s)\n", config.StoreEvents)
+		emailService.StoreEvents = config.StoreEvents
+	}
+
+	// Sender reputation, with reports by our users as complaints
+	if !schemaAtLeast(sqliteDB, schemaReputation) {
+		fmt.Println("⚠️  Sender reputation needs the latest database schema, run `nostremail migrate`")
+		if config.SenderThrottle.Complaints > 0 {
+			return fmt.Errorf("sender throttling needs the latest database schema, run `nostremail migrate`")
+		}
+	} else {
+		emailService.Reputation = NewSenderReputation(sqliteDB, config.SenderThrottle)
+	}
+
+	// New followers are collected in the database and emailed as a summary
+	if config.NotifyFollowers {
+		if !schemaAtLeast(sqliteDB, schemaFollowers) {
+			fmt.Println("⚠️  New-follower notifications need the latest database schema, run `nostremail migrate`")
+			config.NotifyFollowers = false
+		} else {
+			go runFollowerSummaries(sqliteDB, hexToUser, emailService)
+		}
+	}
+
+	// Pick up users who link or remove their npub without a restart
+	userChanges, err := watchUserChanges(client, config.MongoDB.Database)
+	if err != nil && config.UserRefreshInterval > 0 {
+		fmt.Printf("⚠️  Not watching for user changes, reloading users every %s instead: %v\n", config.UserRefreshInterval, err)
+		userChanges = pollUserChanges(config.UserRefreshInterval)
+	} else if err != nil {
+		fmt.Printf("⚠️  Not watching for user changes, restart the daemon to pick up new users: %v\n", err)
+	} else {
+		fmt.Println("👀 Watching for users linking or removing their npub")
+	}
+	var userChangeSignal <-chan struct{}
+	if userChanges != nil {
+		userChangeSignal = userChanges.C
+	}
+
+	// Subscribe to events, and again with the new pubkeys whenever users change
+	daemonHexPubkey, daemonErr := npubToHex(config.SenderNpub)
+	var sub, dmSub chan nostr.RelayEvent
+	cancelSubscriptions := func() {}
+	subscribe := func() {
+		cancelSubscriptions()
+		var ctx context.Context
+		ctx, cancelSubscriptions = context.WithCancel(context.Background())
+
+		since := nostr.Timestamp(time.Now().Add(-1 * time.Hour).Unix())
+		hexPubkeys := getHexPubkeysFromUsers(npubToUser)
+		sub = pool.SubMany(ctx, relays, listenFilters(hexPubkeys, hexToUser, config, emailService, since))
+
+		// Modern clients deliver DMs only to the recipient's DM relays (kind 10050),
+		// so also listen there for DMs to users and gift wraps to the daemon
+		var dmRelayUsers []string
+		if config.Handlers.Enabled("dm") {
+			dmRelayUsers = hexPubkeys
+		}
+		if daemonErr == nil && config.Handlers.Enabled("private_message") {
+			dmRelayUsers = append([]string{daemonHexPubkey}, dmRelayUsers...)
+		}
+		dmSub = nil
+		if len(dmRelayUsers) > 0 {
+			dmRelayLists := loadDMRelayLists(pool, relays, dmRelayUsers)
+			dmSub = subscribeDMRelays(ctx, pool, dmRelayFilters(dmRelayLists, daemonHexPubkey, relays, since))
+		}
+	}
+	subscribe()
 
 	// Process events
-	for evt := range sub {
-		processEvent(evt, npubToUser, hexToUser, client, config, sqliteDB, emailService)
+	for sub != nil || dmSub != nil {
+		var evt nostr.RelayEvent
+		var ok bool
+		select {
+		case evt, ok = <-sub:
+			if !ok {
+				sub = nil
+				continue
+			}
+		case evt, ok = <-dmSub:
+			if !ok {
+				dmSub = nil
+				continue
+			}
+		case <-userChangeSignal:
+			ids, full := userChanges.Take()
+			changed, err := reloadUsers(userSource, ids, full, index, config, pool, emailService)
+			if err != nil {
+				fmt.Printf("⚠️  Failed to reload users: %v\n", err)
+			} else if changed {
+				subscribe()
+			}
+			continue
+		}
+		processEvent(evt, pool, npubToUser, hexToUser, client, config, sqliteDB, emailService, spamFilter)
 	}
+	cancelSubscriptions()
 
 	return nil
 }
 
+// buildEventFilters creates the relay filters for events addressed to the given hex pubkeys.
+// until may be nil for an open-ended subscription.
+func buildEventFilters(hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter {
+	filters := handlerFilters(hexPubkeys, hexToUser, config, since, until)
+
+	// Deletions (NIP-09) by our users, who are the senders of most notifications
+	if config.RecordDeletions {
+		filters = append(filters, nostr.Filter{
+			Kinds:   []int{nostr.KindDeletion},
+			Authors: hexPubkeys,
+			Since:   &since,
+			Until:   until,
+		})
+	}
+
+	return filters
+}
+
+// listenFilters creates the filters of the --nostr-listen subscription: the
+// events we notify about, and the lists, labels and reports that keep the
+// filters of the email service current
+func listenFilters(hexPubkeys []string, hexToUser map[string]User, config *Config, emailService *EmailService, since nostr.Timestamp) []nostr.Filter {
+	filters := buildEventFilters(hexPubkeys, hexToUser, config, since, nil)
+	filters = append(filters, nostr.Filter{
+		Kinds:   []int{nostr.KindMuteList, nostr.KindFollowList},
+		Authors: hexPubkeys,
+		Since:   &since,
+	})
+	if emailService.Labels != nil {
+		filters = append(filters, nostr.Filter{
+			Kinds:   []int{nostr.KindLabel},
+			Authors: config.Moderators,
+			Since:   &since,
+		})
+	}
+	if emailService.Reputation != nil {
+		filters = append(filters, nostr.Filter{
+			Kinds:   []int{nostr.KindReporting},
+			Authors: hexPubkeys,
+			Since:   &since,
+		})
+	}
+	if config.NotifyFollowers {
+		filters = append(filters, nostr.Filter{
+			Kinds: []int{nostr.KindFollowList},
+			Tags:  nostr.TagMap{"p": hexPubkeys},
+			Since: &since,
+		})
+	}
+	return filters
+}
+
+// noteFetchTimeout bounds how long we wait for relays when resolving a referenced event
+const noteFetchTimeout = 10 * time.Second
+
+// fetchEventByID fetches a single event from the given relays
+func fetchEventByID(eventID string, pool *nostr.SimplePool, relays []string) (*nostr.Event, error) {
+	event, err := fetchEvent(nostr.Filter{IDs: []string{eventID}}, pool, relays)
+	if err != nil {
+		return nil, fmt.Errorf("event %s: %v", eventID, err)
+	}
+	return event, nil
+}
+
+// fetchEvent fetches the first event matching a filter from the given relays
+func fetchEvent(filter nostr.Filter, pool *nostr.SimplePool, relays []string) (*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), noteFetchTimeout)
+	defer cancel()
+
+	result := pool.QuerySingle(ctx, relays, filter)
+	if result == nil || result.Event == nil {
+		return nil, fmt.Errorf("not found on relays")
+	}
+	return result.Event, nil
+}
+
 // processEvent handles incoming nostr events
-func processEvent(evt nostr.RelayEvent, npubToUser map[string]User, hexToUser map[string]User, client *mongo.Client, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+func processEvent(evt nostr.RelayEvent, pool *nostr.SimplePool, npubToUser map[string]User, hexToUser map[string]User, client *mongo.Client, config *Config, sqliteDB *sql.DB, emailService *EmailService, spamFilter *SpamFilter) {
 	// Check if this is an event (not a notice or other message type)
 	if evt.Event == nil {
 		return
@@ -435,14 +1324,18 @@ func processEvent(evt nostr.RelayEvent, npubToUser map[string]User, hexToUser ma
 
 	event := evt.Event
 
-	// Convert event pubkey to npub for display
-	eventNpub, err := hexToNpub(event.PubKey)
+	// Authors may delete events before relays send them to us
+	deleted, err := emailService.Notes.DeletedBeforeArrival(event)
 	if err != nil {
-		fmt.Printf("⚠️  Warning: Failed to convert event pubkey to npub: %v\n", err)
-		eventNpub = event.PubKey // fallback to hex
+		fmt.Printf("⚠️  Error checking for an earlier deletion: %v\n", err)
+	}
+	if deleted {
+		fmt.Printf("🗑️  Skipping event %s, deleted by its author before it arrived\n", event.ID)
+		return
 	}
+
 	// Check if this note has already been processed
-	alreadyProcessed, err := isNoteProcessed(sqliteDB, event.ID)
+	alreadyProcessed, err := emailService.Notes.IsNoteProcessed(event.ID)
 	if err != nil {
 		fmt.Printf("⚠️  Error checking if note is processed: %v\n", err)
 		return
@@ -452,20 +1345,84 @@ func processEvent(evt nostr.RelayEvent, npubToUser map[string]User, hexToUser ma
 		return
 	}
 
-	// Handle NIP-4 encrypted direct messages only
-	if event.Kind == 4 {
-		matched := false
-		for _, user := range npubToUser {
-			if isDirectMessageForUser(event, user) {
-				fmt.Printf("📨 DM for %s from %s\n", user.Username, eventNpub)
-				processDirectMessage(event, user, npubToUser, client, config, sqliteDB, emailService)
-				matched = true
+	if filterTimestamp(event, config.Timestamps) {
+		return
+	}
+
+	// Relays may still send old versions of replaceable and addressable events
+	superseded, err := recordReplaceableVersion(sqliteDB, event)
+	if err != nil {
+		fmt.Printf("⚠️  Error checking replaceable event version: %v\n", err)
+	}
+	if superseded {
+		fmt.Printf("⏭️  Skipping superseded version %s of %s\n", event.ID, replaceableAddress(event))
+		return
+	}
+
+	if filterSpam(event, spamFilter, sqliteDB, emailService.Notes) {
+		return
+	}
+
+	// Keep moderation labels current
+	if event.Kind == nostr.KindLabel && emailService.Labels != nil {
+		emailService.Labels.Update(event)
+		return
+	}
+	if filterLabeled(event, emailService.Labels, emailService.Notes) {
+		return
+	}
+
+	// Keep our users' mute lists current
+	if event.Kind == nostr.KindMuteList && emailService.Mutes != nil {
+		muted := emailService.Mutes.Update(event)
+		if emailService.Reputation != nil {
+			for _, pubkey := range muted {
+				if err := emailService.Reputation.RecordUnsubscribe(pubkey); err != nil {
+					fmt.Printf("⚠️  %v\n", err)
+				}
 			}
 		}
-		if !matched {
-			fmt.Printf("ℹ️  No matching recipient for DM from %s\n", eventNpub)
+		return
+	}
+
+	// Shadow-banned senders get no further; mute lists and labels above may
+	// still be theirs
+	if filterShadowBanned(event, emailService) {
+		return
+	}
+
+	// Reports by our users count against the reputation of the reported
+	if event.Kind == nostr.KindReporting && emailService.Reputation != nil {
+		processUserReport(event, hexToUser, emailService.Reputation, emailService.Notes)
+	}
+
+	// Keep our users' follow lists current for the web of trust
+	if event.Kind == nostr.KindFollowList && emailService.Trust != nil {
+		if _, monitored := hexToUser[event.PubKey]; monitored {
+			emailService.Trust.Graph.Update(event)
 		}
 	}
+
+	// Collect new followers of our users
+	if event.Kind == nostr.KindFollowList && config.NotifyFollowers {
+		processFollowList(event, hexToUser, sqliteDB, emailService)
+	}
+
+	// Handle deletions of events we emailed about or are about to
+	if event.Kind == nostr.KindDeletion && config.RecordDeletions {
+		processDeletion(event, emailService)
+	}
+
+	// Turn the event into notifications
+	dispatchEvent(event, &handlerContext{
+		Pool:       pool,
+		NpubToUser: npubToUser,
+		HexToUser:  hexToUser,
+		Client:     client,
+		Config:     config,
+		DB:         sqliteDB,
+		Email:      emailService,
+	})
 }
 
 func displayEmailNotification(event *nostr.Event, user User, relayURL string, emailContent string) {
@@ -481,22 +1438,24 @@ func displayEmailNotification(event *nostr.Event, user User, relayURL string, em
 	fmt.Printf("   Event: %s | %s\n", event.ID, createdTime.Format("15:04:05"))
 }
 
-// isDirectMessageForUser checks if a kind 4 event is a direct message for the user
-func isDirectMessageForUser(event *nostr.Event, user User) bool {
-	// Convert user's npub to hex for comparison
-	userHexPubkey, err := npubToHex(user.NostrNpub)
-	if err != nil {
-		fmt.Printf("⚠️  Warning: Failed to convert user npub to hex: %v\n", err)
-		return false
-	}
-
-	// For NIP-4, check if the user's hex pubkey is in the p tags
+// directMessageRecipients returns the users a kind 4 event is addressed to.
+// Tags carry hex pubkeys, so they are looked up in the hex index of users;
+// npubs are only for display. Users sharing an email address get one email.
+func directMessageRecipients(event *nostr.Event, hexToUser map[string]User) []User {
+	notified := make(map[string]bool)
+	var recipients []User
 	for _, tag := range event.Tags {
-		if len(tag) >= 2 && tag[0] == "p" && tag[1] == userHexPubkey {
-			return true
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		user, exists := hexToUser[strings.ToLower(tag[1])]
+		if !exists || notified[user.Email] {
+			continue
 		}
+		notified[user.Email] = true
+		recipients = append(recipients, user)
 	}
-	return false
+	return recipients
 }
 
 // processDirectMessage handles processing of NIP-4 encrypted direct messages
@@ -515,33 +1474,117 @@ func processDirectMessage(event *nostr.Event, user User, npubToUser map[string]U
 		eventNpub = event.PubKey // fallback to hex
 	}
 
-	// Check if sender is in our list of valid npubs (instead of database lookup)
-	senderUser, exists := npubToUser[eventNpub]
-	if !exists {
+	// Senders must be our users, or have a verified NIP-05 identifier
+	senderNIP5, verified := emailService.verifySender(event.PubKey)
+	if !verified {
 		fmt.Printf("⚠️  Skipping DM from unverified user: %s\n", eventNpub)
 		return
 	}
 
-	senderNIP5 := fmt.Sprintf("%s@trustroots.org", senderUser.Username)
 	fmt.Printf("✅ Verified sender: %s -> %s\n", eventNpub, senderNIP5)
 
 	// Create a notification event with placeholder content (since we can't decrypt)
 	notificationEvent := *event
 	notificationEvent.Content = "[Encrypted Direct Message - Content not available]"
 
-	// Send email notification
-	err = emailService.ProcessNostrDirectMessage(&notificationEvent, user, senderNIP5, eventNpub)
-	if err != nil {
-		fmt.Printf("❌ Failed to send email to %s: %v\n", user.Username, err)
-	} else {
-		fmt.Printf("📧 Email sent to %s\n", user.Username)
+	// DMs addressed to the daemon's own key can be decrypted with our nsec,
+	// whichever npub of its user the key is. Only that user reads them: other
+	// users p-tagged by the same DM get the placeholder.
+	decrypted := false
+	if daemonHexPubkey, err := npubToHex(config.SenderNpub); err == nil && isDaemonKey(user, daemonHexPubkey) && event.Tags.FindWithValue("p", daemonHexPubkey) != nil {
+		plaintext, err := decryptDirectMessage(event, config.SenderNsec)
+		if err != nil {
+			fmt.Printf("⚠️  Failed to decrypt DM from %s: %v\n", eventNpub, err)
+		} else {
+			notificationEvent.Content = plaintext
+			decrypted = true
+		}
+	}
+
+	// The notification shows other content than the DM, keep the DM as received
+	emailService.storeEvent(event)
+
+	// Send email notification, unless Trustroots emails about the message
+	sender, isUser := npubToUser[eventNpub]
+	if !isUser || !emailService.crossReferenceThread(event, sender, user) {
+		err = emailService.ProcessNostrDirectMessage(&notificationEvent, user, senderNIP5, eventNpub, decrypted)
+		if err != nil {
+			fmt.Printf("❌ Failed to send email to %s: %v\n", user.Username, err)
+		} else {
+			fmt.Printf("📧 Email sent to %s\n", user.Username)
+		}
 	}
 
 	// Mark this note as processed
-	err = markNoteProcessed(sqliteDB, event.ID, "relay", user.Email)
+	err = emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", user.Email)
 	if err != nil {
 		fmt.Printf("⚠️  Error marking DM as processed: %v\n", err)
 	}
+	if err := emailService.Notes.RecordMatchType(event.ID, user.Email, matchDirectMessage); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+	if err := emailService.Notes.RecordThreadID(event.ID, user.Email, threadID(event)); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
+
+// isDaemonKey reports whether a user was matched by the daemon's own key
+func isDaemonKey(user User, daemonHexPubkey string) bool {
+	userHexPubkey, err := npubToHex(user.NostrNpub)
+	return err == nil && userHexPubkey == daemonHexPubkey
+}
+
+// sendTestDirectMessage sends a NIP-4 direct message from the sender key to an npub
+func sendTestDirectMessage(config *Config, recipientNpub, message string) error {
+	if recipientNpub == "" || message == "" {
+		return fmt.Errorf("--send-to-npub and --msg are required with --test")
+	}
+
+	recipientHex, err := npubToHex(recipientNpub)
+	if err != nil {
+		return fmt.Errorf("invalid recipient npub: %v", err)
+	}
+	eventID, published, err := sendDirectMessage(config, recipientHex, message)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("📤 Test DM %s published to %d/%d relays\n", eventID, published, len(config.Relays))
+	return nil
+}
+
+// sendDirectMessage publishes a NIP-4 direct message from the sender key and
+// returns its event ID and how many relays accepted it
+func sendDirectMessage(config *Config, recipientHex, message string) (string, int, error) {
+	privateKeyHex, err := nsecToHex(config.SenderNsec)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to decode sender nsec: %v", err)
+	}
+
+	sharedSecret, err := nip04.ComputeSharedSecret(recipientHex, privateKeyHex)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+	ciphertext, err := nip04.Encrypt(message, sharedSecret)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to encrypt message: %v", err)
+	}
+
+	event := nostr.Event{
+		Kind:      nostr.KindEncryptedDirectMessage,
+		Content:   ciphertext,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", recipientHex}},
+	}
+	if err := event.Sign(privateKeyHex); err != nil {
+		return "", 0, fmt.Errorf("failed to sign event: %v", err)
+	}
+
+	publisher := NewRelayPublisher()
+	published := publisher.Publish(context.Background(), config.Relays, event)
+	if published == 0 {
+		return event.ID, 0, fmt.Errorf("no relay accepted the event")
+	}
+	return event.ID, published, nil
 }
 
 // validateNIP4Message validates that a message appears to be NIP-4 formatted
@@ -552,6 +1595,26 @@ func validateNIP4Message(event *nostr.Event) bool {
 	return err == nil
 }
 
+// decryptDirectMessage decrypts the content of a NIP-4 direct message sent to the daemon's key
+func decryptDirectMessage(event *nostr.Event, nsec string) (string, error) {
+	privateKeyHex, err := nsecToHex(nsec)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode sender nsec: %v", err)
+	}
+
+	sharedSecret, err := nip04.ComputeSharedSecret(event.PubKey, privateKeyHex)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+
+	plaintext, err := nip04.Decrypt(event.Content, sharedSecret)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt content: %v", err)
+	}
+
+	return plaintext, nil
+}
+
 // Use the library's built-in functionality for key conversion
 
 // min returns the minimum of two integers
@@ -565,10 +1628,7 @@ func min(a, b int) int {
 // getConfig returns a basic config for MongoDB connection
 func getConfig() Config {
 	return Config{
-		MongoDB: struct {
-			URI      string
-			Database string
-		}{
+		MongoDB: MongoDBConfig{
 			URI:      getEnvOrDefault("MONGODB_URI", "mongodb://localhost:27017"),
 			Database: getEnvOrDefault("MONGODB_DATABASE", "trustroots"),
 		},
@@ -576,24 +1636,38 @@ func getConfig() Config {
 }
 
 // initSQLiteDB initializes the SQLite database for tracking processed notes
-func initSQLiteDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./processed_notes.db")
+func initSQLiteDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open SQLite database: %v", err)
 	}
 
-	// Create table if it doesn't exist
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS processed_notes (
-		event_id TEXT PRIMARY KEY,
-		processed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		relay_url TEXT,
-		user_email TEXT
-	);`
+	// Every connection to ":memory:" is a separate database
+	if path == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
 
-	_, err = db.Exec(createTableSQL)
+	// Existing databases keep their schema until `nostremail migrate` is run
+	var tableCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'processed_notes'").Scan(&tableCount)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create table: %v", err)
+		return nil, fmt.Errorf("failed to inspect schema: %v", err)
+	}
+
+	if tableCount > 0 {
+		version, err := getSchemaVersion(db)
+		if err != nil {
+			return nil, err
+		}
+		if version < latestSchemaVersion() {
+			log.Printf("Warning: %s uses schema version %d (latest is %d), run `nostremail migrate` to upgrade", path, version, latestSchemaVersion())
+		}
+		return db, nil
+	}
+
+	// New databases are created by running all migrations
+	if err := createSQLiteSchema(db); err != nil {
+		return nil, err
 	}
 
 	return db, nil
@@ -609,10 +1683,50 @@ func isNoteProcessed(db *sql.DB, eventID string) (bool, error) {
 	return count > 0, nil
 }
 
-// markNoteProcessed marks a note as processed
-func markNoteProcessed(db *sql.DB, eventID, relayURL, userEmail string) error {
-	_, err := db.Exec("INSERT OR IGNORE INTO processed_notes (event_id, relay_url, user_email) VALUES (?, ?, ?)",
-		eventID, relayURL, userEmail)
+// isNotificationProcessed reports whether a recipient was already notified about an event
+func isNotificationProcessed(db *sql.DB, eventID, userEmail string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM processed_notes WHERE event_id = ? AND user_email = ?", eventID, userEmail).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if notification is processed: %v", err)
+	}
+	return count > 0, nil
+}
+
+// recordMatchType stores how an event matched a recipient it was processed for
+func recordMatchType(db *sql.DB, eventID, userEmail, matchType string) error {
+	if matchType == "" {
+		return nil
+	}
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < schemaMatchTypes {
+		return nil
+	}
+	_, err = db.Exec("UPDATE processed_notes SET match_type = ? WHERE event_id = ? AND user_email = ?", matchType, eventID, userEmail)
+	if err != nil {
+		return fmt.Errorf("failed to record match type: %v", err)
+	}
+	return nil
+}
+
+// markNoteProcessed marks a note as processed. The author is kept so later
+// deletions can be checked against it.
+func markNoteProcessed(db *sql.DB, eventID, authorPubkey, relayURL, userEmail string) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < schemaDeletions {
+		// Databases that were not migrated yet have no author column
+		_, err = db.Exec("INSERT OR IGNORE INTO processed_notes (event_id, relay_url, user_email) VALUES (?, ?, ?)",
+			eventID, relayURL, userEmail)
+	} else {
+		_, err = db.Exec("INSERT OR IGNORE INTO processed_notes (event_id, author_pubkey, relay_url, user_email) VALUES (?, ?, ?, ?)",
+			eventID, authorPubkey, relayURL, userEmail)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to mark note as processed: %v", err)
 	}
@@ -643,47 +1757,136 @@ func getHexPubkeysFromUsers(npubToUser map[string]User) []string {
 	return hexPubkeys
 }
 
-// npubToHex converts an npub string to hex format
-func npubToHex(npub string) (string, error) {
-	// Decode bech32
-	hrp, data, err := bech32.Decode(npub)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode bech32: %v", err)
+// newConfiguredEmailService creates the email service with the settings of
+// config that decide what is sent and when, shared by the daemon and the
+// simulate command; stores and relay-backed services are set up by the caller
+func newConfiguredEmailService(config *Config) (*EmailService, error) {
+	emailService := NewEmailService(
+		config.SMTP.Host,
+		config.SMTP.Port,
+		config.SMTP.Username,
+		config.SMTP.Password,
+		config.SenderEmail,
+		config.SMTP.FromName,
+	)
+	emailService.Transport = newConfiguredTransport(config)
+	emailService.SendDelay = config.SendDelay
+	emailService.QuietHours = config.QuietHours
+	emailService.DigestWindow = config.Digest
+	if config.SendRateLimit.Enabled() {
+		emailService.SendLimit = NewSendLimiter(config.SendRateLimit)
 	}
-	if hrp != "npub" {
-		return "", fmt.Errorf("invalid human readable part: %s", hrp)
+	if config.UserRateLimit.Enabled() {
+		emailService.RateLimit = NewUserRateLimiter(config.UserRateLimit)
 	}
-
-	// Convert from 5-bit groups to 8-bit groups
-	converted, err := bech32.ConvertBits(data, 5, 8, false)
+	signer, err := NewNotificationSigner(config.SenderNsec)
 	if err != nil {
-		return "", fmt.Errorf("failed to convert bits: %v", err)
+		return nil, err
 	}
+	emailService.Signer = signer
+	emailService.SenderAllowlist = senderAllowlist(config)
+	emailService.SubjectStrategies = config.Subjects
+	emailService.AnnotateLanguage = config.AnnotateLanguage
+	emailService.MaxContentLength = config.MaxContentLength
+	emailService.AttachEvents = config.AttachEvents
+	return emailService, nil
+}
 
-	// Convert to hex string
-	return hex.EncodeToString(converted), nil
+// configureUserServices sets up the parts of the email service that depend on
+// the users and relays: names, avatars, sender verification, the web of trust
+// and digests, which users may choose and the policies may hold notifications
+// for. emailService.Notes must be set.
+func configureUserServices(emailService *EmailService, config *Config, pool *nostr.SimplePool, relays []string, npubToUser, hexToUser map[string]User, client *mongo.Client) {
+	// Plain text preferences of the users, see plaintext.go
+	emailService.Users = hexToUser
+
+	// Show nostr: profile references in emails as @names
+	emailService.Names = NewProfileNames(hexToUser, pool, relays)
+	emailService.Names.Cache = emailService.Cache
+	if config.SenderAvatars {
+		emailService.Avatars = NewSenderAvatars(emailService.Names)
+	}
+	emailService.ZapProviders = NewZapProviders(emailService.Names)
+	if config.VerifyNIP05 {
+		emailService.NIP05 = NewNIP05Verifier(emailService.Names, config.NIP05Policy)
+		emailService.NIP05.Cache = emailService.Cache
+	}
+	emailService.Senders = newSenderVerifier(npubToUser, client, config, emailService.NIP05)
+	if len(config.TrustPolicy) > 0 {
+		emailService.Trust = &WebOfTrust{
+			Graph:  loadFollowGraph(pool, relays, getHexPubkeysFromUsers(npubToUser)),
+			Policy: config.TrustPolicy,
+		}
+	}
+	emailService.Digest = emailService.Notes
 }
 
-// hexToNpub converts a hex pubkey to npub format
-func hexToNpub(hexPubkey string) (string, error) {
-	// Decode hex to bytes
-	pubkeyBytes, err := hex.DecodeString(hexPubkey)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode hex: %v", err)
+// senderAllowlist returns the configured sender allowlist as a set, or nil
+// when every sender is allowed
+func senderAllowlist(config *Config) map[string]bool {
+	if len(config.SenderAllowlist) == 0 {
+		return nil
+	}
+	allowlist := make(map[string]bool, len(config.SenderAllowlist))
+	for _, pubkey := range config.SenderAllowlist {
+		allowlist[pubkey] = true
 	}
+	return allowlist
+}
 
-	// Convert from 8-bit groups to 5-bit groups
-	converted, err := bech32.ConvertBits(pubkeyBytes, 8, 5, true)
-	if err != nil {
-		return "", fmt.Errorf("failed to convert bits: %v", err)
+// parsePubkeyList reads a comma-separated list of npub or hex pubkeys as hex
+func parsePubkeyList(value string) ([]string, error) {
+	var pubkeys []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, "npub1") {
+			hexPubkey, err := npubToHex(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pubkey %s: %v", entry, err)
+			}
+			entry = hexPubkey
+		}
+		if !nostr.IsValidPublicKey(entry) {
+			return nil, fmt.Errorf("invalid pubkey %s", entry)
+		}
+		pubkeys = append(pubkeys, strings.ToLower(entry))
 	}
+	return pubkeys, nil
+}
+
+// npubToHex converts an npub string to hex format, checking the bech32
+// checksum, the npub prefix and the 32-byte payload
+func npubToHex(npub string) (string, error) {
+	return decodeBech32Key(npub, "npub")
+}
 
-	// Encode as bech32
-	npub, err := bech32.Encode("npub", converted)
+// nsecToHex converts an nsec string to hex format, checked like npubToHex
+func nsecToHex(nsec string) (string, error) {
+	return decodeBech32Key(nsec, "nsec")
+}
+
+// decodeBech32Key decodes a NIP-19 key with a prefix to hex; nip19.Decode
+// verifies the checksum and that the key is 32 bytes
+func decodeBech32Key(key, prefix string) (string, error) {
+	hrp, value, err := nip19.Decode(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to encode bech32: %v", err)
+		return "", fmt.Errorf("failed to decode bech32: %v", err)
 	}
+	if hrp != prefix {
+		return "", fmt.Errorf("invalid human readable part: %s", hrp)
+	}
+	return value.(string), nil
+}
 
+// hexToNpub converts a hex pubkey to npub format
+func hexToNpub(hexPubkey string) (string, error) {
+	npub, err := nip19.EncodePublicKey(hexPubkey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode npub: %v", err)
+	}
 	return npub, nil
 }
 
@@ -696,7 +1899,7 @@ func displaySummary(users []User, validNpubs, invalidNpubs, emptyNpubs []User) {
 
 	for _, user := range users {
 		// Truncate long npubs for display
-		npub := user.NostrNpub
+		npub := strings.Join(user.Npubs(), ", ")
 		if len(npub) > 80 {
 			npub = npub[:77] + "..."
 		}
@@ -707,14 +1910,14 @@ func displaySummary(users []User, validNpubs, invalidNpubs, emptyNpubs []User) {
 	fmt.Println("\n\nVALID NOSTR NPUBS:")
 	fmt.Println("==================")
 	for i, user := range validNpubs {
-		fmt.Printf("%d. %s | %s | %s\n", i+1, user.Username, user.Email, user.NostrNpub)
+		fmt.Printf("%d. %s | %s | %s\n", i+1, user.Username, user.Email, strings.Join(user.Npubs(), ", "))
 	}
 
 	// Display invalid npubs
 	fmt.Println("\n\nINVALID/OTHER NPUBS:")
 	fmt.Println("===================")
 	for i, user := range invalidNpubs {
-		fmt.Printf("%d. %s | %s | %s\n", i+1, user.Username, user.Email, user.NostrNpub)
+		fmt.Printf("%d. %s | %s | %s\n", i+1, user.Username, user.Email, strings.Join(user.Npubs(), ", "))
 	}
 
 	// Display empty npubs
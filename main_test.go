@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// encodeBech32 encodes bytes as bech32 with a prefix, of any length
+func encodeBech32(t *testing.T, prefix string, data []byte) string {
+	t.Helper()
+	converted, err := bech32.ConvertBits(data, 8, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := bech32.Encode(prefix, converted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// withTypo changes the last character of a bech32 string, which is part of
+// the checksum
+func withTypo(s string) string {
+	if strings.HasSuffix(s, "q") {
+		return s[:len(s)-1] + "p"
+	}
+	return s[:len(s)-1] + "q"
+}
+
+func TestNpubToHex(t *testing.T) {
+	hexPubkey := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	npub, err := hexToNpub(hexPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if npub != "npub180cvv07tjdrrgpa0j7j7tmnyl2yr6yr7l8j4s3evf6u64th6gkwsyjh6w6" {
+		t.Errorf("hexToNpub = %s", npub)
+	}
+	if got, err := npubToHex(npub); err != nil || got != hexPubkey {
+		t.Errorf("npubToHex(%s) = %s, %v, want %s", npub, got, err, hexPubkey)
+	}
+	if !isValidNpub(npub) {
+		t.Errorf("isValidNpub(%s) = false", npub)
+	}
+}
+
+func TestNpubToHexRejectsInvalidNpubs(t *testing.T) {
+	key, _ := hex.DecodeString("3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d")
+	npub := encodeBech32(t, "npub", key)
+	nsec, _ := nip19.EncodePrivateKey(hex.EncodeToString(key))
+	note, _ := nip19.EncodeNote(hex.EncodeToString(key))
+
+	tests := []struct {
+		name, npub string
+	}{
+		{"nsec", nsec},
+		{"note", note},
+		{"nprofile", encodeBech32(t, "nprofile", append([]byte{0, 32}, key...))},
+		{"bad checksum", withTypo(npub)},
+		{"swapped characters", npub[:10] + npub[11:12] + npub[10:11] + npub[12:]},
+		{"short payload", encodeBech32(t, "npub", key[:31])},
+		{"long payload", encodeBech32(t, "npub", append(key, 0))},
+		{"truncated", npub[:len(npub)-5]},
+		{"prefix only", "npub1"},
+		{"hex", hex.EncodeToString(key)},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := npubToHex(tt.npub); err == nil {
+				t.Errorf("npubToHex(%q) = %s, want an error", tt.npub, got)
+			}
+			if isValidNpub(tt.npub) {
+				t.Errorf("isValidNpub(%q) = true", tt.npub)
+			}
+		})
+	}
+}
+
+func TestNsecToHex(t *testing.T) {
+	secret := "67dea2ed018072d675f5415ecfaed7d2597555e202d85b3d65ea4e58d2d92ffa"
+	nsec, err := nip19.EncodePrivateKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := nsecToHex(nsec); err != nil || got != secret {
+		t.Errorf("nsecToHex(%s) = %s, %v, want %s", nsec, got, err, secret)
+	}
+
+	key, _ := hex.DecodeString(secret)
+	npub, _ := nip19.EncodePublicKey(secret)
+	for name, invalid := range map[string]string{
+		"npub":          npub,
+		"bad checksum":  withTypo(nsec),
+		"short payload": encodeBech32(t, "nsec", key[:16]),
+		"long payload":  encodeBech32(t, "nsec", append(key, key...)),
+	} {
+		if got, err := nsecToHex(invalid); err == nil {
+			t.Errorf("%s: nsecToHex(%q) = %s, want an error", name, invalid, got)
+		}
+	}
+}
+
+func TestCategorizeUsers(t *testing.T) {
+	valid, _ := hexToNpub(strings.Repeat("a", 64))
+	other, _ := hexToNpub(strings.Repeat("b", 64))
+	typo := withTypo(valid)
+
+	users := []User{
+		{Username: "valid", NostrNpub: valid},
+		{Username: "typo", NostrNpub: typo},
+		{Username: "heuristic", NostrNpub: "npub1" + strings.Repeat("q", 58)},
+		{Username: "empty", NostrNpub: " "},
+		{Username: "second key", NostrNpub: typo, NostrNpubs: []string{other}},
+	}
+	validNpubs, invalidNpubs, emptyNpubs := categorizeUsers(users)
+
+	usernames := func(users []User) string {
+		var names []string
+		for _, user := range users {
+			names = append(names, user.Username)
+		}
+		return strings.Join(names, ",")
+	}
+	if got := usernames(validNpubs); got != "valid,second key" {
+		t.Errorf("valid = %s", got)
+	}
+	if got := usernames(invalidNpubs); got != "typo,heuristic" {
+		t.Errorf("invalid = %s", got)
+	}
+	if got := usernames(emptyNpubs); got != "empty" {
+		t.Errorf("empty = %s", got)
+	}
+}
+
+func TestProcessDirectMessageDecryptsOnlyForDaemonKeyUser(t *testing.T) {
+	daemonNsec, daemonHexPubkey := testKeys(t)
+	daemonNpub, _ := nip19.EncodePublicKey(daemonHexPubkey)
+	config := &Config{SenderNpub: daemonNpub, SenderNsec: daemonNsec}
+	senderNsec, senderHexPubkey := testKeys(t)
+	senderSecret, _ := nsecToHex(senderNsec)
+	_, otherHexPubkey := testKeys(t)
+
+	operator := testUser(t, "operator", "operator@example.org", testKey("a"), daemonHexPubkey)
+	other := testUser(t, "other", "other@example.org", otherHexPubkey)
+	sender := testUser(t, "sender", "sender@example.org", senderHexPubkey)
+	index := NewUserIndex([]User{operator, other, sender})
+
+	// Encrypted to the daemon, but p-tagging another user as well
+	sharedSecret, err := nip04.ComputeSharedSecret(daemonHexPubkey, senderSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := nip04.Encrypt("The door code is 1234", sharedSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &nostr.Event{
+		Kind:      nostr.KindEncryptedDirectMessage,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", daemonHexPubkey}, {"p", otherHexPubkey}},
+		Content:   content,
+	}
+	if err := event.Sign(senderSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	es := NewEmailService("localhost", 25, "user", "password", "from@example.org", "From")
+	es.DryRun = true
+	es.Notes = &SQLiteNoteStore{DB: db}
+	es.Senders = NewMongoVerifier(index.NpubToUser, nil, "")
+
+	// The handler calls processDirectMessage once per matched npub
+	for _, hexPubkey := range []string{daemonHexPubkey, otherHexPubkey} {
+		processDirectMessage(event, index.HexToUser[hexPubkey], index.NpubToUser, nil, config, db, es)
+	}
+	if len(es.DryRunJobs) != 2 {
+		t.Fatalf("jobs = %+v, want one email per recipient", es.DryRunJobs)
+	}
+	for _, job := range es.DryRunJobs {
+		leaked := strings.Contains(job.Text, "door code") || strings.Contains(job.HTML, "door code")
+		switch job.To {
+		case operator.Email:
+			if !leaked {
+				t.Errorf("the daemon key user did not get the message: %s", job.Text)
+			}
+		case other.Email:
+			if leaked {
+				t.Errorf("decrypted the message for another user: %s", job.Text)
+			}
+		default:
+			t.Errorf("emailed %s", job.To)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxMediaItems bounds how many attachments an email shows
+const maxMediaItems = 6
+
+// mediaURLPattern finds http(s) URLs in content
+var mediaURLPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// mediaExtensions maps file extensions of linked media to their MIME type
+var mediaExtensions = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+}
+
+// MediaItem is an image or video attached to an event
+type MediaItem struct {
+	URL      string
+	MimeType string
+	Alt      string
+}
+
+// IsImage reports whether the item can be shown as a thumbnail
+func (m MediaItem) IsImage() bool {
+	return strings.HasPrefix(m.MimeType, "image/")
+}
+
+// Label describes the item for links, e.g. "video" or its alt text
+func (m MediaItem) Label() string {
+	if m.Alt != "" {
+		return m.Alt
+	}
+	if strings.HasPrefix(m.MimeType, "video/") {
+		return "Video"
+	}
+	return "Image"
+}
+
+// mediaType returns the MIME type of a media URL by its extension, or ""
+func mediaType(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return ""
+	}
+	return mediaExtensions[strings.ToLower(path.Ext(parsed.Path))]
+}
+
+// eventMedia returns the images and videos of an event: those described by
+// NIP-92 imeta tags and media URLs in the content, once each
+func eventMedia(event *nostr.Event) []MediaItem {
+	var items []MediaItem
+	seen := make(map[string]bool)
+	add := func(item MediaItem) {
+		if seen[item.URL] || len(items) >= maxMediaItems {
+			return
+		}
+		seen[item.URL] = true
+		items = append(items, item)
+	}
+
+	// ["imeta", "url https://…", "m image/jpeg", "alt A photo", …]
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "imeta" {
+			continue
+		}
+		var item MediaItem
+		for _, entry := range tag[1:] {
+			key, value, _ := strings.Cut(entry, " ")
+			switch key {
+			case "url":
+				item.URL = value
+			case "m":
+				item.MimeType = value
+			case "alt":
+				item.Alt = sanitizeLine(value)
+			}
+		}
+		if item.MimeType == "" {
+			item.MimeType = mediaType(item.URL)
+		}
+		isMedia := strings.HasPrefix(item.MimeType, "image/") || strings.HasPrefix(item.MimeType, "video/")
+		if parsed, err := url.Parse(item.URL); err == nil && isMedia && (parsed.Scheme == "http" || parsed.Scheme == "https") {
+			add(item)
+		}
+	}
+
+	for _, link := range mediaURLPattern.FindAllString(event.Content, -1) {
+		link = strings.TrimRight(link, ".,;:!?)")
+		if mimeType := mediaType(link); mimeType != "" {
+			add(MediaItem{URL: link, MimeType: mimeType})
+		}
+	}
+	return items
+}
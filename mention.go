@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip27"
+)
+
+// Mention matching strategies, from fewest to most false positives
+const (
+	mentionMatchingStrict   = "strict"   // p tags only
+	mentionMatchingStandard = "standard" // plus nostr: URIs and mention aliases
+	mentionMatchingLoose    = "loose"    // plus Trustroots usernames as whole words
+)
+
+// parseMentionMatching validates a mention matching strategy, defaulting to standard
+func parseMentionMatching(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", mentionMatchingStandard:
+		return mentionMatchingStandard, nil
+	case mentionMatchingStrict:
+		return mentionMatchingStrict, nil
+	case mentionMatchingLoose:
+		return mentionMatchingLoose, nil
+	}
+	return "", fmt.Errorf("invalid mention matching %q, expected strict, standard or loose", value)
+}
+
+// Match types, from strongest to weakest. Each recipient of an event is
+// notified once, and the strongest way the event matched them is recorded.
+const (
+	matchDirectMessage = "direct_message"
+	matchQuote         = "quote" // see quote.go
+	matchPTag          = "p_tag"
+	matchThread        = "thread" // author of the event replied to, see comment.go
+	matchURI           = "nostr_uri"
+	matchAlias         = "alias"
+	matchUsername      = "username"
+)
+
+// matchStrength orders match types, higher is stronger
+var matchStrength = map[string]int{
+	matchDirectMessage: 7,
+	matchQuote:         6,
+	matchPTag:          5,
+	matchThread:        4,
+	matchURI:           3,
+	matchAlias:         2,
+	matchUsername:      1,
+}
+
+// MentionMatches records how an event mentions each pubkey
+type MentionMatches struct {
+	Pubkeys []string          // in order of first match
+	Types   map[string]string // strongest match type by pubkey
+}
+
+// newMentionMatches creates an empty set of matches
+func newMentionMatches() *MentionMatches {
+	return &MentionMatches{Types: make(map[string]string)}
+}
+
+// Add records a match, keeping the stronger type when the pubkey already matched
+func (m *MentionMatches) Add(pubkey, matchType string) {
+	current, exists := m.Types[pubkey]
+	if !exists {
+		m.Pubkeys = append(m.Pubkeys, pubkey)
+	}
+	if !exists || matchStrength[matchType] > matchStrength[current] {
+		m.Types[pubkey] = matchType
+	}
+}
+
+// TypeFor returns how a user was matched
+func (m *MentionMatches) TypeFor(user User) string {
+	hexPubkey, err := npubToHex(user.NostrNpub)
+	if err != nil {
+		return ""
+	}
+	return m.Types[hexPubkey]
+}
+
+// Mention describes where a user was mentioned, for the mention email
+type Mention struct {
+	Context       string            // what the user was mentioned in, e.g. "a comment"
+	Action        string            // optional, defaults to "mentioned you in <Context>"
+	Title         string            // optional title of the mentioning event
+	TitleURL      string            // optional link for the title, e.g. to a channel
+	URL           string            // link to the mentioning event
+	Excerpt       string            // optional shortened content, quoted instead of the full event
+	ParentContent string            // optional content the mentioning event replies to
+	ParentURL     string            // optional link to the parent
+	ParentLabel   string            // optional, defaults to "In reply to"
+	Reply         bool              // the event replies to a note of the recipient, see notificationReply
+	Match         string            // how the recipient was matched, e.g. matchPTag
+	Attachments   []EmailAttachment // optional files, e.g. a calendar invite
+}
+
+// contentMentions returns the profiles mentioned in content as NIP-21 URIs
+// (nostr:npub1… or nostr:nprofile1…, see NIP-27), with nprofile relay hints
+func contentMentions(content string) []nostr.ProfilePointer {
+	var profiles []nostr.ProfilePointer
+	for block := range nip27.Parse(content) {
+		if profile, ok := block.Pointer.(nostr.ProfilePointer); ok {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles
+}
+
+// aliasPatterns caches the compiled patterns of mentionsAlias, every event is
+// matched against the aliases of all users
+var aliasPatterns sync.Map
+
+// mentionsAlias reports whether content contains one of the aliases as a whole
+// word, case-insensitively. "ana" matches "thanks @Ana!" but not "banana".
+func mentionsAlias(content string, aliases []string) bool {
+	var quoted []string
+	for _, alias := range aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			quoted = append(quoted, regexp.QuoteMeta(alias))
+		}
+	}
+	if len(quoted) == 0 {
+		return false
+	}
+	// \b only knows ASCII word characters, so spell out the unicode boundaries
+	pattern := `(?i)(^|[^\p{L}\p{N}_])(` + strings.Join(quoted, "|") + `)($|[^\p{L}\p{N}_])`
+	compiled, cached := aliasPatterns.Load(pattern)
+	if !cached {
+		compiled, _ = aliasPatterns.LoadOrStore(pattern, regexp.MustCompile(pattern))
+	}
+	return compiled.(*regexp.Regexp).MatchString(content)
+}
+
+// addAliasMatches adds the users whose mention aliases appear in content, and
+// with loose matching also those whose username does
+func addAliasMatches(matches *MentionMatches, content string, hexToUser map[string]User, matching string) {
+	for pubkey, user := range hexToUser {
+		if len(user.MentionAliases) > 0 && mentionsAlias(content, user.MentionAliases) {
+			matches.Add(pubkey, matchAlias)
+		} else if matching == mentionMatchingLoose && user.Username != "" && mentionsAlias(content, []string{user.Username}) {
+			matches.Add(pubkey, matchUsername)
+		}
+	}
+}
+
+// mentionMatches returns the pubkeys an event mentions through p tags and,
+// unless matching is strict, nostr: URIs in its content (many clients only do
+// the latter) and the mention aliases of monitored users.
+func mentionMatches(event *nostr.Event, hexToUser map[string]User, matching string) *MentionMatches {
+	matches := newMentionMatches()
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			matches.Add(strings.ToLower(tag[1]), matchPTag)
+		}
+	}
+	if matching == mentionMatchingStrict {
+		return matches
+	}
+	for _, profile := range contentMentions(event.Content) {
+		matches.Add(profile.PublicKey, matchURI)
+	}
+	addAliasMatches(matches, event.Content, hexToUser, matching)
+	return matches
+}
+
+// mentionFilters matches notes p-tagging our users. Relays only match tags,
+// so with NOSTREMAIL_MENTION_SEARCH it also searches (NIP-50) for what
+// mentionMatches finds in content, see mentionSearchTerms. Only some relays
+// (e.g. wss://relay.nostr.band) support search; notes from relays that ignore
+// it are dropped by mentionMatches when they mention no one.
+func mentionFilters(kinds []int, hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter {
+	filters := []nostr.Filter{{
+		Kinds: kinds,
+		Tags:  nostr.TagMap{"p": hexPubkeys},
+		Since: &since,
+		Until: until,
+	}}
+	if !config.MentionSearch {
+		return filters
+	}
+	for _, term := range mentionSearchTerms(hexPubkeys, hexToUser, config.MentionMatching) {
+		filters = append(filters, nostr.Filter{
+			Kinds:  kinds,
+			Search: term,
+			Since:  &since,
+			Until:  until,
+		})
+	}
+	return filters
+}
+
+// mentionSearchTerms returns what content mentions of users are searched for,
+// by matching strategy: nothing when strict, npubs (of nostr:npub1… URIs) and
+// mention aliases when standard, and also usernames when loose. nprofile URIs
+// encode the pubkey with relay hints, so they cannot be searched for.
+func mentionSearchTerms(hexPubkeys []string, hexToUser map[string]User, matching string) []string {
+	if matching == mentionMatchingStrict {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var terms []string
+	add := func(term string) {
+		term = strings.ToLower(strings.TrimSpace(term))
+		if term != "" && !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	for _, hexPubkey := range hexPubkeys {
+		user, exists := hexToUser[hexPubkey]
+		if !exists {
+			continue
+		}
+		add(user.NostrNpub)
+		for _, alias := range user.MentionAliases {
+			add(alias)
+		}
+		if matching == mentionMatchingLoose {
+			add(user.Username)
+		}
+	}
+	// The same filters for the same users, however the pubkeys are ordered
+	slices.Sort(terms)
+	return terms
+}
+
+// usersForPubkeys returns the monitored users among pubkeys, once each however
+// many of their keys are tagged, and without the event author
+func usersForPubkeys(pubkeys []string, authorPubkey string, hexToUser map[string]User) []User {
+	author, authorIsUser := hexToUser[authorPubkey]
+	seen := make(map[string]bool)
+	var users []User
+	for _, pubkey := range pubkeys {
+		user, exists := hexToUser[pubkey]
+		if !exists || seen[user.Email] || pubkey == authorPubkey {
+			continue
+		}
+		if authorIsUser && sameUser(user, author) {
+			continue // users mentioning another key of theirs
+		}
+		seen[user.Email] = true
+		users = append(users, user)
+	}
+	return users
+}
+
+// notifyMention emails a user about an event that mentions them. The sender
+// must be verified, like for DMs.
+func notifyMention(event *nostr.Event, recipientUser User, mention Mention, npubToUser map[string]User, sqliteDB *sql.DB, emailService *EmailService) {
+	senderNpub, err := hexToNpub(event.PubKey)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert event pubkey to npub: %v\n", err)
+		senderNpub = event.PubKey // fallback to hex
+	}
+
+	if sender, exists := npubToUser[senderNpub]; senderNpub == recipientUser.NostrNpub || (exists && sameUser(sender, recipientUser)) {
+		return // users mentioning themselves
+	}
+	senderNIP5, verified := emailService.verifySender(event.PubKey)
+	if !verified {
+		fmt.Printf("ℹ️  Skipping mention from unverified user: %s\n", senderNpub)
+		return
+	}
+
+	// Every recipient gets at most one email per event, whichever path matched first
+	notified, err := emailService.Notes.IsNotificationProcessed(event.ID, recipientUser.Email)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return
+	}
+	if notified {
+		return
+	}
+
+	fmt.Printf("💬 %s mentioned %s in %s\n", senderNIP5, recipientUser.Username, mention.Context)
+
+	if mention.URL == "" {
+		mention.URL = noteURL(event.ID)
+	}
+
+	err = emailService.ProcessNostrMention(event, recipientUser, senderNIP5, senderNpub, mention)
+	if err != nil {
+		fmt.Printf("❌ Failed to send email to %s: %v\n", recipientUser.Username, err)
+	} else {
+		fmt.Printf("📧 Email sent to %s\n", recipientUser.Username)
+	}
+
+	err = emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", recipientUser.Email)
+	if err != nil {
+		fmt.Printf("⚠️  Error marking mention as processed: %v\n", err)
+	}
+	if err := emailService.Notes.RecordMatchType(event.ID, recipientUser.Email, mention.Match); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+	if err := emailService.Notes.RecordThreadID(event.ID, recipientUser.Email, threadID(event)); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
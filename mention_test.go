@@ -0,0 +1,268 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// testKey returns a hex pubkey made of one repeated character
+func testKey(c string) string {
+	return strings.Repeat(c, 64)
+}
+
+// testUser returns a user with npubs of hex pubkeys, the first one linked as
+// nostrNpub and the others as nostrNpubs
+func testUser(t *testing.T, username, email string, hexPubkeys ...string) User {
+	t.Helper()
+	user := User{ID: username, Username: username, Email: email}
+	for i, hexPubkey := range hexPubkeys {
+		npub, err := nip19.EncodePublicKey(hexPubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			user.NostrNpub = npub
+		} else {
+			user.NostrNpubs = append(user.NostrNpubs, npub)
+		}
+	}
+	return user
+}
+
+func TestMentionsAlias(t *testing.T) {
+	tests := []struct {
+		content string
+		aliases []string
+		want    bool
+	}{
+		{"thanks @Ana!", []string{"ana"}, true},
+		{"Ana, see you", []string{"ana"}, true},
+		{"ana", []string{"ana"}, true},
+		{"a banana", []string{"ana"}, false},
+		{"analysis", []string{"ana"}, false},
+		{"ana_bel", []string{"ana"}, false},
+		{"ana2", []string{"ana"}, false},
+		{"(ana)", []string{"ana"}, true},
+		{"hi anabel", []string{"ana"}, false},
+		{"hi anabel", []string{"ana", "anabel"}, true},
+		{"hi ana bel", []string{"ana bel"}, true},
+		{"Danke Jürgen!", []string{"jürgen"}, true},
+		{"Jürgens Haus", []string{"jürgen"}, false},
+		{"JOSÉ was here", []string{"josé"}, true},
+		{"josés", []string{"josé"}, false},
+		{"merci Zoë", []string{"Zoë"}, true},
+		{"Zoëlle", []string{"Zoë"}, false},
+		{"привет Иван", []string{"иван"}, true},
+		{"Ивановна", []string{"иван"}, false},
+		{"a.b+c", []string{"b+c"}, true}, // aliases are literal
+		{"abbc", []string{"b+c"}, false},
+		{"anything", []string{" ", ""}, false},
+	}
+	for _, tt := range tests {
+		if got := mentionsAlias(tt.content, tt.aliases); got != tt.want {
+			t.Errorf("mentionsAlias(%q, %q) = %v, want %v", tt.content, tt.aliases, got, tt.want)
+		}
+	}
+}
+
+func TestMentionMatches(t *testing.T) {
+	alice := testUser(t, "alice", "alice@example.org", testKey("a"))
+	bob := testUser(t, "bob", "bob@example.org", testKey("b"))
+	carol := testUser(t, "carol", "carol@example.org", testKey("c"))
+	carol.MentionAliases = []string{"caro"}
+	jurgen := testUser(t, "jürgen", "jurgen@example.org", testKey("d"))
+	index := NewUserIndex([]User{alice, bob, carol, jurgen})
+
+	bobNpub, _ := nip19.EncodePublicKey(testKey("b"))
+	event := &nostr.Event{
+		Tags:    nostr.Tags{{"p", strings.ToUpper(testKey("a"))}},
+		Content: "gm nostr:" + bobNpub + ", caro and Jürgen!",
+	}
+
+	tests := []struct {
+		matching string
+		want     map[string]string
+	}{
+		{mentionMatchingStrict, map[string]string{
+			testKey("a"): matchPTag,
+		}},
+		{mentionMatchingStandard, map[string]string{
+			testKey("a"): matchPTag,
+			testKey("b"): matchURI,
+			testKey("c"): matchAlias,
+		}},
+		{mentionMatchingLoose, map[string]string{
+			testKey("a"): matchPTag,
+			testKey("b"): matchURI,
+			testKey("c"): matchAlias,
+			testKey("d"): matchUsername,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.matching, func(t *testing.T) {
+			matches := mentionMatches(event, index.HexToUser, tt.matching)
+			if !reflect.DeepEqual(matches.Types, tt.want) {
+				t.Errorf("matches = %v, want %v", matches.Types, tt.want)
+			}
+			if len(matches.Pubkeys) != len(tt.want) || matches.Pubkeys[0] != testKey("a") {
+				t.Errorf("pubkeys = %v, want the p tag first", matches.Pubkeys)
+			}
+			if matchType := matches.TypeFor(alice); matchType != matchPTag {
+				t.Errorf("alice matched by %q", matchType)
+			}
+		})
+	}
+}
+
+func TestMentionMatchesKeepStrongestType(t *testing.T) {
+	alice := testUser(t, "alice", "alice@example.org", testKey("a"))
+	alice.MentionAliases = []string{"alice"}
+	index := NewUserIndex([]User{alice})
+	aliceNpub, _ := nip19.EncodePublicKey(testKey("a"))
+
+	// Matched by alias, username and URI, and tagged
+	event := &nostr.Event{
+		Tags:    nostr.Tags{{"p", testKey("a")}},
+		Content: "alice: nostr:" + aliceNpub,
+	}
+	matches := mentionMatches(event, index.HexToUser, mentionMatchingLoose)
+	if len(matches.Pubkeys) != 1 || matches.Types[testKey("a")] != matchPTag {
+		t.Errorf("matches = %v %v, want one p tag match", matches.Pubkeys, matches.Types)
+	}
+}
+
+func TestAliasesContainingOtherAliases(t *testing.T) {
+	ana := testUser(t, "ana", "ana@example.org", testKey("a"))
+	ana.MentionAliases = []string{"ana"}
+	anabel := testUser(t, "anabel", "anabel@example.org", testKey("b"))
+	anabel.MentionAliases = []string{"anabel", "ana bel"}
+	index := NewUserIndex([]User{ana, anabel})
+
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"thanks anabel", []string{testKey("b")}},
+		// Aliases of several words contain the whole words of others
+		{"thanks ana bel", []string{testKey("a"), testKey("b")}},
+		{"thanks ana", []string{testKey("a")}},
+		{"ana and anabel", []string{testKey("a"), testKey("b")}},
+		{"banana", nil},
+	}
+	for _, tt := range tests {
+		matches := newMentionMatches()
+		addAliasMatches(matches, tt.content, index.HexToUser, mentionMatchingStandard)
+		var got []string
+		for _, pubkey := range []string{testKey("a"), testKey("b")} {
+			if matches.Types[pubkey] == matchAlias {
+				got = append(got, pubkey)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) || len(matches.Pubkeys) != len(tt.want) {
+			t.Errorf("%q matched %v, want %v", tt.content, matches.Pubkeys, tt.want)
+		}
+	}
+}
+
+func TestUsersForPubkeys(t *testing.T) {
+	// Alice has two keys, Bob's two accounts share an address
+	alice := testUser(t, "alice", "alice@example.org", testKey("a"), testKey("1"))
+	bob := testUser(t, "bob", "bob@example.org", testKey("b"))
+	bobAgain := testUser(t, "bob2", "bob@example.org", testKey("2"))
+	carol := testUser(t, "carol", "carol@example.org", testKey("c"))
+	index := NewUserIndex([]User{alice, bob, bobAgain, carol})
+
+	usernames := func(users []User) []string {
+		var names []string
+		for _, user := range users {
+			names = append(names, user.Username)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name    string
+		pubkeys []string
+		author  string
+		want    []string
+	}{
+		{"unknown keys", []string{testKey("e"), testKey("a")}, testKey("f"), []string{"alice"}},
+		{"both keys of a user", []string{testKey("a"), testKey("1"), testKey("c")}, testKey("f"), []string{"alice", "carol"}},
+		{"accounts sharing an address", []string{testKey("2"), testKey("b")}, testKey("f"), []string{"bob2"}},
+		{"author", []string{testKey("a"), testKey("c")}, testKey("c"), []string{"alice"}},
+		{"other key of the author", []string{testKey("1"), testKey("c")}, testKey("a"), []string{"carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usernames(usersForPubkeys(tt.pubkeys, tt.author, index.HexToUser)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("usersForPubkeys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMentionFilters(t *testing.T) {
+	alice := testUser(t, "alice", "alice@example.org", testKey("a"))
+	carol := testUser(t, "carol", "carol@example.org", testKey("c"), testKey("e"))
+	carol.MentionAliases = []string{"Caro", "alice"}
+	index := NewUserIndex([]User{alice, carol})
+	hexPubkeys := []string{testKey("e"), testKey("a"), testKey("c")}
+	aliceNpub, _ := nip19.EncodePublicKey(testKey("a"))
+	carolNpub, _ := nip19.EncodePublicKey(testKey("c"))
+	carolNpub2, _ := nip19.EncodePublicKey(testKey("e"))
+
+	// Only the mention handler, whose filters are all kind 1
+	handlers := make(HandlerSettings)
+	for _, handler := range eventHandlers {
+		handlers[handler.Name] = handler.Name == "mention"
+	}
+
+	tests := []struct {
+		name     string
+		matching string
+		search   bool
+		want     []string // search terms
+	}{
+		{"without search", mentionMatchingLoose, false, nil},
+		{"strict", mentionMatchingStrict, true, nil},
+		{"standard", mentionMatchingStandard, true, []string{"alice", aliceNpub, carolNpub, carolNpub2, "caro"}},
+		{"loose", mentionMatchingLoose, true, []string{"alice", aliceNpub, carolNpub, carolNpub2, "caro", "carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Handlers: handlers, MentionMatching: tt.matching, MentionSearch: tt.search}
+			filters := handlerFilters(hexPubkeys, index.HexToUser, config, nostr.Now(), nil)
+			if len(filters) == 0 || !reflect.DeepEqual(filters[0].Tags["p"], hexPubkeys) {
+				t.Fatalf("filters = %v, want the p tags of all users first", filters)
+			}
+			var terms []string
+			for _, filter := range filters[1:] {
+				if filter.Search == "" || !reflect.DeepEqual(filter.Kinds, []int{nostr.KindTextNote}) || len(filter.Tags) > 0 {
+					t.Errorf("filter %v is no search for notes", filter)
+				}
+				terms = append(terms, filter.Search)
+			}
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !reflect.DeepEqual(terms, want) {
+				t.Errorf("search terms = %v, want %v", terms, want)
+			}
+
+			// Notes found by a search, which tag no one, match the user searched for
+			for _, term := range terms {
+				event := &nostr.Event{Content: "gm " + term + "!"}
+				if strings.HasPrefix(term, "npub1") {
+					event.Content = "gm nostr:" + term
+				}
+				if matches := mentionMatches(event, index.HexToUser, tt.matching); len(matches.Pubkeys) == 0 {
+					t.Errorf("note found by searching %q mentions no one", term)
+				}
+			}
+		})
+	}
+}
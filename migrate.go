@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// processedNotesDBPath is the default location of the processed notes database
+const processedNotesDBPath = "./processed_notes.db"
+
+// sqliteBaseSchema is schema version 0, the table of the first releases.
+// New databases start from it and get the current schema from sqliteMigrations
+// like existing ones, so both always end up with the same tables.
+const sqliteBaseSchema = `
+	CREATE TABLE processed_notes (
+		event_id TEXT PRIMARY KEY,
+		processed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		relay_url TEXT,
+		user_email TEXT
+	);`
+
+// sqliteMigration upgrades the processed notes database by one schema version
+type sqliteMigration struct {
+	Description string
+	SQL         string
+}
+
+// sqliteMigrations upgrades processed_notes one version at a time; entry i
+// migrates a database from schema version i to i+1. The version is stored in
+// PRAGMA user_version, legacy databases report version 0. Schema changes
+// (new tables, columns, indexes) are appended here; applied migrations are
+// never edited, deployments may have run them already.
+var sqliteMigrations = []sqliteMigration{
+	// version 1
+	{"composite key so every recipient of an event is recorded", `
+	CREATE TABLE processed_notes_v1 (
+		event_id TEXT NOT NULL,
+		processed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		relay_url TEXT,
+		user_email TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (event_id, user_email)
+	);
+	INSERT INTO processed_notes_v1 (event_id, processed_at, relay_url, user_email)
+		SELECT event_id, processed_at, relay_url, COALESCE(user_email, '') FROM processed_notes;
+	DROP TABLE processed_notes;
+	ALTER TABLE processed_notes_v1 RENAME TO processed_notes;`},
+	// version 2
+	{"versioned digest items (see digest_store.go)", `
+	CREATE TABLE digest_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		recipient_email TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_digest_items_recipient ON digest_items (recipient_email);`},
+	// version 3
+	{"event authors and NIP-09 deletions (see deletion.go)", `
+	ALTER TABLE processed_notes ADD COLUMN author_pubkey TEXT NOT NULL DEFAULT '';
+	ALTER TABLE processed_notes ADD COLUMN deleted_at DATETIME;
+	ALTER TABLE processed_notes ADD COLUMN deletion_event_id TEXT;`},
+	// version 4
+	{"events held back by the spam filter (see spam.go)", `
+	CREATE TABLE quarantined_events (
+		event_id TEXT PRIMARY KEY,
+		rule TEXT NOT NULL,
+		event_json TEXT NOT NULL,
+		quarantined_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`},
+	// version 5
+	{"newest version of replaceable and addressable events (see replaceable.go)", `
+	CREATE TABLE replaceable_versions (
+		address TEXT PRIMARY KEY,
+		event_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);`},
+	// version 6
+	{"followers of our users for new-follower summaries (see followers.go)", `
+	CREATE TABLE followers (
+		followed_pubkey TEXT NOT NULL,
+		follower_pubkey TEXT NOT NULL,
+		followed_at DATETIME NOT NULL,
+		notified_at DATETIME,
+		PRIMARY KEY (followed_pubkey, follower_pubkey)
+	);`},
+	// version 7
+	{"how an event matched each recipient (see mention.go)", `
+	ALTER TABLE processed_notes ADD COLUMN match_type TEXT NOT NULL DEFAULT '';`},
+	// version 8
+	{"the nostr conversation of each notification (see threads.go)", `
+	ALTER TABLE processed_notes ADD COLUMN thread_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX idx_processed_notes_thread ON processed_notes (thread_id);`},
+	// version 9
+	{"npub ownership challenges (see challenge.go)", `
+	CREATE TABLE npub_challenges (
+		token TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		npub TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		verified_at DATETIME
+	);
+	CREATE INDEX idx_npub_challenges_user ON npub_challenges (username, npub);`},
+	// version 10
+	{"sender reputation and verification history (see reputation.go)", `
+	CREATE TABLE sender_reputation (
+		pubkey TEXT PRIMARY KEY,
+		first_seen DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		verified INTEGER NOT NULL DEFAULT 0,
+		identifier TEXT NOT NULL DEFAULT '',
+		notifications INTEGER NOT NULL DEFAULT 0,
+		complaints INTEGER NOT NULL DEFAULT 0,
+		unsubscribes INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE sender_verifications (
+		pubkey TEXT NOT NULL,
+		verified INTEGER NOT NULL,
+		identifier TEXT NOT NULL DEFAULT '',
+		changed_at DATETIME NOT NULL
+	);
+	CREATE INDEX idx_sender_verifications_pubkey ON sender_verifications (pubkey, changed_at);`},
+	// version 11
+	{"signed events notifications were about (see eventstore.go)", `
+	CREATE TABLE stored_events (
+		event_id TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL,
+		encoding TEXT NOT NULL,
+		data BLOB NOT NULL,
+		stored_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_stored_events_created ON stored_events (created_at);`},
+	// version 12
+	{"addresses no email is sent to (see suppression.go)", `
+	CREATE TABLE suppressions (
+		email TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		suppressed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`},
+	// version 13
+	{"what happened to every email (see delivery.go)", `
+	CREATE TABLE deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL,
+		event_id TEXT NOT NULL DEFAULT '',
+		type TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		recorded_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_deliveries_email ON deliveries (email);
+	CREATE INDEX idx_deliveries_event ON deliveries (event_id);`},
+	// version 14
+	{"senders whose events are never emailed (see shadowban.go)", `
+	CREATE TABLE shadow_bans (
+		pubkey TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		banned_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`},
+	// version 15
+	{"Trustroots threads of nostr conversations (see trustroots_threads.go)", `
+	CREATE TABLE thread_links (
+		thread_id TEXT PRIMARY KEY,
+		trustroots_thread_id TEXT NOT NULL,
+		linked_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`},
+	// version 16
+	{"outgoing emails until they are sent (see queue.go)", `
+	CREATE TABLE email_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		event_id TEXT NOT NULL DEFAULT '',
+		event_author TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		queued_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_email_queue_due ON email_queue (status, next_attempt_at);
+	CREATE INDEX idx_email_queue_event ON email_queue (event_id);`},
+	// version 17
+	{"how addresses want to be emailed (see plaintext.go)", `
+	CREATE TABLE email_preferences (
+		email TEXT PRIMARY KEY,
+		plain_text BOOLEAN NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`},
+}
+
+// Schema versions features need, named after the migration in
+// sqliteMigrations that adds their tables or columns
+const (
+	schemaCompositeKey      = 1
+	schemaDigestItems       = 2
+	schemaDeletions         = 3
+	schemaQuarantine        = 4
+	schemaReplaceable       = 5
+	schemaFollowers         = 6
+	schemaMatchTypes        = 7
+	schemaThreadIDs         = 8
+	schemaNpubChallenges    = 9
+	schemaReputation        = 10
+	schemaStoredEvents      = 11
+	schemaSuppressions      = 12
+	schemaDeliveries        = 13
+	schemaShadowBans        = 14
+	schemaTrustrootsThreads = 15
+	schemaEmailQueue        = 16
+	schemaPreferences       = 17
+)
+
+// schemaAtLeast reports whether the SQLite database has the tables of a
+// migration, e.g. schemaSuppressions. Unreadable versions count as too old.
+func schemaAtLeast(db sqlExecer, version int) bool {
+	current, err := getSchemaVersion(db)
+	return err == nil && current >= version
+}
+
+// noteStoreAtLeast reports whether the note store has the tables of a
+// migration: PostgreSQL stores always do, SQLite ones once migrated
+func noteStoreAtLeast(db sqlExecer, config *Config, version int) bool {
+	return config.PostgresURL != "" || schemaAtLeast(db, version)
+}
+
+// latestSchemaVersion returns the schema version after all migrations
+func latestSchemaVersion() int {
+	return len(sqliteMigrations)
+}
+
+// applySQLiteMigrations upgrades a database from schema version from to the
+// latest version
+func applySQLiteMigrations(db sqlExecer, from int) error {
+	for v := from; v < latestSchemaVersion(); v++ {
+		if _, err := db.Exec(sqliteMigrations[v].SQL); err != nil {
+			return fmt.Errorf("migration to version %d (%s) failed: %v", v+1, sqliteMigrations[v].Description, err)
+		}
+	}
+	return setSchemaVersion(db, latestSchemaVersion())
+}
+
+// createSQLiteSchema creates the tables of a new database at the latest
+// schema version, in one transaction
+func createSQLiteSchema(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(sqliteBaseSchema); err != nil {
+		return fmt.Errorf("failed to create table: %v", err)
+	}
+	if err := applySQLiteMigrations(tx, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlExecer is implemented by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// getSchemaVersion reads the schema version of the processed notes database
+func getSchemaVersion(db sqlExecer) (int, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// setSchemaVersion stores the schema version of the processed notes database
+func setSchemaVersion(db sqlExecer, version int) error {
+	// PRAGMA statements cannot take bound parameters
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %v", err)
+	}
+	return nil
+}
+
+// runMigrate implements `nostremail migrate [--db path] [--status]`
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := fs.String("db", processedNotesDBPath, "Path of the processed notes database to upgrade")
+	status := fs.Bool("status", false, "Show the schema version and pending migrations without applying them")
+	fs.Parse(args)
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		return fmt.Errorf("cannot open %s: %v", *dbPath, err)
+	}
+
+	db, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	defer db.Close()
+
+	if *status {
+		return showMigrationStatus(db, *dbPath)
+	}
+	return migrateSQLiteDB(db, *dbPath)
+}
+
+// showMigrationStatus prints the schema version of a database and the
+// migrations `nostremail migrate` would apply
+func showMigrationStatus(db *sql.DB, dbPath string) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("📋 %s is at schema version %d, latest is %d\n", dbPath, version, latestSchemaVersion())
+	for v := version; v < latestSchemaVersion(); v++ {
+		fmt.Printf("   pending migration %d: %s\n", v+1, sqliteMigrations[v].Description)
+	}
+	return nil
+}
+
+// migrateSQLiteDB backs up the database, applies pending migrations in a single
+// transaction and verifies that no dedup history was lost before committing.
+// Any failure rolls the transaction back, leaving the database untouched.
+func migrateSQLiteDB(db *sql.DB, dbPath string) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := latestSchemaVersion()
+	if version >= latest {
+		fmt.Printf("✅ %s is already at schema version %d\n", dbPath, version)
+		return nil
+	}
+	fmt.Printf("🔧 Migrating %s from schema version %d to %d\n", dbPath, version, latest)
+
+	// Consistent copy of the database, even if it is being written to
+	backupPath := fmt.Sprintf("%s.bak-%s", dbPath, time.Now().Format("20060102-150405"))
+	if _, err := db.Exec("VACUUM INTO ?", backupPath); err != nil {
+		return fmt.Errorf("failed to back up database: %v", err)
+	}
+	fmt.Printf("💾 Backup written to %s\n", backupPath)
+
+	eventsBefore, err := countProcessedEvents(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := applySQLiteMigrations(tx, version); err != nil {
+		return err
+	}
+	for v := version; v < latest; v++ {
+		fmt.Printf("   applied migration %d: %s\n", v+1, sqliteMigrations[v].Description)
+	}
+
+	// Verify before committing
+	eventsAfter, err := countProcessedEvents(tx)
+	if err != nil {
+		return err
+	}
+	if eventsAfter != eventsBefore {
+		return fmt.Errorf("verification failed: %d processed events before, %d after", eventsBefore, eventsAfter)
+	}
+	var integrity string
+	if err := tx.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil {
+		return fmt.Errorf("failed to run integrity check: %v", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("verification failed: integrity check returned %s", integrity)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration: %v", err)
+	}
+
+	fmt.Printf("✅ Migrated %d processed events to schema version %d\n", eventsAfter, latest)
+	fmt.Printf("   To roll back, stop the daemon and restore %s\n", backupPath)
+	return nil
+}
+
+// countProcessedEvents returns the number of distinct processed event IDs
+func countProcessedEvents(db sqlExecer) (int, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(DISTINCT event_id) FROM processed_notes").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count processed events: %v", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// openLegacyDB returns an in-memory database of the first releases, schema
+// version 0, with a few processed notes
+func openLegacyDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(sqliteBaseSchema); err != nil {
+		t.Fatal(err)
+	}
+	for _, note := range []struct {
+		eventID, relay string
+		email          interface{}
+	}{
+		{"event1", "wss://relay.one", "alice@example.org"},
+		{"event2", "wss://relay.two", "bob@example.org"},
+		{"event3", "relay", nil}, // recipients were not recorded at first
+	} {
+		if _, err := db.Exec("INSERT INTO processed_notes (event_id, relay_url, user_email) VALUES (?, ?, ?)",
+			note.eventID, note.relay, note.email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// processedNotes returns event ID, relay and recipient of every processed note
+func processedNotes(t *testing.T, db *sql.DB) [][3]string {
+	t.Helper()
+	rows, err := db.Query("SELECT event_id, relay_url, COALESCE(user_email, '') FROM processed_notes ORDER BY event_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var notes [][3]string
+	for rows.Next() {
+		var note [3]string
+		if err := rows.Scan(&note[0], &note[1], &note[2]); err != nil {
+			t.Fatal(err)
+		}
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+// tableNames returns the tables of a database, sorted
+func tableNames(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestApplySQLiteMigrationsToLegacyDatabase(t *testing.T) {
+	db := openLegacyDB(t)
+	before := processedNotes(t, db)
+
+	if err := applySQLiteMigrations(db, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("user_version = %d, want %d", version, latestSchemaVersion())
+	}
+	if after := processedNotes(t, db); !reflect.DeepEqual(after, before) {
+		t.Errorf("processed notes = %v, want %v", after, before)
+	}
+
+	// The migrated database works with the note store
+	store := &SQLiteNoteStore{DB: db}
+	processed, err := isNoteProcessed(db, "event1")
+	if err != nil || !processed {
+		t.Errorf("isNoteProcessed(event1) = %v, %v, want true", processed, err)
+	}
+	if err := store.MarkNoteProcessed("event1", "pubkey", "relay", "carol@example.org"); err != nil {
+		t.Errorf("recording a second recipient of a legacy event: %v", err)
+	}
+	if err := store.SetPlainText("alice@example.org", true); err != nil {
+		t.Errorf("SetPlainText on the latest schema: %v", err)
+	}
+}
+
+func TestMigratedLegacyDatabaseMatchesNewDatabase(t *testing.T) {
+	legacy := openLegacyDB(t)
+	if err := applySQLiteMigrations(legacy, 0); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+
+	if got, want := tableNames(t, legacy), tableNames(t, fresh); !reflect.DeepEqual(got, want) {
+		t.Errorf("tables of a migrated database = %v, of a new one %v", got, want)
+	}
+	if version, _ := getSchemaVersion(fresh); version != latestSchemaVersion() {
+		t.Errorf("new database at version %d, want %d", version, latestSchemaVersion())
+	}
+}
+
+func TestSchemaVersionsNameTheirMigrations(t *testing.T) {
+	for version, description := range map[int]string{
+		schemaCompositeKey:      "composite key",
+		schemaDigestItems:       "digest_store.go",
+		schemaDeletions:         "deletion.go",
+		schemaQuarantine:        "spam.go",
+		schemaReplaceable:       "replaceable.go",
+		schemaFollowers:         "followers.go",
+		schemaMatchTypes:        "mention.go",
+		schemaThreadIDs:         "threads.go",
+		schemaNpubChallenges:    "challenge.go",
+		schemaReputation:        "reputation.go",
+		schemaStoredEvents:      "eventstore.go",
+		schemaSuppressions:      "suppression.go",
+		schemaDeliveries:        "delivery.go",
+		schemaShadowBans:        "shadowban.go",
+		schemaTrustrootsThreads: "trustroots_threads.go",
+		schemaEmailQueue:        "queue.go",
+		schemaPreferences:       "plaintext.go",
+	} {
+		if got := sqliteMigrations[version-1].Description; !strings.Contains(got, description) {
+			t.Errorf("migration to version %d is %q, want %s", version, got, description)
+		}
+	}
+}
+
+func TestSchemaAtLeast(t *testing.T) {
+	legacy := openLegacyDB(t)
+	if schemaAtLeast(legacy, schemaSuppressions) {
+		t.Error("legacy database has the suppression list")
+	}
+	if !noteStoreAtLeast(legacy, &Config{PostgresURL: "postgres://localhost/nostremail"}, schemaSuppressions) {
+		t.Error("PostgreSQL note store without the suppression list")
+	}
+	if noteStoreAtLeast(legacy, &Config{}, schemaSuppressions) {
+		t.Error("legacy SQLite note store has the suppression list")
+	}
+
+	fresh, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if !schemaAtLeast(fresh, latestSchemaVersion()) || schemaAtLeast(fresh, latestSchemaVersion()+1) {
+		t.Errorf("new database not exactly at version %d", latestSchemaVersion())
+	}
+	fresh.Close()
+	if schemaAtLeast(fresh, schemaCompositeKey) {
+		t.Error("closed database reports a schema version")
+	}
+}
+
+func TestMigrateSQLiteDB(t *testing.T) {
+	db := openLegacyDB(t)
+	before := processedNotes(t, db)
+	dbPath := filepath.Join(t.TempDir(), "processed_notes.db")
+
+	if err := migrateSQLiteDB(db, dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, _ := getSchemaVersion(db); version != latestSchemaVersion() {
+		t.Errorf("user_version = %d, want %d", version, latestSchemaVersion())
+	}
+	if after := processedNotes(t, db); !reflect.DeepEqual(after, before) {
+		t.Errorf("processed notes = %v, want %v", after, before)
+	}
+
+	// The backup is the legacy database
+	backups, err := filepath.Glob(dbPath + ".bak-*")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("backups = %v, %v, want one", backups, err)
+	}
+	backup, err := sql.Open("sqlite3", backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if version, _ := getSchemaVersion(backup); version != 0 {
+		t.Errorf("backup at version %d, want 0", version)
+	}
+	if notes := processedNotes(t, backup); !reflect.DeepEqual(notes, before) {
+		t.Errorf("backed up notes = %v, want %v", notes, before)
+	}
+
+	// Migrating again changes nothing
+	if err := migrateSQLiteDB(db, dbPath); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := filepath.Glob(dbPath + ".bak-*"); len(backups) != 1 {
+		t.Errorf("migrating an up-to-date database wrote another backup: %v", backups)
+	}
+}
+
+func TestMigrateSQLiteDBRollsBackOnFailure(t *testing.T) {
+	db := openLegacyDB(t)
+	before := processedNotes(t, db)
+	// A table of a later migration that exists already makes it fail
+	if _, err := db.Exec("CREATE TABLE quarantined_events (event_id TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateSQLiteDB(db, filepath.Join(t.TempDir(), "processed_notes.db")); err == nil {
+		t.Fatal("migration succeeded, want an error")
+	}
+
+	if version, _ := getSchemaVersion(db); version != 0 {
+		t.Errorf("user_version = %d after a failed migration, want 0", version)
+	}
+	if after := processedNotes(t, db); !reflect.DeepEqual(after, before) {
+		t.Errorf("processed notes = %v after a failed migration, want %v", after, before)
+	}
+	var digestTables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'digest_items'").Scan(&digestTables)
+	if digestTables != 0 {
+		t.Error("earlier migrations were kept after a failed migration")
+	}
+}
+
+func TestRunMigrateStatusLeavesDatabaseAlone(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "processed_notes.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(sqliteBaseSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runMigrate([]string{"--db", dbPath, "--status"}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := getSchemaVersion(db); version != 0 {
+		t.Errorf("user_version = %d after --status, want 0", version)
+	}
+	if err := runMigrate([]string{"--db", filepath.Join(t.TempDir(), "missing.db")}); err == nil {
+		t.Error("migrating a missing database succeeded")
+	}
+	if backups, _ := filepath.Glob(dbPath + ".bak-*"); len(backups) != 0 {
+		t.Errorf("--status wrote a backup: %v", backups)
+	}
+}
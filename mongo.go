@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// mongoRetryDelay and mongoRetryMaxDelay bound the backoff between retries of
+// transient MongoDB errors, mongoRetryLimit how long we keep retrying
+const (
+	mongoRetryDelay    = time.Second
+	mongoRetryMaxDelay = time.Minute
+	mongoRetryLimit    = 5 * time.Minute
+)
+
+// MongoDBConfig is how we connect to MongoDB. Options set here override
+// those in the URI.
+type MongoDBConfig struct {
+	URI      string
+	Database string
+	// Username and Password authenticate against AuthSource (default the
+	// database in the URI, or admin)
+	Username   string
+	Password   string
+	AuthSource string
+	// TLS encrypts the connection, trusting the CAs in TLSCAFile when set and
+	// the system CAs otherwise
+	TLS       bool
+	TLSCAFile string
+	// ReplicaSet names the replica set, ReadPreference is a mode like
+	// primary or secondaryPreferred
+	ReplicaSet     string
+	ReadPreference string
+	// MaxPoolSize and MinPoolSize size the connection pool, zero keeps the
+	// driver default
+	MaxPoolSize uint64
+	MinPoolSize uint64
+}
+
+// loadMongoDBConfig reads the MONGO_* environment variables
+func loadMongoDBConfig() (MongoDBConfig, error) {
+	config := MongoDBConfig{
+		URI:            getEnvOrDefault("MONGO_URI", "mongodb://localhost:27017"),
+		Database:       getEnvOrDefault("MONGO_DB", "trust-roots"),
+		Username:       os.Getenv("MONGO_USERNAME"),
+		Password:       os.Getenv("MONGO_PASSWORD"),
+		AuthSource:     os.Getenv("MONGO_AUTH_SOURCE"),
+		TLSCAFile:      os.Getenv("MONGO_TLS_CA_FILE"),
+		ReplicaSet:     os.Getenv("MONGO_REPLICA_SET"),
+		ReadPreference: os.Getenv("MONGO_READ_PREFERENCE"),
+	}
+	var err error
+	if value := os.Getenv("MONGO_TLS"); value != "" {
+		if config.TLS, err = strconv.ParseBool(value); err != nil {
+			return config, fmt.Errorf("MONGO_TLS: %v", err)
+		}
+	}
+	if value := os.Getenv("MONGO_MAX_POOL_SIZE"); value != "" {
+		if config.MaxPoolSize, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return config, fmt.Errorf("MONGO_MAX_POOL_SIZE: %v", err)
+		}
+	}
+	if value := os.Getenv("MONGO_MIN_POOL_SIZE"); value != "" {
+		if config.MinPoolSize, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return config, fmt.Errorf("MONGO_MIN_POOL_SIZE: %v", err)
+		}
+	}
+	if config.ReadPreference != "" {
+		if _, err := readpref.ModeFromString(config.ReadPreference); err != nil {
+			return config, fmt.Errorf("MONGO_READ_PREFERENCE: %v", err)
+		}
+	}
+	if config.MaxPoolSize > 0 && config.MinPoolSize > config.MaxPoolSize {
+		return config, fmt.Errorf("MONGO_MIN_POOL_SIZE must not exceed MONGO_MAX_POOL_SIZE")
+	}
+	return config, nil
+}
+
+// clientOptions builds the driver options of the config
+func (c MongoDBConfig) clientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(c.URI)
+	if c.Username != "" {
+		opts.SetAuth(options.Credential{
+			Username:   c.Username,
+			Password:   c.Password,
+			AuthSource: c.AuthSource,
+		})
+	}
+	if c.TLS || c.TLSCAFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.TLSCAFile != "" {
+			pem, err := os.ReadFile(c.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read MONGO_TLS_CA_FILE: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", c.TLSCAFile)
+			}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if c.ReplicaSet != "" {
+		opts.SetReplicaSet(c.ReplicaSet)
+	}
+	if c.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(c.ReadPreference)
+		if err != nil {
+			return nil, err
+		}
+		pref, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetReadPreference(pref)
+	}
+	if c.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(c.MaxPoolSize)
+	}
+	if c.MinPoolSize > 0 {
+		opts.SetMinPoolSize(c.MinPoolSize)
+	}
+	return opts, opts.Validate()
+}
+
+// isTransientMongoError reports whether an operation may succeed when retried:
+// network errors and timeouts, e.g. while a replica set elects a new primary
+func isTransientMongoError(err error) bool {
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err)
+}
+
+// retryMongo runs fn until it succeeds, retrying transient errors with an
+// exponential backoff for up to mongoRetryLimit
+func retryMongo(what string, fn func() error) error {
+	delay := mongoRetryDelay
+	deadline := time.Now().Add(mongoRetryLimit)
+	for {
+		err := fn()
+		if err == nil || !isTransientMongoError(err) || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		fmt.Printf("⚠️  Failed to %s, retrying in %s: %v\n", what, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > mongoRetryMaxDelay {
+			delay = mongoRetryMaxDelay
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// muteListFetchTimeout bounds how long we wait for relays when loading mute lists
+const muteListFetchTimeout = 30 * time.Second
+
+// MuteList holds the public entries of a NIP-51 mute list (kind 10000). Private
+// entries are encrypted to the user's own key, so we cannot read them.
+type MuteList struct {
+	CreatedAt nostr.Timestamp
+	Pubkeys   map[string]bool
+	Hashtags  map[string]bool
+	Words     []string
+}
+
+// MuteLists holds the mute lists of monitored users by hex pubkey
+type MuteLists struct {
+	mu    sync.RWMutex
+	lists map[string]*MuteList
+}
+
+// NewMuteLists creates an empty mute list store
+func NewMuteLists() *MuteLists {
+	return &MuteLists{lists: make(map[string]*MuteList)}
+}
+
+// parseMuteList reads the public p, t and word tags of a mute list event
+func parseMuteList(event *nostr.Event) *MuteList {
+	list := &MuteList{
+		CreatedAt: event.CreatedAt,
+		Pubkeys:   make(map[string]bool),
+		Hashtags:  make(map[string]bool),
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[1] == "" {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			list.Pubkeys[tag[1]] = true
+		case "t":
+			list.Hashtags[strings.ToLower(tag[1])] = true
+		case "word":
+			list.Words = append(list.Words, strings.ToLower(tag[1]))
+		}
+	}
+	return list
+}
+
+// Update stores a mute list event if it is newer than the one we have and
+// returns the pubkeys it newly mutes
+func (m *MuteLists) Update(event *nostr.Event) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.lists[event.PubKey]
+	if exists && current.CreatedAt >= event.CreatedAt {
+		return nil
+	}
+	list := parseMuteList(event)
+	m.lists[event.PubKey] = list
+
+	var muted []string
+	for pubkey := range list.Pubkeys {
+		if !exists || !current.Pubkeys[pubkey] {
+			muted = append(muted, pubkey)
+		}
+	}
+	return muted
+}
+
+// Mutes reports whether a user muted the author, a hashtag or a word of an event
+func (m *MuteLists) Mutes(userHexPubkey string, event *nostr.Event) bool {
+	m.mu.RLock()
+	list, exists := m.lists[userHexPubkey]
+	m.mu.RUnlock()
+	if !exists {
+		return false
+	}
+
+	if list.Pubkeys[notificationAuthor(event)] {
+		return true
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "t" && list.Hashtags[strings.ToLower(tag[1])] {
+			return true
+		}
+	}
+
+	content := strings.ToLower(event.Content)
+	for _, word := range list.Words {
+		if strings.Contains(content, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadMuteLists fetches the current mute lists of the given users
+func loadMuteLists(pool *nostr.SimplePool, relays []string, hexPubkeys []string) *MuteLists {
+	mutes := NewMuteLists()
+
+	ctx, cancel := context.WithTimeout(context.Background(), muteListFetchTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{Kinds: []int{nostr.KindMuteList}, Authors: hexPubkeys}
+	for evt := range pool.SubManyEose(ctx, relays, nostr.Filters{filter}) {
+		mutes.Update(evt.Event)
+	}
+
+	fmt.Printf("🔇 Loaded mute lists of %d users\n", len(mutes.lists))
+	return mutes
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nip05Timeout bounds a request to a NIP-05 endpoint
+const nip05Timeout = 10 * time.Second
+
+// nip05CacheTTL is how long a verification result is trusted
+const nip05CacheTTL = time.Hour
+
+// nip05ReverifyInterval is how often expired results are re-verified
+const nip05ReverifyInterval = 10 * time.Minute
+
+// nip05ForgetAfter is how long results of senders we no longer hear from are kept
+const nip05ForgetAfter = 7 * 24 * time.Hour
+
+// nip05MaxResponseSize bounds the nostr.json documents we read
+const nip05MaxResponseSize = 512 * 1024
+
+// nip05NamePattern is the allowed local part of an identifier (NIP-05)
+var nip05NamePattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// NIP-05 domain trust modes
+const (
+	nip05TrustAll        = "all"        // every verified domain
+	nip05TrustAllowlist  = "allowlist"  // trustroots.org and the allowlisted domains
+	nip05TrustTrustroots = "trustroots" // trustroots.org only
+)
+
+// trustrootsDomain is the NIP-05 domain of Trustroots users
+const trustrootsDomain = "trustroots.org"
+
+// NIP05Policy decides which verified domains are trusted as senders, and
+// whether events of trusted senders from other domains are emailed or digested
+type NIP05Policy struct {
+	Mode     string
+	Domains  map[string]bool // allowlisted domains
+	Delivery string          // trustActionEmail or trustActionDigest
+}
+
+// parseNIP05Policy parses the trust mode, the domain allowlist and the
+// delivery of events from trusted senders of other domains
+func parseNIP05Policy(mode, domains, delivery string) (NIP05Policy, error) {
+	policy := NIP05Policy{Mode: nip05TrustAll, Domains: make(map[string]bool), Delivery: trustActionEmail}
+
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "":
+	case nip05TrustAll, nip05TrustAllowlist, nip05TrustTrustroots:
+		policy.Mode = mode
+	default:
+		return policy, fmt.Errorf("invalid mode %q, expected all, allowlist or trustroots", mode)
+	}
+
+	for _, domain := range strings.Split(domains, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			policy.Domains[domain] = true
+		}
+	}
+	if policy.Mode == nip05TrustAllowlist && len(policy.Domains) == 0 {
+		return policy, fmt.Errorf("allowlist mode needs domains")
+	}
+
+	switch delivery = strings.ToLower(strings.TrimSpace(delivery)); delivery {
+	case "":
+	case trustActionEmail, trustActionDigest:
+		policy.Delivery = delivery
+	default:
+		return policy, fmt.Errorf("invalid delivery %q, expected email or digest", delivery)
+	}
+	return policy, nil
+}
+
+// Trusts reports whether senders verified on a domain are trusted
+func (p NIP05Policy) Trusts(domain string) bool {
+	switch p.Mode {
+	case nip05TrustTrustroots:
+		return domain == trustrootsDomain
+	case nip05TrustAllowlist:
+		return domain == trustrootsDomain || p.Domains[domain]
+	}
+	return true
+}
+
+// nip05Result is a cached verification result
+type nip05Result struct {
+	Identifier string // "" when not verified
+	CheckedAt  time.Time
+	UsedAt     time.Time `json:"-"` // last time an event of the sender asked for it
+}
+
+// NIP05Verifier verifies the NIP-05 identifiers senders claim in their
+// profiles over HTTP, so senders without a Trustroots account can be named.
+// Results are shared with other instances in Cache when set.
+type NIP05Verifier struct {
+	Profiles *ProfileNames
+	Client   *http.Client
+	Policy   NIP05Policy
+	Cache    *RedisCache
+
+	mu      sync.Mutex
+	results map[string]nip05Result // by hex pubkey
+}
+
+// NewNIP05Verifier creates a verifier that reads profiles from the given resolver
+func NewNIP05Verifier(profiles *ProfileNames, policy NIP05Policy) *NIP05Verifier {
+	return &NIP05Verifier{
+		Profiles: profiles,
+		Policy:   policy,
+		Client: &http.Client{
+			Timeout: nip05Timeout,
+			// NIP-05: fetchers must ignore redirects
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		results: make(map[string]nip05Result),
+	}
+}
+
+// parseNIP05 splits an identifier into its local part and domain; a bare
+// domain stands for "_@domain"
+func parseNIP05(identifier string) (name, domain string, err error) {
+	identifier = strings.ToLower(strings.TrimSpace(identifier))
+	name, domain, found := strings.Cut(identifier, "@")
+	if !found {
+		name, domain = "_", identifier
+	}
+	if !nip05NamePattern.MatchString(name) {
+		return "", "", fmt.Errorf("invalid NIP-05 name %q", name)
+	}
+	if !strings.Contains(domain, ".") || strings.ContainsAny(domain, "/?#@:") {
+		return "", "", fmt.Errorf("invalid NIP-05 domain %q", domain)
+	}
+	// Identifiers must not make us query hosts by address
+	if net.ParseIP(domain) != nil {
+		return "", "", fmt.Errorf("NIP-05 domain %q is an IP address", domain)
+	}
+	return name, domain, nil
+}
+
+// displayNIP05 shows an identifier the way clients do, "_@domain" as "domain"
+func displayNIP05(identifier string) string {
+	return strings.TrimPrefix(strings.ToLower(identifier), "_@")
+}
+
+// verified returns the NIP-05 identifier of a pubkey when its domain confirms it
+func (v *NIP05Verifier) verified(hexPubkey string) (string, bool) {
+	now := time.Now()
+	v.mu.Lock()
+	result, cached := v.results[hexPubkey]
+	if cached {
+		result.UsedAt = now
+		v.results[hexPubkey] = result
+	}
+	v.mu.Unlock()
+	if cached && now.Sub(result.CheckedAt) < nip05CacheTTL {
+		return result.Identifier, result.Identifier != ""
+	}
+
+	if shared, found := v.sharedResult(hexPubkey); found && now.Sub(shared.CheckedAt) < nip05CacheTTL {
+		result = shared
+	} else {
+		result = v.resolve(hexPubkey)
+		v.shareResult(hexPubkey, result)
+	}
+	result.UsedAt = now
+	v.mu.Lock()
+	v.results[hexPubkey] = result
+	v.mu.Unlock()
+	return result.Identifier, result.Identifier != ""
+}
+
+// resolve verifies the identifier in the profile of a pubkey
+func (v *NIP05Verifier) resolve(hexPubkey string) nip05Result {
+	result := nip05Result{CheckedAt: time.Now()}
+	if identifier := v.Profiles.NIP05(hexPubkey); identifier != "" {
+		if err := v.check(identifier, hexPubkey); err != nil {
+			fmt.Printf("ℹ️  NIP-05 %s of %s not verified: %v\n", identifier, hexPubkey, err)
+		} else {
+			result.Identifier = strings.ToLower(identifier)
+		}
+	}
+	return result
+}
+
+// sharedResult returns the result another instance stored in Cache
+func (v *NIP05Verifier) sharedResult(hexPubkey string) (nip05Result, bool) {
+	var result nip05Result
+	if v.Cache == nil {
+		return result, false
+	}
+	found, err := v.Cache.GetJSON("nip05:"+hexPubkey, &result)
+	if err != nil {
+		fmt.Printf("⚠️  Redis lookup of NIP-05 result %s failed: %v\n", hexPubkey, err)
+	}
+	return result, found
+}
+
+// shareResult stores a result in Cache for the other instances
+func (v *NIP05Verifier) shareResult(hexPubkey string, result nip05Result) {
+	if v.Cache == nil {
+		return
+	}
+	if err := v.Cache.SetJSON("nip05:"+hexPubkey, result, nip05CacheTTL); err != nil {
+		fmt.Printf("⚠️  Failed to share NIP-05 result of %s in Redis: %v\n", hexPubkey, err)
+	}
+}
+
+// Reverify re-verifies the expired results of verified senders, so their
+// events are not held up by a lookup, and downgrades senders whose identifier
+// stopped resolving to them. Expired misses and senders not heard
+// from within nip05ForgetAfter are dropped, they are checked again when needed.
+func (v *NIP05Verifier) Reverify(now time.Time) (reverified, downgraded int) {
+	var expired []string
+	v.mu.Lock()
+	for hexPubkey, result := range v.results {
+		switch {
+		case now.Sub(result.CheckedAt) < nip05CacheTTL:
+		case result.Identifier == "" || now.Sub(result.UsedAt) > nip05ForgetAfter:
+			delete(v.results, hexPubkey)
+		default:
+			expired = append(expired, hexPubkey)
+		}
+	}
+	v.mu.Unlock()
+
+	for _, hexPubkey := range expired {
+		// Senders may have changed the identifier in their profile
+		v.Profiles.Forget(hexPubkey)
+		result := v.resolve(hexPubkey)
+		v.shareResult(hexPubkey, result)
+
+		v.mu.Lock()
+		previous := v.results[hexPubkey]
+		result.UsedAt = previous.UsedAt
+		v.results[hexPubkey] = result
+		v.mu.Unlock()
+
+		reverified++
+		switch {
+		case result.Identifier == "":
+			downgraded++
+			fmt.Printf("⬇️  NIP-05 %s of %s no longer verified\n", previous.Identifier, hexPubkey)
+		case result.Identifier != previous.Identifier:
+			fmt.Printf("🔁 %s is now verified as %s instead of %s\n", hexPubkey, result.Identifier, previous.Identifier)
+		}
+	}
+	return reverified, downgraded
+}
+
+// runNIP05Reverification re-verifies expired results every nip05ReverifyInterval
+func runNIP05Reverification(v *NIP05Verifier) {
+	for {
+		time.Sleep(nip05ReverifyInterval)
+		if reverified, downgraded := v.Reverify(time.Now()); reverified > 0 {
+			fmt.Printf("🔁 Re-verified %d NIP-05 identifiers, %d downgraded\n", reverified, downgraded)
+		}
+	}
+}
+
+// check fetches https://<domain>/.well-known/nostr.json?name=<name> and
+// compares the pubkey listed for the name
+func (v *NIP05Verifier) check(identifier, hexPubkey string) error {
+	name, domain, err := parseNIP05(identifier)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://%s/.well-known/nostr.json?name=%s", domain, url.QueryEscape(name))
+	ctx, cancel := context.WithTimeout(context.Background(), nip05Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", endpoint, resp.Status)
+	}
+
+	var response NIP5Response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, nip05MaxResponseSize)).Decode(&response); err != nil {
+		return fmt.Errorf("invalid nostr.json from %s: %v", domain, err)
+	}
+	listed, exists := response.Names[name]
+	if !exists {
+		return fmt.Errorf("%s does not list %s", domain, name)
+	}
+	if !strings.EqualFold(listed, hexPubkey) {
+		return fmt.Errorf("%s lists another pubkey for %s", domain, name)
+	}
+	return nil
+}
+
+// Verify verifies senders with an identifier on a domain the policy trusts;
+// senders verified on other domains are only named
+func (v *NIP05Verifier) Verify(hexPubkey string) (string, bool) {
+	identifier, verified := v.verified(hexPubkey)
+	if !verified {
+		return "", false
+	}
+	_, domain, err := parseNIP05(identifier)
+	if err != nil || !v.Policy.Trusts(domain) {
+		fmt.Printf("ℹ️  %s is verified, but its domain is not trusted\n", identifier)
+		return displayNIP05(identifier), false
+	}
+	return displayNIP05(identifier), true
+}
+
+// Digest reports whether notifications from a sender go to the digest: trusted
+// senders of other domains when the policy says so
+func (v *NIP05Verifier) Digest(hexPubkey string) bool {
+	if v.Policy.Delivery != trustActionDigest {
+		return false
+	}
+	if _, monitored := v.Profiles.Users[hexPubkey]; monitored {
+		return false
+	}
+	identifier, trusted := v.Verify(hexPubkey)
+	return trusted && !isTrustrootsIdentifier(identifier)
+}
+
+// isTrustrootsIdentifier reports whether a NIP-05 identifier is on trustroots.org
+func isTrustrootsIdentifier(identifier string) bool {
+	return strings.HasSuffix(strings.ToLower(identifier), "@"+trustrootsDomain)
+}
+
+// senderProfileURL links the profile of a sender: on Trustroots for our users,
+// on a nostr web client for everyone else
+func senderProfileURL(senderNIP5, senderNpub string) string {
+	if isTrustrootsIdentifier(senderNIP5) {
+		return fmt.Sprintf("https://www.trustroots.org/profile/%s", extractUsernameFromNIP5(senderNIP5))
+	}
+	return fmt.Sprintf("https://njump.me/%s", senderNpub)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nostrJSONCacheTTL is how long the names loaded from the user source are served
+const nostrJSONCacheTTL = 5 * time.Minute
+
+// NostrJSON serves /.well-known/nostr.json (NIP-05) for Trustroots users, so
+// username@trustroots.org verifies as a nostr identity when trustroots.org
+// forwards the path to the daemon
+type NostrJSON struct {
+	Users UserSource
+	// VerifiedNpubs limits the names to users who confirmed owning their npub
+	// (see challenge.go) when set
+	VerifiedNpubs *sql.DB
+
+	mu       sync.Mutex
+	names    map[string]string // lowercase username to hex pubkey
+	loadedAt time.Time
+}
+
+// Names returns the NIP-05 names of Trustroots users, reloaded from the user
+// source after nostrJSONCacheTTL; the last names are kept when reloading fails
+func (n *NostrJSON) Names() (map[string]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.names != nil && time.Since(n.loadedAt) < nostrJSONCacheTTL {
+		return n.names, nil
+	}
+
+	names, err := n.load()
+	if err != nil {
+		if n.names != nil {
+			fmt.Printf("⚠️  Serving cached nostr.json: %v\n", err)
+			return n.names, nil
+		}
+		return nil, err
+	}
+	n.names = names
+	n.loadedAt = time.Now()
+	return names, nil
+}
+
+// load reads the usernames and npubs of users with a valid npub. A name maps
+// to one pubkey: of users with several npubs, the first valid one, nostrNpub
+// first.
+func (n *NostrJSON) load() (map[string]string, error) {
+	users, err := n.Users.Users()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load users: %v", err)
+	}
+
+	names := make(map[string]string)
+	for _, user := range users {
+		name := strings.ToLower(user.Username)
+		if !nip05NamePattern.MatchString(name) {
+			continue
+		}
+		for _, key := range userKeys(user) {
+			hexPubkey, err := npubToHex(key.NostrNpub)
+			if err != nil {
+				continue
+			}
+			if n.VerifiedNpubs != nil {
+				verified, err := isNpubVerified(n.VerifiedNpubs, key.Username, key.NostrNpub)
+				if err != nil {
+					return nil, err
+				}
+				if !verified {
+					continue
+				}
+			}
+			names[name] = hexPubkey
+			break
+		}
+	}
+	return names, nil
+}
+
+// ServeHTTP answers ?name=<username> with that user only, and without a name
+// with every user
+func (n *NostrJSON) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// NIP-05: web clients fetch nostr.json from other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names, err := n.Names()
+	if err != nil {
+		fmt.Printf("❌ Failed to serve nostr.json: %v\n", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := NIP5Response{Names: names}
+	if name := r.URL.Query().Get("name"); name != "" {
+		response.Names = make(map[string]string)
+		name = strings.ToLower(name)
+		if hexPubkey, exists := names[name]; exists {
+			response.Names[name] = hexPubkey
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(nostrJSONCacheTTL.Seconds())))
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Printf("⚠️  Failed to write nostr.json: %v\n", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// EmailPreferences holds how addresses want to be emailed, as chosen on the
+// unsubscribe page. The note stores implement it.
+type EmailPreferences interface {
+	// PlainText reports whether an address asked for plain text emails
+	PlainText(email string) (bool, error)
+	// SetPlainText chooses plain text or HTML emails for an address
+	SetPlainText(email string, plainText bool) error
+}
+
+// queryPlainText reads the plain text preference selected by a query,
+// false when the address has none
+func queryPlainText(db *sql.DB, query string, args ...interface{}) (bool, error) {
+	var plainText bool
+	err := db.QueryRow(query, args...).Scan(&plainText)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load email preferences: %v", err)
+	}
+	return plainText, nil
+}
+
+// trackingParameters are query parameters that only serve tracking, besides
+// those starting with utm_
+var trackingParameters = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+	"mc_cid": true,
+	"mc_eid": true,
+}
+
+// textLinkPattern matches the links in plain text emails
+var textLinkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// withoutTracking removes tracking parameters from the links in text
+func withoutTracking(text string) string {
+	return textLinkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		parsed, err := url.Parse(link)
+		if err != nil || parsed.RawQuery == "" {
+			return link
+		}
+		query := parsed.Query()
+		changed := false
+		for name := range query {
+			if strings.HasPrefix(strings.ToLower(name), "utm_") || trackingParameters[strings.ToLower(name)] {
+				query.Del(name)
+				changed = true
+			}
+		}
+		if !changed {
+			return link
+		}
+		parsed.RawQuery = query.Encode()
+		return parsed.String()
+	})
+}
+
+// plainTextOnly reports whether an address gets plain text emails: its user
+// chose so in their Trustroots preferences (nostrPlainText) or it did on the
+// unsubscribe page. Lookups that fail keep HTML.
+func (es *EmailService) plainTextOnly(email string) bool {
+	if es.Users != nil {
+		if user, exists := userByEmail(es.Users, email); exists && user.PlainText {
+			return true
+		}
+	}
+	if es.Preferences == nil {
+		return false
+	}
+	plainText, err := es.Preferences.PlainText(email)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return false
+	}
+	return plainText
+}
+
+// plainTextEmail turns an email into a plain text one: without the HTML
+// alternative, the images embedded in it and tracking parameters
+func plainTextEmail(email *OutgoingEmail) {
+	email.HTML = ""
+	email.Text = withoutTracking(email.Text)
+	var attachments []EmailAttachment
+	for _, attachment := range email.Attachments {
+		if !attachment.Inline {
+			attachments = append(attachments, attachment)
+		}
+	}
+	email.Attachments = attachments
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// postgresConnectTimeout bounds how long we wait for PostgreSQL at startup
+const postgresConnectTimeout = 10 * time.Second
+
+// postgresNoteStoreSchema creates the shared tables of PostgresNoteStore, the
+// same columns as in processed_notes.db at the latest schema version
+const postgresNoteStoreSchema = `
+	CREATE TABLE IF NOT EXISTS processed_notes (
+		event_id TEXT NOT NULL,
+		processed_at TIMESTAMPTZ DEFAULT now(),
+		relay_url TEXT,
+		user_email TEXT NOT NULL DEFAULT '',
+		author_pubkey TEXT NOT NULL DEFAULT '',
+		deleted_at TIMESTAMPTZ,
+		deletion_event_id TEXT,
+		match_type TEXT NOT NULL DEFAULT '',
+		thread_id TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (event_id, user_email)
+	);
+	CREATE INDEX IF NOT EXISTS idx_processed_notes_thread ON processed_notes (thread_id);
+	CREATE TABLE IF NOT EXISTS digest_items (
+		id BIGSERIAL PRIMARY KEY,
+		recipient_email TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS idx_digest_items_recipient ON digest_items (recipient_email);
+	CREATE TABLE IF NOT EXISTS stored_events (
+		event_id TEXT PRIMARY KEY,
+		created_at BIGINT NOT NULL,
+		encoding TEXT NOT NULL,
+		data BYTEA NOT NULL,
+		stored_at TIMESTAMPTZ DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS idx_stored_events_created ON stored_events (created_at);
+	CREATE TABLE IF NOT EXISTS suppressions (
+		email TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		suppressed_at TIMESTAMPTZ DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		email TEXT NOT NULL,
+		event_id TEXT NOT NULL DEFAULT '',
+		type TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		recorded_at TIMESTAMPTZ DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_email ON deliveries (email);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_event ON deliveries (event_id);
+	CREATE TABLE IF NOT EXISTS shadow_bans (
+		pubkey TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		banned_at TIMESTAMPTZ DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS thread_links (
+		thread_id TEXT PRIMARY KEY,
+		trustroots_thread_id TEXT NOT NULL,
+		linked_at TIMESTAMPTZ DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS email_preferences (
+		email TEXT PRIMARY KEY,
+		plain_text BOOLEAN NOT NULL DEFAULT false,
+		updated_at TIMESTAMPTZ DEFAULT now()
+	);`
+
+// PostgresNoteStore keeps processed notes and digest items in PostgreSQL, so
+// replicas of the daemon running in several containers share them
+type PostgresNoteStore struct {
+	DB *sql.DB
+}
+
+// NewPostgresNoteStore connects to a PostgreSQL database and creates the
+// tables when they do not exist yet
+func NewPostgresNoteStore(url string) (*PostgresNoteStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PostgreSQL database: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), postgresConnectTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+	if _, err := db.Exec(postgresNoteStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %v", err)
+	}
+	return &PostgresNoteStore{DB: db}, nil
+}
+
+func (s *PostgresNoteStore) IsNoteProcessed(eventID string) (bool, error) {
+	var count int
+	err := s.DB.QueryRow("SELECT COUNT(*) FROM processed_notes WHERE event_id = $1", eventID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if note is processed: %v", err)
+	}
+	return count > 0, nil
+}
+
+func (s *PostgresNoteStore) IsNotificationProcessed(eventID, userEmail string) (bool, error) {
+	var count int
+	err := s.DB.QueryRow("SELECT COUNT(*) FROM processed_notes WHERE event_id = $1 AND user_email = $2", eventID, userEmail).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if notification is processed: %v", err)
+	}
+	return count > 0, nil
+}
+
+func (s *PostgresNoteStore) MarkNoteProcessed(eventID, authorPubkey, relayURL, userEmail string) error {
+	_, err := s.DB.Exec(`INSERT INTO processed_notes (event_id, author_pubkey, relay_url, user_email) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, eventID, authorPubkey, relayURL, userEmail)
+	if err != nil {
+		return fmt.Errorf("failed to mark note as processed: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) RecordMatchType(eventID, userEmail, matchType string) error {
+	if matchType == "" {
+		return nil
+	}
+	_, err := s.DB.Exec("UPDATE processed_notes SET match_type = $1 WHERE event_id = $2 AND user_email = $3", matchType, eventID, userEmail)
+	if err != nil {
+		return fmt.Errorf("failed to record match type: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) RecordThreadID(eventID, userEmail, thread string) error {
+	_, err := s.DB.Exec("UPDATE processed_notes SET thread_id = $1 WHERE event_id = $2 AND user_email = $3", thread, eventID, userEmail)
+	if err != nil {
+		return fmt.Errorf("failed to record thread: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) PruneProcessedNotes(before time.Time) (int64, error) {
+	if _, err := s.DB.Exec("DELETE FROM deliveries WHERE recorded_at < $1", before); err != nil {
+		return 0, fmt.Errorf("failed to prune deliveries: %v", err)
+	}
+	if _, err := s.DB.Exec("DELETE FROM stored_events WHERE stored_at < $1", before); err != nil {
+		return 0, fmt.Errorf("failed to prune stored events: %v", err)
+	}
+	result, err := s.DB.Exec("DELETE FROM processed_notes WHERE processed_at < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune processed notes: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func (s *PostgresNoteStore) RecordDeletion(eventID, authorPubkey, deletionEventID string) (int64, error) {
+	result, err := s.DB.Exec(`UPDATE processed_notes SET deleted_at = now(), deletion_event_id = $1
+		WHERE event_id = $2 AND author_pubkey = $3 AND deleted_at IS NULL`,
+		deletionEventID, eventID, authorPubkey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record deletion: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func (s *PostgresNoteStore) RecordEarlyDeletion(eventID, authorPubkey, deletionEventID string) error {
+	_, err := s.DB.Exec(`INSERT INTO processed_notes (event_id, author_pubkey, relay_url, user_email, deleted_at, deletion_event_id)
+		VALUES ($1, $2, $3, '', now(), $4) ON CONFLICT DO NOTHING`,
+		eventID, authorPubkey, earlyDeletionRelay, deletionEventID)
+	if err != nil {
+		return fmt.Errorf("failed to record early deletion: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) DeletedBeforeArrival(event *nostr.Event) (bool, error) {
+	var authorPubkey string
+	err := s.DB.QueryRow("SELECT author_pubkey FROM processed_notes WHERE event_id = $1 AND user_email = '' AND relay_url = $2",
+		event.ID, earlyDeletionRelay).Scan(&authorPubkey)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check for early deletion: %v", err)
+	}
+	if authorPubkey == event.PubKey {
+		return true, nil
+	}
+
+	// Only the author may delete an event, early deletions by anyone else are forgotten
+	_, err = s.DB.Exec("DELETE FROM processed_notes WHERE event_id = $1 AND user_email = '' AND relay_url = $2",
+		event.ID, earlyDeletionRelay)
+	if err != nil {
+		return false, fmt.Errorf("failed to forget early deletion: %v", err)
+	}
+	return false, nil
+}
+
+func (s *PostgresNoteStore) StoreEvent(event *nostr.Event, encoding string) error {
+	data, err := encodeStoredEvent(event, encoding)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec("INSERT INTO stored_events (event_id, created_at, encoding, data) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+		event.ID, int64(event.CreatedAt), encoding, data)
+	if err != nil {
+		return fmt.Errorf("failed to store event %s: %v", event.ID, err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) StoredEvent(eventID string) (*nostr.Event, error) {
+	events, err := queryStoredEvents(s.DB, "SELECT encoding, data FROM stored_events WHERE event_id = $1", eventID)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+func (s *PostgresNoteStore) StoredEvents(since, until nostr.Timestamp) ([]*nostr.Event, error) {
+	return queryStoredEvents(s.DB, "SELECT encoding, data FROM stored_events WHERE created_at >= $1 AND created_at <= $2 ORDER BY created_at",
+		int64(since), int64(until))
+}
+
+func (s *PostgresNoteStore) Suppression(email string) (*Suppression, error) {
+	suppressions, err := querySuppressions(s.DB, "SELECT email, reason, suppressed_at FROM suppressions WHERE email = $1", normalizeEmail(email))
+	if err != nil || len(suppressions) == 0 {
+		return nil, err
+	}
+	return &suppressions[0], nil
+}
+
+func (s *PostgresNoteStore) Suppress(email, reason string) error {
+	_, err := s.DB.Exec(`INSERT INTO suppressions (email, reason) VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE SET reason = excluded.reason`, normalizeEmail(email), reason)
+	if err != nil {
+		return fmt.Errorf("failed to suppress %s: %v", email, err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) Unsuppress(email string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM suppressions WHERE email = $1", normalizeEmail(email))
+	if err != nil {
+		return false, fmt.Errorf("failed to unsuppress %s: %v", email, err)
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (s *PostgresNoteStore) Suppressions() ([]Suppression, error) {
+	return querySuppressions(s.DB, "SELECT email, reason, suppressed_at FROM suppressions ORDER BY suppressed_at, email")
+}
+
+func (s *PostgresNoteStore) RecordDelivery(delivery Delivery) error {
+	_, err := s.DB.Exec("INSERT INTO deliveries (email, event_id, type, status, detail) VALUES ($1, $2, $3, $4, $5)",
+		delivery.Email, delivery.EventID, delivery.Type, delivery.Status, delivery.Detail)
+	if err != nil {
+		return fmt.Errorf("failed to record delivery to %s: %v", delivery.Email, err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) Deliveries(email, eventID string, limit int) ([]Delivery, error) {
+	return queryDeliveries(s.DB, `SELECT email, event_id, type, status, detail, recorded_at FROM deliveries
+		WHERE ($1 = '' OR email = $1) AND ($2 = '' OR event_id = $2) ORDER BY id DESC LIMIT $3`,
+		normalizeEmail(email), eventID, limit)
+}
+
+func (s *PostgresNoteStore) ShadowBan(pubkey string) (*ShadowBan, error) {
+	bans, err := queryShadowBans(s.DB, "SELECT pubkey, reason, banned_at FROM shadow_bans WHERE pubkey = $1", pubkey)
+	if err != nil || len(bans) == 0 {
+		return nil, err
+	}
+	return &bans[0], nil
+}
+
+func (s *PostgresNoteStore) AddShadowBan(pubkey, reason string) error {
+	_, err := s.DB.Exec(`INSERT INTO shadow_bans (pubkey, reason) VALUES ($1, $2)
+		ON CONFLICT (pubkey) DO UPDATE SET reason = excluded.reason`, pubkey, reason)
+	if err != nil {
+		return fmt.Errorf("failed to shadow-ban %s: %v", pubkey, err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) RemoveShadowBan(pubkey string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM shadow_bans WHERE pubkey = $1", pubkey)
+	if err != nil {
+		return false, fmt.Errorf("failed to lift the shadow ban of %s: %v", pubkey, err)
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (s *PostgresNoteStore) ShadowBans() ([]ShadowBan, error) {
+	return queryShadowBans(s.DB, "SELECT pubkey, reason, banned_at FROM shadow_bans ORDER BY banned_at, pubkey")
+}
+
+func (s *PostgresNoteStore) LinkThread(thread, trustrootsThread string) error {
+	_, err := s.DB.Exec(`INSERT INTO thread_links (thread_id, trustroots_thread_id) VALUES ($1, $2)
+		ON CONFLICT (thread_id) DO UPDATE SET trustroots_thread_id = excluded.trustroots_thread_id`, thread, trustrootsThread)
+	if err != nil {
+		return fmt.Errorf("failed to link thread %s: %v", thread, err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) TrustrootsThread(thread string) (string, error) {
+	return queryTrustrootsThread(s.DB, "SELECT trustroots_thread_id FROM thread_links WHERE thread_id = $1", thread)
+}
+
+func (s *PostgresNoteStore) PlainText(email string) (bool, error) {
+	return queryPlainText(s.DB, "SELECT plain_text FROM email_preferences WHERE email = $1", normalizeEmail(email))
+}
+
+func (s *PostgresNoteStore) SetPlainText(email string, plainText bool) error {
+	_, err := s.DB.Exec(`INSERT INTO email_preferences (email, plain_text) VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE SET plain_text = excluded.plain_text, updated_at = now()`, normalizeEmail(email), plainText)
+	if err != nil {
+		return fmt.Errorf("failed to save email preferences of %s: %v", email, err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) AddDigestItem(item DigestItem) error {
+	payload, version, err := encodeDigestItem(item)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec("INSERT INTO digest_items (recipient_email, version, payload) VALUES ($1, $2, $3)",
+		item.RecipientEmail, version, payload)
+	if err != nil {
+		return fmt.Errorf("failed to store digest item: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) DigestItems(recipientEmail string) ([]DigestItem, error) {
+	if recipientEmail == "" {
+		return queryDigestItems(s.DB, "SELECT id, version, payload, created_at FROM digest_items ORDER BY id")
+	}
+	return queryDigestItems(s.DB, "SELECT id, version, payload, created_at FROM digest_items WHERE recipient_email = $1 ORDER BY id", recipientEmail)
+}
+
+func (s *PostgresNoteStore) DeleteDigestItems(items []DigestItem) error {
+	for _, item := range items {
+		if _, err := s.DB.Exec("DELETE FROM digest_items WHERE id = $1", item.ID); err != nil {
+			return fmt.Errorf("failed to delete digest item %d: %v", item.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresNoteStore) ClaimDigestItems(items []DigestItem) ([]DigestItem, error) {
+	return claimDigestItems(s.DB, "DELETE FROM digest_items WHERE id = $1", items)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// postmarkTimeout bounds one call of the Postmark API
+const postmarkTimeout = 30 * time.Second
+
+// PostmarkConfig configures the Postmark API provider
+type PostmarkConfig struct {
+	ServerToken string
+	// MessageStream separates notifications from other mail of the server,
+	// e.g. broadcasts; "outbound" is the default transactional stream
+	MessageStream string
+}
+
+// loadPostmarkConfig reads NOSTREMAIL_POSTMARK_SERVER_TOKEN and
+// NOSTREMAIL_POSTMARK_MESSAGE_STREAM (default outbound)
+func loadPostmarkConfig() PostmarkConfig {
+	return PostmarkConfig{
+		ServerToken:   os.Getenv("NOSTREMAIL_POSTMARK_SERVER_TOKEN"),
+		MessageStream: getEnvOrDefault("NOSTREMAIL_POSTMARK_MESSAGE_STREAM", "outbound"),
+	}
+}
+
+// PostmarkTransport delivers emails with the email API of Postmark
+type PostmarkTransport struct {
+	Config   PostmarkConfig
+	Endpoint string
+	Client   *http.Client
+}
+
+// NewPostmarkTransport creates a transport for the Postmark API
+func NewPostmarkTransport(config PostmarkConfig) *PostmarkTransport {
+	return &PostmarkTransport{
+		Config:   config,
+		Endpoint: "https://api.postmarkapp.com",
+		Client:   &http.Client{Timeout: postmarkTimeout},
+	}
+}
+
+// postmarkHeader is a header in email requests
+type postmarkHeader struct {
+	Name  string
+	Value string
+}
+
+// postmarkAttachment is an attachment in email requests
+type postmarkAttachment struct {
+	Name        string
+	Content     []byte // base64 in JSON
+	ContentType string
+	ContentID   string `json:",omitempty"` // cid:<name> for inline attachments
+}
+
+// postmarkEmail is the body of an email request
+type postmarkEmail struct {
+	From          string
+	To            string
+	ReplyTo       string `json:",omitempty"`
+	Subject       string
+	HtmlBody      string `json:",omitempty"`
+	TextBody      string
+	Headers       []postmarkHeader     `json:",omitempty"`
+	Attachments   []postmarkAttachment `json:",omitempty"`
+	Tag           string               `json:",omitempty"`
+	MessageStream string
+}
+
+// postmarkRequest is the email request of an email, tagged with its template name
+func (t *PostmarkTransport) postmarkRequest(email *OutgoingEmail) postmarkEmail {
+	from := (&mail.Address{Name: email.FromName, Address: email.From}).String()
+	request := postmarkEmail{
+		From:          from,
+		To:            email.To,
+		ReplyTo:       email.ReplyTo,
+		Subject:       email.Subject,
+		HtmlBody:      email.HTML,
+		TextBody:      email.Text,
+		Tag:           email.Type,
+		MessageStream: t.Config.MessageStream,
+	}
+	for _, name := range email.HeaderNames() {
+		request.Headers = append(request.Headers, postmarkHeader{name, email.Headers[name]})
+	}
+	for _, attachment := range email.Attachments {
+		postmark := postmarkAttachment{
+			Name:        attachment.Filename,
+			Content:     attachment.Data,
+			ContentType: attachment.ContentType,
+		}
+		if attachment.Inline {
+			postmark.ContentID = "cid:" + attachment.Filename
+		}
+		request.Attachments = append(request.Attachments, postmark)
+	}
+	return request
+}
+
+// Send sends an email and returns the MessageID Postmark gave it, which its
+// webhooks refer to
+func (t *PostmarkTransport) Send(email *OutgoingEmail) (string, error) {
+	body, err := json.Marshal(t.postmarkRequest(email))
+	if err != nil {
+		return "", fmt.Errorf("failed to encode Postmark request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(t.Endpoint, "/")+"/email", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", t.Config.ServerToken)
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Postmark request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read Postmark response: %v", err)
+	}
+	var result struct {
+		ErrorCode int
+		Message   string
+		MessageID string
+	}
+	json.Unmarshal(response, &result)
+	if resp.StatusCode != http.StatusOK || result.ErrorCode != 0 {
+		if result.Message == "" {
+			result.Message = strings.TrimSpace(string(response))
+		}
+		return "", fmt.Errorf("Postmark returned %s (error %d): %s", resp.Status, result.ErrorCode, result.Message)
+	}
+	return result.MessageID, nil
+}
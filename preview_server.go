@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
@@ -58,21 +60,470 @@ var sampleDMData = EmailTemplateData{
 	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
 }
 
+// Sample data for repost preview
+var sampleRepostData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "nostroots@trustroots.org reposted your note",
+	Title:            "Your note was reposted",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"buttonURL":  "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View your note",
+	},
+	EventContent:  "Hosting two travelers in Berlin this weekend, anyone around for a picnic?",
+	EventID:       "sample-note-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// Sample data for zap preview
+var sampleZapData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "You received a zap of 2100 sats from nostroots@trustroots.org",
+	Title:            "You received a zap",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"amountSats": 2100,
+		"buttonURL":  "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View on nostr",
+	},
+	EventContent:  "Thanks for hosting us last week!",
+	EventID:       "sample-zap-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// Sample data for mention preview
+var sampleMentionData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "nostroots@trustroots.org mentioned you in a comment",
+	Title:            "You were mentioned",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"context":       "a comment",
+		"action":        "mentioned you in a comment",
+		"parentLabel":   "In reply to",
+		"parentContent": "Hosting two travelers in Berlin this weekend, anyone around for a picnic?",
+		"parentURL":     "https://njump.me/note1parent123456789abcdefghijklmnopqrstuvwxyz",
+		"media": []MediaItem{
+			{URL: "https://trustroots.org/img/tribes/hitchhikers.jpg", MimeType: "image/jpeg", Alt: "Bread from the bakery"},
+			{URL: "https://example.com/picnic.mp4", MimeType: "video/mp4"},
+		},
+		"buttonURL":  "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View on nostr",
+	},
+	EventContent:  "Count me in, I'll bring some bread! https://trustroots.org/img/tribes/hitchhikers.jpg",
+	EventID:       "sample-comment-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// Sample data for reply preview
+var sampleReplyData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "nostroots@trustroots.org replied to your note",
+	Title:            "New reply to your note",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"parentContent": "Hosting two travelers in Berlin this weekend, anyone around for a picnic?",
+		"parentURL":     "https://njump.me/note1parent123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonURL":     "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText":    "View on nostr",
+	},
+	EventContent:  "Count me in, I'll bring some bread!",
+	EventID:       "sample-reply-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// Sample data for reaction preview
+var sampleReactionData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "🤙 nostroots@trustroots.org reacted to your note",
+	Title:            "🤙 New reaction to your note",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"reaction":   "🤙",
+		"buttonURL":  "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View your note",
+	},
+	EventContent:  "Hosting two travelers in Berlin this weekend, anyone around for a picnic?",
+	EventID:       "sample-note-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// Sample data for article mention preview
+var sampleArticleMentionData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "nostroots@trustroots.org mentioned you in an article",
+	Title:            "You were mentioned",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"context":    "an article",
+		"action":     "mentioned you in an article",
+		"title":      "Three weeks of hospitality in the Balkans",
+		"buttonURL":  "https://njump.me/naddr1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View on nostr",
+	},
+	EventContent:  "## Belgrade\n\nOur first host was @testuser, who showed us the best burek in town and took us along to a concert on the river.\n\n…",
+	EventID:       "sample-article-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// Sample data for channel mention preview
+var sampleChannelMentionData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "nostroots@trustroots.org mentioned you in a channel",
+	Title:            "You were mentioned",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"context":    "a channel",
+		"action":     "mentioned you in a channel",
+		"title":      "Hitchhiking Europe",
+		"titleURL":   "https://njump.me/nevent1channel123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonURL":  "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View on nostr",
+	},
+	EventContent:  "@testuser knows the best spots to get out of Lyon",
+	EventID:       "sample-channel-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// Sample data for new followers preview
+var sampleNewFollowersData = EmailTemplateData{
+	Username:      "testuser",
+	Name:          "Test User",
+	FirstName:     "Test",
+	Email:         "testuser@example.com",
+	HeaderURL:     "https://trustroots.org",
+	FooterURL:     "https://trustroots.org",
+	SupportURL:    "https://trustroots.org/support",
+	ProfileURL:    "https://www.trustroots.org/profile/testuser",
+	Subject:       "👥 You have 2 new followers on nostr",
+	Title:         "👥 New followers",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"followers": []map[string]string{
+			{"name": "nostroots", "url": "https://njump.me/npub1sample123456789abcdefghijklmnopqrstuvwxyz"},
+			{"name": "npub1other…wxyz", "url": "https://njump.me/npub1other123456789abcdefghijklmnopqrstuvwxyz"},
+		},
+		"count":      2,
+		"buttonURL":  "https://njump.me/npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View your profile on nostr",
+	},
+}
+
+// Sample data for rate limit summary preview
+var sampleRateLimitedData = EmailTemplateData{
+	Username:      "testuser",
+	Name:          "Test User",
+	FirstName:     "Test",
+	Email:         "testuser@example.com",
+	HeaderURL:     "https://trustroots.org",
+	FooterURL:     "https://trustroots.org",
+	SupportURL:    "https://trustroots.org/support",
+	ProfileURL:    "https://www.trustroots.org/profile/testuser",
+	Subject:       "🔔 You have 23 more notifications from nostr",
+	Title:         "🔔 More notifications",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"subjects": []string{
+			"💬 nostroots mentioned you",
+			"⚡ nostroots zapped you 21 sats",
+			"🔁 npub1other…wxyz reposted your note",
+		},
+		"count":      23,
+		"unlisted":   20,
+		"buttonURL":  "https://njump.me/npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View your profile on nostr",
+	},
+}
+
+// Sample data for digest preview
+var sampleDigestData = EmailTemplateData{
+	Username:      "testuser",
+	Name:          "Test User",
+	FirstName:     "Test",
+	Email:         "testuser@example.com",
+	HeaderURL:     "https://trustroots.org",
+	FooterURL:     "https://trustroots.org",
+	SupportURL:    "https://trustroots.org/support",
+	ProfileURL:    "https://www.trustroots.org/profile/testuser",
+	Subject:       "📬 Your nostr digest: 3 notifications",
+	Title:         "📬 Your nostr digest",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"senders": []digestSender{
+			{
+				Name:       "nostroots",
+				ProfileURL: "https://njump.me/npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+				Threads: []digestThread{{
+					URL: "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+					Entries: []digestEntry{
+						{Label: "💬 mentioned you", Content: "Hey @testuser, are you hosting in Berlin next week?", CreatedAt: "2024-01-15 10:30 UTC", URL: "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz"},
+						{Label: "💬 mentioned you", Content: "@testuser I could bring dinner!", CreatedAt: "2024-01-15 10:42 UTC", URL: "https://njump.me/note1reply123456789abcdefghijklmnopqrstuvwxyz"},
+					},
+				}},
+			},
+			{
+				Name:       "npub1other…wxyz",
+				ProfileURL: "https://njump.me/npub1other123456789abcdefghijklmnopqrstuvwxyz",
+				Threads: []digestThread{{
+					URL: "https://njump.me/note1repost123456789abcdefghijklmnopqrstuvwxyz",
+					Entries: []digestEntry{
+						{Label: "🔁 reposted your note", Content: "Looking for a couch in Lisbon this summer", CreatedAt: "2024-01-15 11:05 UTC", URL: "https://njump.me/note1repost123456789abcdefghijklmnopqrstuvwxyz"},
+					},
+				}},
+			},
+		},
+		"count":      3,
+		"buttonURL":  "https://njump.me/npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View your profile on nostr",
+	},
+}
+
+// Sample data for npub challenge preview
+var sampleNpubChallengeData = EmailTemplateData{
+	Username:      "testuser",
+	Name:          "Test User",
+	FirstName:     "Test",
+	Email:         "testuser@example.com",
+	HeaderURL:     "https://trustroots.org",
+	FooterURL:     "https://trustroots.org",
+	SupportURL:    "https://trustroots.org/support",
+	ProfileURL:    "https://www.trustroots.org/profile/testuser",
+	Subject:       "🔑 Confirm your nostr key to get notifications by email",
+	Title:         "🔑 Confirm your nostr key",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"validHours": 24,
+		"buttonURL":  "https://notifications.example.org/confirm?token=sample",
+		"buttonText": "Enter your code",
+	},
+}
+
+// Sample data for abuse report preview
+var sampleAbuseReportData = EmailTemplateData{
+	Name:         "Trustroots safety team",
+	FirstName:    "safety team",
+	Email:        "safety@example.com",
+	HeaderURL:    "https://trustroots.org",
+	FooterURL:    "https://trustroots.org",
+	SupportURL:   "https://trustroots.org/support",
+	Subject:      "🚩 Nostr abuse report against testuser",
+	Title:        "🚩 Abuse report on nostr",
+	EventContent: "This account keeps posting fake hosting offers asking for deposits.",
+	EventID:      "sample-report-id",
+	CreatedAt:    "2024-01-15 10:30:00 UTC",
+	SenderNpub:   "npub1reporter123456789abcdefghijklmnopqrstuvwxyz",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	SenderProfileURL: "https://njump.me/npub1reporter123456789abcdefghijklmnopqrstuvwxyz",
+	Content: map[string]interface{}{
+		"reported": []map[string]string{
+			{
+				"username":   "testuser",
+				"profileURL": "https://www.trustroots.org/profile/testuser",
+				"npubURL":    "https://njump.me/npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+				"reportType": "spam",
+			},
+		},
+		"usernames":       "testuser",
+		"reporterName":    "npub1repor…wxyz",
+		"reportedNoteURL": "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonURL":       "https://njump.me/note1report123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText":      "View the report on nostr",
+	},
+}
+
+// Sample data for watched note preview
+var sampleWatchedNoteData = EmailTemplateData{
+	Name:         "Trustroots community team",
+	FirstName:    "community team",
+	Email:        "community@example.com",
+	HeaderURL:    "https://trustroots.org",
+	FooterURL:    "https://trustroots.org",
+	SupportURL:   "https://trustroots.org/support",
+	Subject:      "🔭 Nostr note with #hospex",
+	Title:        "🔭 Watched note on nostr",
+	EventContent: "Looking for a host in Lisbon next week, any #hospex folks around?",
+	EventID:      "sample-watched-note-id",
+	CreatedAt:    "2024-01-15 10:30:00 UTC",
+	SenderNpub:   "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	SenderProfileURL: "https://njump.me/npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	Content: map[string]interface{}{
+		"matches":    "#hospex",
+		"authorName": "npub1sampl…wxyz",
+		"buttonURL":  "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText": "View the note on nostr",
+	},
+}
+
+// Sample data for quote preview
+var sampleQuoteData = EmailTemplateData{
+	Username:         "testuser",
+	Name:             "Test User",
+	FirstName:        "Test",
+	Email:            "testuser@example.com",
+	HeaderURL:        "https://trustroots.org",
+	FooterURL:        "https://trustroots.org",
+	SupportURL:       "https://trustroots.org/support",
+	ProfileURL:       "https://www.trustroots.org/profile/testuser",
+	SenderProfileURL: "https://www.trustroots.org/profile/nostroots",
+	Subject:          "nostroots@trustroots.org quoted your note",
+	Title:            "You were mentioned",
+	From: EmailSender{
+		Name:    "Trustroots Nostr",
+		Address: "noreply@trustroots.org",
+	},
+	Content: map[string]interface{}{
+		"context":       "a quote",
+		"action":        "quoted your note",
+		"parentContent": "Hosting two travelers in Berlin this weekend, anyone around for a picnic?",
+		"parentURL":     "https://njump.me/note1parent123456789abcdefghijklmnopqrstuvwxyz",
+		"parentLabel":   "Your note",
+		"buttonURL":     "https://njump.me/note1sample123456789abcdefghijklmnopqrstuvwxyz",
+		"buttonText":    "View on nostr",
+	},
+	EventContent:  "This is what Trustroots is all about 💚",
+	EventID:       "sample-quote-event-id-12345",
+	CreatedAt:     time.Now().Format("2006-01-02 15:04:05 UTC"),
+	SenderNIP5:    "nostroots@trustroots.org",
+	SenderNpub:    "npub1sample123456789abcdefghijklmnopqrstuvwxyz",
+	RecipientNpub: "npub1recipient123456789abcdefghijklmnopqrstuvwxyz",
+}
+
 // renderHTMLTemplate renders the HTML email template
 func renderHTMLTemplate(templateName string, data EmailTemplateData) (string, error) {
 	// Load HTML templates
-	htmlTemplates, err := template.ParseGlob("templates/html/*.html")
+	htmlTemplates, err := parseHTMLTemplates(templateFiles)
 	if err != nil {
 		return "", fmt.Errorf("failed to load HTML templates: %v", err)
 	}
 
-	var buf bytes.Buffer
-	if err := htmlTemplates.ExecuteTemplate(&buf, templateName+".html", data); err != nil {
-		return "", fmt.Errorf("failed to execute HTML template %s: %v", templateName, err)
+	body, err := executeHTMLTemplate(htmlTemplates, templateName, data)
+	if err != nil {
+		return "", err
 	}
 
 	// Inline CSS for better email client compatibility
-	prem, err := premailer.NewPremailerFromString(buf.String(), premailer.NewOptions())
+	prem, err := premailer.NewPremailerFromString(body, premailer.NewOptions())
 	if err != nil {
 		return "", fmt.Errorf("failed to create premailer: %v", err)
 	}
@@ -88,7 +539,7 @@ func renderHTMLTemplate(templateName string, data EmailTemplateData) (string, er
 // renderTextTemplate renders the plain text email template
 func renderTextTemplate(templateName string, data EmailTemplateData) (string, error) {
 	// Load text templates
-	textTemplates, err := template.ParseGlob("templates/text/*.txt")
+	textTemplates, err := parseTextTemplates(templateFiles)
 	if err != nil {
 		return "", fmt.Errorf("failed to load text templates: %v", err)
 	}
@@ -101,33 +552,76 @@ func renderTextTemplate(templateName string, data EmailTemplateData) (string, er
 	return buf.String(), nil
 }
 
-// handleDMPreview renders the direct message email preview
-func handleDMPreview(w http.ResponseWriter, r *http.Request) {
-	html, err := renderHTMLTemplate("nostr_direct_message", sampleDMData)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error rendering template: %v", err), http.StatusInternalServerError)
-		return
+// emailPreview describes an email template shown by the preview server
+type emailPreview struct {
+	Path         string // URL segment, e.g. "dm" for /preview/dm/html
+	TemplateName string
+	Title        string
+	Description  string
+	Data         EmailTemplateData
+}
+
+// emailPreviews lists every email template with its sample data
+var emailPreviews = []emailPreview{
+	{"dm", "nostr_direct_message", "Direct Message Notifications", "When someone sends an encrypted direct message", sampleDMData},
+	{"repost", "nostr_repost", "Repost Notifications", "When someone reposts one of your notes", sampleRepostData},
+	{"reaction", "nostr_reaction", "Reaction Notifications", "When someone reacts to one of your notes", sampleReactionData},
+	{"zap", "nostr_zap", "Zap Notifications", "When someone zaps you", sampleZapData},
+	{"mention", "nostr_mention", "Mention Notifications", "When someone mentions you, e.g. in a comment", sampleMentionData},
+	{"reply", "nostr_reply", "Reply Notifications", "When someone replies to one of your notes", sampleReplyData},
+	{"article", "nostr_mention", "Article Mention Notifications", "When someone mentions you in a long-form article", sampleArticleMentionData},
+	{"channel", "nostr_mention", "Channel Mention Notifications", "When someone mentions you in a public channel", sampleChannelMentionData},
+	{"followers", "nostr_new_followers", "New Follower Notifications", "Daily summary of people who started following you", sampleNewFollowersData},
+	{"ratelimit", "nostr_rate_limited", "Rate Limit Summaries", "Notifications held back after a user reached their hourly or daily email limit", sampleRateLimitedData},
+	{"digest", "nostr_digest", "Digests", "Hourly or daily summary of notifications for users who chose digests", sampleDigestData},
+	{"quote", "nostr_mention", "Quote Notifications", "When someone quotes one of your notes", sampleQuoteData},
+	{"challenge", "nostr_npub_challenge", "Npub Confirmation", "Link to enter the code sent by DM, to confirm owning an npub", sampleNpubChallengeData},
+	{"report", "nostr_abuse_report", "Abuse Report Alerts", "Sent to the moderator email when a user is reported on nostr", sampleAbuseReportData},
+	{"watch", "nostr_watched_note", "Watched Hashtags and Keywords", "Sent to the watch email when a note has a watched hashtag or keyword", sampleWatchedNoteData},
+}
+
+// handleHTMLPreview renders the HTML version of an email preview
+func handleHTMLPreview(preview emailPreview) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		html, err := renderHTMLTemplate(preview.TemplateName, preview.Data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error rendering template: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, html)
 	}
+}
 
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, html)
+// handleTextPreview renders the plain text version of an email preview
+func handleTextPreview(preview emailPreview) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		text, err := renderTextTemplate(preview.TemplateName, preview.Data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error rendering template: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, text)
+	}
 }
 
-// handleTextDMPreview renders the direct message text email preview
-func handleTextDMPreview(w http.ResponseWriter, r *http.Request) {
-	text, err := renderTextTemplate("nostr_direct_message", sampleDMData)
+// handleTemplateDocs renders the template variable reference
+func handleTemplateDocs(w http.ResponseWriter, r *http.Request) {
+	html, err := renderTemplateDocsHTML()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error rendering template: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error rendering template docs: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprint(w, text)
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, html)
 }
 
-// handleIndex renders the main index page with links to all previews
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	html := `
+// indexPage is the preview server landing page with links to all previews
+var indexPage = template.Must(template.New("index").Parse(`
 <!DOCTYPE html>
 <html>
 <head>
@@ -157,13 +651,21 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
     <div class="container">
         <h1>Trustroots Nostr Email Preview</h1>
         <p>Preview how the email notifications will look to users.</p>
-        
+        {{range .}}
         <div class="preview-section">
-            <h2>Direct Message Notifications</h2>
-            <div class="description">When someone sends an encrypted direct message</div>
+            <h2>{{.Title}}</h2>
+            <div class="description">{{.Description}}</div>
             <div class="preview-links">
-                <a href="/preview/dm/html" target="_blank">HTML Preview</a>
-                <a href="/preview/dm/text" target="_blank">Text Preview</a>
+                <a href="/preview/{{.Path}}/html" target="_blank">HTML Preview</a>
+                <a href="/preview/{{.Path}}/text" target="_blank">Text Preview</a>
+            </div>
+        </div>
+        {{end}}
+        <div class="preview-section">
+            <h2>Template Reference</h2>
+            <div class="description">Every variable and helper available to template authors</div>
+            <div class="preview-links">
+                <a href="/docs/templates" target="_blank">Template Variables</a>
             </div>
         </div>
         
@@ -179,25 +681,53 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         </div>
     </div>
 </body>
-</html>`
+</html>`))
 
+// handleIndex renders the main index page with links to all previews
+func handleIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, html)
+	if err := indexPage.Execute(w, emailPreviews); err != nil {
+		http.Error(w, fmt.Sprintf("Error rendering index: %v", err), http.StatusInternalServerError)
+	}
 }
 
-func startPreviewServer() {
-	// Set up routes
-	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/preview/dm/html", handleDMPreview)
-	http.HandleFunc("/preview/dm/text", handleTextDMPreview)
+// runPreview implements `nostremail preview [--port 8080]`
+func runPreview(args []string) {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	port := fs.String("port", "8080", "Port of the email preview server")
+	templateDir := fs.String("template-dir", os.Getenv("NOSTREMAIL_TEMPLATE_DIR"), "Directory of templates overriding the built-in ones, e.g. templates to preview edits without rebuilding")
+	fs.Parse(args)
 
-	// Start server
-	port := "8080"
+	if *templateDir != "" {
+		if err := checkTemplateDir(*templateDir); err != nil {
+			log.Fatal("❌ --template-dir: ", err)
+		}
+	}
+	useTemplateDir(*templateDir)
+	startPreviewServer(*port)
+}
+
+// previewRoutes returns the routes of the preview server
+func previewRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleIndex)
+	for _, preview := range emailPreviews {
+		mux.HandleFunc("/preview/"+preview.Path+"/html", handleHTMLPreview(preview))
+		mux.HandleFunc("/preview/"+preview.Path+"/text", handleTextPreview(preview))
+	}
+	mux.HandleFunc("/docs/templates", handleTemplateDocs)
+	return mux
+}
+
+// startPreviewServer serves the email previews and template reference
+func startPreviewServer(port string) {
 	fmt.Printf("🚀 Email preview server starting on http://localhost:%s\n", port)
 	fmt.Println("📧 Available previews:")
-	fmt.Println("   • HTML Direct Message: http://localhost:8080/preview/dm/html")
-	fmt.Println("   • Text Direct Message: http://localhost:8080/preview/dm/text")
+	for _, preview := range emailPreviews {
+		fmt.Printf("   • %s: http://localhost:%s/preview/%s/html (text: /preview/%s/text)\n", preview.Title, port, preview.Path, preview.Path)
+	}
+	fmt.Printf("   • Template Variables: http://localhost:%s/docs/templates\n", port)
 	fmt.Println("\nPress Ctrl+C to stop the server")
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, previewRoutes()))
 }
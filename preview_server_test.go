@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPreviewRoutes(t *testing.T) {
+	server := httptest.NewServer(previewRoutes())
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode, string(body)
+	}
+
+	code, index := get("/")
+	if code != http.StatusOK {
+		t.Fatalf("index returned %d", code)
+	}
+	for _, preview := range emailPreviews {
+		for _, format := range []string{"html", "text"} {
+			path := "/preview/" + preview.Path + "/" + format
+			if !strings.Contains(index, path) {
+				t.Errorf("index does not link %s", path)
+			}
+			code, body := get(path)
+			if code != http.StatusOK || strings.TrimSpace(body) == "" {
+				t.Errorf("%s returned %d: %.200s", path, code, body)
+			}
+		}
+	}
+	if code, _ := get("/docs/templates"); code != http.StatusOK {
+		t.Errorf("template reference returned %d", code)
+	}
+}
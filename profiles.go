@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip27"
+)
+
+// ProfileNames resolves pubkeys to human-readable names: the Trustroots
+// username of monitored users, else the name in the profile (kind 0) fetched
+// from the relays. Fetched profiles are cached, including misses, and shared
+// in Cache when set.
+type ProfileNames struct {
+	Users  map[string]User // monitored users by hex pubkey
+	Pool   *nostr.SimplePool
+	Relays []string
+	Cache  *RedisCache
+
+	mu       sync.Mutex
+	profiles map[string]profileContent
+}
+
+// profileContent holds the fields of a kind 0 profile we use
+type profileContent struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	NIP05       string `json:"nip05"`
+	Picture     string `json:"picture"`
+	LUD16       string `json:"lud16"` // lightning address, see lnurl.go
+	LUD06       string `json:"lud06"`
+}
+
+// NewProfileNames creates a name resolver for the given users and relays
+func NewProfileNames(users map[string]User, pool *nostr.SimplePool, relays []string) *ProfileNames {
+	return &ProfileNames{
+		Users:    users,
+		Pool:     pool,
+		Relays:   relays,
+		profiles: make(map[string]profileContent),
+	}
+}
+
+// Name returns the name of a pubkey, or "" when it has none we know of
+func (p *ProfileNames) Name(hexPubkey string) string {
+	if user, exists := p.Users[hexPubkey]; exists && user.Username != "" {
+		return user.Username
+	}
+	profile := p.profile(hexPubkey)
+	name := profile.DisplayName
+	if name == "" {
+		name = profile.Name
+	}
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// NIP05 returns the NIP-05 identifier a pubkey claims in its profile, or ""
+func (p *ProfileNames) NIP05(hexPubkey string) string {
+	return strings.TrimSpace(p.profile(hexPubkey).NIP05)
+}
+
+// Picture returns the URL of a pubkey's profile picture, or "" when its
+// profile has no http(s) picture
+func (p *ProfileNames) Picture(hexPubkey string) string {
+	picture, err := url.Parse(strings.TrimSpace(p.profile(hexPubkey).Picture))
+	if err != nil || (picture.Scheme != "https" && picture.Scheme != "http") || picture.Host == "" {
+		return ""
+	}
+	return picture.String()
+}
+
+// Forget drops the cached profile of a pubkey, it is fetched again when needed
+func (p *ProfileNames) Forget(hexPubkey string) {
+	p.mu.Lock()
+	delete(p.profiles, hexPubkey)
+	p.mu.Unlock()
+	if p.Cache != nil {
+		if err := p.Cache.Delete("profile:" + hexPubkey); err != nil {
+			fmt.Printf("⚠️  Failed to forget profile of %s in Redis: %v\n", hexPubkey, err)
+		}
+	}
+}
+
+// profile returns the profile of a pubkey from the relays, cached
+func (p *ProfileNames) profile(hexPubkey string) profileContent {
+	if p.Pool == nil {
+		return profileContent{}
+	}
+
+	p.mu.Lock()
+	profile, cached := p.profiles[hexPubkey]
+	p.mu.Unlock()
+	if cached {
+		return profile
+	}
+
+	shared := false
+	if p.Cache != nil {
+		var err error
+		shared, err = p.Cache.GetJSON("profile:"+hexPubkey, &profile)
+		if err != nil {
+			fmt.Printf("⚠️  Redis lookup of profile %s failed: %v\n", hexPubkey, err)
+		}
+	}
+	if !shared {
+		filter := nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}, Authors: []string{hexPubkey}}
+		if event, err := fetchLatestEvent(filter, p.Pool, p.Relays); err == nil {
+			if json.Unmarshal([]byte(event.Content), &profile) != nil {
+				profile = profileContent{}
+			}
+		}
+		if p.Cache != nil {
+			if err := p.Cache.SetJSON("profile:"+hexPubkey, profile, redisProfileTTL); err != nil {
+				fmt.Printf("⚠️  Failed to share profile of %s in Redis: %v\n", hexPubkey, err)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.profiles[hexPubkey] = profile
+	p.mu.Unlock()
+	return profile
+}
+
+// renderMentions replaces nostr:npub1… and nostr:nprofile1… references in
+// content with @names (see NIP-27), so emails don't show bech32 mid-sentence.
+// Profiles without a known name are shown as an abbreviated npub.
+func renderMentions(content string, names *ProfileNames) string {
+	if !strings.Contains(content, "nostr:") {
+		return content
+	}
+
+	var rendered strings.Builder
+	next := 0
+	for block := range nip27.Parse(content) {
+		profile, ok := block.Pointer.(nostr.ProfilePointer)
+		if !ok {
+			continue
+		}
+		rendered.WriteString(content[next:block.Start])
+		next = block.Start + len(block.Text)
+
+		name := ""
+		if names != nil {
+			name = names.Name(profile.PublicKey)
+		}
+		if name == "" {
+			npub, err := hexToNpub(profile.PublicKey)
+			if err != nil {
+				rendered.WriteString(block.Text)
+				continue
+			}
+			name = shortNpub(npub)
+		}
+		rendered.WriteString("@" + name)
+	}
+	rendered.WriteString(content[next:])
+	return rendered.String()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// notePruneInterval is how often processed notes past their retention are removed
+const notePruneInterval = time.Hour
+
+// checkNoteRetention makes sure pruned events cannot be emailed again: events
+// older than the retention must be rejected by the timestamp limits
+func checkNoteRetention(retention time.Duration, limits TimestampLimits) error {
+	if retention <= 0 {
+		return nil
+	}
+	if limits.MaxAge <= 0 || limits.Action != timestampActionReject {
+		return fmt.Errorf("needs NOSTREMAIL_MAX_EVENT_AGE with NOSTREMAIL_TIMESTAMP_ACTION=reject, pruned events would be emailed again")
+	}
+	if retention <= limits.MaxAge {
+		return fmt.Errorf("%s must be longer than NOSTREMAIL_MAX_EVENT_AGE (%s), pruned events would be emailed again", retention, limits.MaxAge)
+	}
+	return nil
+}
+
+// pruneProcessedNotes removes processed notes, stored events and deliveries
+// recorded before the given time
+func pruneProcessedNotes(db *sql.DB, before time.Time) (int64, error) {
+	// processed_at, stored_at and recorded_at hold CURRENT_TIMESTAMP, UTC in this format
+	cutoff := before.UTC().Format("2006-01-02 15:04:05")
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if version >= schemaStoredEvents {
+		if _, err := db.Exec("DELETE FROM stored_events WHERE stored_at < ?", cutoff); err != nil {
+			return 0, fmt.Errorf("failed to prune stored events: %v", err)
+		}
+	}
+	if version >= schemaDeliveries {
+		if _, err := db.Exec("DELETE FROM deliveries WHERE recorded_at < ?", cutoff); err != nil {
+			return 0, fmt.Errorf("failed to prune deliveries: %v", err)
+		}
+	}
+	result, err := db.Exec("DELETE FROM processed_notes WHERE processed_at < ?", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune processed notes: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// runNotePrune removes processed notes older than the retention, forever
+func runNotePrune(notes NoteStore, retention time.Duration) {
+	for {
+		pruned, err := notes.PruneProcessedNotes(time.Now().Add(-retention))
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		} else if pruned > 0 {
+			fmt.Printf("🧹 Pruned %d processed notes older than %s\n", pruned, retention)
+		}
+		time.Sleep(notePruneInterval)
+	}
+}
+
+// runPrune implements `nostremail prune --older-than <duration> [--db path] [--postgres url]`
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 0, "Remove processed notes recorded longer ago than this, e.g. 8760h")
+	dbPath := fs.String("db", processedNotesDBPath, "Path of the processed notes database")
+	postgresURL := fs.String("postgres", "", "Prune the PostgreSQL note store at this URL instead")
+	fs.Parse(args)
+
+	if *olderThan <= 0 {
+		return fmt.Errorf("--older-than is required")
+	}
+	before := time.Now().Add(-*olderThan)
+
+	if *postgresURL != "" {
+		notes, err := NewPostgresNoteStore(*postgresURL)
+		if err != nil {
+			return err
+		}
+		defer notes.DB.Close()
+		pruned, err := notes.PruneProcessedNotes(before)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("🧹 Pruned %d processed notes older than %s from PostgreSQL\n", pruned, *olderThan)
+		return nil
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		return fmt.Errorf("cannot open %s: %v", *dbPath, err)
+	}
+	db, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	defer db.Close()
+
+	pruned, err := pruneProcessedNotes(db, before)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🧹 Pruned %d processed notes older than %s from %s\n", pruned, *olderThan, *dbPath)
+
+	// SQLite reuses the freed pages, VACUUM gives them back to the filesystem
+	if pruned > 0 {
+		if _, err := db.Exec("VACUUM"); err != nil {
+			return fmt.Errorf("failed to vacuum database: %v", err)
+		}
+	}
+	return nil
+}
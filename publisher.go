@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// minPublishBackoff is the first pause after a relay reports rate limiting
+	minPublishBackoff = 5 * time.Second
+	// maxPublishBackoff caps the pause after repeated rate limiting
+	maxPublishBackoff = 10 * time.Minute
+	// maxPublishWait is how long Publish blocks for a throttled relay before deferring instead
+	maxPublishWait = 30 * time.Second
+)
+
+// relayThrottle tracks rate limiting reported by a single relay
+type relayThrottle struct {
+	until   time.Time
+	backoff time.Duration
+}
+
+// RelayPublisher publishes events to relays and backs off from relays that
+// report rate limiting through OK reasons or NOTICE messages
+type RelayPublisher struct {
+	mu        sync.Mutex
+	relays    map[string]*nostr.Relay
+	throttles map[string]*relayThrottle
+}
+
+// NewRelayPublisher creates a new relay publisher
+func NewRelayPublisher() *RelayPublisher {
+	return &RelayPublisher{
+		relays:    make(map[string]*nostr.Relay),
+		throttles: make(map[string]*relayThrottle),
+	}
+}
+
+// isRateLimitMessage reports whether an OK reason or NOTICE says we are publishing too fast
+func isRateLimitMessage(message string) bool {
+	message = strings.ToLower(message)
+	// NIP-01 machine readable prefix, go-nostr reports OK reasons as "msg: <reason>"
+	if strings.HasPrefix(strings.TrimPrefix(message, "msg: "), "rate-limited:") {
+		return true
+	}
+	for _, phrase := range []string{"rate limit", "rate-limit", "too many", "too fast", "slow down"} {
+		if strings.Contains(message, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteRateLimit doubles the backoff for a relay
+func (p *RelayPublisher) noteRateLimit(url, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	throttle, exists := p.throttles[url]
+	if !exists {
+		throttle = &relayThrottle{}
+		p.throttles[url] = throttle
+	}
+	throttle.backoff *= 2
+	if throttle.backoff < minPublishBackoff {
+		throttle.backoff = minPublishBackoff
+	}
+	if throttle.backoff > maxPublishBackoff {
+		throttle.backoff = maxPublishBackoff
+	}
+	throttle.until = time.Now().Add(throttle.backoff)
+	fmt.Printf("🐢 %s is rate limiting us (%s), pausing publishing for %s\n", url, reason, throttle.backoff)
+}
+
+// noteSuccess forgets the backoff of a relay after a successful publish
+func (p *RelayPublisher) noteSuccess(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.throttles, url)
+}
+
+// throttledFor returns how long publishing to a relay should still wait
+func (p *RelayPublisher) throttledFor(url string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	throttle, exists := p.throttles[url]
+	if !exists {
+		return 0
+	}
+	if wait := time.Until(throttle.until); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// connect returns a connection to a relay, watching its NOTICEs for rate limiting
+func (p *RelayPublisher) connect(ctx context.Context, url string) (*nostr.Relay, error) {
+	p.mu.Lock()
+	relay, exists := p.relays[url]
+	p.mu.Unlock()
+	if exists && relay.IsConnected() {
+		return relay, nil
+	}
+
+	relay, err := nostr.RelayConnect(ctx, url, nostr.WithNoticeHandler(func(notice string) {
+		if isRateLimitMessage(notice) {
+			p.noteRateLimit(url, notice)
+		}
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", url, err)
+	}
+
+	p.mu.Lock()
+	p.relays[url] = relay
+	p.mu.Unlock()
+	return relay, nil
+}
+
+// publishToRelay publishes an event to a single relay, waiting out short throttles.
+// It returns the remaining throttle when the relay should be retried later.
+func (p *RelayPublisher) publishToRelay(ctx context.Context, url string, event nostr.Event) (time.Duration, error) {
+	if wait := p.throttledFor(url); wait > 0 {
+		if wait > maxPublishWait {
+			return wait, nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	relay, err := p.connect(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := relay.Publish(ctx, event); err != nil {
+		if isRateLimitMessage(err.Error()) {
+			p.noteRateLimit(url, err.Error())
+			return p.throttledFor(url), nil
+		}
+		return 0, fmt.Errorf("failed to publish to %s: %v", url, err)
+	}
+
+	p.noteSuccess(url)
+	return 0, nil
+}
+
+// Publish publishes an event to the given relays. Relays that are rate limiting
+// us are waited for briefly; if the pause is longer, publishing to them is
+// deferred and retried in the background once the pause is over.
+func (p *RelayPublisher) Publish(ctx context.Context, urls []string, event nostr.Event) (published int) {
+	for _, url := range urls {
+		retryIn, err := p.publishToRelay(ctx, url, event)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			continue
+		}
+		if retryIn > 0 {
+			p.deferPublish(url, event, retryIn)
+			continue
+		}
+		published++
+	}
+	return published
+}
+
+// deferPublish retries publishing to a rate limiting relay once its pause is over
+func (p *RelayPublisher) deferPublish(url string, event nostr.Event, retryIn time.Duration) {
+	fmt.Printf("⏳ Deferring event %s to %s for %s\n", event.ID, url, retryIn.Round(time.Second))
+	time.AfterFunc(retryIn, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), maxPublishWait)
+		defer cancel()
+
+		retryIn, err := p.publishToRelay(ctx, url, event)
+		if err != nil {
+			fmt.Printf("⚠️  Deferred publish failed: %v\n", err)
+			return
+		}
+		if retryIn > 0 {
+			p.deferPublish(url, event, retryIn)
+			return
+		}
+		fmt.Printf("✅ Deferred event %s published to %s\n", event.ID, url)
+	})
+}
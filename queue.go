@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Queued email states
+const (
+	queuePending = "pending"
+	queueSending = "sending"
+	queueDead    = "dead" // gave up after MaxAttempts, see `nostremail queue`
+)
+
+// queuePollInterval is how often idle workers look for emails that became
+// due; queueRetryDelay doubles after every failed attempt up to
+// queueMaxRetryDelay
+const (
+	queuePollInterval  = 5 * time.Second
+	queueRetryDelay    = time.Minute
+	queueMaxRetryDelay = 2 * time.Hour
+)
+
+// EmailQueue keeps outgoing emails in the email_queue table of
+// processed_notes.db until they are sent, so neither SMTP failures nor
+// restarts lose them. Failed emails are retried with an exponential backoff
+// and end up dead after MaxAttempts attempts.
+type EmailQueue struct {
+	DB          *sql.DB
+	Workers     int
+	MaxAttempts int
+
+	mu   sync.Mutex // claims of the workers
+	wake chan struct{}
+}
+
+// QueuedEmail is an email in the queue
+type QueuedEmail struct {
+	ID            int64
+	Job           EmailJob
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// NewEmailQueue opens the queue, returning emails that were being sent when
+// the daemon stopped to the queue; they may have been sent already
+func NewEmailQueue(db *sql.DB, workers, maxAttempts int) (*EmailQueue, error) {
+	if _, err := db.Exec("UPDATE email_queue SET status = ? WHERE status = ?", queuePending, queueSending); err != nil {
+		return nil, fmt.Errorf("failed to recover the email queue: %v", err)
+	}
+	return &EmailQueue{
+		DB:          db,
+		Workers:     workers,
+		MaxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+// Enqueue adds an email to be sent from a time on
+func (q *EmailQueue) Enqueue(job EmailJob, notBefore time.Time) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode email to %s: %v", job.To, err)
+	}
+	_, err = q.DB.Exec(`INSERT INTO email_queue (job, recipient, event_id, event_author, status, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, string(data), job.To, job.EventID, job.EventAuthor, queuePending, notBefore.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to queue email to %s: %v", job.To, err)
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Cancel removes the pending emails about an event by its author and
+// returns them
+func (q *EmailQueue) Cancel(eventID, authorPubkey string) ([]EmailJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	emails, err := q.query("WHERE status = ? AND event_id = ? AND event_author = ?", queuePending, eventID, authorPubkey)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []EmailJob
+	for _, email := range emails {
+		if _, err := q.DB.Exec("DELETE FROM email_queue WHERE id = ?", email.ID); err != nil {
+			return jobs, fmt.Errorf("failed to cancel email to %s: %v", email.Job.To, err)
+		}
+		jobs = append(jobs, email.Job)
+	}
+	return jobs, nil
+}
+
+// Emails lists the queued emails with a status, of any status for ""
+func (q *EmailQueue) Emails(status string) ([]QueuedEmail, error) {
+	return q.query("WHERE (? = '' OR status = ?) ORDER BY id", status, status)
+}
+
+// Retry returns a dead email to the queue, due now, and reports whether
+// there was one
+func (q *EmailQueue) Retry(id int64) (bool, error) {
+	result, err := q.DB.Exec("UPDATE email_queue SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ? AND status = ?",
+		queuePending, time.Now().Unix(), id, queueDead)
+	if err != nil {
+		return false, fmt.Errorf("failed to retry email %d: %v", id, err)
+	}
+	retried, err := result.RowsAffected()
+	return retried > 0, err
+}
+
+// Drop removes an email that is not being sent and reports whether there was one
+func (q *EmailQueue) Drop(id int64) (bool, error) {
+	result, err := q.DB.Exec("DELETE FROM email_queue WHERE id = ? AND status != ?", id, queueSending)
+	if err != nil {
+		return false, fmt.Errorf("failed to drop email %d: %v", id, err)
+	}
+	dropped, err := result.RowsAffected()
+	return dropped > 0, err
+}
+
+// query reads the queued emails selected by a WHERE clause
+func (q *EmailQueue) query(where string, args ...interface{}) ([]QueuedEmail, error) {
+	rows, err := q.DB.Query("SELECT id, job, status, attempts, next_attempt_at, last_error FROM email_queue "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the email queue: %v", err)
+	}
+	defer rows.Close()
+
+	var emails []QueuedEmail
+	for rows.Next() {
+		var email QueuedEmail
+		var data string
+		var nextAttemptAt int64
+		if err := rows.Scan(&email.ID, &data, &email.Status, &email.Attempts, &nextAttemptAt, &email.LastError); err != nil {
+			return nil, fmt.Errorf("failed to read queued email: %v", err)
+		}
+		if err := json.Unmarshal([]byte(data), &email.Job); err != nil {
+			return nil, fmt.Errorf("failed to decode queued email %d: %v", email.ID, err)
+		}
+		email.NextAttemptAt = time.Unix(nextAttemptAt, 0)
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// claim marks the next due email as being sent, nil when none is due
+func (q *EmailQueue) claim() (*QueuedEmail, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	emails, err := q.query("WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT 1", queuePending, time.Now().Unix())
+	if err != nil || len(emails) == 0 {
+		return nil, err
+	}
+	if _, err := q.DB.Exec("UPDATE email_queue SET status = ? WHERE id = ?", queueSending, emails[0].ID); err != nil {
+		return nil, fmt.Errorf("failed to claim queued email: %v", err)
+	}
+	return &emails[0], nil
+}
+
+// retryDelay is the backoff after a number of failed attempts
+func retryDelay(attempts int) time.Duration {
+	delay := queueRetryDelay
+	for i := 1; i < attempts && delay < queueMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > queueMaxRetryDelay {
+		delay = queueMaxRetryDelay
+	}
+	return delay
+}
+
+// finish removes a sent email, or schedules the next attempt of a failed one
+// and reports whether it is dead
+func (q *EmailQueue) finish(email *QueuedEmail, sendErr error) (dead bool, err error) {
+	if sendErr == nil {
+		_, err = q.DB.Exec("DELETE FROM email_queue WHERE id = ?", email.ID)
+		return false, err
+	}
+	attempts := email.Attempts + 1
+	status := queuePending
+	if attempts >= q.MaxAttempts {
+		status = queueDead
+	}
+	_, err = q.DB.Exec("UPDATE email_queue SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+		status, attempts, time.Now().Add(retryDelay(attempts)).Unix(), sendErr.Error(), email.ID)
+	return status == queueDead, err
+}
+
+// Run starts the workers, which send due emails with send; deadLetter is
+// called for emails that failed MaxAttempts times
+func (q *EmailQueue) Run(send func(EmailJob) error, deadLetter func(EmailJob, error)) {
+	for i := 0; i < q.Workers; i++ {
+		go q.work(send, deadLetter)
+	}
+}
+
+func (q *EmailQueue) work(send func(EmailJob) error, deadLetter func(EmailJob, error)) {
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		email, err := q.claim()
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+		if email == nil {
+			select {
+			case <-q.wake:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		sendErr := send(email.Job)
+		dead, err := q.finish(email, sendErr)
+		if err != nil {
+			fmt.Printf("⚠️  Failed to update queued email %d: %v\n", email.ID, err)
+		}
+		switch {
+		case dead:
+			deadLetter(email.Job, fmt.Errorf("gave up after %d attempts: %v", email.Attempts+1, sendErr))
+		case sendErr != nil:
+			fmt.Printf("🔁 Retrying email to %s in %s: %v\n", email.Job.To, retryDelay(email.Attempts+1), sendErr)
+		}
+	}
+}
+
+// runQueue implements `nostremail queue list|retry|drop [--db path]`
+func runQueue(args []string) error {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	dbPath := fs.String("db", processedNotesDBPath, "Path of the processed notes database")
+	dead := fs.Bool("dead", false, "Only list dead emails")
+	usage := fmt.Errorf("usage: nostremail queue [--db path] list [--dead] | retry <id>|all | drop <id>")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usage
+	}
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	if command == "list" {
+		// --dead may follow the command
+		fs.Parse(rest)
+		rest = fs.Args()
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		return fmt.Errorf("cannot open %s: %v", *dbPath, err)
+	}
+	db, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	defer db.Close()
+	queue := &EmailQueue{DB: db}
+
+	switch {
+	case command == "list" && len(rest) == 0:
+		status := ""
+		if *dead {
+			status = queueDead
+		}
+		emails, err := queue.Emails(status)
+		if err != nil {
+			return err
+		}
+		for _, email := range emails {
+			event := email.Job.EventID
+			if event == "" {
+				event = "-"
+			}
+			fmt.Printf("%d | %s | %d attempts | next %s | %s | %s | %s | %s\n", email.ID, email.Status, email.Attempts,
+				email.NextAttemptAt.UTC().Format("2006-01-02 15:04:05"), email.Job.To, email.Job.Type, event, email.LastError)
+		}
+		fmt.Fprintf(os.Stderr, "%d queued emails\n", len(emails))
+	case command == "retry" && len(rest) == 1 && rest[0] == "all":
+		emails, err := queue.Emails(queueDead)
+		if err != nil {
+			return err
+		}
+		for _, email := range emails {
+			if _, err := queue.Retry(email.ID); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("🔁 Returned %d dead emails to the queue\n", len(emails))
+	case (command == "retry" || command == "drop") && len(rest) == 1:
+		id, err := strconv.ParseInt(rest[0], 10, 64)
+		if err != nil {
+			return usage
+		}
+		if command == "retry" {
+			retried, err := queue.Retry(id)
+			if err != nil {
+				return err
+			}
+			if !retried {
+				return fmt.Errorf("email %d is not dead", id)
+			}
+			fmt.Printf("🔁 Returned email %d to the queue\n", id)
+			return nil
+		}
+		dropped, err := queue.Drop(id)
+		if err != nil {
+			return err
+		}
+		if !dropped {
+			return fmt.Errorf("email %d is not queued or being sent", id)
+		}
+		fmt.Printf("🗑️  Dropped email %d\n", id)
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingTransport fails to send the first failures emails it gets
+type failingTransport struct {
+	mu       sync.Mutex
+	failures int
+	sent     []*OutgoingEmail
+}
+
+func (t *failingTransport) Send(email *OutgoingEmail) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failures > 0 {
+		t.failures--
+		return "", errors.New("connection refused")
+	}
+	t.sent = append(t.sent, email)
+	return "message-id", nil
+}
+
+// newTestQueue returns an email queue in an in-memory database and an email
+// service sending through a failing transport
+func newTestQueue(t *testing.T, failures, maxAttempts int) (*EmailQueue, *EmailService, *failingTransport) {
+	t.Helper()
+	db, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	queue, err := NewEmailQueue(db, 1, maxAttempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &failingTransport{failures: failures}
+	es := NewEmailService("localhost", 25, "user", "password", "from@example.org", "From")
+	es.Transport = transport
+	es.Queue = queue
+	es.Deliveries = &SQLiteNoteStore{DB: db}
+	return queue, es, transport
+}
+
+// testJob is a queued email about an event
+var testJob = EmailJob{To: "alice@example.org", Subject: "Hi", Text: "Hello", EventID: "event1", EventAuthor: "author", Type: "nostr_mention"}
+
+// attempt sends the next due email like a worker and reports whether it is
+// dead; it fails the test when no email is due
+func attempt(t *testing.T, queue *EmailQueue, es *EmailService) (*QueuedEmail, bool) {
+	t.Helper()
+	email, err := queue.claim()
+	if err != nil || email == nil {
+		t.Fatalf("claim() = %v, %v, want a due email", email, err)
+	}
+	dead, err := queue.finish(email, es.deliverEmailJob(email.Job))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return email, dead
+}
+
+// makeDue moves the next attempt of every queued email to now
+func makeDue(t *testing.T, queue *EmailQueue) {
+	t.Helper()
+	if _, err := queue.DB.Exec("UPDATE email_queue SET next_attempt_at = ?", time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// onlyEmail returns the one email in the queue
+func onlyEmail(t *testing.T, queue *EmailQueue) QueuedEmail {
+	t.Helper()
+	emails, err := queue.Emails("")
+	if err != nil || len(emails) != 1 {
+		t.Fatalf("queue = %v, %v, want one email", emails, err)
+	}
+	return emails[0]
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		3:  4 * time.Minute,
+		7:  64 * time.Minute,
+		8:  queueMaxRetryDelay,
+		20: queueMaxRetryDelay,
+	} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestEmailQueueRetriesFailedEmails(t *testing.T) {
+	queue, es, transport := newTestQueue(t, 2, 5)
+	if err := queue.Enqueue(testJob, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempts := 1; attempts <= 2; attempts++ {
+		before := time.Now()
+		if _, dead := attempt(t, queue, es); dead {
+			t.Fatalf("email dead after %d attempts", attempts)
+		}
+		email := onlyEmail(t, queue)
+		if email.Status != queuePending || email.Attempts != attempts {
+			t.Errorf("after %d failures: status %s, %d attempts", attempts, email.Status, email.Attempts)
+		}
+		if email.LastError != "failed to send email: connection refused" {
+			t.Errorf("last error = %q", email.LastError)
+		}
+		// Stored with a precision of seconds
+		want := before.Add(retryDelay(attempts)).Truncate(time.Second)
+		if email.NextAttemptAt.Before(want) || email.NextAttemptAt.After(want.Add(2*time.Second)) {
+			t.Errorf("after %d failures: next attempt at %s, want %s", attempts, email.NextAttemptAt, want)
+		}
+
+		// Not attempted again before the backoff passed
+		if email, err := queue.claim(); err != nil || email != nil {
+			t.Fatalf("claim() = %v, %v before the next attempt is due", email, err)
+		}
+		makeDue(t, queue)
+	}
+
+	if _, dead := attempt(t, queue, es); dead {
+		t.Fatal("sent email is dead")
+	}
+	if emails, _ := queue.Emails(""); len(emails) != 0 {
+		t.Errorf("sent email still queued: %v", emails)
+	}
+	if len(transport.sent) != 1 || transport.sent[0].To != testJob.To {
+		t.Errorf("sent %v, want the queued email", transport.sent)
+	}
+	deliveries, err := es.Deliveries.Deliveries(testJob.To, testJob.EventID, -1)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Status != deliverySent {
+		t.Errorf("deliveries = %v, %v, want one sent", deliveries, err)
+	}
+}
+
+func TestEmailQueueDeadLetter(t *testing.T) {
+	queue, es, transport := newTestQueue(t, 10, 3)
+	if err := queue.Enqueue(testJob, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempts := 1; attempts < 3; attempts++ {
+		if _, dead := attempt(t, queue, es); dead {
+			t.Fatalf("email dead after %d of 3 attempts", attempts)
+		}
+		makeDue(t, queue)
+	}
+	if _, dead := attempt(t, queue, es); !dead {
+		t.Fatal("email not dead after the last attempt")
+	}
+
+	email := onlyEmail(t, queue)
+	if email.Status != queueDead || email.Attempts != 3 {
+		t.Errorf("status %s, %d attempts, want dead after 3", email.Status, email.Attempts)
+	}
+	// Dead emails are not attempted again, even when due
+	makeDue(t, queue)
+	if email, err := queue.claim(); err != nil || email != nil {
+		t.Fatalf("claim() = %v, %v, want no dead email", email, err)
+	}
+
+	// Until they are retried by hand
+	if retried, err := queue.Retry(email.ID); err != nil || !retried {
+		t.Fatalf("Retry() = %v, %v", retried, err)
+	}
+	transport.failures = 0
+	if _, dead := attempt(t, queue, es); dead {
+		t.Fatal("retried email is dead")
+	}
+	if len(transport.sent) != 1 {
+		t.Errorf("sent %d emails after retrying, want 1", len(transport.sent))
+	}
+}
+
+func TestEmailQueueWorkersDeadLetter(t *testing.T) {
+	queue, es, transport := newTestQueue(t, 10, 1)
+	failed := make(chan error, 1)
+	queue.Run(es.deliverEmailJob, func(job EmailJob, err error) {
+		es.emailFailed(job, err)
+		failed <- err
+	})
+	if err := queue.Enqueue(testJob, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-failed:
+		if want := "gave up after 1 attempts: failed to send email: connection refused"; err.Error() != want {
+			t.Errorf("dead letter error = %q, want %q", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failing email did not reach the dead letter handler")
+	}
+	if email := onlyEmail(t, queue); email.Status != queueDead {
+		t.Errorf("status %s, want dead", email.Status)
+	}
+	deliveries, err := es.Deliveries.Deliveries(testJob.To, testJob.EventID, -1)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Status != deliveryFailed {
+		t.Errorf("deliveries = %v, %v, want one failed", deliveries, err)
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if transport.failures != 9 {
+		t.Errorf("%d attempts, want 1", 10-transport.failures)
+	}
+}
+
+func TestEmailQueueReclaimsEmailsOnRestart(t *testing.T) {
+	queue, es, _ := newTestQueue(t, 0, 3)
+	for _, to := range []string{"alice@example.org", "bob@example.org"} {
+		job := testJob
+		job.To = to
+		if err := queue.Enqueue(job, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The daemon stops while sending the first email
+	claimed, err := queue.claim()
+	if err != nil || claimed == nil {
+		t.Fatalf("claim() = %v, %v", claimed, err)
+	}
+	if sending, _ := queue.Emails(queueSending); len(sending) != 1 {
+		t.Fatalf("%d emails being sent, want 1", len(sending))
+	}
+
+	restarted, err := NewEmailQueue(queue.DB, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sending, _ := restarted.Emails(queueSending); len(sending) != 0 {
+		t.Errorf("%d emails still being sent after a restart", len(sending))
+	}
+	pending, err := restarted.Emails(queuePending)
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("pending emails = %v, %v, want both", pending, err)
+	}
+
+	// Both are sent, the interrupted one first
+	for _, want := range []int64{claimed.ID, pending[1].ID} {
+		if email, _ := attempt(t, restarted, es); email.ID != want {
+			t.Errorf("sent email %d, want %d", email.ID, want)
+		}
+	}
+	if email, err := restarted.claim(); err != nil || email != nil {
+		t.Errorf("claim() = %v, %v after sending everything", email, err)
+	}
+}
+
+func TestEmailQueueCancel(t *testing.T) {
+	queue, _, _ := newTestQueue(t, 0, 3)
+	if err := queue.Enqueue(testJob, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the author of the event cancels its emails
+	if jobs, err := queue.Cancel(testJob.EventID, "someone else"); err != nil || len(jobs) != 0 {
+		t.Errorf("Cancel by another author = %v, %v", jobs, err)
+	}
+	jobs, err := queue.Cancel(testJob.EventID, testJob.EventAuthor)
+	if err != nil || len(jobs) != 1 || jobs[0].To != testJob.To {
+		t.Errorf("Cancel = %v, %v, want the queued email", jobs, err)
+	}
+	if emails, _ := queue.Emails(""); len(emails) != 0 {
+		t.Errorf("cancelled email still queued: %v", emails)
+	}
+}
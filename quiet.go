@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Delivery of notifications arriving during quiet hours
+const (
+	quietDeliveryHold   = "hold"   // send at the end of the quiet hours
+	quietDeliveryDigest = "digest" // fold into the next digest
+)
+
+// QuietHours is a daily window, in minutes after midnight, in which a user is
+// not emailed. Windows may span midnight, e.g. 22:00-07:00.
+type QuietHours struct {
+	Start int
+	End   int
+}
+
+// parseQuietHours parses a window like "22:00-07:00", empty means none
+func parseQuietHours(value string) (*QuietHours, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	start, end, found := strings.Cut(value, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid quiet hours %q, expected HH:MM-HH:MM", value)
+	}
+	startTime, err := time.Parse("15:04", strings.TrimSpace(start))
+	if err != nil {
+		return nil, fmt.Errorf("invalid start of quiet hours %q, expected HH:MM", start)
+	}
+	endTime, err := time.Parse("15:04", strings.TrimSpace(end))
+	if err != nil {
+		return nil, fmt.Errorf("invalid end of quiet hours %q, expected HH:MM", end)
+	}
+	return &QuietHours{
+		Start: startTime.Hour()*60 + startTime.Minute(),
+		End:   endTime.Hour()*60 + endTime.Minute(),
+	}, nil
+}
+
+// EndAfter returns when the quiet hours t falls into end, or the zero time
+// when t is outside them; t is read in its own location
+func (q *QuietHours) EndAfter(t time.Time) time.Time {
+	if q == nil || q.Start == q.End {
+		return time.Time{}
+	}
+	minute := t.Hour()*60 + t.Minute()
+	quiet := minute >= q.Start && minute < q.End
+	if q.Start > q.End {
+		quiet = minute >= q.Start || minute < q.End
+	}
+	if !quiet {
+		return time.Time{}
+	}
+
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.End/60, q.End%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, q.End/60, q.End%60, 0, 0, t.Location())
+	}
+	return end
+}
+
+// QuietHoursPolicy holds the quiet hours of users who set none themselves
+// (nostrQuietHours), the timezone of users without nostrTimezone and what
+// happens to notifications arriving during quiet hours
+type QuietHoursPolicy struct {
+	Default  *QuietHours
+	Location *time.Location // UTC when nil
+	Delivery string
+}
+
+// parseQuietHoursPolicy parses NOSTREMAIL_QUIET_HOURS, NOSTREMAIL_TIMEZONE and
+// NOSTREMAIL_QUIET_HOURS_DELIVERY
+func parseQuietHoursPolicy(window, timezone, delivery string) (QuietHoursPolicy, error) {
+	var policy QuietHoursPolicy
+	var err error
+	policy.Default, err = parseQuietHours(window)
+	if err != nil {
+		return policy, err
+	}
+	if timezone = strings.TrimSpace(timezone); timezone != "" {
+		policy.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return policy, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+	}
+	switch policy.Delivery = strings.ToLower(strings.TrimSpace(delivery)); policy.Delivery {
+	case "":
+		policy.Delivery = quietDeliveryHold
+	case quietDeliveryHold, quietDeliveryDigest:
+	default:
+		return policy, fmt.Errorf("invalid delivery %q, expected hold or digest", delivery)
+	}
+	return policy, nil
+}
+
+// Until returns when the quiet hours of a user end, or the zero time when
+// they may be emailed now. Invalid settings of a user are reported and
+// replaced by the defaults.
+func (p QuietHoursPolicy) Until(user User, now time.Time) time.Time {
+	window := p.Default
+	if user.QuietHours != "" {
+		userWindow, err := parseQuietHours(user.QuietHours)
+		if err != nil {
+			fmt.Printf("⚠️  Quiet hours of %s: %v\n", user.Username, err)
+		} else {
+			window = userWindow
+		}
+	}
+	if window == nil {
+		return time.Time{}
+	}
+
+	location := p.Location
+	if location == nil {
+		location = time.UTC
+	}
+	if user.Timezone != "" {
+		userLocation, err := time.LoadLocation(user.Timezone)
+		if err != nil {
+			fmt.Printf("⚠️  Timezone of %s: %v\n", user.Username, err)
+		} else {
+			location = userLocation
+		}
+	}
+	return window.EndAfter(now.In(location))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip27"
+)
+
+// quotedNotes returns the notes quoted by an event through NIP-18 q tags or
+// nostr:nevent1… URIs in its content, once each
+func quotedNotes(event *nostr.Event) []nostr.EventPointer {
+	var pointers []nostr.EventPointer
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "q" {
+			continue
+		}
+		// q tags may also hold "a" coordinates, those are not notes
+		if pointer, err := nostr.EventPointerFromTag(tag); err == nil {
+			pointers = append(pointers, pointer)
+		}
+	}
+	for block := range nip27.Parse(event.Content) {
+		if pointer, ok := block.Pointer.(nostr.EventPointer); ok {
+			pointers = append(pointers, pointer)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var unique []nostr.EventPointer
+	for _, pointer := range pointers {
+		if seen[pointer.ID] {
+			continue
+		}
+		seen[pointer.ID] = true
+		unique = append(unique, pointer)
+	}
+	return unique
+}
+
+// quoteMentions returns a mention, keyed by npub, for each monitored user whose
+// note an event quotes, fetching the quoted notes for their content and author
+func quoteMentions(event *nostr.Event, pool *nostr.SimplePool, hexToUser map[string]User, relays []string) map[string]Mention {
+	mentions := make(map[string]Mention)
+	for _, pointer := range quotedNotes(event) {
+		// Skip fetching notes whose author hint is not one of our users
+		if pointer.Author != "" {
+			if _, exists := hexToUser[pointer.Author]; !exists {
+				continue
+			}
+		}
+
+		noteRelays := append(append([]string{}, pointer.Relays...), relays...)
+		note, err := fetchEventByID(pointer.ID, pool, noteRelays)
+		if err != nil {
+			fmt.Printf("⚠️  Failed to fetch quoted note for %s: %v\n", event.ID, err)
+			continue
+		}
+		user, exists := hexToUser[note.PubKey]
+		if !exists || note.PubKey == event.PubKey {
+			continue
+		}
+		if _, exists := mentions[user.NostrNpub]; exists {
+			continue
+		}
+
+		mentions[user.NostrNpub] = Mention{
+			Context:       "a quote",
+			Action:        "quoted your note",
+			ParentContent: truncateText(note.Content, parentExcerptLength),
+			ParentURL:     noteURL(note.ID),
+			ParentLabel:   "Your note",
+			Match:         matchQuote,
+		}
+	}
+	return mentions
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSummaryInterval is how often held back notifications are checked
+// for a summary
+const rateLimitSummaryInterval = time.Minute
+
+// rateLimitSummaryItems bounds the notifications listed in a summary
+const rateLimitSummaryItems = 20
+
+// UserRateLimit caps the notification emails a recipient gets per hour and
+// per day, zero disables a cap
+type UserRateLimit struct {
+	PerHour int
+	PerDay  int
+}
+
+// parseUserRateLimit parses a limit like "hour=10,day=50"
+func parseUserRateLimit(value string) (UserRateLimit, error) {
+	var limit UserRateLimit
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, setting, found := strings.Cut(entry, "=")
+		if !found {
+			return limit, fmt.Errorf("invalid entry %q, expected hour=N or day=N", entry)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(setting))
+		if err != nil || count < 0 {
+			return limit, fmt.Errorf("invalid count %q for %s", setting, key)
+		}
+		switch strings.TrimSpace(key) {
+		case "hour":
+			limit.PerHour = count
+		case "day":
+			limit.PerDay = count
+		default:
+			return limit, fmt.Errorf("unknown window %q, expected hour or day", key)
+		}
+	}
+	return limit, nil
+}
+
+// Enabled reports whether any cap is set
+func (l UserRateLimit) Enabled() bool {
+	return l.PerHour > 0 || l.PerDay > 0
+}
+
+// rateOverflow holds the notifications of a recipient over the limit
+type rateOverflow struct {
+	User     User
+	Count    int
+	Subjects []string // the first rateLimitSummaryItems
+}
+
+// UserRateLimiter counts the notification emails of each recipient and holds
+// back those over the limit, to be sent as one summary once the limit allows
+// another email. Send times are kept in memory, a restart starts new windows.
+type UserRateLimiter struct {
+	Limit UserRateLimit
+
+	mu       sync.Mutex
+	sent     map[string][]time.Time // by recipient email, within the last day
+	overflow map[string]*rateOverflow
+}
+
+// NewUserRateLimiter creates a rate limiter with the given caps
+func NewUserRateLimiter(limit UserRateLimit) *UserRateLimiter {
+	return &UserRateLimiter{
+		Limit:    limit,
+		sent:     make(map[string][]time.Time),
+		overflow: make(map[string]*rateOverflow),
+	}
+}
+
+// Allow reports whether a recipient may be emailed a notification now and
+// counts it. Notifications over the limit are held for the summary, as are
+// all later ones until the summary was sent, so it comes before them.
+func (l *UserRateLimiter) Allow(user User, subject string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	held, holding := l.overflow[user.Email]
+	if !holding && l.take(user.Email, now) {
+		return true
+	}
+	if !holding {
+		held = &rateOverflow{User: user}
+		l.overflow[user.Email] = held
+	}
+	held.Count++
+	if len(held.Subjects) < rateLimitSummaryItems {
+		held.Subjects = append(held.Subjects, subject)
+	}
+	return false
+}
+
+// DueSummaries returns the held notifications of recipients the limit allows
+// an email again, counting the summary
+func (l *UserRateLimiter) DueSummaries(now time.Time) []rateOverflow {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var due []rateOverflow
+	for email, held := range l.overflow {
+		if l.take(email, now) {
+			due = append(due, *held)
+			delete(l.overflow, email)
+		}
+	}
+	return due
+}
+
+// take counts an email to a recipient if the limit allows it; l.mu is held
+func (l *UserRateLimiter) take(email string, now time.Time) bool {
+	var lastDay []time.Time
+	lastHour := 0
+	for _, sentAt := range l.sent[email] {
+		if now.Sub(sentAt) < 24*time.Hour {
+			lastDay = append(lastDay, sentAt)
+			if now.Sub(sentAt) < time.Hour {
+				lastHour++
+			}
+		}
+	}
+
+	if (l.Limit.PerHour > 0 && lastHour >= l.Limit.PerHour) || (l.Limit.PerDay > 0 && len(lastDay) >= l.Limit.PerDay) {
+		l.sent[email] = lastDay
+		return false
+	}
+	l.sent[email] = append(lastDay, now)
+	return true
+}
+
+// runRateLimitSummaries emails the summaries of held back notifications once
+// the limit of their recipients allows, forever
+func runRateLimitSummaries(es *EmailService) {
+	for range time.Tick(rateLimitSummaryInterval) {
+		for _, held := range es.RateLimit.DueSummaries(time.Now()) {
+			if err := es.ProcessNostrRateLimitSummary(held); err != nil {
+				fmt.Printf("⚠️  Failed to send notification summary to %s: %v\n", held.User.Username, err)
+			}
+		}
+	}
+}
+
+// SendRateLimit caps outgoing emails per second, minute and hour, to protect
+// the reputation of the SMTP provider or stay within the rate limit of an
+// email API; zero disables a cap
+type SendRateLimit struct {
+	PerSecond int
+	PerMinute int
+	PerHour   int
+}
+
+// parseSendRateLimit parses a limit like "minute=30,hour=500" or "second=14"
+func parseSendRateLimit(value string) (SendRateLimit, error) {
+	var limit SendRateLimit
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, setting, found := strings.Cut(entry, "=")
+		if !found {
+			return limit, fmt.Errorf("invalid entry %q, expected second=N, minute=N or hour=N", entry)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(setting))
+		if err != nil || count < 0 {
+			return limit, fmt.Errorf("invalid count %q for %s", setting, key)
+		}
+		switch strings.TrimSpace(key) {
+		case "second":
+			limit.PerSecond = count
+		case "minute":
+			limit.PerMinute = count
+		case "hour":
+			limit.PerHour = count
+		default:
+			return limit, fmt.Errorf("unknown window %q, expected second, minute or hour", key)
+		}
+	}
+	return limit, nil
+}
+
+// Enabled reports whether any cap is set
+func (l SendRateLimit) Enabled() bool {
+	return l.PerSecond > 0 || l.PerMinute > 0 || l.PerHour > 0
+}
+
+// tokenBucket allows Burst emails at once and refills one every Interval. It
+// hands out the next free slot to every caller (GCRA), so callers are served
+// in order instead of retrying.
+type tokenBucket struct {
+	Interval time.Duration
+	Burst    int
+
+	next time.Time // theoretical time of the next email with an empty bucket
+}
+
+// reserve takes a token and returns how long to wait before using it
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if b.next.Before(now) {
+		b.next = now
+	}
+	wait := b.next.Add(-time.Duration(b.Burst-1) * b.Interval).Sub(now)
+	b.next = b.next.Add(b.Interval)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// SendLimiter spaces out all outgoing emails to a SendRateLimit. Emails over
+// the limit wait for their turn in memory, they are not dropped.
+type SendLimiter struct {
+	mu      sync.Mutex
+	buckets []*tokenBucket
+}
+
+// NewSendLimiter creates a limiter with a token bucket per capped window
+func NewSendLimiter(limit SendRateLimit) *SendLimiter {
+	l := &SendLimiter{}
+	if limit.PerSecond > 0 {
+		l.buckets = append(l.buckets, &tokenBucket{Interval: time.Second / time.Duration(limit.PerSecond), Burst: limit.PerSecond})
+	}
+	if limit.PerMinute > 0 {
+		l.buckets = append(l.buckets, &tokenBucket{Interval: time.Minute / time.Duration(limit.PerMinute), Burst: limit.PerMinute})
+	}
+	if limit.PerHour > 0 {
+		l.buckets = append(l.buckets, &tokenBucket{Interval: time.Hour / time.Duration(limit.PerHour), Burst: limit.PerHour})
+	}
+	return l
+}
+
+// Reserve takes the next slot for an email and returns how long to wait for it
+func (l *SendLimiter) Reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	for _, bucket := range l.buckets {
+		if bucketWait := bucket.reserve(now); bucketWait > wait {
+			wait = bucketWait
+		}
+	}
+	return wait
+}
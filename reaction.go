@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// reactionMaxLength bounds the reaction shown in emails, in characters;
+// reactions are meant to be an emoji or a word
+const reactionMaxLength = 16
+
+// reactionEmoji returns what a NIP-25 reaction shows in emails: likes ("+"
+// or empty) as 👍, emoji and shortcodes as they are, "" for dislikes ("-")
+func reactionEmoji(content string) string {
+	switch content = strings.TrimSpace(content); content {
+	case "", "+":
+		return "👍"
+	case "-":
+		return ""
+	}
+	if runes := []rune(content); len(runes) > reactionMaxLength {
+		return string(runes[:reactionMaxLength]) + "…"
+	}
+	return content
+}
+
+// resolveReactedNote returns the note a kind 7 reaction refers to, the last
+// e tag following NIP-25
+func resolveReactedNote(event *nostr.Event, pool *nostr.SimplePool, relays []string) (*nostr.Event, error) {
+	var eTag nostr.Tag
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			eTag = tag
+		}
+	}
+	if eTag == nil {
+		return nil, fmt.Errorf("reaction has no e tag")
+	}
+
+	// Prefer the relay hint from the e tag
+	if hint := eTag.Relay(); hint != "" {
+		relays = append([]string{hint}, relays...)
+	}
+
+	return fetchEventByID(eTag[1], pool, relays)
+}
+
+// processReaction notifies a user when someone reacts to one of their notes
+func processReaction(event *nostr.Event, pool *nostr.SimplePool, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	reaction := reactionEmoji(event.Content)
+	if reaction == "" {
+		return // dislikes are not emailed
+	}
+
+	reactorNpub, err := hexToNpub(event.PubKey)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert event pubkey to npub: %v\n", err)
+		reactorNpub = event.PubKey // fallback to hex
+	}
+
+	// Only reactions by verified senders are emailed, like reposts
+	reactorNIP5, verified := emailService.verifySender(event.PubKey)
+	if !verified {
+		fmt.Printf("ℹ️  Skipping reaction from unverified user: %s\n", reactorNpub)
+		return
+	}
+
+	note, err := resolveReactedNote(event, pool, config.Relays)
+	if err != nil {
+		fmt.Printf("⚠️  Failed to resolve reacted note for %s: %v\n", event.ID, err)
+		return
+	}
+
+	// The p tag is only a hint, the note author decides who gets the email
+	recipientUser, exists := hexToUser[note.PubKey]
+	if !exists {
+		return
+	}
+	if note.PubKey == event.PubKey {
+		return // reaction to one's own note
+	}
+
+	fmt.Printf("%s Reaction to %s's note by %s\n", reaction, recipientUser.Username, reactorNIP5)
+
+	err = emailService.ProcessNostrReaction(event, note, recipientUser, reactorNIP5, reactorNpub)
+	if err != nil {
+		fmt.Printf("❌ Failed to send email to %s: %v\n", recipientUser.Username, err)
+	} else {
+		fmt.Printf("📧 Email sent to %s\n", recipientUser.Username)
+	}
+
+	err = emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", recipientUser.Email)
+	if err != nil {
+		fmt.Printf("⚠️  Error marking reaction as processed: %v\n", err)
+	}
+	// Reactions belong to the thread of the note reacted to
+	if err := emailService.Notes.RecordThreadID(event.ID, recipientUser.Email, threadID(note)); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds connecting to Redis and each command
+const redisTimeout = 5 * time.Second
+
+// redisKeyPrefix namespaces our keys in a shared Redis
+const redisKeyPrefix = "nostremail:"
+
+// redisProcessedTTL is how long processed event IDs are kept in Redis, the
+// note store remains the full history
+const redisProcessedTTL = 7 * 24 * time.Hour
+
+// redisProfileTTL is how long fetched profiles are shared in Redis
+const redisProfileTTL = time.Hour
+
+// RedisCache shares processed event IDs and short-lived lookups (profiles,
+// NIP-05 results) between daemon instances. It speaks the few Redis commands
+// we need over one connection, which is reopened after errors.
+type RedisCache struct {
+	addr     string
+	password string
+	db       int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisCache connects to Redis at a URL like redis://:password@host:6379/0
+func NewRedisCache(rawURL string) (*RedisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q, expected redis://[:password@]host[:port][/db]", rawURL)
+	}
+	c := &RedisCache{addr: u.Host}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if password, set := u.User.Password(); set {
+		c.password = password
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+
+	if _, err := c.do("PING"); err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	return c, nil
+}
+
+// Close closes the connection to Redis
+func (c *RedisCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Get returns the value of a key, found is false when it does not exist
+func (c *RedisCache) Get(key string) (value string, found bool, err error) {
+	reply, err := c.do("GET", redisKeyPrefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	return reply.(string), true, nil
+}
+
+// Set stores the value of a key for ttl
+func (c *RedisCache) Set(key, value string, ttl time.Duration) error {
+	_, err := c.do("SET", redisKeyPrefix+key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Delete removes a key
+func (c *RedisCache) Delete(key string) error {
+	_, err := c.do("DEL", redisKeyPrefix+key)
+	return err
+}
+
+// GetJSON decodes the value of a key into v and reports whether it existed
+func (c *RedisCache) GetJSON(key string, v interface{}) (bool, error) {
+	value, found, err := c.Get(key)
+	if err != nil || !found {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// SetJSON stores v encoded as JSON for ttl
+func (c *RedisCache) SetJSON(key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", key, err)
+	}
+	return c.Set(key, string(value), ttl)
+}
+
+// do sends a command and returns its reply: a string, an int64, nil for a
+// missing value or a []interface{}. A failed connection is dropped and the
+// next command reconnects.
+func (c *RedisCache) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args)
+	if _, isRedisError := err.(redisError); err != nil && !isRedisError {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// connect opens the connection, authenticates and selects the database
+func (c *RedisCache) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(args); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("%s failed: %v", args[0], err)
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command in the Redis protocol (RESP) and reads its reply
+func (c *RedisCache) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(command.String())); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+// redisError is an error reply of Redis, the connection remains usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// readRedisReply reads one reply in the Redis protocol (RESP)
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty Redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis reply %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis reply %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid Redis reply %q", line)
+}
+
+// CachedNoteStore answers whether events were processed from Redis first, so
+// instances sharing the Redis skip events another instance already handled.
+// Everything is still written to the wrapped store, which answers when Redis
+// has no record or fails.
+type CachedNoteStore struct {
+	NoteStore
+	Cache *RedisCache
+}
+
+func (s *CachedNoteStore) IsNoteProcessed(eventID string) (bool, error) {
+	if s.cached("processed:" + eventID) {
+		return true, nil
+	}
+	return s.NoteStore.IsNoteProcessed(eventID)
+}
+
+func (s *CachedNoteStore) IsNotificationProcessed(eventID, userEmail string) (bool, error) {
+	if s.cached("notified:" + eventID + ":" + userEmail) {
+		return true, nil
+	}
+	return s.NoteStore.IsNotificationProcessed(eventID, userEmail)
+}
+
+func (s *CachedNoteStore) MarkNoteProcessed(eventID, authorPubkey, relayURL, userEmail string) error {
+	if err := s.NoteStore.MarkNoteProcessed(eventID, authorPubkey, relayURL, userEmail); err != nil {
+		return err
+	}
+	keys := []string{"processed:" + eventID, "notified:" + eventID + ":" + userEmail}
+	for _, key := range keys {
+		if err := s.Cache.Set(key, "1", redisProcessedTTL); err != nil {
+			fmt.Printf("⚠️  Failed to share processed event %s in Redis: %v\n", eventID, err)
+			break
+		}
+	}
+	return nil
+}
+
+// cached reports whether Redis has a key; failures count as misses
+func (s *CachedNoteStore) cached(key string) bool {
+	_, found, err := s.Cache.Get(key)
+	if err != nil {
+		fmt.Printf("⚠️  Redis lookup of %s failed: %v\n", key, err)
+	}
+	return found
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// replaceableAddress returns the address under which newer versions of an
+// event replace older ones: "kind:pubkey" for replaceable events (kind 0, 3
+// and 10000-19999) and "kind:pubkey:d" for addressable events (30000-39999).
+// Other events are never replaced and get "".
+func replaceableAddress(event *nostr.Event) string {
+	switch {
+	case nostr.IsReplaceableKind(event.Kind):
+		return fmt.Sprintf("%d:%s", event.Kind, event.PubKey)
+	case nostr.IsAddressableKind(event.Kind):
+		return articleAddress(event)
+	}
+	return ""
+}
+
+// isNewer reports whether event a replaces event b: the newer one wins and
+// equal timestamps are decided by the lower ID, as NIP-01 specifies
+func isNewer(a, b *nostr.Event) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.ID < b.ID
+}
+
+// recordReplaceableVersion remembers the newest version seen per address and
+// reports whether the event is superseded by a version we already saw. Older
+// databases without the replaceable_versions table treat every event as current.
+func recordReplaceableVersion(db *sql.DB, event *nostr.Event) (bool, error) {
+	address := replaceableAddress(event)
+	if address == "" {
+		return false, nil
+	}
+
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return false, err
+	}
+	if version < schemaReplaceable {
+		return false, nil
+	}
+
+	var eventID string
+	var createdAt int64
+	err = db.QueryRow("SELECT event_id, created_at FROM replaceable_versions WHERE address = ?", address).Scan(&eventID, &createdAt)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to read replaceable version: %v", err)
+	}
+	if err == nil {
+		current := &nostr.Event{ID: eventID, CreatedAt: nostr.Timestamp(createdAt)}
+		if eventID == event.ID || !isNewer(event, current) {
+			return eventID != event.ID, nil
+		}
+	}
+
+	_, err = db.Exec(`INSERT INTO replaceable_versions (address, event_id, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(address) DO UPDATE SET event_id = excluded.event_id, created_at = excluded.created_at`,
+		address, event.ID, int64(event.CreatedAt))
+	if err != nil {
+		return false, fmt.Errorf("failed to record replaceable version: %v", err)
+	}
+	return false, nil
+}
+
+// fetchLatestEvent fetches the newest event matching a filter from the given
+// relays, for replaceable events where relays may still serve old versions
+func fetchLatestEvent(filter nostr.Filter, pool *nostr.SimplePool, relays []string) (*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), noteFetchTimeout)
+	defer cancel()
+
+	var latest *nostr.Event
+	for evt := range pool.SubManyEose(ctx, relays, nostr.Filters{filter}) {
+		if latest == nil || isNewer(evt.Event, latest) {
+			latest = evt.Event
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("not found on relays")
+	}
+	return latest, nil
+}
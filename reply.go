@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip10"
+)
+
+// parentExcerptLength is how many characters of a parent note are quoted in emails
+const parentExcerptLength = 300
+
+// fetchReplyParent returns the note an event replies to following NIP-10
+// markers, or nil when the event is not a reply
+func fetchReplyParent(event *nostr.Event, pool *nostr.SimplePool, relays []string) (*nostr.Event, error) {
+	pointer := nip10.GetImmediateParent(event.Tags)
+	if pointer == nil {
+		return nil, nil
+	}
+
+	// Prefer the relay hint of the e tag
+	if eventPointer, ok := pointer.(nostr.EventPointer); ok && len(eventPointer.Relays) > 0 {
+		relays = append(append([]string{}, eventPointer.Relays...), relays...)
+	}
+
+	parent, err := fetchEvent(pointer.AsFilter(), pool, relays)
+	if err != nil {
+		return nil, fmt.Errorf("parent %s: %v", pointer.AsTagReference(), err)
+	}
+	return parent, nil
+}
+
+// processTextNote notifies users mentioned in, replied to or quoted by a note
+// (kind 1), quoting the parent or quoted note
+func processTextNote(event *nostr.Event, pool *nostr.SimplePool, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	// Quotes are the more specific notification, quoted users get only that one
+	quotes := quoteMentions(event, pool, hexToUser, config.Relays)
+	for npub, mention := range quotes {
+		notifyMention(event, npubToUser[npub], mention, npubToUser, sqliteDB, emailService)
+	}
+
+	var recipients []User
+	matches := mentionMatches(event, hexToUser, config.MentionMatching)
+	for _, user := range usersForPubkeys(matches.Pubkeys, event.PubKey, hexToUser) {
+		if _, quoted := quotes[user.NostrNpub]; !quoted {
+			recipients = append(recipients, user)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	mention := Mention{Context: "a note"}
+	parent, err := fetchReplyParent(event, pool, config.Relays)
+	if err != nil {
+		fmt.Printf("⚠️  Failed to fetch reply context for %s: %v\n", event.ID, err)
+	}
+	if parent != nil {
+		mention.Context = "a reply"
+		mention.ParentContent = truncateText(parent.Content, parentExcerptLength)
+		mention.ParentURL = noteURL(parent.ID)
+	}
+
+	for _, user := range recipients {
+		mention.Match = matches.TypeFor(user)
+		// The author of the parent gets a reply email, others in the thread a mention
+		mention.Reply = false
+		if parent != nil {
+			parentAuthor, exists := hexToUser[parent.PubKey]
+			mention.Reply = exists && sameUser(parentAuthor, user)
+		}
+		notifyMention(event, user, mention, npubToUser, sqliteDB, emailService)
+	}
+}
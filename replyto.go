@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// replyAddressPrefix starts the local part of reply addresses, followed by the token
+const replyAddressPrefix = "reply+"
+
+// Kinds of reply addresses, the first byte of their token: what a reply by
+// email is posted as
+const (
+	replyKindDirectMessage byte = 'd' // a DM to the sender
+	replyKindNote          byte = 'n' // a reply to the sender's note
+)
+
+// replyMACSize is the length of the truncated HMAC in reply tokens
+const replyMACSize = 10
+
+// replyKinds are the notification emails that can be answered, by template
+var replyKinds = map[string]byte{
+	"nostr_direct_message": replyKindDirectMessage,
+	"nostr_mention":        replyKindNote,
+	"nostr_reply":          replyKindNote,
+}
+
+// replyEncoding encodes reply tokens, in lowercase since mail servers may
+// not keep the case of local parts
+var replyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ReplyTarget is what a reply address refers to
+type ReplyTarget struct {
+	Kind    byte   // replyKindDirectMessage or replyKindNote
+	Pubkey  string // hex, the sender of the notification
+	EventID string // the event replied to, its tags lead to the thread
+}
+
+// ReplyAddresses gives notification emails a Reply-To address encoding the
+// sender and the event, so replies by email can be posted back to nostr. Like
+// unsubscribe links, the addresses carry an HMAC, bound to the recipient, and
+// nothing is stored per email.
+type ReplyAddresses struct {
+	Domain string // e.g. notifications.trustroots.org, receives the replies
+	Secret []byte
+}
+
+// replySignature is the truncated HMAC of a token payload for a recipient
+func (r *ReplyAddresses) replySignature(payload []byte, recipient string) []byte {
+	mac := hmac.New(sha256.New, r.Secret)
+	mac.Write([]byte("nostremail-reply:" + normalizeEmail(recipient) + ":"))
+	mac.Write(payload)
+	return mac.Sum(nil)[:replyMACSize]
+}
+
+// Token returns the token of a reply address for a recipient: the kind, the
+// sender pubkey and the event ID, signed
+func (r *ReplyAddresses) Token(target ReplyTarget, recipient string) (string, error) {
+	pubkey, err := hex.DecodeString(target.Pubkey)
+	if err != nil || len(pubkey) != 32 {
+		return "", fmt.Errorf("invalid pubkey %s", target.Pubkey)
+	}
+	eventID, err := hex.DecodeString(target.EventID)
+	if err != nil || len(eventID) != 32 {
+		return "", fmt.Errorf("invalid event ID %s", target.EventID)
+	}
+
+	payload := append([]byte{target.Kind}, pubkey...)
+	payload = append(payload, eventID...)
+	payload = append(payload, r.replySignature(payload, recipient)...)
+	return strings.ToLower(replyEncoding.EncodeToString(payload)), nil
+}
+
+// Address returns the reply address of a notification for a recipient,
+// reply+<token>@<domain>
+func (r *ReplyAddresses) Address(target ReplyTarget, recipient string) (string, error) {
+	token, err := r.Token(target, recipient)
+	if err != nil {
+		return "", err
+	}
+	return replyAddressPrefix + token + "@" + r.Domain, nil
+}
+
+// Verify returns what a reply address refers to, or an error when it was not
+// signed with the secret for the recipient
+func (r *ReplyAddresses) Verify(address, recipient string) (ReplyTarget, error) {
+	local, domain, found := strings.Cut(strings.TrimSpace(address), "@")
+	token, hasPrefix := strings.CutPrefix(strings.ToLower(local), replyAddressPrefix)
+	if !found || !hasPrefix || !strings.EqualFold(domain, r.Domain) {
+		return ReplyTarget{}, fmt.Errorf("not a reply address")
+	}
+	payload, err := replyEncoding.DecodeString(strings.ToUpper(token))
+	if err != nil || len(payload) != 1+32+32+replyMACSize {
+		return ReplyTarget{}, fmt.Errorf("invalid reply address")
+	}
+	signed, signature := payload[:65], payload[65:]
+	if subtle.ConstantTimeCompare(signature, r.replySignature(signed, recipient)) != 1 {
+		return ReplyTarget{}, fmt.Errorf("invalid reply address")
+	}
+	target := ReplyTarget{
+		Kind:    signed[0],
+		Pubkey:  hex.EncodeToString(signed[1:33]),
+		EventID: hex.EncodeToString(signed[33:65]),
+	}
+	if target.Kind != replyKindDirectMessage && target.Kind != replyKindNote {
+		return ReplyTarget{}, fmt.Errorf("invalid reply address")
+	}
+	return target, nil
+}
+
+// jobAddress returns the reply address of a queued email, "" for emails that
+// cannot be answered
+func (r *ReplyAddresses) jobAddress(job EmailJob) string {
+	kind, exists := replyKinds[job.Type]
+	if !exists || job.EventID == "" || job.EventAuthor == "" {
+		return ""
+	}
+	address, err := r.Address(ReplyTarget{Kind: kind, Pubkey: job.EventAuthor, EventID: job.EventID}, job.To)
+	if err != nil {
+		fmt.Printf("⚠️  No reply address for %s: %v\n", job.EventID, err)
+		return ""
+	}
+	return address
+}
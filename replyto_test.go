@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testPubkey  = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	testEventID = "5c83da77af1dec6d7289834998ad7aafbd9e2191396d75ec3cc27f5a77226f36"
+)
+
+func TestReplyAddressRoundTrip(t *testing.T) {
+	r := &ReplyAddresses{Domain: "reply.example.org", Secret: []byte("secret")}
+	target := ReplyTarget{Kind: replyKindNote, Pubkey: testPubkey, EventID: testEventID}
+
+	address, err := r.Address(target, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(address, replyAddressPrefix) || !strings.HasSuffix(address, "@reply.example.org") {
+		t.Errorf("address = %q, want reply+<token>@reply.example.org", address)
+	}
+
+	// Mail servers may change the case of addresses
+	for _, variant := range []string{address, strings.ToUpper(address)} {
+		got, err := r.Verify(variant, "ALICE@example.org")
+		if err != nil {
+			t.Errorf("Verify(%q): %v", variant, err)
+			continue
+		}
+		if got != target {
+			t.Errorf("Verify(%q) = %+v, want %+v", variant, got, target)
+		}
+	}
+}
+
+func TestReplyAddressRejectsForgeries(t *testing.T) {
+	r := &ReplyAddresses{Domain: "reply.example.org", Secret: []byte("secret")}
+	target := ReplyTarget{Kind: replyKindDirectMessage, Pubkey: testPubkey, EventID: testEventID}
+	address, err := r.Address(target, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _, _ := strings.Cut(address, "@")
+	token := strings.TrimPrefix(local, replyAddressPrefix)
+
+	// Another target signed for the same recipient, with the signature of
+	// the first one
+	otherToken, err := r.Token(ReplyTarget{Kind: replyKindDirectMessage, Pubkey: testEventID, EventID: testPubkey}, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	macStart := len(token) - 16 // the last base32 characters only cover the MAC
+	swapped := otherToken[:macStart] + token[macStart:]
+
+	// One character of the target changed
+	modified := []byte(token)
+	if modified[10] == 'a' {
+		modified[10] = 'b'
+	} else {
+		modified[10] = 'a'
+	}
+
+	tests := []struct {
+		name, address, sender string
+		secret                string
+	}{
+		{"wrong domain", local + "@evil.example.org", "alice@example.org", "secret"},
+		{"other sender", address, "mallory@example.org", "secret"},
+		{"modified target", replyAddressPrefix + string(modified) + "@reply.example.org", "alice@example.org", "secret"},
+		{"swapped target", replyAddressPrefix + swapped + "@reply.example.org", "alice@example.org", "secret"},
+		{"wrong secret", address, "alice@example.org", "other secret"},
+		{"truncated token", address[:len(local)-4] + "@reply.example.org", "alice@example.org", "secret"},
+		{"no prefix", token + "@reply.example.org", "alice@example.org", "secret"},
+		{"no domain", local, "alice@example.org", "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := &ReplyAddresses{Domain: r.Domain, Secret: []byte(tt.secret)}
+			if got, err := verifier.Verify(tt.address, tt.sender); err == nil {
+				t.Errorf("Verify(%q, %q) = %+v, want an error", tt.address, tt.sender, got)
+			}
+		})
+	}
+}
+
+func TestReplyAddressRejectsInvalidTargets(t *testing.T) {
+	r := &ReplyAddresses{Domain: "reply.example.org", Secret: []byte("secret")}
+	for _, target := range []ReplyTarget{
+		{Kind: replyKindNote, Pubkey: "npub1abc", EventID: testEventID},
+		{Kind: replyKindNote, Pubkey: testPubkey, EventID: testEventID[:62]},
+	} {
+		if _, err := r.Address(target, "alice@example.org"); err == nil {
+			t.Errorf("Address(%+v) succeeded, want an error", target)
+		}
+	}
+
+	// Signed tokens of unknown kinds are refused too
+	token, err := r.Token(ReplyTarget{Kind: 'x', Pubkey: testPubkey, EventID: testEventID}, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Verify(replyAddressPrefix+token+"@reply.example.org", "alice@example.org"); err == nil {
+		t.Error("Verify accepted a reply address of an unknown kind")
+	}
+}
+
+func TestReplyAddressOfJob(t *testing.T) {
+	r := &ReplyAddresses{Domain: "reply.example.org", Secret: []byte("secret")}
+	job := EmailJob{To: "alice@example.org", Type: "nostr_reply", EventID: testEventID, EventAuthor: testPubkey}
+
+	address := r.jobAddress(job)
+	target, err := r.Verify(address, "alice@example.org")
+	if err != nil {
+		t.Fatalf("Verify(%q): %v", address, err)
+	}
+	if target.Kind != replyKindNote || target.Pubkey != testPubkey || target.EventID != testEventID {
+		t.Errorf("target = %+v", target)
+	}
+
+	// Emails that cannot be answered get no address
+	for _, emailType := range []string{"nostr_zap", "nostr_digest", "nostr_reaction"} {
+		job.Type = emailType
+		if address := r.jobAddress(job); address != "" {
+			t.Errorf("%s email got reply address %q", emailType, address)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ReportedUser is a monitored user named in an abuse report
+type ReportedUser struct {
+	User
+	ReportType string // NIP-56 type, e.g. "spam" or "impersonation", or ""
+}
+
+// reportedUsers returns the monitored users a report (kind 1984, NIP-56)
+// names, tagged ["p", <pubkey>, <report type>]
+func reportedUsers(event *nostr.Event, hexToUser map[string]User) []ReportedUser {
+	var reported []ReportedUser
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		hexPubkey := strings.ToLower(tag[1])
+		user, monitored := hexToUser[hexPubkey]
+		if !monitored || seen[hexPubkey] {
+			continue
+		}
+		seen[hexPubkey] = true
+
+		reportType := reportTypeOf(event, tag)
+		reported = append(reported, ReportedUser{User: user, ReportType: reportType})
+	}
+	return reported
+}
+
+// reportTypeOf returns the report type of a p tag, or of the e tag when the
+// report is about a note of that user
+func reportTypeOf(event *nostr.Event, pTag nostr.Tag) string {
+	if len(pTag) >= 3 && pTag[2] != "" {
+		return pTag[2]
+	}
+	if eTag := event.Tags.Find("e"); eTag != nil && len(eTag) >= 3 {
+		return eTag[2]
+	}
+	return ""
+}
+
+// processReport emails the moderators about abuse reports (kind 1984, NIP-56)
+// against monitored users
+func processReport(event *nostr.Event, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	if config.ModeratorEmail == "" {
+		return
+	}
+	reported := reportedUsers(event, hexToUser)
+	if len(reported) == 0 {
+		return
+	}
+
+	notified, err := emailService.Notes.IsNotificationProcessed(event.ID, config.ModeratorEmail)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return
+	}
+	if notified {
+		return
+	}
+
+	for _, user := range reported {
+		fmt.Printf("🚩 %s was reported on nostr (%s) by %s\n", user.Username, user.ReportType, event.PubKey)
+	}
+
+	if err := emailService.ProcessNostrAbuseReport(event, reported, npubToUser, config.ModeratorEmail); err != nil {
+		fmt.Printf("❌ Failed to send abuse report to moderators: %v\n", err)
+	}
+
+	if err := emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", config.ModeratorEmail); err != nil {
+		fmt.Printf("⚠️  Error marking report as processed: %v\n", err)
+	}
+}
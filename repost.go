@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// resolveRepostedNote returns the note a kind 6/16 repost refers to. NIP-18 reposts
+// usually embed the stringified note as content; otherwise it is fetched by its e tag.
+func resolveRepostedNote(event *nostr.Event, pool *nostr.SimplePool, relays []string) (*nostr.Event, error) {
+	eTag := event.Tags.Find("e")
+	if eTag == nil {
+		return nil, fmt.Errorf("repost has no e tag")
+	}
+	noteID := eTag[1]
+
+	// Embedded note, only trusted when it is the one referenced and correctly signed
+	if event.Content != "" {
+		var note nostr.Event
+		if err := json.Unmarshal([]byte(event.Content), &note); err == nil && note.ID == noteID && note.CheckID() {
+			if ok, _ := note.CheckSignature(); ok {
+				return &note, nil
+			}
+		}
+	}
+
+	// Prefer the relay hint from the e tag
+	if hint := eTag.Relay(); hint != "" {
+		relays = append([]string{hint}, relays...)
+	}
+
+	return fetchEventByID(noteID, pool, relays)
+}
+
+// processRepost notifies a user when one of their notes is reposted
+func processRepost(event *nostr.Event, pool *nostr.SimplePool, npubToUser map[string]User, hexToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	reposterNpub, err := hexToNpub(event.PubKey)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert event pubkey to npub: %v\n", err)
+		reposterNpub = event.PubKey // fallback to hex
+	}
+
+	// Only reposts by verified senders are emailed, like DMs
+	reposterNIP5, verified := emailService.verifySender(event.PubKey)
+	if !verified {
+		fmt.Printf("ℹ️  Skipping repost from unverified user: %s\n", reposterNpub)
+		return
+	}
+
+	note, err := resolveRepostedNote(event, pool, config.Relays)
+	if err != nil {
+		fmt.Printf("⚠️  Failed to resolve reposted note for %s: %v\n", event.ID, err)
+		return
+	}
+
+	// The p tag is only a hint, the note author decides who gets the email
+	recipientUser, exists := hexToUser[note.PubKey]
+	if !exists {
+		return
+	}
+	if note.PubKey == event.PubKey {
+		return // self-repost
+	}
+
+	fmt.Printf("🔁 Repost of %s's note by %s\n", recipientUser.Username, reposterNIP5)
+
+	err = emailService.ProcessNostrRepost(event, note, recipientUser, reposterNIP5, reposterNpub)
+	if err != nil {
+		fmt.Printf("❌ Failed to send email to %s: %v\n", recipientUser.Username, err)
+	} else {
+		fmt.Printf("📧 Email sent to %s\n", recipientUser.Username)
+	}
+
+	err = emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", recipientUser.Email)
+	if err != nil {
+		fmt.Printf("⚠️  Error marking repost as processed: %v\n", err)
+	}
+	if err := emailService.Notes.RecordThreadID(event.ID, recipientUser.Email, threadID(event)); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
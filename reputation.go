@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SenderThrottle limits senders with a bad reputation to a few notifications
+// per window; a zero Complaints disables it
+type SenderThrottle struct {
+	Complaints int // complaints and unsubscribes after which a sender is throttled
+	Limit      int // notifications per Window
+	Window     time.Duration
+}
+
+// parseSenderThrottle parses a throttle like "complaints=3,limit=5,window=24h"
+func parseSenderThrottle(value string) (SenderThrottle, error) {
+	throttle := SenderThrottle{Limit: 5, Window: 24 * time.Hour}
+	if strings.TrimSpace(value) == "" {
+		return SenderThrottle{}, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		key, setting, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			return throttle, fmt.Errorf("invalid entry %q, expected key=value", entry)
+		}
+		var err error
+		switch strings.TrimSpace(key) {
+		case "complaints":
+			throttle.Complaints, err = strconv.Atoi(strings.TrimSpace(setting))
+		case "limit":
+			throttle.Limit, err = strconv.Atoi(strings.TrimSpace(setting))
+		case "window":
+			throttle.Window, err = time.ParseDuration(strings.TrimSpace(setting))
+		default:
+			return throttle, fmt.Errorf("unknown key %q, expected complaints, limit or window", key)
+		}
+		if err != nil {
+			return throttle, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	if throttle.Complaints <= 0 {
+		return throttle, fmt.Errorf("complaints must be at least 1")
+	}
+	if throttle.Limit < 0 || throttle.Window <= 0 {
+		return throttle, fmt.Errorf("limit must not be negative and window must be positive")
+	}
+	return throttle, nil
+}
+
+// Reputation is the history of a sender
+type Reputation struct {
+	Pubkey        string
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	Verified      bool
+	Identifier    string // how the sender was last verified or named
+	Notifications int    // emails and digest items generated
+	Complaints    int    // reports (NIP-56) by our users against the sender
+	Unsubscribes  int    // our users muting the sender (NIP-51)
+}
+
+// SenderReputation keeps the history of senders in SQLite, so the
+// notification pipeline can throttle repeat offenders
+type SenderReputation struct {
+	DB       *sql.DB
+	Throttle SenderThrottle
+
+	mu     sync.Mutex
+	recent map[string][]time.Time // notification times within the throttle window by sender
+}
+
+// NewSenderReputation creates a reputation store on the given database
+func NewSenderReputation(db *sql.DB, throttle SenderThrottle) *SenderReputation {
+	return &SenderReputation{DB: db, Throttle: throttle, recent: make(map[string][]time.Time)}
+}
+
+// touch creates the reputation of a sender or updates when they were last seen
+func (r *SenderReputation) touch(pubkey string, now time.Time) error {
+	_, err := r.DB.Exec(`INSERT INTO sender_reputation (pubkey, first_seen, last_seen) VALUES (?, ?, ?)
+		ON CONFLICT (pubkey) DO UPDATE SET last_seen = excluded.last_seen`, pubkey, now.UTC(), now.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record sender %s: %v", pubkey, err)
+	}
+	return nil
+}
+
+// count adds one to a counter of a sender
+func (r *SenderReputation) count(pubkey, column string) error {
+	if err := r.touch(pubkey, time.Now()); err != nil {
+		return err
+	}
+	// column is one of our constants, never input
+	if _, err := r.DB.Exec("UPDATE sender_reputation SET "+column+" = "+column+" + 1 WHERE pubkey = ?", pubkey); err != nil {
+		return fmt.Errorf("failed to count %s of %s: %v", column, pubkey, err)
+	}
+	return nil
+}
+
+// RecordNotification counts a notification generated from an event of a sender
+func (r *SenderReputation) RecordNotification(pubkey string) error {
+	if r.Throttle.Complaints > 0 {
+		r.mu.Lock()
+		r.recent[pubkey] = append(r.recentNotifications(pubkey, time.Now()), time.Now())
+		r.mu.Unlock()
+	}
+	return r.count(pubkey, "notifications")
+}
+
+// recentNotifications returns the notification times of a sender within the
+// throttle window and forgets older ones; r.mu must be held
+func (r *SenderReputation) recentNotifications(pubkey string, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, notifiedAt := range r.recent[pubkey] {
+		if now.Sub(notifiedAt) < r.Throttle.Window {
+			recent = append(recent, notifiedAt)
+		}
+	}
+	if recent == nil {
+		delete(r.recent, pubkey)
+	} else {
+		r.recent[pubkey] = recent
+	}
+	return recent
+}
+
+// RecordComplaint counts a report by one of our users against a sender
+func (r *SenderReputation) RecordComplaint(pubkey string) error {
+	return r.count(pubkey, "complaints")
+}
+
+// RecordUnsubscribe counts one of our users muting a sender
+func (r *SenderReputation) RecordUnsubscribe(pubkey string) error {
+	return r.count(pubkey, "unsubscribes")
+}
+
+// RecordVerification stores the verification status of a sender, and in the
+// history when it changed
+func (r *SenderReputation) RecordVerification(pubkey, identifier string, verified bool) error {
+	now := time.Now()
+	if err := r.touch(pubkey, now); err != nil {
+		return err
+	}
+	result, err := r.DB.Exec(`UPDATE sender_reputation SET verified = ?, identifier = ?
+		WHERE pubkey = ? AND (verified != ? OR identifier != ?)`, verified, identifier, pubkey, verified, identifier)
+	if err != nil {
+		return fmt.Errorf("failed to record verification of %s: %v", pubkey, err)
+	}
+	if changed, _ := result.RowsAffected(); changed == 0 {
+		return nil
+	}
+	_, err = r.DB.Exec("INSERT INTO sender_verifications (pubkey, verified, identifier, changed_at) VALUES (?, ?, ?, ?)",
+		pubkey, verified, identifier, now.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record verification of %s: %v", pubkey, err)
+	}
+	return nil
+}
+
+// Get returns the reputation of a sender, or nil for senders we have not seen
+func (r *SenderReputation) Get(pubkey string) (*Reputation, error) {
+	reputation := Reputation{Pubkey: pubkey}
+	err := r.DB.QueryRow(`SELECT first_seen, last_seen, verified, identifier, notifications, complaints, unsubscribes
+		FROM sender_reputation WHERE pubkey = ?`, pubkey).Scan(&reputation.FirstSeen, &reputation.LastSeen,
+		&reputation.Verified, &reputation.Identifier, &reputation.Notifications, &reputation.Complaints, &reputation.Unsubscribes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reputation of %s: %v", pubkey, err)
+	}
+	return &reputation, nil
+}
+
+// Throttled reports whether a sender with too many complaints and unsubscribes
+// already generated Limit notifications within Window. Notification times are
+// kept in memory, a restart starts a new window.
+func (r *SenderReputation) Throttled(pubkey string) (bool, error) {
+	if r.Throttle.Complaints <= 0 {
+		return false, nil
+	}
+	reputation, err := r.Get(pubkey)
+	if err != nil || reputation == nil {
+		return false, err
+	}
+	if reputation.Complaints+reputation.Unsubscribes < r.Throttle.Complaints {
+		return false, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.recentNotifications(pubkey, time.Now())) >= r.Throttle.Limit, nil
+}
+
+// processUserReport counts a report (kind 1984, NIP-56) by one of our users
+// as a complaint against each reported pubkey
+func processUserReport(event *nostr.Event, hexToUser map[string]User, reputation *SenderReputation, notes NoteStore) {
+	if _, monitored := hexToUser[event.PubKey]; !monitored {
+		return
+	}
+	// Count each report once, however often relays send it
+	if err := notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", ""); err != nil {
+		fmt.Printf("⚠️  Error marking report as processed: %v\n", err)
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" || tag[1] == event.PubKey {
+			continue
+		}
+		if err := reputation.RecordComplaint(strings.ToLower(tag[1])); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			continue
+		}
+		fmt.Printf("📉 %s complained about %s\n", hexToUser[event.PubKey].Username, tag[1])
+	}
+}
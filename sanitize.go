@@ -0,0 +1,200 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ansiEscapePattern matches ANSI/VT100 escape sequences (CSI and OSC)
+var ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[@-_]`)
+
+// isBidiControl reports whether r overrides the text direction, which can be
+// used to make content look different from what it is
+func isBidiControl(r rune) bool {
+	return (r >= '\u202A' && r <= '\u202E') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// hiddenElements are the HTML elements stripMarkup drops with their content,
+// which is no text to show
+var hiddenElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Iframe:   true,
+	atom.Math:     true,
+	atom.Noscript: true,
+	atom.Object:   true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Svg:      true,
+	atom.Template: true,
+	atom.Title:    true,
+}
+
+// voidElements are the HTML elements without content or end tag
+var voidElements = map[atom.Atom]bool{
+	atom.Area:   true,
+	atom.Base:   true,
+	atom.Br:     true,
+	atom.Col:    true,
+	atom.Embed:  true,
+	atom.Hr:     true,
+	atom.Img:    true,
+	atom.Input:  true,
+	atom.Link:   true,
+	atom.Meta:   true,
+	atom.Source: true,
+	atom.Track:  true,
+	atom.Wbr:    true,
+}
+
+// hiddenStylePattern matches inline styles that hide an element
+var hiddenStylePattern = regexp.MustCompile(`(?i)(^|;)\s*(display\s*:\s*none|visibility\s*:\s*hidden)\b`)
+
+// isHiddenTag reports whether the attributes of the current tag of a
+// tokenizer hide the element, by the hidden attribute or an inline style
+func isHiddenTag(tokenizer *html.Tokenizer) bool {
+	for {
+		key, value, more := tokenizer.TagAttr()
+		switch string(key) {
+		case "hidden":
+			return true
+		case "style":
+			if hiddenStylePattern.Match(value) {
+				return true
+			}
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// lineBreakElements are the HTML elements stripMarkup ends a line after
+var lineBreakElements = map[atom.Atom]bool{
+	atom.Br:         true,
+	atom.P:          true,
+	atom.Div:        true,
+	atom.Li:         true,
+	atom.Tr:         true,
+	atom.Blockquote: true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+}
+
+// stripMarkup removes HTML from text and keeps what it says: tags, comments
+// and doctypes are dropped, and so are scripts, styles and the other
+// hiddenElements with their content, as well as elements hidden by the hidden
+// attribute or a display:none or visibility:hidden style. Only HTML elements
+// count, so text that merely looks like a tag such as <3 or
+// <https://example.org> stays, and entities are left as written;
+// html/template escapes both.
+func stripMarkup(text string) string {
+	if !strings.Contains(text, "<") {
+		return text
+	}
+
+	var stripped strings.Builder
+	// hidden counts the open hiddenElement elements, so the content of a
+	// hidden element ends at its own end tag when others of its name nest
+	var hiddenElement atom.Atom
+	hidden := 0
+	tokenizer := html.NewTokenizer(strings.NewReader(text))
+	for {
+		tokenType := tokenizer.Next()
+		raw := string(tokenizer.Raw()) // TagName reuses the buffer
+		if tokenType == html.ErrorToken {
+			// An unfinished tag at the end is no markup
+			if hidden == 0 {
+				stripped.WriteString(raw)
+			}
+			return stripped.String()
+		}
+		switch tokenType {
+		case html.TextToken:
+			if hidden == 0 {
+				stripped.WriteString(raw)
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, hasAttributes := tokenizer.TagName()
+			element := atom.Lookup(name)
+			switch {
+			case element == 0:
+				if hidden == 0 {
+					stripped.WriteString(raw)
+				}
+			case hidden > 0:
+				if element != hiddenElement {
+					break
+				}
+				if tokenType == html.StartTagToken {
+					hidden++
+				} else if tokenType == html.EndTagToken {
+					hidden--
+				}
+			case tokenType == html.StartTagToken && !voidElements[element] &&
+				(hiddenElements[element] || hasAttributes && isHiddenTag(tokenizer)):
+				hiddenElement = element
+				hidden = 1
+			case lineBreakElements[element]:
+				if element == atom.Br || tokenType == html.EndTagToken {
+					stripped.WriteString("\n")
+				}
+			}
+		}
+	}
+}
+
+// sanitizeText makes event-derived text safe to put into an email: HTML
+// markup (see stripMarkup), invalid UTF-8, ANSI escapes, control characters
+// (except newlines and tabs) and bidi overrides are removed and the text is
+// normalized to NFC. HTML escaping is left to html/template.
+func sanitizeText(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	text = stripMarkup(text)
+	text = ansiEscapePattern.ReplaceAllString(text, "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+
+	return norm.NFC.String(text)
+}
+
+// sanitizeLine sanitizes text that must stay on one line, e.g. the subject
+func sanitizeLine(text string) string {
+	return strings.Join(strings.Fields(sanitizeText(text)), " ")
+}
+
+// sanitizeTemplateData sanitizes every field of template data that comes from
+// nostr events, so templates can use them without further care
+func sanitizeTemplateData(data EmailTemplateData) EmailTemplateData {
+	data.EventContent = sanitizeText(data.EventContent)
+	data.SenderNIP5 = sanitizeLine(data.SenderNIP5)
+	data.Subject = sanitizeLine(data.Subject)
+	data.Title = sanitizeLine(data.Title)
+
+	content := make(map[string]interface{}, len(data.Content))
+	for key, value := range data.Content {
+		if text, ok := value.(string); ok {
+			value = sanitizeText(text)
+		}
+		content[key] = value
+	}
+	data.Content = content
+	return data
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripMarkup(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"plain", "Hello nostr", "Hello nostr"},
+		{"tags", "<b>bold</b> and <a href=\"https://example.org\">a link</a>", "bold and a link"},
+		{"script", "Hi<script>alert('x')</script> there", "Hi there"},
+		{"script with markup", "Hi<script>document.write('</p>')</script> there", "Hi there"},
+		{"style", "<style>body { display: none }</style>Hi", "Hi"},
+		{"tracking pixel", "Hi<img src=\"https://tracker.example.org/p.gif\" width=\"1\">", "Hi"},
+		{"display none", "Hi<span style=\"display:none\">secret</span> there", "Hi there"},
+		{"display none spaced", "Hi<div style=\"color: red; DISPLAY : none\">secret</div> there", "Hi there"},
+		{"visibility hidden", "Hi<p style=\"visibility:hidden\">secret</p> there", "Hi there"},
+		{"hidden attribute", "Hi<span hidden>secret</span> there", "Hi there"},
+		{"nested hidden", "<div style=\"display:none\"><div>secret</div>still secret</div>shown", "shown"},
+		{"hidden void element", "<img style=\"display:none\" src=\"x.png\">shown", "shown"},
+		{"displayed", "<span style=\"display:inline\">shown</span>", "shown"},
+		{"comment", "Hi<!-- secret --> there", "Hi there"},
+		{"line breaks", "<p>one<br>two</p><p>three</p>", "one\ntwo\nthree\n"},
+		{"heart", "I <3 nostr", "I <3 nostr"},
+		{"angle link", "See <https://example.org>", "See <https://example.org>"},
+		{"comparison", "a < b > c", "a < b > c"},
+		{"entity", "a &lt; b", "a &lt; b"},
+		{"unfinished tag", "Hi <b", "Hi <b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripMarkup(tt.text); got != tt.want {
+				t.Errorf("stripMarkup(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"plain", "Hello nostr", "Hello nostr"},
+		{"newlines and tabs", "one\r\ntwo\n\tthree", "one\ntwo\n\tthree"},
+		{"bidi override", "invoice‮fdp.exe", "invoicefdp.exe"},
+		{"bidi isolates", "a⁦b⁩c", "abc"},
+		{"ansi color", "\x1b[31mred\x1b[0m text", "red text"},
+		{"ansi title", "\x1b]0;owned\x07text", "text"},
+		{"control characters", "bell\x07 null\x00 delete\x7f", "bell null delete"},
+		{"invalid utf-8", "bad\xffbyte", "badbyte"},
+		{"nfc", "Café", "Café"},
+		{"markup", "<script>alert(1)</script>Hi <b>there</b>", "Hi there"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeText(tt.text); got != tt.want {
+				t.Errorf("sanitizeText(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+
+	if got := sanitizeLine("Alice\n‮evil\t <b>name</b>"); got != "Alice evil name" {
+		t.Errorf("sanitizeLine = %q, want %q", got, "Alice evil name")
+	}
+}
+
+func TestRenderedEmailEscapesContentOnce(t *testing.T) {
+	es := NewEmailService("localhost", 25, "user", "password", "from@example.org", "From")
+	data := EmailTemplateData{
+		FirstName:    "Alice",
+		SenderNIP5:   "bob@example.org",
+		EventContent: "I <3 nostr<script>alert(1)</script> & <span style=\"display:none\">secret</span>you",
+		Content: map[string]interface{}{
+			"action":        "mentioned you",
+			"parentContent": "a < b",
+			"parentLabel":   "In reply to",
+			"buttonText":    "View on nostr",
+			"buttonURL":     "https://example.org",
+		},
+	}
+
+	template, err := es.renderEmail("nostr_mention", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"I &lt;3 nostr &amp; you", "a &lt; b"} {
+		if !strings.Contains(template.HTMLContent, want) {
+			t.Errorf("HTML does not contain %q", want)
+		}
+	}
+	for _, unwanted := range []string{"&amp;lt;", "&amp;amp;", "<script>alert", "secret"} {
+		if strings.Contains(template.HTMLContent, unwanted) {
+			t.Errorf("HTML contains %q", unwanted)
+		}
+	}
+	if !strings.Contains(template.TextContent, "I <3 nostr & you") {
+		t.Errorf("text does not contain the unescaped content:\n%s", template.TextContent)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendGridTimeout bounds one call of the SendGrid API
+const sendGridTimeout = 30 * time.Second
+
+// SendGridConfig configures the SendGrid API provider
+type SendGridConfig struct {
+	APIKey string
+	// Categories tag every email, besides the template name, e.g. the
+	// deployment; SendGrid's statistics are broken down by category
+	Categories []string
+	// Sandbox validates emails without delivering them, for staging
+	Sandbox bool
+}
+
+// loadSendGridConfig reads NOSTREMAIL_SENDGRID_API_KEY,
+// NOSTREMAIL_SENDGRID_CATEGORIES and NOSTREMAIL_SENDGRID_SANDBOX
+func loadSendGridConfig() SendGridConfig {
+	config := SendGridConfig{APIKey: os.Getenv("NOSTREMAIL_SENDGRID_API_KEY")}
+	for _, category := range strings.Split(os.Getenv("NOSTREMAIL_SENDGRID_CATEGORIES"), ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			config.Categories = append(config.Categories, category)
+		}
+	}
+	config.Sandbox, _ = strconv.ParseBool(os.Getenv("NOSTREMAIL_SENDGRID_SANDBOX"))
+	return config
+}
+
+// SendGridTransport delivers emails with the v3 Mail Send API of SendGrid
+type SendGridTransport struct {
+	Config   SendGridConfig
+	Endpoint string
+	Client   *http.Client
+}
+
+// NewSendGridTransport creates a transport for the SendGrid API
+func NewSendGridTransport(config SendGridConfig) *SendGridTransport {
+	return &SendGridTransport{
+		Config:   config,
+		Endpoint: "https://api.sendgrid.com",
+		Client:   &http.Client{Timeout: sendGridTimeout},
+	}
+}
+
+// sendGridAddress is an address in Mail Send requests
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// sendGridContent is a body in Mail Send requests
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// sendGridAttachment is an attachment in Mail Send requests
+type sendGridAttachment struct {
+	Content     []byte `json:"content"` // base64 in JSON
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+// sendGridRequest is the body of a Mail Send request
+func (t *SendGridTransport) sendGridRequest(email *OutgoingEmail) map[string]interface{} {
+	request := map[string]interface{}{
+		"personalizations": []map[string]interface{}{
+			{"to": []sendGridAddress{{Email: email.To}}},
+		},
+		"from":    sendGridAddress{Email: email.From, Name: email.FromName},
+		"subject": email.Subject,
+		"content": []sendGridContent{
+			{Type: "text/plain", Value: email.Text},
+		},
+	}
+	if email.HTML != "" {
+		request["content"] = []sendGridContent{
+			{Type: "text/plain", Value: email.Text},
+			{Type: "text/html", Value: email.HTML},
+		}
+	}
+	if email.ReplyTo != "" {
+		request["reply_to"] = sendGridAddress{Email: email.ReplyTo}
+	}
+	if len(email.Headers) > 0 {
+		request["headers"] = email.Headers
+	}
+	if len(email.Attachments) > 0 {
+		var attachments []sendGridAttachment
+		for _, attachment := range email.Attachments {
+			sendGrid := sendGridAttachment{
+				Content:  attachment.Data,
+				Type:     attachment.ContentType,
+				Filename: attachment.Filename,
+			}
+			if attachment.Inline {
+				sendGrid.Disposition, sendGrid.ContentID = "inline", attachment.Filename
+			}
+			attachments = append(attachments, sendGrid)
+		}
+		request["attachments"] = attachments
+	}
+
+	categories := append([]string{}, t.Config.Categories...)
+	if email.Type != "" {
+		categories = append(categories, email.Type)
+	}
+	if len(categories) > 0 {
+		request["categories"] = categories
+	}
+	if t.Config.Sandbox {
+		request["mail_settings"] = map[string]interface{}{
+			"sandbox_mode": map[string]bool{"enable": true},
+		}
+	}
+	return request
+}
+
+// Send sends an email and returns the X-Message-Id SendGrid gave it, which
+// its event webhook refers to
+func (t *SendGridTransport) Send(email *OutgoingEmail) (string, error) {
+	body, err := json.Marshal(t.sendGridRequest(email))
+	if err != nil {
+		return "", fmt.Errorf("failed to encode SendGrid request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(t.Endpoint, "/")+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.Config.APIKey)
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("SendGrid request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read SendGrid response: %v", err)
+	}
+	// Sandbox mode answers 200, delivery 202
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		json.Unmarshal(response, &failure)
+		var messages []string
+		for _, e := range failure.Errors {
+			messages = append(messages, e.Message)
+		}
+		if len(messages) == 0 {
+			messages = append(messages, strings.TrimSpace(string(response)))
+		}
+		return "", fmt.Errorf("SendGrid returned %s: %s", resp.Status, strings.Join(messages, "; "))
+	}
+	return resp.Header.Get("X-Message-Id"), nil
+}
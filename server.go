@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// daemonMux routes the public HTTP endpoints of the daemon: the npub
+// confirmation page (see challenge.go) and, when enabled, nostr.json,
+// unsubscribe links, bounce webhooks, inbound replies and the admin API
+func daemonMux(config *Config, userSource UserSource, sqliteDB *sql.DB, verifiedNpubs *sql.DB, shadowBans ShadowBanList, suppressions SuppressionList, unsubscribe *Unsubscriber, inbound *InboundReplies) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/confirm", handleConfirm(sqliteDB))
+	if config.ServeNostrJSON {
+		mux.Handle("/.well-known/nostr.json", &NostrJSON{
+			Users:         userSource,
+			VerifiedNpubs: verifiedNpubs,
+		})
+	}
+	if unsubscribe != nil {
+		mux.HandleFunc("/unsubscribe", handleUnsubscribe(unsubscribe))
+	}
+	if config.WebhookToken != "" && suppressions != nil {
+		for _, provider := range []string{bounceProviderSES, bounceProviderMailgun, bounceProviderSendGrid} {
+			mux.HandleFunc("/webhooks/"+provider, handleBounces(provider, suppressions, config.WebhookToken))
+		}
+	}
+	if config.WebhookToken != "" && inbound != nil {
+		for _, provider := range []string{inboundProviderMailgun, inboundProviderSendGrid, inboundProviderPostmark} {
+			mux.HandleFunc("/webhooks/inbound/"+provider, handleInboundReplies(provider, inbound, config.WebhookToken))
+		}
+	}
+	if config.AdminToken != "" && shadowBans != nil {
+		mux.HandleFunc("/admin/shadow-bans", handleShadowBans(shadowBans, config.AdminToken))
+	}
+	return mux
+}
+
+// runHTTPServer serves the public HTTP endpoints until the listener fails
+func runHTTPServer(addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	fmt.Printf("🌐 HTTP endpoints listening on %s\n", addr)
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Printf("❌ HTTP endpoints stopped: %v\n", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sesTimeout bounds one call of the SES API
+const sesTimeout = 30 * time.Second
+
+// SESConfig configures the Amazon SES API provider; the credentials are read
+// from the standard AWS environment variables
+type SESConfig struct {
+	Region           string
+	ConfigurationSet string // optional, e.g. to publish bounces to SNS
+	AccessKeyID      string
+	SecretAccessKey  string
+	SessionToken     string // for temporary credentials
+}
+
+// loadSESConfig reads NOSTREMAIL_SES_REGION (or AWS_REGION),
+// NOSTREMAIL_SES_CONFIGURATION_SET and the AWS credentials
+func loadSESConfig() SESConfig {
+	return SESConfig{
+		Region:           getEnvOrDefault("NOSTREMAIL_SES_REGION", os.Getenv("AWS_REGION")),
+		ConfigurationSet: os.Getenv("NOSTREMAIL_SES_CONFIGURATION_SET"),
+		AccessKeyID:      os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey:  os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// SESTransport delivers messages with the SendEmail call of the SES v2 API,
+// signed with AWS Signature Version 4
+type SESTransport struct {
+	Config   SESConfig
+	Endpoint string // e.g. https://email.eu-west-1.amazonaws.com
+	Client   *http.Client
+}
+
+// NewSESTransport creates a transport for the SES endpoint of the region
+func NewSESTransport(config SESConfig) *SESTransport {
+	return &SESTransport{
+		Config:   config,
+		Endpoint: fmt.Sprintf("https://email.%s.amazonaws.com", config.Region),
+		Client:   &http.Client{Timeout: sesTimeout},
+	}
+}
+
+// Send sends the raw message and returns the SES message ID, which bounce
+// and complaint notifications refer to
+func (t *SESTransport) Send(email *OutgoingEmail) (string, error) {
+	var raw bytes.Buffer
+	if _, err := email.Message().WriteTo(&raw); err != nil {
+		return "", fmt.Errorf("failed to encode message: %v", err)
+	}
+	request := map[string]interface{}{
+		"Content": map[string]interface{}{
+			"Raw": map[string]interface{}{"Data": raw.Bytes()}, // base64 in JSON
+		},
+	}
+	if t.Config.ConfigurationSet != "" {
+		request["ConfigurationSetName"] = t.Config.ConfigurationSet
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode SES request: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(t.Endpoint, "/")+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, body, t.Config, "ses", time.Now())
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("SES request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read SES response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(response, &failure)
+		if failure.Message == "" {
+			failure.Message = strings.TrimSpace(string(response))
+		}
+		return "", fmt.Errorf("SES returned %s: %s", resp.Status, failure.Message)
+	}
+
+	var sent struct {
+		MessageID string `json:"MessageId"`
+	}
+	if err := json.Unmarshal(response, &sent); err != nil {
+		return "", fmt.Errorf("invalid SES response: %v", err)
+	}
+	return sent.MessageID, nil
+}
+
+// hmacSHA256 is one step of the Signature Version 4 key derivation
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsSigningKey derives the Signature Version 4 key of a day, region and service
+func awsSigningKey(secretAccessKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// awsQueryEscape escapes like Signature Version 4 expects: everything but
+// unreserved characters, spaces as %20
+func awsQueryEscape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// signAWSRequest adds the X-Amz-Date and Authorization headers of AWS
+// Signature Version 4 to a request with the given body
+func signAWSRequest(req *http.Request, body []byte, config SESConfig, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", config.SessionToken)
+	}
+
+	// Canonical request: the signed headers are host and every header set so
+	// far, with their values trimmed and sequential spaces collapsed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		var trimmed []string
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, awsQueryEscape(key)+"="+awsQueryEscape(value))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, config.Region, service)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := awsSigningKey(config.SecretAccessKey, date, config.Region, service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.AccessKeyID, scope, signedHeaders, signature))
+}
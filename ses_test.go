@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The credentials, region and service of the AWS Signature Version 4 test
+// suite, https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+var awsTestConfig = SESConfig{
+	Region:          "us-east-1",
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestAWSSigningKey(t *testing.T) {
+	// The key derivation example of the AWS documentation
+	key := awsSigningKey(awsTestConfig.SecretAccessKey, "20120215", "us-east-1", "iam")
+	if got := hex.EncodeToString(key); got != "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d" {
+		t.Errorf("signing key = %s", got)
+	}
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name, method, url string
+		headers           map[string]string
+		body              string
+		signedHeaders     string
+		signature         string
+	}{
+		{
+			name: "get-vanilla", method: http.MethodGet, url: "https://example.amazonaws.com/",
+			signedHeaders: "host;x-amz-date",
+			signature:     "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "post-vanilla", method: http.MethodPost, url: "https://example.amazonaws.com/",
+			signedHeaders: "host;x-amz-date",
+			signature:     "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name: "get-vanilla-query-order-key-case", method: http.MethodGet, url: "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			signedHeaders: "host;x-amz-date",
+			signature:     "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name: "get-header-value-trim", method: http.MethodGet, url: "https://example.amazonaws.com/",
+			headers:       map[string]string{"My-Header1": " value1", "My-Header2": ` "a   b   c"`},
+			signedHeaders: "host;my-header1;my-header2;x-amz-date",
+			signature:     "acc3ed3afb60bb290fc8d2dd0098b9911fcaa05412b367055dee359757a9c736",
+		},
+		{
+			name: "post-x-www-form-urlencoded", method: http.MethodPost, url: "https://example.amazonaws.com/",
+			headers:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:          "Param1=value1",
+			signedHeaders: "content-type;host;x-amz-date",
+			signature:     "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			signAWSRequest(req, []byte(tt.body), awsTestConfig, "service", now)
+
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %s", got)
+			}
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=" +
+				tt.signedHeaders + ", Signature=" + tt.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization = %s\nwant %s", got, want)
+			}
+		})
+	}
+}
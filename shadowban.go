@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ShadowBan is a sender whose events are never emailed
+type ShadowBan struct {
+	Pubkey   string    `json:"pubkey"` // hex
+	Reason   string    `json:"reason"`
+	BannedAt time.Time `json:"bannedAt"`
+}
+
+// ShadowBanList holds the senders moderators shadow-banned: their events are
+// recorded as processed like any other, so nothing tells them apart, but never
+// emailed. The note stores implement it, so replicas sharing PostgreSQL share
+// the list.
+type ShadowBanList interface {
+	// ShadowBan returns the ban of a hex pubkey, nil when it is not banned
+	ShadowBan(pubkey string) (*ShadowBan, error)
+	// AddShadowBan bans a hex pubkey, or updates the reason of a banned one
+	AddShadowBan(pubkey, reason string) error
+	// RemoveShadowBan lifts the ban of a hex pubkey and reports whether it was banned
+	RemoveShadowBan(pubkey string) (bool, error)
+	// ShadowBans lists the banned pubkeys, oldest first
+	ShadowBans() ([]ShadowBan, error)
+}
+
+// parsePubkey reads one npub or hex pubkey as hex
+func parsePubkey(value string) (string, error) {
+	pubkeys, err := parsePubkeyList(value)
+	if err != nil {
+		return "", err
+	}
+	if len(pubkeys) != 1 {
+		return "", fmt.Errorf("expected one npub or hex pubkey, got %q", value)
+	}
+	return pubkeys[0], nil
+}
+
+// queryShadowBans reads the bans selected by a query for pubkey, reason and
+// banned_at
+func queryShadowBans(db *sql.DB, query string, args ...interface{}) ([]ShadowBan, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shadow bans: %v", err)
+	}
+	defer rows.Close()
+
+	var bans []ShadowBan
+	for rows.Next() {
+		var ban ShadowBan
+		if err := rows.Scan(&ban.Pubkey, &ban.Reason, &ban.BannedAt); err != nil {
+			return nil, fmt.Errorf("failed to read shadow ban: %v", err)
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// shadowBanned reports whether a sender is shadow-banned; lookups that fail
+// do not hold emails back
+func (es *EmailService) shadowBanned(pubkey string) bool {
+	if es.ShadowBans == nil {
+		return false
+	}
+	ban, err := es.ShadowBans.ShadowBan(pubkey)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return false
+	}
+	return ban != nil
+}
+
+// filterShadowBanned drops the events of shadow-banned authors, marking them
+// processed so they are not evaluated again
+func filterShadowBanned(event *nostr.Event, emailService *EmailService) bool {
+	if !emailService.shadowBanned(event.PubKey) {
+		return false
+	}
+	fmt.Printf("🤫 Dropped event %s, author shadow-banned\n", event.ID)
+	if err := emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", ""); err != nil {
+		fmt.Printf("⚠️  Error marking shadow-banned event as processed: %v\n", err)
+	}
+	return true
+}
+
+// runShadowBan implements `nostremail shadowban add|remove|list [--db path] [--postgres url]`
+func runShadowBan(args []string) error {
+	fs := flag.NewFlagSet("shadowban", flag.ExitOnError)
+	dbPath := fs.String("db", processedNotesDBPath, "Path of the processed notes database")
+	postgresURL := fs.String("postgres", "", "Use the shadow-ban list of the PostgreSQL note store at this URL instead")
+	reason := fs.String("reason", "harassment", "Why the sender is banned, for other moderators")
+	usage := fmt.Errorf("usage: nostremail shadowban [--db path] [--postgres url] add [--reason reason] <npub> | remove <npub> | list")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usage
+	}
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	if command == "add" {
+		// --reason may follow the command
+		fs.Parse(rest)
+		rest = fs.Args()
+	}
+
+	var pubkey string
+	if (command == "add" || command == "remove") && len(rest) == 1 {
+		var err error
+		if pubkey, err = parsePubkey(rest[0]); err != nil {
+			return err
+		}
+	}
+
+	notes, closeNotes, err := openNoteStore(*dbPath, *postgresURL)
+	if err != nil {
+		return err
+	}
+	defer closeNotes()
+
+	switch {
+	case command == "add" && pubkey != "":
+		if err := notes.AddShadowBan(pubkey, *reason); err != nil {
+			return err
+		}
+		fmt.Printf("🤫 Shadow-banned %s (%s)\n", pubkey, *reason)
+	case command == "remove" && pubkey != "":
+		removed, err := notes.RemoveShadowBan(pubkey)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("%s is not shadow-banned", rest[0])
+		}
+		fmt.Printf("✅ Lifted the shadow ban of %s\n", pubkey)
+	case command == "list" && len(rest) == 0:
+		bans, err := notes.ShadowBans()
+		if err != nil {
+			return err
+		}
+		for _, ban := range bans {
+			npub, _ := hexToNpub(ban.Pubkey)
+			fmt.Printf("%s | %s | %s | %s\n", ban.Pubkey, npub, ban.Reason, ban.BannedAt.UTC().Format("2006-01-02 15:04:05"))
+		}
+		fmt.Fprintf(os.Stderr, "%d shadow-banned senders\n", len(bans))
+	default:
+		return usage
+	}
+	return nil
+}
+
+// handleShadowBans serves the shadow-ban list to moderators holding the admin
+// token: GET lists the bans, POST {"pubkey", "reason"} adds one and DELETE
+// ?pubkey= lifts one
+func handleShadowBans(bans ShadowBanList, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			list, err := bans.ShadowBans()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if list == nil {
+				list = []ShadowBan{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case http.MethodPost:
+			var request struct {
+				Pubkey string `json:"pubkey"`
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+			pubkey, err := parsePubkey(request.Pubkey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if request.Reason == "" {
+				request.Reason = "harassment"
+			}
+			if err := bans.AddShadowBan(pubkey, request.Reason); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("🤫 Shadow-banned %s (%s)\n", pubkey, request.Reason)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			pubkey, err := parsePubkey(r.URL.Query().Get("pubkey"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			removed, err := bans.RemoveShadowBan(pubkey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !removed {
+				http.Error(w, "Not shadow-banned", http.StatusNotFound)
+				return
+			}
+			fmt.Printf("✅ Lifted the shadow ban of %s\n", pubkey)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Headers of signed notification emails
+const (
+	eventIDHeader               = "X-Nostr-Event-Id"
+	notificationSignatureHeader = "X-Nostr-Notification-Signature"
+)
+
+// notificationSignatureVersion is part of the signature header, bump it when
+// the signed event changes
+const notificationSignatureVersion = "v2"
+
+// kindNotificationSignature is the kind of the events the daemon signs for
+// emails. They are never published, so the kind is ephemeral.
+const kindNotificationSignature = 27510
+
+// notificationEvent is the event the daemon signs for an email about an
+// event: that it was generated from the event for the recipient. The email
+// headers carry what it takes to rebuild it.
+func notificationEvent(eventID, recipient, pubkey string, createdAt nostr.Timestamp) nostr.Event {
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: createdAt,
+		Kind:      kindNotificationSignature,
+		Tags: nostr.Tags{
+			{"e", strings.ToLower(eventID)},
+			{"email", strings.ToLower(strings.TrimSpace(recipient))},
+		},
+	}
+}
+
+// NotificationSigner signs notification emails with the daemon's key, so
+// Trustroots can later prove which emails were generated from which events
+type NotificationSigner struct {
+	secretKey string // hex
+	Pubkey    string // hex
+}
+
+// NewNotificationSigner creates a signer for the daemon's nsec
+func NewNotificationSigner(nsec string) (*NotificationSigner, error) {
+	secretKey, err := nsecToHex(nsec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sender nsec: %v", err)
+	}
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive sender pubkey: %v", err)
+	}
+	return &NotificationSigner{secretKey: secretKey, Pubkey: pubkey}, nil
+}
+
+// Headers returns the headers of an email about an event: the event ID and
+// the signature of a notification event naming the event and the recipient
+func (s *NotificationSigner) Headers(eventID, recipient string) (map[string]string, error) {
+	event := notificationEvent(eventID, recipient, s.Pubkey, nostr.Now())
+	if err := event.Sign(s.secretKey); err != nil {
+		return nil, fmt.Errorf("failed to sign notification: %v", err)
+	}
+	return map[string]string{
+		eventIDHeader: eventID,
+		notificationSignatureHeader: fmt.Sprintf("v=%s; pubkey=%s; created_at=%d; sig=%s",
+			notificationSignatureVersion, event.PubKey, event.CreatedAt, event.Sig),
+	}, nil
+}
+
+// parseSignatureHeader reads the key=value fields of a signature header
+func parseSignatureHeader(value string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(value, ";") {
+		if key, setting, found := strings.Cut(strings.TrimSpace(field), "="); found {
+			fields[strings.TrimSpace(key)] = strings.TrimSpace(setting)
+		}
+	}
+	return fields
+}
+
+// verifyNotificationSignature rebuilds the notification event of an email
+// about an event, checks its signature and returns the hex pubkey that signed it
+func verifyNotificationSignature(eventID, recipient, header string) (string, error) {
+	fields := parseSignatureHeader(header)
+	if fields["v"] != notificationSignatureVersion {
+		return "", fmt.Errorf("unsupported signature version %q", fields["v"])
+	}
+	if !nostr.IsValidPublicKey(fields["pubkey"]) {
+		return "", fmt.Errorf("invalid pubkey %q", fields["pubkey"])
+	}
+	createdAt, err := strconv.ParseInt(fields["created_at"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid created_at: %v", err)
+	}
+
+	event := notificationEvent(eventID, recipient, fields["pubkey"], nostr.Timestamp(createdAt))
+	event.ID = event.GetID()
+	event.Sig = fields["sig"]
+	if valid, _ := event.CheckSignature(); !valid {
+		return "", fmt.Errorf("signature does not match event %s and recipient %s", eventID, recipient)
+	}
+	return event.PubKey, nil
+}
+
+// runVerifyEmail implements `nostremail verify-email [--npub npub] <file.eml>`,
+// checking which event an email was generated from. The signer must be the
+// given npub, by default NOSTREMAIL_SENDER_NPUB.
+func runVerifyEmail(args []string) error {
+	// Like the daemon, read NOSTREMAIL_SENDER_NPUB from .env when there is one
+	godotenv.Load()
+
+	fs := flag.NewFlagSet("verify-email", flag.ExitOnError)
+	expectedNpub := fs.String("npub", os.Getenv("NOSTREMAIL_SENDER_NPUB"), "The daemon's npub the signature must be made with (default NOSTREMAIL_SENDER_NPUB)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: nostremail verify-email [--npub npub] <file.eml>")
+	}
+	return verifyEmailFile(fs.Arg(0), *expectedNpub)
+}
+
+// verifyEmailFile checks that an email was signed by the expected npub, and
+// prints the event it was generated from
+func verifyEmailFile(path, expectedNpub string) error {
+	if expectedNpub == "" {
+		return fmt.Errorf("no npub to check the signer against, pass --npub or set NOSTREMAIL_SENDER_NPUB")
+	}
+	expectedHex, err := npubToHex(expectedNpub)
+	if err != nil {
+		return fmt.Errorf("invalid --npub: %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %v", path, err)
+	}
+	defer file.Close()
+	message, err := mail.ReadMessage(file)
+	if err != nil {
+		return fmt.Errorf("failed to read email: %v", err)
+	}
+
+	eventID := message.Header.Get(eventIDHeader)
+	header := message.Header.Get(notificationSignatureHeader)
+	if eventID == "" || header == "" {
+		return fmt.Errorf("email has no %s or %s header", eventIDHeader, notificationSignatureHeader)
+	}
+	to, err := mail.ParseAddress(message.Header.Get("To"))
+	if err != nil {
+		return fmt.Errorf("invalid To header: %v", err)
+	}
+
+	signer, err := verifyNotificationSignature(eventID, to.Address, header)
+	if err != nil {
+		return err
+	}
+	signerNpub, err := hexToNpub(signer)
+	if err != nil {
+		return err
+	}
+	if signer != expectedHex {
+		return fmt.Errorf("signed by %s, not by %s", signerNpub, expectedNpub)
+	}
+
+	fmt.Printf("✅ Email to %s was generated from event %s\n", to.Address, eventID)
+	fmt.Printf("   Signed by %s\n", signerNpub)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// writeSignedEmail writes an email about an event with the headers of a
+// signer, changed by modify, and returns its path
+func writeSignedEmail(t *testing.T, signer *NotificationSigner, eventID, to string, modify func(headers map[string]string)) string {
+	t.Helper()
+	headers, err := signer.Headers(eventID, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers["To"] = "Alice <" + to + ">"
+	headers["Subject"] = "You were mentioned"
+	if modify != nil {
+		modify(headers)
+	}
+
+	var email strings.Builder
+	for name, value := range headers {
+		fmt.Fprintf(&email, "%s: %s\r\n", name, value)
+	}
+	email.WriteString("\r\nbob mentioned you\r\n")
+	path := filepath.Join(t.TempDir(), "message.eml")
+	if err := os.WriteFile(path, []byte(email.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyEmailFile(t *testing.T) {
+	daemonNsec, daemonHexPubkey := testKeys(t)
+	daemonNpub, _ := nip19.EncodePublicKey(daemonHexPubkey)
+	signer, err := NewNotificationSigner(daemonNsec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Pubkey != daemonHexPubkey {
+		t.Fatalf("signer pubkey = %s, want %s", signer.Pubkey, daemonHexPubkey)
+	}
+	otherNsec, otherHexPubkey := testKeys(t)
+	otherNpub, _ := nip19.EncodePublicKey(otherHexPubkey)
+	otherSigner, _ := NewNotificationSigner(otherNsec)
+
+	// The header of another event, the signature of another recipient
+	otherEvent, _ := signer.Headers(testKey("b"), "alice@example.org")
+	otherRecipient, _ := signer.Headers(testEventID, "mallory@example.org")
+
+	valid := writeSignedEmail(t, signer, testEventID, "alice@example.org", nil)
+	if err := verifyEmailFile(valid, daemonNpub); err != nil {
+		t.Errorf("valid email: %v", err)
+	}
+	// Addresses are compared case-insensitively
+	if err := verifyEmailFile(writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+		headers["To"] = "Alice@Example.org"
+	}), daemonNpub); err != nil {
+		t.Errorf("recipient in other case: %v", err)
+	}
+
+	tests := []struct {
+		name, path, expectedNpub string
+	}{
+		{"no expected key", valid, ""},
+		{"invalid expected key", valid, "npub1invalid"},
+		{"wrong key", valid, otherNpub},
+		{"signed by another key", writeSignedEmail(t, otherSigner, testEventID, "alice@example.org", nil), daemonNpub},
+		{"other event ID", writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+			headers[eventIDHeader] = testKey("b")
+		}), daemonNpub},
+		{"signature of another event", writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+			headers[notificationSignatureHeader] = otherEvent[notificationSignatureHeader]
+		}), daemonNpub},
+		{"forwarded to another recipient", writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+			headers["To"] = "mallory@example.org"
+		}), daemonNpub},
+		{"signature of another recipient", writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+			headers[notificationSignatureHeader] = otherRecipient[notificationSignatureHeader]
+		}), daemonNpub},
+		{"other timestamp", writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+			headers[notificationSignatureHeader] = strings.Replace(headers[notificationSignatureHeader], "created_at=", "created_at=1", 1)
+		}), daemonNpub},
+		{"claimed pubkey", writeSignedEmail(t, otherSigner, testEventID, "alice@example.org", func(headers map[string]string) {
+			headers[notificationSignatureHeader] = strings.Replace(headers[notificationSignatureHeader], otherHexPubkey, daemonHexPubkey, 1)
+		}), daemonNpub},
+		{"old version", writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+			headers[notificationSignatureHeader] = strings.Replace(headers[notificationSignatureHeader], "v=v2", "v=v1", 1)
+		}), daemonNpub},
+		{"no signature", writeSignedEmail(t, signer, testEventID, "alice@example.org", func(headers map[string]string) {
+			delete(headers, notificationSignatureHeader)
+		}), daemonNpub},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyEmailFile(tt.path, tt.expectedNpub); err == nil {
+				t.Error("verified, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// signedEventFilename names the attached event of a notification
+const signedEventFilename = "nostr-event.json"
+
+// signedEventAttachment returns an event as a JSON attachment, so recipients
+// can verify its signature themselves, e.g. with `nak verify`. Events that do
+// not verify are not attached: unsigned NIP-17 rumors, and DMs whose content
+// was replaced for the email.
+func signedEventAttachment(event *nostr.Event) (EmailAttachment, bool) {
+	if event.GetID() != event.ID {
+		return EmailAttachment{}, false
+	}
+	if valid, _ := event.CheckSignature(); !valid {
+		return EmailAttachment{}, false
+	}
+	data, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return EmailAttachment{}, false
+	}
+	return EmailAttachment{Filename: signedEventFilename, ContentType: "application/json", Data: append(data, '\n')}, true
+}
+
+// eventAttachments returns the attachments of an email about an event, with
+// the signed event when AttachEvents is set
+func (es *EmailService) eventAttachments(event *nostr.Event, template *EmailTemplate) []EmailAttachment {
+	if !es.AttachEvents {
+		return template.Attachments
+	}
+	attachment, ok := signedEventAttachment(event)
+	if !ok {
+		return template.Attachments
+	}
+	attachments := append([]EmailAttachment{}, template.Attachments...)
+	return append(attachments, attachment)
+}
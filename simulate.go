@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// simulationTimeout bounds how long we wait for relays to return stored events
+const simulationTimeout = 30 * time.Second
+
+// simulateUserNotifications replays relay history for a single user through the
+// normal event processing in dry-run mode and reports which emails would be sent.
+// With stored set, the events stored there (see eventstore.go) are replayed
+// instead. Nothing is sent and the processed_notes database is not touched.
+func simulateUserNotifications(username string, since, until time.Duration, stored NoteStore, validNpubs []User, client *mongo.Client, config *Config) error {
+	var target *User
+	for i := range validNpubs {
+		if strings.EqualFold(validNpubs[i].Username, username) {
+			target = &validNpubs[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no user with a valid npub found for username %s", username)
+	}
+
+	var targetHexes []string
+	for _, key := range userKeys(*target) {
+		targetHex, err := npubToHex(key.NostrNpub)
+		if err != nil {
+			return fmt.Errorf("failed to convert npub %s to hex: %v", key.NostrNpub, err)
+		}
+		targetHexes = append(targetHexes, targetHex)
+	}
+
+	npubToUser := make(map[string]User)
+	hexToUser := make(map[string]User)
+	for _, user := range validNpubs {
+		for _, key := range userKeys(user) {
+			npubToUser[key.NostrNpub] = key
+			if hexPubkey, err := npubToHex(key.NostrNpub); err == nil {
+				hexToUser[hexPubkey] = key
+			}
+		}
+	}
+
+	spamFilter, err := newSpamFilterFromConfig(config)
+	if err != nil {
+		return err
+	}
+
+	// Throwaway database so already processed events are replayed too
+	memoryDB, err := initSQLiteDB(":memory:")
+	if err != nil {
+		return err
+	}
+	defer memoryDB.Close()
+
+	// The settings of real delivery, so held, deferred and digested
+	// notifications are reported as such
+	emailService, err := newConfiguredEmailService(config)
+	if err != nil {
+		return err
+	}
+	emailService.DryRun = true
+	emailService.Notes = &SQLiteNoteStore{DB: memoryDB}
+	emailService.Deliveries = emailService.Notes
+
+	now := time.Now()
+	sinceTs := nostr.Timestamp(now.Add(-since).Unix())
+	untilTs := nostr.Timestamp(now.Add(-until).Unix())
+
+	fmt.Printf("🧪 Simulating notifications for %s (%s) from %s to %s\n",
+		target.Username, strings.Join(target.Npubs(), ", "), sinceTs.Time().Format(time.RFC3339), untilTs.Time().Format(time.RFC3339))
+
+	ctx, cancel := context.WithTimeout(context.Background(), simulationTimeout)
+	defer cancel()
+
+	pool := nostr.NewSimplePool(ctx)
+	emailService.Mutes = loadMuteLists(pool, config.Relays, targetHexes)
+	configureUserServices(emailService, config, pool, config.Relays, npubToUser, hexToUser, client)
+	// Replayed events are old by design
+	config.Timestamps.MaxAge = 0
+	// Watched notes go to the monitoring address, not to the simulated user
+	config.Watch = WatchConfig{}
+	filters := buildEventFilters(targetHexes, hexToUser, config, sinceTs, &untilTs)
+
+	eventCount := 0
+	if stored != nil {
+		events, err := stored.StoredEvents(sinceTs, untilTs)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			eventCount++
+			processEvent(nostr.RelayEvent{Event: event}, pool, npubToUser, hexToUser, client, config, memoryDB, emailService, spamFilter)
+		}
+	} else {
+		// Also replay from the user's DM relays (kind 10050), where modern clients deliver DMs
+		replayRelays := append([]string{}, config.Relays...)
+		for _, dmRelays := range loadDMRelayLists(pool, config.Relays, targetHexes) {
+			replayRelays = append(replayRelays, dmRelays...)
+		}
+
+		for evt := range pool.SubManyEose(ctx, replayRelays, filters) {
+			eventCount++
+			processEvent(evt, pool, npubToUser, hexToUser, client, config, memoryDB, emailService, spamFilter)
+		}
+	}
+
+	// Report only the emails that would have reached the simulated user
+	fmt.Printf("\n=== SIMULATION RESULT FOR %s ===\n", target.Username)
+	fmt.Printf("Events replayed: %d\n", eventCount)
+	notifications := 0
+	for _, job := range emailService.DryRunJobs {
+		if job.To != target.Email {
+			continue
+		}
+		notifications++
+		if sendAt := emailService.sendTime(job, time.Now()); sendAt.After(time.Now()) {
+			fmt.Printf("⏳ %s | %s | sent at %s\n", job.EventID, job.Subject, sendAt.Format(time.RFC3339))
+			continue
+		}
+		fmt.Printf("📧 %s | %s\n", job.EventID, job.Subject)
+	}
+	fmt.Printf("Notifications that would be sent: %d\n", notifications)
+
+	// Notifications over the rate limit and those not emailed at all
+	deliveries, err := emailService.Notes.Deliveries(target.Email, "", -1) // no limit in SQLite
+	if err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		switch delivery.Status {
+		case deliveryHeld:
+			fmt.Printf("🚦 %s | held for the rate limit summary\n", delivery.EventID)
+		case deliverySkipped, deliverySuppressed:
+			fmt.Printf("🚫 %s | not emailed: %s\n", delivery.EventID, delivery.Detail)
+		}
+	}
+
+	digestItems, err := emailService.Notes.DigestItems(target.Email)
+	if err != nil {
+		return err
+	}
+	for _, item := range digestItems {
+		fmt.Printf("🕸️  %s | held for digest (%s)\n", item.EventID, item.Kind)
+	}
+	if len(digestItems) > 0 {
+		fmt.Printf("Notifications that would be held for the digest: %d\n", len(digestItems))
+	}
+
+	return nil
+}
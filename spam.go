@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Spam rule actions
+const (
+	spamActionDrop       = "drop"
+	spamActionQuarantine = "quarantine"
+)
+
+// knownScamPatterns match common nostr scams, enabled with "scamPatterns"
+var knownScamPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(seed|recovery|secret) ?phrase\b`),
+	regexp.MustCompile(`(?i)\bdouble your (btc|bitcoin|sats|crypto)\b`),
+	regexp.MustCompile(`(?i)\b(airdrop|giveaway)\b.*\b(claim|connect your wallet|verify your wallet)\b`),
+	regexp.MustCompile(`(?i)\b(contact|message|dm) me on (whatsapp|telegram)\b`),
+	regexp.MustCompile(`(?i)\bguaranteed (profit|returns)\b`),
+}
+
+// linkPattern counts links in content
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://`)
+
+// SpamRulesConfig is the JSON file configuring the spam filter (NOSTREMAIL_SPAM_RULES)
+type SpamRulesConfig struct {
+	Action       string   `json:"action"`       // "drop" (default) or "quarantine"
+	Blocklist    []string `json:"blocklist"`    // regular expressions matched against the content
+	MaxLinks     int      `json:"maxLinks"`     // 0 disables the rule
+	MaxLength    int      `json:"maxLength"`    // in characters, 0 disables the rule; not applied to articles
+	RepeatLimit  int      `json:"repeatLimit"`  // identical content seen more often than this within repeatWindow is spam
+	RepeatWindow string   `json:"repeatWindow"` // duration, e.g. "1h"
+	ScamPatterns bool     `json:"scamPatterns"` // enable knownScamPatterns
+}
+
+// SpamFilter drops or quarantines events matching configurable rules before
+// they become emails, and counts the hits of each rule
+type SpamFilter struct {
+	action       string
+	blocklist    []*regexp.Regexp
+	scamPatterns bool
+	maxLinks     int
+	maxLength    int
+	repeatLimit  int
+	repeatWindow time.Duration
+
+	// Labeler publishes a spam label for quarantined events when set
+	Labeler *QuarantineLabeler
+
+	mu     sync.Mutex
+	seen   map[[32]byte][]time.Time
+	counts map[string]int
+}
+
+// spamCheckedKinds are the kinds with plain text content; DMs and gift wraps
+// are encrypted and repost content is the reposted note
+var spamCheckedKinds = map[int]bool{
+	nostr.KindTextNote:       true,
+	nostr.KindComment:        true,
+	nostr.KindArticle:        true,
+	nostr.KindChannelMessage: true,
+}
+
+// loadSpamFilter reads the spam rules from a JSON file
+func loadSpamFilter(path string) (*SpamFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spam rules: %v", err)
+	}
+	var rules SpamRulesConfig
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid spam rules: %v", err)
+	}
+	return NewSpamFilter(rules)
+}
+
+// newSpamFilterFromConfig loads the configured spam filter, or returns nil when
+// no rules are configured
+func newSpamFilterFromConfig(config *Config) (*SpamFilter, error) {
+	if config.SpamRulesPath == "" {
+		return nil, nil
+	}
+	return loadSpamFilter(config.SpamRulesPath)
+}
+
+// NewSpamFilter creates a spam filter from its configuration
+func NewSpamFilter(rules SpamRulesConfig) (*SpamFilter, error) {
+	filter := &SpamFilter{
+		action:       spamActionDrop,
+		scamPatterns: rules.ScamPatterns,
+		maxLinks:     rules.MaxLinks,
+		maxLength:    rules.MaxLength,
+		repeatLimit:  rules.RepeatLimit,
+		seen:         make(map[[32]byte][]time.Time),
+		counts:       make(map[string]int),
+	}
+
+	switch rules.Action {
+	case "", spamActionDrop:
+	case spamActionQuarantine:
+		filter.action = spamActionQuarantine
+	default:
+		return nil, fmt.Errorf("invalid spam action %q, expected drop or quarantine", rules.Action)
+	}
+
+	for _, pattern := range rules.Blocklist {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocklist pattern %q: %v", pattern, err)
+		}
+		filter.blocklist = append(filter.blocklist, re)
+	}
+
+	if rules.RepeatLimit > 0 {
+		filter.repeatWindow = time.Hour
+		if rules.RepeatWindow != "" {
+			window, err := time.ParseDuration(rules.RepeatWindow)
+			if err != nil {
+				return nil, fmt.Errorf("invalid repeatWindow: %v", err)
+			}
+			filter.repeatWindow = window
+		}
+	}
+
+	return filter, nil
+}
+
+// match returns the name of the first rule an event breaks, or ""
+func (f *SpamFilter) match(event *nostr.Event) string {
+	content := event.Content
+
+	for _, re := range f.blocklist {
+		if re.MatchString(content) {
+			return "blocklist"
+		}
+	}
+	if f.scamPatterns {
+		for _, re := range knownScamPatterns {
+			if re.MatchString(content) {
+				return "scam_pattern"
+			}
+		}
+	}
+	if f.maxLinks > 0 && len(linkPattern.FindAllStringIndex(content, -1)) > f.maxLinks {
+		return "max_links"
+	}
+	if f.maxLength > 0 && event.Kind != nostr.KindArticle && len([]rune(content)) > f.maxLength {
+		return "max_length"
+	}
+	if f.repeatLimit > 0 && f.isRepeated(content) {
+		return "repeated_content"
+	}
+	return ""
+}
+
+// isRepeated records content and reports whether it was seen more than
+// repeatLimit times within repeatWindow
+func (f *SpamFilter) isRepeated(content string) bool {
+	normalized := strings.Join(strings.Fields(strings.ToLower(content)), " ")
+	if normalized == "" {
+		return false
+	}
+	key := sha256.Sum256([]byte(normalized))
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var recent []time.Time
+	for _, seenAt := range f.seen[key] {
+		if now.Sub(seenAt) < f.repeatWindow {
+			recent = append(recent, seenAt)
+		}
+	}
+	recent = append(recent, now)
+	f.seen[key] = recent
+
+	// Forget old content now and then so the map does not grow unbounded
+	if len(f.seen) > 10000 {
+		for k, times := range f.seen {
+			if now.Sub(times[len(times)-1]) >= f.repeatWindow {
+				delete(f.seen, k)
+			}
+		}
+	}
+
+	return len(recent) > f.repeatLimit
+}
+
+// Check returns the rule an event breaks and counts the hit, or "" for events
+// that may become emails
+func (f *SpamFilter) Check(event *nostr.Event) string {
+	if !spamCheckedKinds[event.Kind] {
+		return ""
+	}
+	rule := f.match(event)
+	if rule == "" {
+		return ""
+	}
+
+	f.mu.Lock()
+	f.counts[rule]++
+	f.mu.Unlock()
+	return rule
+}
+
+// Counts returns how often each rule was hit
+func (f *SpamFilter) Counts() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counts := make(map[string]int, len(f.counts))
+	for rule, count := range f.counts {
+		counts[rule] = count
+	}
+	return counts
+}
+
+// quarantineEvent keeps a spam event for review instead of dropping it
+func quarantineEvent(db *sql.DB, event *nostr.Event, rule string) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO quarantined_events (event_id, rule, event_json) VALUES (?, ?, ?)",
+		event.ID, rule, string(eventJSON))
+	if err != nil {
+		return fmt.Errorf("failed to quarantine event: %v", err)
+	}
+	return nil
+}
+
+// filterSpam applies the spam filter to an event and reports whether it was
+// dropped or quarantined (in sqliteDB)
+func filterSpam(event *nostr.Event, spamFilter *SpamFilter, sqliteDB *sql.DB, notes NoteStore) bool {
+	if spamFilter == nil {
+		return false
+	}
+	rule := spamFilter.Check(event)
+	if rule == "" {
+		return false
+	}
+
+	count := spamFilter.Counts()[rule]
+	if spamFilter.action == spamActionQuarantine {
+		if err := quarantineEvent(sqliteDB, event, rule); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+		fmt.Printf("🚫 Quarantined event %s (rule %s, %d hits)\n", event.ID, rule, count)
+		if spamFilter.Labeler != nil {
+			go func() {
+				if err := spamFilter.Labeler.Publish(event, rule); err != nil {
+					fmt.Printf("⚠️  Failed to publish spam label: %v\n", err)
+				}
+			}()
+		}
+	} else {
+		fmt.Printf("🚫 Dropped event %s (rule %s, %d hits)\n", event.ID, rule, count)
+	}
+
+	// Spam is not evaluated again when relays send it once more
+	if err := notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", ""); err != nil {
+		fmt.Printf("⚠️  Error marking spam as processed: %v\n", err)
+	}
+	return true
+}
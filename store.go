@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NoteStore keeps the dedup history of processed events (processed_notes) and
+// the digest queue (digest_items). SQLiteNoteStore keeps them in
+// processed_notes.db next to the daemon, PostgresNoteStore in a database that
+// several replicas of the daemon can share.
+type NoteStore interface {
+	// IsNoteProcessed reports whether an event was processed for anyone
+	IsNoteProcessed(eventID string) (bool, error)
+	// IsNotificationProcessed reports whether a recipient was already notified about an event
+	IsNotificationProcessed(eventID, userEmail string) (bool, error)
+	// MarkNoteProcessed records that an event was processed for a recipient,
+	// "" for events processed without one
+	MarkNoteProcessed(eventID, authorPubkey, relayURL, userEmail string) error
+	// RecordMatchType stores how an event matched a recipient, see MentionMatches
+	RecordMatchType(eventID, userEmail, matchType string) error
+	// RecordThreadID stores the nostr conversation of a notification, see threadID
+	RecordThreadID(eventID, userEmail, thread string) error
+	// PruneProcessedNotes removes processed notes and stored events recorded
+	// before the given time and returns how many notes there were, see prune.go
+	PruneProcessedNotes(before time.Time) (int64, error)
+
+	// RecordDeletion annotates the notifications about an event its author
+	// deleted and returns how many there were
+	RecordDeletion(eventID, authorPubkey, deletionEventID string) (int64, error)
+	// RecordEarlyDeletion remembers the deletion of an event that did not reach us yet
+	RecordEarlyDeletion(eventID, authorPubkey, deletionEventID string) error
+	// DeletedBeforeArrival reports whether the author of an event deleted it
+	// before it reached us
+	DeletedBeforeArrival(event *nostr.Event) (bool, error)
+
+	// StoreEvent keeps the signed JSON of an event, encoded as json or gzip,
+	// see eventstore.go
+	StoreEvent(event *nostr.Event, encoding string) error
+	// StoredEvent returns a stored event, nil when it is not stored
+	StoredEvent(eventID string) (*nostr.Event, error)
+	// StoredEvents returns the stored events created in a time range
+	StoredEvents(since, until nostr.Timestamp) ([]*nostr.Event, error)
+
+	// The suppression list, see suppression.go
+	SuppressionList
+	// The delivery history, see delivery.go
+	DeliveryHistory
+	// The shadow-banned senders, see shadowban.go
+	ShadowBanList
+	// The Trustroots threads of nostr conversations, see trustroots_threads.go
+	ThreadLinks
+	// How addresses want to be emailed, see plaintext.go
+	EmailPreferences
+
+	// AddDigestItem stores an item for the next digest of its recipient
+	AddDigestItem(item DigestItem) error
+	// DigestItems returns the pending digest items of a recipient, of everyone for ""
+	DigestItems(recipientEmail string) ([]DigestItem, error)
+	// DeleteDigestItems removes digest items that were sent or suppressed
+	DeleteDigestItems(items []DigestItem) error
+	// ClaimDigestItems removes digest items about to be sent and returns
+	// those no other replica claimed first
+	ClaimDigestItems(items []DigestItem) ([]DigestItem, error)
+}
+
+// openNoteStore opens the PostgreSQL note store when postgresURL is set and
+// the existing SQLite database at dbPath otherwise, for subcommands
+func openNoteStore(dbPath, postgresURL string) (NoteStore, func(), error) {
+	if postgresURL != "" {
+		notes, err := NewPostgresNoteStore(postgresURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		return notes, func() { notes.DB.Close() }, nil
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, nil, fmt.Errorf("cannot open %s: %v", dbPath, err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	return &SQLiteNoteStore{DB: db}, func() { db.Close() }, nil
+}
+
+// SQLiteNoteStore keeps processed notes and digest items in processed_notes.db
+type SQLiteNoteStore struct {
+	DB *sql.DB
+}
+
+func (s *SQLiteNoteStore) IsNoteProcessed(eventID string) (bool, error) {
+	return isNoteProcessed(s.DB, eventID)
+}
+
+func (s *SQLiteNoteStore) IsNotificationProcessed(eventID, userEmail string) (bool, error) {
+	return isNotificationProcessed(s.DB, eventID, userEmail)
+}
+
+func (s *SQLiteNoteStore) MarkNoteProcessed(eventID, authorPubkey, relayURL, userEmail string) error {
+	return markNoteProcessed(s.DB, eventID, authorPubkey, relayURL, userEmail)
+}
+
+func (s *SQLiteNoteStore) RecordMatchType(eventID, userEmail, matchType string) error {
+	return recordMatchType(s.DB, eventID, userEmail, matchType)
+}
+
+func (s *SQLiteNoteStore) RecordThreadID(eventID, userEmail, thread string) error {
+	return recordThreadID(s.DB, eventID, userEmail, thread)
+}
+
+func (s *SQLiteNoteStore) PruneProcessedNotes(before time.Time) (int64, error) {
+	return pruneProcessedNotes(s.DB, before)
+}
+
+func (s *SQLiteNoteStore) RecordDeletion(eventID, authorPubkey, deletionEventID string) (int64, error) {
+	return recordDeletion(s.DB, eventID, authorPubkey, deletionEventID)
+}
+
+func (s *SQLiteNoteStore) RecordEarlyDeletion(eventID, authorPubkey, deletionEventID string) error {
+	return recordEarlyDeletion(s.DB, eventID, authorPubkey, deletionEventID)
+}
+
+func (s *SQLiteNoteStore) DeletedBeforeArrival(event *nostr.Event) (bool, error) {
+	return deletedBeforeArrival(s.DB, event)
+}
+
+func (s *SQLiteNoteStore) StoreEvent(event *nostr.Event, encoding string) error {
+	return storeEvent(s.DB, event, encoding)
+}
+
+func (s *SQLiteNoteStore) StoredEvent(eventID string) (*nostr.Event, error) {
+	events, err := queryStoredEvents(s.DB, "SELECT encoding, data FROM stored_events WHERE event_id = ?", eventID)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+func (s *SQLiteNoteStore) StoredEvents(since, until nostr.Timestamp) ([]*nostr.Event, error) {
+	return queryStoredEvents(s.DB, "SELECT encoding, data FROM stored_events WHERE created_at >= ? AND created_at <= ? ORDER BY created_at",
+		int64(since), int64(until))
+}
+
+func (s *SQLiteNoteStore) Suppression(email string) (*Suppression, error) {
+	suppressions, err := querySuppressions(s.DB, "SELECT email, reason, suppressed_at FROM suppressions WHERE email = ?", normalizeEmail(email))
+	if err != nil || len(suppressions) == 0 {
+		return nil, err
+	}
+	return &suppressions[0], nil
+}
+
+func (s *SQLiteNoteStore) Suppress(email, reason string) error {
+	_, err := s.DB.Exec(`INSERT INTO suppressions (email, reason) VALUES (?, ?)
+		ON CONFLICT (email) DO UPDATE SET reason = excluded.reason`, normalizeEmail(email), reason)
+	if err != nil {
+		return fmt.Errorf("failed to suppress %s: %v", email, err)
+	}
+	return nil
+}
+
+func (s *SQLiteNoteStore) Unsuppress(email string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM suppressions WHERE email = ?", normalizeEmail(email))
+	if err != nil {
+		return false, fmt.Errorf("failed to unsuppress %s: %v", email, err)
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (s *SQLiteNoteStore) Suppressions() ([]Suppression, error) {
+	return querySuppressions(s.DB, "SELECT email, reason, suppressed_at FROM suppressions ORDER BY suppressed_at, email")
+}
+
+func (s *SQLiteNoteStore) RecordDelivery(delivery Delivery) error {
+	_, err := s.DB.Exec("INSERT INTO deliveries (email, event_id, type, status, detail) VALUES (?, ?, ?, ?, ?)",
+		delivery.Email, delivery.EventID, delivery.Type, delivery.Status, delivery.Detail)
+	if err != nil {
+		return fmt.Errorf("failed to record delivery to %s: %v", delivery.Email, err)
+	}
+	return nil
+}
+
+func (s *SQLiteNoteStore) Deliveries(email, eventID string, limit int) ([]Delivery, error) {
+	return queryDeliveries(s.DB, `SELECT email, event_id, type, status, detail, recorded_at FROM deliveries
+		WHERE (? = '' OR email = ?) AND (? = '' OR event_id = ?) ORDER BY id DESC LIMIT ?`,
+		normalizeEmail(email), normalizeEmail(email), eventID, eventID, limit)
+}
+
+func (s *SQLiteNoteStore) ShadowBan(pubkey string) (*ShadowBan, error) {
+	bans, err := queryShadowBans(s.DB, "SELECT pubkey, reason, banned_at FROM shadow_bans WHERE pubkey = ?", pubkey)
+	if err != nil || len(bans) == 0 {
+		return nil, err
+	}
+	return &bans[0], nil
+}
+
+func (s *SQLiteNoteStore) AddShadowBan(pubkey, reason string) error {
+	_, err := s.DB.Exec(`INSERT INTO shadow_bans (pubkey, reason) VALUES (?, ?)
+		ON CONFLICT (pubkey) DO UPDATE SET reason = excluded.reason`, pubkey, reason)
+	if err != nil {
+		return fmt.Errorf("failed to shadow-ban %s: %v", pubkey, err)
+	}
+	return nil
+}
+
+func (s *SQLiteNoteStore) RemoveShadowBan(pubkey string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM shadow_bans WHERE pubkey = ?", pubkey)
+	if err != nil {
+		return false, fmt.Errorf("failed to lift the shadow ban of %s: %v", pubkey, err)
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (s *SQLiteNoteStore) ShadowBans() ([]ShadowBan, error) {
+	return queryShadowBans(s.DB, "SELECT pubkey, reason, banned_at FROM shadow_bans ORDER BY banned_at, pubkey")
+}
+
+func (s *SQLiteNoteStore) LinkThread(thread, trustrootsThread string) error {
+	_, err := s.DB.Exec(`INSERT INTO thread_links (thread_id, trustroots_thread_id) VALUES (?, ?)
+		ON CONFLICT (thread_id) DO UPDATE SET trustroots_thread_id = excluded.trustroots_thread_id`, thread, trustrootsThread)
+	if err != nil {
+		return fmt.Errorf("failed to link thread %s: %v", thread, err)
+	}
+	return nil
+}
+
+func (s *SQLiteNoteStore) TrustrootsThread(thread string) (string, error) {
+	return queryTrustrootsThread(s.DB, "SELECT trustroots_thread_id FROM thread_links WHERE thread_id = ?", thread)
+}
+
+func (s *SQLiteNoteStore) PlainText(email string) (bool, error) {
+	return queryPlainText(s.DB, "SELECT plain_text FROM email_preferences WHERE email = ?", normalizeEmail(email))
+}
+
+func (s *SQLiteNoteStore) SetPlainText(email string, plainText bool) error {
+	_, err := s.DB.Exec(`INSERT INTO email_preferences (email, plain_text) VALUES (?, ?)
+		ON CONFLICT (email) DO UPDATE SET plain_text = excluded.plain_text, updated_at = CURRENT_TIMESTAMP`, normalizeEmail(email), plainText)
+	if err != nil {
+		return fmt.Errorf("failed to save email preferences of %s: %v", email, err)
+	}
+	return nil
+}
+
+func (s *SQLiteNoteStore) AddDigestItem(item DigestItem) error {
+	return addDigestItem(s.DB, item)
+}
+
+func (s *SQLiteNoteStore) DigestItems(recipientEmail string) ([]DigestItem, error) {
+	if recipientEmail == "" {
+		return queryDigestItems(s.DB, "SELECT id, version, payload, created_at FROM digest_items ORDER BY id")
+	}
+	return loadDigestItems(s.DB, recipientEmail)
+}
+
+func (s *SQLiteNoteStore) DeleteDigestItems(items []DigestItem) error {
+	return deleteDigestItems(s.DB, items)
+}
+
+func (s *SQLiteNoteStore) ClaimDigestItems(items []DigestItem) ([]DigestItem, error) {
+	return claimDigestItems(s.DB, "DELETE FROM digest_items WHERE id = ?", items)
+}
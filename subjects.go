@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Subject strategies
+const (
+	subjectGeneric = "generic" // e.g. "💬 alice@trustroots.org mentioned you"
+	subjectSummary = "summary" // e.g. "💬 alice@trustroots.org: Anyone hosting in Lisbon?"
+)
+
+// subjectSummaryLength bounds the summary part of a subject, in characters
+const subjectSummaryLength = 60
+
+// summarySubjectTemplates are the templates whose event content is a message
+// by the sender, so it can summarize the email
+var summarySubjectTemplates = map[string]bool{
+	"nostr_mention":        true,
+	"nostr_reply":          true,
+	"nostr_direct_message": true,
+	"nostr_watched_note":   true,
+}
+
+// subjectNoisePattern matches URLs and bech32 references, which say nothing in a subject
+var subjectNoisePattern = regexp.MustCompile(`https?://\S+|(nostr:)?(npub|nprofile|note|nevent|naddr)1[02-9ac-hj-np-z]+`)
+
+// sentenceEndPattern matches the end of the first sentence
+var sentenceEndPattern = regexp.MustCompile(`[.!?…]+(\s|$)`)
+
+// parseSubjectStrategies parses strategies per template, e.g.
+// "default=summary,nostr_direct_message=generic"
+func parseSubjectStrategies(value string) (map[string]string, error) {
+	strategies := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		templateName, strategy, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid entry %q, expected template=strategy", entry)
+		}
+		strategy = strings.ToLower(strings.TrimSpace(strategy))
+		if strategy != subjectGeneric && strategy != subjectSummary {
+			return nil, fmt.Errorf("invalid strategy %q for %s, expected generic or summary", strategy, templateName)
+		}
+		strategies[strings.TrimSpace(templateName)] = strategy
+	}
+	return strategies, nil
+}
+
+// subjectStrategyFor returns the subject strategy of a template
+func subjectStrategyFor(strategies map[string]string, templateName string) string {
+	if strategy, exists := strategies[templateName]; exists {
+		return strategy
+	}
+	if strategy, exists := strategies["default"]; exists {
+		return strategy
+	}
+	return subjectSummary
+}
+
+// summarizeSubject returns the first sentence of content without URLs and
+// bech32 references, truncated at a word boundary, or "" when nothing is left
+func summarizeSubject(content string) string {
+	content = subjectNoisePattern.ReplaceAllString(content, " ")
+
+	// The first line that says something
+	var line string
+	for _, candidate := range strings.Split(content, "\n") {
+		if line = strings.Join(strings.Fields(candidate), " "); line != "" {
+			break
+		}
+	}
+
+	if loc := sentenceEndPattern.FindStringIndex(line); loc != nil {
+		line = strings.TrimSpace(line[:loc[1]])
+	}
+	line = strings.TrimSpace(strings.TrimRight(line, ".,;:"))
+	if !strings.ContainsFunc(line, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) {
+		return ""
+	}
+	return truncateText(line, subjectSummaryLength)
+}
+
+// subjectIcon returns the leading emoji of a subject, or ""
+func subjectIcon(subject string) string {
+	fields := strings.Fields(subject)
+	if len(fields) == 0 || strings.ContainsFunc(fields[0], unicode.IsLetter) {
+		return ""
+	}
+	return fields[0]
+}
+
+// summarySubject creates a subject from the sender and a summary of the event
+// content, or returns the generic subject when the content cannot summarize it
+func summarySubject(templateName string, data EmailTemplateData) string {
+	if !summarySubjectTemplates[templateName] {
+		return data.Subject
+	}
+	// Undecrypted DMs only hold ciphertext
+	if templateName == "nostr_direct_message" && !data.Decrypted {
+		return data.Subject
+	}
+	summary := summarizeSubject(data.EventContent)
+	if summary == "" {
+		return data.Subject
+	}
+
+	sender := data.SenderNIP5
+	if authorName, ok := data.Content["authorName"].(string); ok && sender == "" {
+		sender = authorName
+	}
+	if sender == "" && data.SenderNpub != "" {
+		sender = shortNpub(data.SenderNpub)
+	}
+
+	subject := summary
+	if sender != "" {
+		subject = sender + ": " + summary
+	}
+	if icon := subjectIcon(data.Subject); icon != "" {
+		subject = icon + " " + subject
+	}
+	return subject
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Suppression is an address no email is sent to
+type Suppression struct {
+	Email        string
+	Reason       string
+	SuppressedAt time.Time
+}
+
+// SuppressionList holds the addresses no email is queued for: hard bounces,
+// unsubscribes and banned accounts. The note stores implement it, so replicas
+// sharing PostgreSQL share the list.
+type SuppressionList interface {
+	// Suppression returns the suppression of an address, nil when it is not suppressed
+	Suppression(email string) (*Suppression, error)
+	// Suppress adds an address, or updates the reason of a suppressed one
+	Suppress(email, reason string) error
+	// Unsuppress removes an address and reports whether it was suppressed
+	Unsuppress(email string) (bool, error)
+	// Suppressions lists the suppressed addresses, oldest first
+	Suppressions() ([]Suppression, error)
+}
+
+// normalizeEmail makes addresses match regardless of case and whitespace
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// querySuppressions reads the suppressions selected by a query for email,
+// reason and suppressed_at
+func querySuppressions(db *sql.DB, query string, args ...interface{}) ([]Suppression, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load suppressions: %v", err)
+	}
+	defer rows.Close()
+
+	var suppressions []Suppression
+	for rows.Next() {
+		var suppression Suppression
+		if err := rows.Scan(&suppression.Email, &suppression.Reason, &suppression.SuppressedAt); err != nil {
+			return nil, fmt.Errorf("failed to read suppression: %v", err)
+		}
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, rows.Err()
+}
+
+// suppressed reports whether an address is on the suppression list; lookups
+// that fail do not hold emails back
+func (es *EmailService) suppressed(email string) bool {
+	if es.Suppressions == nil {
+		return false
+	}
+	suppression, err := es.Suppressions.Suppression(email)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return false
+	}
+	if suppression == nil {
+		return false
+	}
+	fmt.Printf("⛔ Not emailing %s, suppressed (%s)\n", email, suppression.Reason)
+	return true
+}
+
+// runSuppress implements `nostremail suppress add|remove|list [--db path] [--postgres url]`
+func runSuppress(args []string) error {
+	fs := flag.NewFlagSet("suppress", flag.ExitOnError)
+	dbPath := fs.String("db", processedNotesDBPath, "Path of the processed notes database")
+	postgresURL := fs.String("postgres", "", "Use the suppression list of the PostgreSQL note store at this URL instead")
+	reason := fs.String("reason", "manual", "Why the address is suppressed, e.g. bounce, unsubscribe or banned")
+	usage := fmt.Errorf("usage: nostremail suppress [--db path] [--postgres url] add [--reason reason] <email> | remove <email> | list")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usage
+	}
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	if command == "add" {
+		// --reason may follow the command
+		fs.Parse(rest)
+		rest = fs.Args()
+	}
+
+	notes, closeNotes, err := openNoteStore(*dbPath, *postgresURL)
+	if err != nil {
+		return err
+	}
+	defer closeNotes()
+
+	switch {
+	case command == "add" && len(rest) == 1:
+		if err := notes.Suppress(rest[0], *reason); err != nil {
+			return err
+		}
+		fmt.Printf("⛔ Suppressed %s (%s)\n", normalizeEmail(rest[0]), *reason)
+	case command == "remove" && len(rest) == 1:
+		removed, err := notes.Unsuppress(rest[0])
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("%s is not suppressed", rest[0])
+		}
+		fmt.Printf("✅ Removed %s from the suppression list\n", normalizeEmail(rest[0]))
+	case command == "list" && len(rest) == 0:
+		suppressions, err := notes.Suppressions()
+		if err != nil {
+			return err
+		}
+		for _, suppression := range suppressions {
+			fmt.Printf("%s | %s | %s\n", suppression.Email, suppression.Reason, suppression.SuppressedAt.UTC().Format("2006-01-02 15:04:05"))
+		}
+		fmt.Fprintf(os.Stderr, "%d suppressed addresses\n", len(suppressions))
+	default:
+		return usage
+	}
+	return nil
+}
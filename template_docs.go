@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// TemplateVariable describes a field of EmailTemplateData available to templates
+type TemplateVariable struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// TemplateHelper describes a function registered in templateFuncs
+type TemplateHelper struct {
+	Name        string
+	Signature   string
+	Description string
+}
+
+// collectTemplateVariables walks EmailTemplateData and returns every variable,
+// using dotted paths for nested structs (e.g. ".From.Name")
+func collectTemplateVariables() []TemplateVariable {
+	return collectStructVariables(reflect.TypeOf(EmailTemplateData{}), "")
+}
+
+// collectStructVariables returns the exported fields of a struct type
+func collectStructVariables(t reflect.Type, prefix string) []TemplateVariable {
+	var variables []TemplateVariable
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := prefix + "." + field.Name
+		variables = append(variables, TemplateVariable{
+			Name:        name,
+			Type:        field.Type.String(),
+			Description: field.Tag.Get("doc"),
+		})
+
+		// Descend into nested structs so their fields are documented too
+		if field.Type.Kind() == reflect.Struct {
+			variables = append(variables, collectStructVariables(field.Type, name)...)
+		}
+	}
+	return variables
+}
+
+// collectTemplateHelpers returns the registered template functions sorted by name
+func collectTemplateHelpers() []TemplateHelper {
+	var helpers []TemplateHelper
+	for name, fn := range templateFuncs {
+		helpers = append(helpers, TemplateHelper{
+			Name:        name,
+			Signature:   reflect.TypeOf(fn).String(),
+			Description: templateFuncDocs[name],
+		})
+	}
+	// Methods of EmailTemplateData, called on the data like {{.T "Hello"}}
+	dataType := reflect.TypeOf(EmailTemplateData{})
+	for i := 0; i < dataType.NumMethod(); i++ {
+		method := dataType.Method(i)
+		helpers = append(helpers, TemplateHelper{
+			Name:        "." + method.Name,
+			Signature:   strings.Replace(method.Type.String(), "main.EmailTemplateData, ", "", 1),
+			Description: templateFuncDocs["."+method.Name],
+		})
+	}
+	sort.Slice(helpers, func(i, j int) bool {
+		return helpers[i].Name < helpers[j].Name
+	})
+	return helpers
+}
+
+// writeTemplateDocsText writes a plain text template reference
+func writeTemplateDocsText(w io.Writer) {
+	fmt.Fprintln(w, "=== TEMPLATE VARIABLES ===")
+	for _, v := range collectTemplateVariables() {
+		fmt.Fprintf(w, "{{%s}} (%s)\n    %s\n", v.Name, v.Type, v.Description)
+	}
+
+	fmt.Fprintln(w, "\n=== TEMPLATE HELPERS ===")
+	for _, h := range collectTemplateHelpers() {
+		fmt.Fprintf(w, "%s %s\n    %s\n", h.Name, h.Signature, h.Description)
+	}
+}
+
+// templateDocsPage is the HTML layout of the template reference
+var templateDocsPage = template.Must(template.New("docs").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>Email Template Reference</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 40px; background-color: #f5f5f5; }
+        .container { max-width: 1000px; margin: 0 auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1, h2 { color: #12b591; }
+        table { width: 100%; border-collapse: collapse; margin-bottom: 30px; }
+        th, td { text-align: left; padding: 8px; border-bottom: 1px solid #ddd; vertical-align: top; }
+        code { background: #f0f0f0; padding: 2px 4px; border-radius: 3px; }
+        .description { color: #666; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>Email Template Reference</h1>
+        <p class="description">Generated from EmailTemplateData and the registered template helpers.</p>
+
+        <h2>Variables</h2>
+        <table>
+            <tr><th>Variable</th><th>Type</th><th>Description</th></tr>
+            {{range .Variables}}
+            <tr><td><code>{{"{{"}}{{.Name}}{{"}}"}}</code></td><td><code>{{.Type}}</code></td><td>{{.Description}}</td></tr>
+            {{end}}
+        </table>
+
+        <h2>Helpers</h2>
+        <table>
+            <tr><th>Helper</th><th>Signature</th><th>Description</th></tr>
+            {{range .Helpers}}
+            <tr><td><code>{{.Name}}</code></td><td><code>{{.Signature}}</code></td><td>{{.Description}}</td></tr>
+            {{end}}
+        </table>
+    </div>
+</body>
+</html>`))
+
+// renderTemplateDocsHTML renders the template reference as an HTML page
+func renderTemplateDocsHTML() (string, error) {
+	data := struct {
+		Variables []TemplateVariable
+		Helpers   []TemplateHelper
+	}{
+		Variables: collectTemplateVariables(),
+		Helpers:   collectTemplateHelpers(),
+	}
+
+	var buf bytes.Buffer
+	if err := templateDocsPage.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute template docs: %v", err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Notification types, the keys of notificationTemplates
+const (
+	notificationDirectMessage = "direct_message"
+	notificationMention       = "mention"
+	notificationReply         = "reply"
+	notificationRepost        = "repost"
+	notificationReaction      = "reaction"
+	notificationZap           = "zap"
+	notificationDigest        = "digest"
+)
+
+// NotificationTemplate is the email of one notification type, an HTML/text
+// template pair. Its title and subject are the headings <type>.title and
+// <type>.subject of templates/headings.txt, rendered with the same data.
+type NotificationTemplate struct {
+	// Template names the pair templates/html/<Template>.html and
+	// templates/text/<Template>.txt
+	Template string
+}
+
+// notificationTemplates is the registry of notification emails by type.
+// Digest items are labeled by type too, see digestKindLabels.
+var notificationTemplates = map[string]NotificationTemplate{
+	notificationDirectMessage: {Template: "nostr_direct_message"},
+	notificationMention:       {Template: "nostr_mention"},
+	notificationReply:         {Template: "nostr_reply"},
+	notificationRepost:        {Template: "nostr_repost"},
+	notificationReaction:      {Template: "nostr_reaction"},
+	notificationZap:           {Template: "nostr_zap"},
+	notificationDigest:        {Template: "nostr_digest"},
+}
+
+// Emails outside the registry, named like notification types for their
+// headings
+const (
+	emailNewFollowers  = "new_followers"
+	emailRateLimited   = "rate_limited"
+	emailNpubChallenge = "npub_challenge"
+	emailAbuseReport   = "abuse_report"
+	emailWatchedNote   = "watched_note"
+)
+
+// otherEmailTemplates are the templates of the emails outside the registry
+var otherEmailTemplates = map[string]string{
+	emailNewFollowers:  "nostr_new_followers",
+	emailRateLimited:   "nostr_rate_limited",
+	emailNpubChallenge: "nostr_npub_challenge",
+	emailAbuseReport:   "nostr_abuse_report",
+	emailWatchedNote:   "nostr_watched_note",
+}
+
+// headingsFile defines the title and subject of every email as text/templates
+// of EmailTemplateData, named <type>.title and <type>.subject
+const headingsFile = "headings.txt"
+
+// headingTemplate returns the template of the email a heading belongs to, by
+// notification type or name of another email
+func headingTemplate(email string) (string, bool) {
+	if registered, exists := notificationTemplates[email]; exists {
+		return registered.Template, true
+	}
+	templateName, exists := otherEmailTemplates[email]
+	return templateName, exists
+}
+
+// headedEmails returns the notification types and names of other emails,
+// every one has a title and a subject
+func headedEmails() []string {
+	var emails []string
+	for notification := range notificationTemplates {
+		emails = append(emails, notification)
+	}
+	for email := range otherEmailTemplates {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails
+}
+
+// parseHeadings parses the headings of fsys and checks that every email has
+// a title and a subject
+func parseHeadings(fsys fs.FS) (*texttemplate.Template, error) {
+	headings, err := texttemplate.New("headings").Funcs(texttemplate.FuncMap(templateFuncs)).ParseFS(fsys, headingsFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, email := range headedEmails() {
+		for _, name := range []string{email + ".title", email + ".subject"} {
+			if headings.Lookup(name) == nil {
+				return nil, fmt.Errorf("%s does not define %s", headingsFile, name)
+			}
+		}
+	}
+	return headings, nil
+}
+
+// executeHeading renders the title or subject of an email, as translated by
+// the catalog of the data when it has one. Whitespace is collapsed, so
+// headings may span lines.
+func (set *templateSet) executeHeading(name string, data EmailTemplateData) (string, error) {
+	headings := set.headings
+	if data.catalog != nil && data.catalog.headings.Lookup(name) != nil {
+		headings = data.catalog.headings
+	}
+	var buf bytes.Buffer
+	if err := headings.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", fmt.Errorf("failed to execute %s: %v", name, err)
+	}
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// renderNotification renders the email of a notification type, with its
+// title and subject in the language of the email
+func (es *EmailService) renderNotification(notification string, data EmailTemplateData) (*EmailTemplate, error) {
+	if _, exists := notificationTemplates[notification]; !exists {
+		return nil, fmt.Errorf("unknown notification type %s", notification)
+	}
+	return es.renderHeadedEmail(notification, data)
+}
+
+// renderHeadedEmail renders an email by notification type or name of another
+// email, with the title and subject of headings.txt in the language of the
+// email
+func (es *EmailService) renderHeadedEmail(email string, data EmailTemplateData) (*EmailTemplate, error) {
+	templateName, exists := headingTemplate(email)
+	if !exists {
+		return nil, fmt.Errorf("unknown email %s", email)
+	}
+
+	templates := es.currentTemplates()
+	data.Language = es.emailLanguage(templateName, data.Locale, detectLanguage(data.EventContent))
+	data.catalog = templates.translations[data.Language]
+	var err error
+	if data.Title, err = templates.executeHeading(email+".title", data); err != nil {
+		return nil, err
+	}
+	if data.Subject, err = templates.executeHeading(email+".subject", data); err != nil {
+		return nil, err
+	}
+	return es.renderEmail(templateName, data)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// templateReloadInterval is how often the override directory is checked for
+// changed templates, see watchTemplateDir
+const templateReloadInterval = 2 * time.Second
+
+// embeddedTemplates are the default templates, built into the binary so it
+// runs from any working directory
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// templateFiles is where templates are loaded from, paths are relative to
+// templates/ (e.g. html/base.html); see useTemplateDir
+var templateFiles = templateFS("")
+
+// templateFS returns the embedded templates overlaid by the files in dir:
+// a file there replaces the embedded one of the same path, new files are
+// added. An empty dir returns the embedded templates.
+func templateFS(dir string) fs.FS {
+	embedded, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		panic(err) // the directory is embedded
+	}
+	if dir == "" {
+		return embedded
+	}
+	return overlayFS{upper: os.DirFS(dir), lower: embedded}
+}
+
+// checkTemplateDir checks that an override directory of templates exists
+func checkTemplateDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// useTemplateDir loads templates from the embedded ones overlaid by dir,
+// for email services created afterwards
+func useTemplateDir(dir string) {
+	templateFiles = templateFS(dir)
+	if dir != "" {
+		fmt.Printf("🎨 Templates in %s override the built-in ones\n", dir)
+	}
+}
+
+// overlayFS reads files from upper, falling back to lower when upper does
+// not have them; directories list the files of both
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+// Open opens the file of upper, or of lower when upper does not have it
+func (o overlayFS) Open(name string) (fs.File, error) {
+	file, err := o.upper.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.lower.Open(name)
+	}
+	return file, err
+}
+
+// ReadDir lists a directory of both file systems, sorted by name; entries of
+// upper hide those of lower with the same name
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, upperErr := fs.ReadDir(o.upper, name)
+	lower, lowerErr := fs.ReadDir(o.lower, name)
+	if upperErr != nil && !errors.Is(upperErr, fs.ErrNotExist) {
+		return nil, upperErr
+	}
+	if upperErr != nil && lowerErr != nil {
+		return nil, lowerErr
+	}
+
+	entries := make(map[string]fs.DirEntry)
+	for _, entry := range lower {
+		entries[entry.Name()] = entry
+	}
+	for _, entry := range upper {
+		entries[entry.Name()] = entry
+	}
+	merged := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		merged = append(merged, entry)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+	return merged, nil
+}
+
+// templateSet holds the parsed templates of an email service
+type templateSet struct {
+	html         map[string]*template.Template
+	text         *texttemplate.Template
+	headings     *texttemplate.Template         // titles and subjects, see headingsFile
+	translations map[string]*TranslationCatalog // by language, see i18n.go
+}
+
+// parseTemplateSet parses the HTML and text templates, headings and
+// translation catalogs of fsys
+func parseTemplateSet(fsys fs.FS) (*templateSet, error) {
+	html, err := parseHTMLTemplates(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("HTML templates: %v", err)
+	}
+	text, err := parseTextTemplates(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("text templates: %v", err)
+	}
+	headings, err := parseHeadings(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("headings: %v", err)
+	}
+	translations, err := loadTranslations(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("translations: %v", err)
+	}
+	return &templateSet{html: html, text: text, headings: headings, translations: translations}, nil
+}
+
+// validate renders the sample emails of the preview server in every
+// language, catching templates that parse but fail to execute, e.g. by
+// referring to fields that do not exist
+func (set *templateSet) validate() error {
+	catalogs := map[string]*TranslationCatalog{"": nil}
+	for language, catalog := range set.translations {
+		catalogs[language] = catalog
+	}
+	for _, preview := range emailPreviews {
+		for language, catalog := range catalogs {
+			data := preview.Data
+			data.Language = language
+			data.catalog = catalog
+			if _, err := executeHTMLTemplate(set.html, preview.TemplateName, data); err != nil {
+				return err
+			}
+			if err := set.text.ExecuteTemplate(io.Discard, preview.TemplateName+".txt", data); err != nil {
+				return fmt.Errorf("failed to execute text template %s: %v", preview.TemplateName, err)
+			}
+			if err := set.validateHeadings(preview.TemplateName, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateHeadings renders the title and subject of the emails of a template
+// with sample data
+func (set *templateSet) validateHeadings(templateName string, data EmailTemplateData) error {
+	for _, email := range headedEmails() {
+		if emailTemplate, _ := headingTemplate(email); emailTemplate != templateName {
+			continue
+		}
+		for _, name := range []string{email + ".title", email + ".subject"} {
+			if _, err := set.executeHeading(name, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// currentTemplates returns the templates emails are rendered with
+func (es *EmailService) currentTemplates() *templateSet {
+	es.templatesMu.RLock()
+	defer es.templatesMu.RUnlock()
+	return es.templates
+}
+
+// reloadTemplates parses and validates the templates of templateFiles and
+// switches to them; on errors the current templates stay in use
+func (es *EmailService) reloadTemplates() error {
+	templates, err := parseTemplateSet(templateFiles)
+	if err != nil {
+		return err
+	}
+	if err := templates.validate(); err != nil {
+		return err
+	}
+
+	es.templatesMu.Lock()
+	es.templates = templates
+	es.templatesMu.Unlock()
+	return nil
+}
+
+// templateDirState describes the files in dir by path, size and
+// modification time, so edits change it
+func templateDirState(dir string) (string, error) {
+	var state strings.Builder
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&state, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return state.String(), err
+}
+
+// watchTemplateDir reloads the templates whenever files in the override
+// directory change, so template edits need no restart. Templates that fail
+// to parse or render the sample emails are rejected, emails keep using the
+// previous ones until the errors are fixed.
+func (es *EmailService) watchTemplateDir(dir string) {
+	state, err := templateDirState(dir)
+	if err != nil {
+		fmt.Printf("⚠️  Failed to read templates in %s: %v\n", dir, err)
+	}
+	for range time.Tick(templateReloadInterval) {
+		current, err := templateDirState(dir)
+		if err != nil {
+			current = "" // reload once the directory is readable again
+		}
+		if current == state {
+			continue
+		}
+		state = current
+		if err != nil {
+			fmt.Printf("⚠️  Failed to read templates in %s: %v\n", dir, err)
+			continue
+		}
+
+		if err := es.reloadTemplates(); err != nil {
+			fmt.Printf("❌ Keeping the previous templates, the templates in %s have errors: %v\n", dir, err)
+			continue
+		}
+		fmt.Printf("🎨 Reloaded templates from %s\n", dir)
+	}
+}
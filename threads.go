@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// threadID returns the ID of the nostr conversation an event belongs to: the
+// root of its thread, or the event itself when it starts a thread. Emails about
+// events with the same thread ID are about the same conversation.
+func threadID(event *nostr.Event) string {
+	// NIP-22 comments name their root scope in uppercase tags
+	if event.Kind == nostr.KindComment {
+		for _, name := range []string{"E", "A", "I"} {
+			if tag := event.Tags.Find(name); tag != nil {
+				return tag[1]
+			}
+		}
+	}
+
+	// Reposts belong to the thread of the reposted note, when it is embedded
+	if event.Kind == nostr.KindRepost || event.Kind == nostr.KindGenericRepost {
+		var note nostr.Event
+		eTag := event.Tags.Find("e")
+		if err := json.Unmarshal([]byte(event.Content), &note); err == nil && eTag != nil && note.ID == eTag[1] && note.CheckID() {
+			return threadID(&note)
+		}
+	}
+
+	// NIP-10 marked e tags: ["e", <id>, <relay>, "root"|"reply"|"mention"]
+	var reply, firstUnmarked string
+	marked := false
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+		if len(tag) >= 4 && tag[3] != "" {
+			marked = true
+			switch tag[3] {
+			case "root":
+				return tag[1]
+			case "reply":
+				if reply == "" {
+					reply = tag[1]
+				}
+			}
+			continue
+		}
+		if firstUnmarked == "" {
+			firstUnmarked = tag[1]
+		}
+	}
+	if reply != "" {
+		return reply
+	}
+
+	// Deprecated positional e tags, the first one is the root
+	if !marked && firstUnmarked != "" {
+		return firstUnmarked
+	}
+	return event.ID
+}
+
+// recordThreadID stores the thread an event belongs to for a recipient it was processed for
+func recordThreadID(db *sql.DB, eventID, userEmail, thread string) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < schemaThreadIDs {
+		return nil
+	}
+	_, err = db.Exec("UPDATE processed_notes SET thread_id = ? WHERE event_id = ? AND user_email = ?", thread, eventID, userEmail)
+	if err != nil {
+		return fmt.Errorf("failed to record thread: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Timestamp check actions
+const (
+	timestampActionReject = "reject"
+	timestampActionFlag   = "flag"
+)
+
+// TimestampLimits bounds the created_at of events we notify about. Spoofed
+// future timestamps would otherwise pass every since filter and sort first in
+// digests.
+type TimestampLimits struct {
+	MaxFuture time.Duration // how far ahead of our clock an event may be, 0 disables
+	MaxAge    time.Duration // how old an event may be, 0 disables
+	Action    string        // "reject" (default) drops events, "flag" only logs them
+}
+
+// parseTimestampLimits reads the timestamp tolerances, an empty duration keeps
+// the default and "0" disables a check
+func parseTimestampLimits(maxFuture, maxAge, action string) (TimestampLimits, error) {
+	limits := TimestampLimits{
+		MaxFuture: 15 * time.Minute,
+		MaxAge:    7 * 24 * time.Hour,
+		Action:    timestampActionReject,
+	}
+
+	if maxFuture != "" {
+		duration, err := time.ParseDuration(maxFuture)
+		if err != nil {
+			return limits, fmt.Errorf("invalid max future skew: %v", err)
+		}
+		limits.MaxFuture = duration
+	}
+	if maxAge != "" {
+		duration, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return limits, fmt.Errorf("invalid max event age: %v", err)
+		}
+		limits.MaxAge = duration
+	}
+
+	switch action {
+	case "", timestampActionReject:
+	case timestampActionFlag:
+		limits.Action = timestampActionFlag
+	default:
+		return limits, fmt.Errorf("invalid action %q, expected reject or flag", action)
+	}
+	return limits, nil
+}
+
+// Check returns why an event's timestamp is implausible at now, or ""
+func (l TimestampLimits) Check(event *nostr.Event, now time.Time) string {
+	createdAt := event.CreatedAt.Time()
+
+	if l.MaxFuture > 0 && createdAt.After(now.Add(l.MaxFuture)) {
+		return fmt.Sprintf("%s in the future", createdAt.Sub(now).Round(time.Second))
+	}
+
+	// Replaceable lists are legitimately old, they are valid until replaced
+	if l.MaxAge <= 0 || nostr.IsReplaceableKind(event.Kind) {
+		return ""
+	}
+	maxAge := l.MaxAge
+	if event.Kind == nostr.KindGiftWrap {
+		maxAge += giftWrapMaxSkew * time.Second
+	}
+	if createdAt.Before(now.Add(-maxAge)) {
+		return fmt.Sprintf("%s old", now.Sub(createdAt).Round(time.Second))
+	}
+	return ""
+}
+
+// filterTimestamp checks an event's timestamp and reports whether it must be
+// dropped; flagged events are only logged
+func filterTimestamp(event *nostr.Event, limits TimestampLimits) bool {
+	reason := limits.Check(event, time.Now())
+	if reason == "" {
+		return false
+	}
+	if limits.Action == timestampActionFlag {
+		fmt.Printf("🕰️  Event %s has an implausible timestamp (%s)\n", event.ID, reason)
+		return false
+	}
+	fmt.Printf("🕰️  Rejected event %s with an implausible timestamp (%s)\n", event.ID, reason)
+	return true
+}
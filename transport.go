@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Email providers of NOSTREMAIL_EMAIL_PROVIDER
+const (
+	emailProviderSMTP     = "smtp"
+	emailProviderSES      = "ses"
+	emailProviderSendGrid = "sendgrid"
+	emailProviderMailgun  = "mailgun"
+	emailProviderPostmark = "postmark"
+	emailProviderDev      = "dev"
+)
+
+// emailProviders lists the email providers, e.g. for their rate limits
+var emailProviders = []string{emailProviderSMTP, emailProviderSES, emailProviderSendGrid, emailProviderMailgun, emailProviderPostmark, emailProviderDev}
+
+// failoverCooldown is how long FailoverTransport sends with the fallback
+// after the primary failed, before trying the primary again
+const failoverCooldown = 5 * time.Minute
+
+// MailTransport delivers emails to an email provider
+type MailTransport interface {
+	// Send delivers an email and returns the ID the provider gave it, ""
+	// when it gives none
+	Send(email *OutgoingEmail) (string, error)
+}
+
+// OutgoingEmail is an email ready to be sent. Transports of providers taking
+// MIME messages send its Message, API providers its fields.
+type OutgoingEmail struct {
+	From        string
+	FromName    string
+	To          string
+	Subject     string
+	HTML        string // "" for plain text emails
+	Text        string
+	ReplyTo     string            // "" replies go to From
+	Headers     map[string]string // e.g. List-Unsubscribe
+	Attachments []EmailAttachment
+	Type        string // template name, "" for emails without one
+}
+
+// HeaderNames lists the extra headers in a stable order
+func (e *OutgoingEmail) HeaderNames() []string {
+	names := make([]string, 0, len(e.Headers))
+	for name := range e.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Message creates the MIME message of the email
+func (e *OutgoingEmail) Message() *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", m.FormatAddress(e.From, e.FromName))
+	m.SetHeader("To", e.To)
+	m.SetHeader("Subject", e.Subject)
+	if e.ReplyTo != "" {
+		m.SetHeader("Reply-To", e.ReplyTo)
+	}
+	for _, name := range e.HeaderNames() {
+		m.SetHeader(name, e.Headers[name])
+	}
+	m.SetBody("text/plain", e.Text)
+	if e.HTML != "" {
+		m.AddAlternative("text/html", e.HTML)
+	}
+	for _, attachment := range e.Attachments {
+		data := attachment.Data
+		settings := []gomail.FileSetting{
+			gomail.SetHeader(map[string][]string{"Content-Type": {attachment.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		}
+		// Embedded files get the Content-ID <filename>
+		if attachment.Inline {
+			m.Embed(attachment.Filename, settings...)
+		} else {
+			m.Attach(attachment.Filename, settings...)
+		}
+	}
+	return m
+}
+
+// parseEmailProvider parses NOSTREMAIL_EMAIL_PROVIDER, empty means SMTP
+func parseEmailProvider(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "":
+		return emailProviderSMTP, nil
+	case emailProviderSMTP, emailProviderSES, emailProviderSendGrid, emailProviderMailgun, emailProviderPostmark, emailProviderDev:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown email provider %q, expected smtp, ses, sendgrid, mailgun, postmark or dev", value)
+}
+
+// smtpIdleTimeout is how long an SMTP connection is kept open without
+// sending, below the few minutes after which servers drop idle clients
+const smtpIdleTimeout = 30 * time.Second
+
+// loadProviderRateLimits reads the NOSTREMAIL_<PROVIDER>_RATE_LIMIT of every
+// email provider, e.g. NOSTREMAIL_SES_RATE_LIMIT=second=14
+func loadProviderRateLimits() (map[string]SendRateLimit, error) {
+	limits := map[string]SendRateLimit{}
+	for _, provider := range emailProviders {
+		key := "NOSTREMAIL_" + strings.ToUpper(provider) + "_RATE_LIMIT"
+		limit, err := parseSendRateLimit(os.Getenv(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if limit.Enabled() {
+			limits[provider] = limit
+		}
+	}
+	return limits, nil
+}
+
+// ThrottledTransport spaces out the emails of a transport to the rate limit
+// of its provider. Send waits for the next free slot, so queue workers stop
+// claiming emails while the provider is saturated and bursts stay queued.
+type ThrottledTransport struct {
+	Transport MailTransport
+	Limit     *SendLimiter
+	Name      string
+}
+
+func (t *ThrottledTransport) Send(email *OutgoingEmail) (string, error) {
+	if wait := t.Limit.Reserve(time.Now()); wait > 0 {
+		fmt.Printf("🚦 Sending to %s with %s in %s, provider rate limit reached\n", email.To, t.Name, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+	}
+	return t.Transport.Send(email)
+}
+
+// SMTPTransport delivers emails over SMTP. Connections are reused for later
+// emails, one per concurrent sender, and closed after smtpIdleTimeout.
+type SMTPTransport struct {
+	Host     string
+	Port     int
+	Username string // no authentication when empty
+	Password string
+	// Insecure accepts any TLS certificate, for test servers
+	Insecure bool
+
+	mu        sync.Mutex
+	idle      []*smtpConn // connections not sending, oldest first
+	idleTimer *time.Timer
+}
+
+// smtpConn is an open SMTP connection
+type smtpConn struct {
+	sender   gomail.SendCloser
+	lastUsed time.Time
+}
+
+func (t *SMTPTransport) Send(email *OutgoingEmail) (string, error) {
+	message := email.Message()
+	if conn := t.take(); conn != nil {
+		if err := gomail.Send(conn.sender, message); err == nil {
+			t.release(conn)
+			return "", nil
+		}
+		// The server may have dropped the connection, send on a new one
+		conn.sender.Close()
+	}
+
+	dialer := gomail.NewDialer(t.Host, t.Port, t.Username, t.Password)
+	if t.Insecure {
+		dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	sender, err := dialer.Dial()
+	if err != nil {
+		return "", err
+	}
+	if err := gomail.Send(sender, message); err != nil {
+		sender.Close()
+		return "", err
+	}
+	t.release(&smtpConn{sender: sender})
+	return "", nil
+}
+
+// take removes the most recently used idle connection from the pool, nil
+// when there is none
+func (t *SMTPTransport) take() *smtpConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) == 0 {
+		return nil
+	}
+	conn := t.idle[len(t.idle)-1]
+	t.idle = t.idle[:len(t.idle)-1]
+	return conn
+}
+
+// release returns a connection to the pool after sending
+func (t *SMTPTransport) release(conn *smtpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn.lastUsed = time.Now()
+	t.idle = append(t.idle, conn)
+	if t.idleTimer == nil {
+		t.idleTimer = time.AfterFunc(smtpIdleTimeout, t.closeIdle)
+	}
+}
+
+// closeIdle closes the connections idle for smtpIdleTimeout and checks
+// again when the next one will be
+func (t *SMTPTransport) closeIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	expired := 0
+	for expired < len(t.idle) && now.Sub(t.idle[expired].lastUsed) >= smtpIdleTimeout {
+		t.idle[expired].sender.Close()
+		expired++
+	}
+	t.idle = append(t.idle[:0], t.idle[expired:]...)
+	if len(t.idle) == 0 {
+		t.idleTimer = nil
+		return
+	}
+	t.idleTimer = time.AfterFunc(smtpIdleTimeout-now.Sub(t.idle[0].lastUsed), t.closeIdle)
+}
+
+// checkEmailProvider checks that the settings an email provider needs are set
+func checkEmailProvider(provider string, config *Config) error {
+	switch provider {
+	case emailProviderSMTP:
+		if config.SMTP.Host == "" {
+			return fmt.Errorf("NOSTREMAIL_SMTP_HOST environment variable is required")
+		}
+		if config.SMTP.Username == "" {
+			return fmt.Errorf("NOSTREMAIL_SMTP_USERNAME environment variable is required")
+		}
+		if config.SMTP.Password == "" {
+			return fmt.Errorf("NOSTREMAIL_SMTP_PASSWORD environment variable is required")
+		}
+	case emailProviderSES:
+		if config.SES.Region == "" {
+			return fmt.Errorf("the ses email provider needs NOSTREMAIL_SES_REGION or AWS_REGION")
+		}
+		if config.SES.AccessKeyID == "" || config.SES.SecretAccessKey == "" {
+			return fmt.Errorf("the ses email provider needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+	case emailProviderSendGrid:
+		if config.SendGrid.APIKey == "" {
+			return fmt.Errorf("the sendgrid email provider needs NOSTREMAIL_SENDGRID_API_KEY")
+		}
+	case emailProviderMailgun:
+		if config.Mailgun.Domain == "" || config.Mailgun.APIKey == "" {
+			return fmt.Errorf("the mailgun email provider needs NOSTREMAIL_MAILGUN_DOMAIN and NOSTREMAIL_MAILGUN_API_KEY")
+		}
+	case emailProviderPostmark:
+		if config.Postmark.ServerToken == "" {
+			return fmt.Errorf("the postmark email provider needs NOSTREMAIL_POSTMARK_SERVER_TOKEN")
+		}
+	case emailProviderDev:
+		return checkDevMail(config)
+	}
+	return nil
+}
+
+// newMailTransport creates the transport of an email provider, throttled to
+// its rate limit, and describes it
+func newMailTransport(provider string, config *Config) (MailTransport, string) {
+	transport, description := newProviderTransport(provider, config)
+	if limit, exists := config.RateLimits[provider]; exists {
+		transport = &ThrottledTransport{Transport: transport, Limit: NewSendLimiter(limit), Name: provider}
+		description += " (rate limited)"
+	}
+	return transport, description
+}
+
+// newProviderTransport creates the transport of an email provider and describes it
+func newProviderTransport(provider string, config *Config) (MailTransport, string) {
+	switch provider {
+	case emailProviderSES:
+		return NewSESTransport(config.SES), fmt.Sprintf("the SES API in %s", config.SES.Region)
+	case emailProviderSendGrid:
+		if config.SendGrid.Sandbox {
+			return NewSendGridTransport(config.SendGrid), "the SendGrid API in sandbox mode, nothing is delivered"
+		}
+		return NewSendGridTransport(config.SendGrid), "the SendGrid API"
+	case emailProviderMailgun:
+		return NewMailgunTransport(config.Mailgun), fmt.Sprintf("the Mailgun API for %s (%s)", config.Mailgun.Domain, config.Mailgun.Region)
+	case emailProviderPostmark:
+		return NewPostmarkTransport(config.Postmark), fmt.Sprintf("the Postmark API in the %s message stream", config.Postmark.MessageStream)
+	case emailProviderDev:
+		return &SMTPTransport{Host: config.DevMail.Host, Port: config.DevMail.Port, Insecure: true},
+			fmt.Sprintf("the test SMTP server at %s:%d, nothing is delivered", config.DevMail.Host, config.DevMail.Port)
+	}
+	return &SMTPTransport{
+		Host:     config.SMTP.Host,
+		Port:     config.SMTP.Port,
+		Username: config.SMTP.Username,
+		Password: config.SMTP.Password,
+	}, fmt.Sprintf("SMTP via %s", config.SMTP.Host)
+}
+
+// newConfiguredTransport creates the transport of EmailProvider, failing
+// over to EmailFallback when one is set; with EMLDir emails are written to
+// files instead
+func newConfiguredTransport(config *Config) MailTransport {
+	if config.EMLDir != "" {
+		fmt.Printf("📝 Writing emails as .eml files to %s instead of sending them\n", config.EMLDir)
+		return &EMLTransport{Dir: config.EMLDir}
+	}
+	primary, description := newMailTransport(config.EmailProvider, config)
+	if config.EmailFallback == "" {
+		fmt.Printf("📮 Sending emails with %s\n", description)
+		return primary
+	}
+	fallback, fallbackDescription := newMailTransport(config.EmailFallback, config)
+	fmt.Printf("📮 Sending emails with %s, falling back to %s\n", description, fallbackDescription)
+	return &FailoverTransport{
+		Primary:      primary,
+		Fallback:     fallback,
+		PrimaryName:  config.EmailProvider,
+		FallbackName: config.EmailFallback,
+	}
+}
+
+// FailoverTransport sends with Primary and, when it returns an error, with
+// Fallback. After a failure of the primary, emails go straight to the
+// fallback for failoverCooldown, so an outage does not slow every email down.
+type FailoverTransport struct {
+	Primary      MailTransport
+	Fallback     MailTransport
+	PrimaryName  string
+	FallbackName string
+
+	mu          sync.Mutex
+	primaryDown time.Time // when the primary last failed
+}
+
+func (t *FailoverTransport) Send(email *OutgoingEmail) (string, error) {
+	t.mu.Lock()
+	skipPrimary := time.Since(t.primaryDown) < failoverCooldown
+	t.mu.Unlock()
+
+	var primaryErr error
+	if !skipPrimary {
+		messageID, err := t.Primary.Send(email)
+		if err == nil {
+			return messageID, nil
+		}
+		primaryErr = err
+		t.mu.Lock()
+		t.primaryDown = time.Now()
+		t.mu.Unlock()
+		fmt.Printf("🔀 %s failed, sending with %s for the next %s: %v\n", t.PrimaryName, t.FallbackName, failoverCooldown, err)
+	}
+
+	messageID, err := t.Fallback.Send(email)
+	if err != nil {
+		if primaryErr != nil {
+			return "", fmt.Errorf("%s: %v; %s: %v", t.PrimaryName, primaryErr, t.FallbackName, err)
+		}
+		return "", fmt.Errorf("%s: %v", t.FallbackName, err)
+	}
+	return messageID, nil
+}
+
+// EMLTransport writes emails as .eml files (RFC 5322) to Dir instead of
+// sending them, to check how real traffic renders without emailing anyone
+type EMLTransport struct {
+	Dir string
+}
+
+// Send writes the MIME message of an email to a new file named after the
+// time and template, and returns the file name as message ID
+func (t *EMLTransport) Send(email *OutgoingEmail) (string, error) {
+	emailType := email.Type
+	if emailType == "" {
+		emailType = "email"
+	}
+	file, err := os.CreateTemp(t.Dir, time.Now().UTC().Format("20060102T150405Z")+"-"+emailType+"-*.eml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create .eml file: %v", err)
+	}
+	if _, err := email.Message().WriteTo(file); err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to write %s: %v", file.Name(), err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", file.Name(), err)
+	}
+	return filepath.Base(file.Name()), nil
+}
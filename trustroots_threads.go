@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// trustrootsDuplicateWindow is how close a Trustroots message between the same
+// users must be to a nostr message to count as the same message
+const trustrootsDuplicateWindow = 10 * time.Minute
+
+// ThreadLinks maps nostr conversations (see threadID) to the Trustroots
+// message threads between the same users, for "continue this conversation on
+// Trustroots" links. The note stores implement it.
+type ThreadLinks interface {
+	// LinkThread links a nostr thread to a Trustroots thread ID
+	LinkThread(thread, trustrootsThread string) error
+	// TrustrootsThread returns the Trustroots thread linked to a nostr
+	// thread, "" when there is none
+	TrustrootsThread(thread string) (string, error)
+}
+
+// TrustrootsThreads looks up the message threads of Trustroots users in the
+// threads and messages collections
+type TrustrootsThreads struct {
+	Client   *mongo.Client
+	Database string
+}
+
+// userObjectID turns a user ID into the ObjectID Trustroots references users by
+func userObjectID(id string) (primitive.ObjectID, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return objectID, fmt.Errorf("invalid Trustroots user ID %q: %v", id, err)
+	}
+	return objectID, nil
+}
+
+// Thread returns the ID of the Trustroots thread between two users, "" when
+// they never wrote each other on Trustroots
+func (t *TrustrootsThreads) Thread(userID, otherID string) (string, error) {
+	user, err := userObjectID(userID)
+	if err != nil {
+		return "", err
+	}
+	other, err := userObjectID(otherID)
+	if err != nil {
+		return "", err
+	}
+
+	var thread struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	filter := bson.M{"$or": []bson.M{
+		{"userFrom": user, "userTo": other},
+		{"userFrom": other, "userTo": user},
+	}}
+	collection := t.Client.Database(t.Database).Collection("threads")
+	err = retryMongo("load Trustroots thread", func() error {
+		return collection.FindOne(context.TODO(), filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&thread)
+	})
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load Trustroots thread: %v", err)
+	}
+	return thread.ID.Hex(), nil
+}
+
+// SentAround reports whether a user sent another a Trustroots message within
+// trustrootsDuplicateWindow of a time
+func (t *TrustrootsThreads) SentAround(senderID, recipientID string, at time.Time) (bool, error) {
+	sender, err := userObjectID(senderID)
+	if err != nil {
+		return false, err
+	}
+	recipient, err := userObjectID(recipientID)
+	if err != nil {
+		return false, err
+	}
+
+	filter := bson.M{
+		"userFrom": sender,
+		"userTo":   recipient,
+		"created": bson.M{
+			"$gte": at.Add(-trustrootsDuplicateWindow),
+			"$lte": at.Add(trustrootsDuplicateWindow),
+		},
+	}
+	var count int64
+	collection := t.Client.Database(t.Database).Collection("messages")
+	err = retryMongo("load Trustroots messages", func() error {
+		count, err = collection.CountDocuments(context.TODO(), filter, options.Count().SetLimit(1))
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to load Trustroots messages: %v", err)
+	}
+	return count > 0, nil
+}
+
+// crossReferenceThread links the nostr conversation of a message between two
+// Trustroots users to their Trustroots thread, and reports whether the sender
+// also sent the message on Trustroots, which emails about it itself. Lookups
+// that fail do not hold emails back.
+func (es *EmailService) crossReferenceThread(event *nostr.Event, sender, recipient User) bool {
+	if es.TrustrootsThreads == nil || es.ThreadLinks == nil || sender.ID == "" || recipient.ID == "" {
+		return false
+	}
+
+	thread := threadID(event)
+	linked, err := es.ThreadLinks.TrustrootsThread(thread)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return false
+	}
+	if linked == "" {
+		if linked, err = es.TrustrootsThreads.Thread(sender.ID, recipient.ID); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			return false
+		}
+		if linked == "" {
+			return false
+		}
+		if err := es.ThreadLinks.LinkThread(thread, linked); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+		fmt.Printf("🔗 Linked thread %s to Trustroots thread %s\n", thread, linked)
+	}
+
+	duplicate, err := es.TrustrootsThreads.SentAround(sender.ID, recipient.ID, event.CreatedAt.Time())
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return false
+	}
+	if duplicate {
+		fmt.Printf("🔁 Not emailing %s about %s, %s also wrote them on Trustroots\n", recipient.Username, event.ID, sender.Username)
+		es.recordDelivery(recipient.Email, event.ID, "nostr_direct_message", deliverySkipped, "also sent on Trustroots")
+	}
+	return duplicate
+}
+
+// queryTrustrootsThread reads the Trustroots thread selected by a query, ""
+// when there is none
+func queryTrustrootsThread(db *sql.DB, query string, args ...interface{}) (string, error) {
+	var trustrootsThread string
+	err := db.QueryRow(query, args...).Scan(&trustrootsThread)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load thread link: %v", err)
+	}
+	return trustrootsThread, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Headers of one-click unsubscribes (RFC 8058)
+const (
+	listUnsubscribeHeader     = "List-Unsubscribe"
+	listUnsubscribePostHeader = "List-Unsubscribe-Post"
+)
+
+// unsubscribeReason is the suppression reason of addresses that unsubscribed
+const unsubscribeReason = "unsubscribe"
+
+// Unsubscriber adds one-click unsubscribe links to emails and suppresses the
+// addresses that follow them. The links carry the address and an HMAC of it,
+// so only recipients can unsubscribe themselves and nothing is stored per email.
+// With Preferences set, the page also lets recipients switch to plain text emails.
+type Unsubscriber struct {
+	BaseURL      string // public URL of the HTTP endpoints, see server.go
+	Secret       []byte
+	Suppressions SuppressionList
+	Preferences  EmailPreferences
+}
+
+// unsubscribeSignature is the HMAC of an address
+func (u *Unsubscriber) unsubscribeSignature(email string) []byte {
+	mac := hmac.New(sha256.New, u.Secret)
+	mac.Write([]byte("nostremail-unsubscribe:" + normalizeEmail(email)))
+	return mac.Sum(nil)
+}
+
+// Token returns the unsubscribe token of an address: the address and its
+// signature
+func (u *Unsubscriber) Token(email string) string {
+	email = normalizeEmail(email)
+	return base64.RawURLEncoding.EncodeToString([]byte(email)) + "." + hex.EncodeToString(u.unsubscribeSignature(email))
+}
+
+// Verify returns the address of a token, or an error when it was not signed
+// with the secret
+func (u *Unsubscriber) Verify(token string) (string, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return "", fmt.Errorf("invalid unsubscribe link")
+	}
+	email, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid unsubscribe link")
+	}
+	given, err := hex.DecodeString(signature)
+	if err != nil || subtle.ConstantTimeCompare(given, u.unsubscribeSignature(string(email))) != 1 {
+		return "", fmt.Errorf("invalid unsubscribe link")
+	}
+	return string(email), nil
+}
+
+// URL returns the unsubscribe link of an address
+func (u *Unsubscriber) URL(email string) string {
+	return fmt.Sprintf("%s/unsubscribe?token=%s", strings.TrimRight(u.BaseURL, "/"), url.QueryEscape(u.Token(email)))
+}
+
+// Headers returns the one-click unsubscribe headers of an email to an address
+func (u *Unsubscriber) Headers(email string) map[string]string {
+	return map[string]string{
+		listUnsubscribeHeader:     "<" + u.URL(email) + ">",
+		listUnsubscribePostHeader: "List-Unsubscribe=One-Click",
+	}
+}
+
+// Email formats recipients choose on the unsubscribe page, the format form field
+const (
+	emailFormatText = "text"
+	emailFormatHTML = "html"
+)
+
+// unsubscribePage asks to confirm an unsubscribe and shows the outcome, and
+// offers to switch between plain text and HTML emails
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width">
+    <title>Unsubscribe - Trustroots</title>
+    <style>
+        body { font-family: Arial, sans-serif; max-width: 480px; margin: 50px auto; padding: 20px; color: #333; }
+        h1 { color: #12b591; font-size: 24px; }
+        .error { color: #b00020; }
+        button { background-color: #12b591; color: white; border: 0; border-radius: 4px; padding: 12px 24px; font-size: 16px; }
+        button.secondary { background-color: white; color: #12b591; border: 1px solid #12b591; }
+        hr { border: 0; border-top: 1px solid #ddd; margin: 30px 0; }
+    </style>
+</head>
+<body>
+    <h1>📭 Unsubscribe</h1>
+    {{if .Error}}
+    <p class="error">{{.Error}}</p>
+    {{else if .Unsubscribed}}
+    <p>{{.Email}} will no longer receive nostr notifications by email.</p>
+    {{else}}
+    <p>Stop emailing nostr notifications to {{.Email}}?</p>
+    <form method="post" action="/unsubscribe">
+        <input type="hidden" name="token" value="{{.Token}}">
+        <p><button type="submit">Unsubscribe</button></p>
+    </form>
+    {{if .FormatOffered}}
+    <hr>
+    {{if .FormatSaved}}<p>✅ Saved.</p>{{end}}
+    {{if .PlainText}}
+    <p>{{.Email}} gets plain text emails, without images, formatting or tracking parameters.</p>
+    <form method="post" action="/unsubscribe">
+        <input type="hidden" name="token" value="{{.Token}}">
+        <input type="hidden" name="format" value="html">
+        <p><button type="submit" class="secondary">Switch to HTML emails</button></p>
+    </form>
+    {{else}}
+    <p>Rather get plain text emails, without images, formatting or tracking parameters?</p>
+    <form method="post" action="/unsubscribe">
+        <input type="hidden" name="token" value="{{.Token}}">
+        <input type="hidden" name="format" value="text">
+        <p><button type="submit" class="secondary">Switch to plain text emails</button></p>
+    </form>
+    {{end}}
+    {{end}}
+    {{end}}
+</body>
+</html>
+`))
+
+// unsubscribePageData is what unsubscribePage shows
+type unsubscribePageData struct {
+	Token        string
+	Email        string
+	Unsubscribed bool
+	Error        string
+
+	FormatOffered bool // the page can switch between plain text and HTML
+	PlainText     bool
+	FormatSaved   bool
+}
+
+// handleUnsubscribe shows a confirmation button on GET and unsubscribes on
+// POST, which is also what mail clients send for one-click unsubscribes; a
+// POST with a format switches between plain text and HTML emails instead.
+// Only POST changes anything, so links opened by mail scanners do no harm.
+func handleUnsubscribe(u *Unsubscriber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 4096)
+		data := unsubscribePageData{Token: r.FormValue("token")}
+		email, err := u.Verify(data.Token)
+		status := http.StatusOK
+		switch {
+		case err != nil:
+			data.Error = err.Error()
+			status = http.StatusBadRequest
+		case r.Method == http.MethodPost && u.Preferences != nil && (r.FormValue("format") == emailFormatText || r.FormValue("format") == emailFormatHTML):
+			plainText := r.FormValue("format") == emailFormatText
+			if err := u.Preferences.SetPlainText(email, plainText); err != nil {
+				fmt.Printf("⚠️  %v\n", err)
+				data.Error = "Saving failed, please try again later."
+				status = http.StatusInternalServerError
+				break
+			}
+			data.FormatSaved = true
+			fmt.Printf("📝 %s chose %s emails\n", email, r.FormValue("format"))
+		case r.Method == http.MethodPost:
+			if err := u.Suppressions.Suppress(email, unsubscribeReason); err != nil {
+				fmt.Printf("⚠️  %v\n", err)
+				data.Error = "Unsubscribing failed, please try again later."
+				status = http.StatusInternalServerError
+				break
+			}
+			data.Unsubscribed = true
+			fmt.Printf("📭 %s unsubscribed\n", email)
+		}
+		data.Email = email
+		if u.Preferences != nil && err == nil {
+			plainText, err := u.Preferences.PlainText(email)
+			if err != nil {
+				fmt.Printf("⚠️  %v\n", err)
+			}
+			data.FormatOffered, data.PlainText = err == nil, plainText
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := unsubscribePage.Execute(w, data); err != nil {
+			fmt.Printf("⚠️  Error rendering unsubscribe page: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscribeTokenRoundTrip(t *testing.T) {
+	u := &Unsubscriber{Secret: []byte("secret")}
+
+	email, err := u.Verify(u.Token(" Alice@Example.org "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != "alice@example.org" {
+		t.Errorf("Verify returned %q, want the normalized address", email)
+	}
+	if u.Token("alice@example.org") != u.Token("ALICE@example.org") {
+		t.Error("tokens of the same address differ by case")
+	}
+
+	// Links carry the token as a query parameter
+	u.BaseURL = "https://notifications.example.org/"
+	link, err := url.Parse(u.URL("alice@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Path != "/unsubscribe" {
+		t.Errorf("link path = %q, want /unsubscribe", link.Path)
+	}
+	if email, err := u.Verify(link.Query().Get("token")); err != nil || email != "alice@example.org" {
+		t.Errorf("token of the link verifies as %q, %v", email, err)
+	}
+}
+
+func TestUnsubscribeTokenRejectsForgeries(t *testing.T) {
+	u := &Unsubscriber{Secret: []byte("secret")}
+	token := u.Token("alice@example.org")
+	encoded, signature, _ := strings.Cut(token, ".")
+
+	// The signature with its last hex digit changed
+	flipped := []byte(signature)
+	if flipped[len(flipped)-1] == '0' {
+		flipped[len(flipped)-1] = '1'
+	} else {
+		flipped[len(flipped)-1] = '0'
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered email", base64.RawURLEncoding.EncodeToString([]byte("bob@example.org")) + "." + signature},
+		{"tampered signature", encoded + "." + string(flipped)},
+		{"truncated signature", encoded + "." + signature[:len(signature)-2]},
+		{"wrong secret", (&Unsubscriber{Secret: []byte("other secret")}).Token("alice@example.org")},
+		{"no signature", encoded},
+		{"empty signature", encoded + "."},
+		{"invalid base64", "not base64!." + signature},
+		{"invalid hex", encoded + ".zz"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if email, err := u.Verify(tt.token); err == nil {
+				t.Errorf("Verify(%q) = %q, want an error", tt.token, email)
+			}
+		})
+	}
+}
+
+func TestHandleUnsubscribe(t *testing.T) {
+	db, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := &SQLiteNoteStore{DB: db}
+	u := &Unsubscriber{Secret: []byte("secret"), Suppressions: store}
+	handler := handleUnsubscribe(u)
+	token := u.Token("alice@example.org")
+
+	request := func(method, token string) int {
+		form := url.Values{"token": {token}}
+		var r *http.Request
+		if method == http.MethodPost {
+			r = httptest.NewRequest(method, "/unsubscribe", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, "/unsubscribe?"+form.Encode(), nil)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	suppressed := func() bool {
+		suppression, err := store.Suppression("alice@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return suppression != nil
+	}
+
+	// Mail scanners opening the link unsubscribe nobody
+	if code := request(http.MethodGet, token); code != http.StatusOK {
+		t.Errorf("GET returned %d, want 200", code)
+	}
+	if suppressed() {
+		t.Error("GET unsubscribed the address")
+	}
+
+	if code := request(http.MethodPost, u.Token("bob@example.org")+"0"); code != http.StatusBadRequest {
+		t.Errorf("POST with a forged token returned %d, want 400", code)
+	}
+	if suppressed() {
+		t.Error("a forged token unsubscribed the address")
+	}
+
+	if code := request(http.MethodPost, token); code != http.StatusOK {
+		t.Errorf("POST returned %d, want 200", code)
+	}
+	if !suppressed() {
+		t.Error("POST did not unsubscribe the address")
+	}
+}
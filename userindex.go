@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// UserIndex holds the monitored users by npub, hex pubkey, username and
+// document ID. Every valid npub of a user is a key (see userKeys). The event
+// handlers get NpubToUser and HexToUser, which updates change in place, so
+// the index is only written by the event loop and read under usersMu by
+// background jobs.
+type UserIndex struct {
+	NpubToUser map[string]User
+	HexToUser  map[string]User
+
+	byUsername map[string]User     // lowercase username, one key of the user
+	keysByID   map[string][]string // hex pubkeys of each user with an ID
+}
+
+// NewUserIndex indexes the users with a valid npub
+func NewUserIndex(validNpubs []User) *UserIndex {
+	index := &UserIndex{
+		NpubToUser: make(map[string]User),
+		HexToUser:  make(map[string]User),
+		byUsername: make(map[string]User),
+		keysByID:   make(map[string][]string),
+	}
+	index.Replace(validNpubs)
+	return index
+}
+
+// ByUsername returns a user by username, case-insensitively
+func (idx *UserIndex) ByUsername(username string) (User, bool) {
+	user, exists := idx.byUsername[strings.ToLower(username)]
+	return user, exists
+}
+
+// Replace swaps the indexed users for the given ones, touching only the
+// entries that changed, and returns the hex pubkeys added and removed
+func (idx *UserIndex) Replace(validNpubs []User) (added, removed []string) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	current := make(map[string]User)
+	for _, user := range validNpubs {
+		for hexPubkey, key := range indexKeys(user) {
+			current[hexPubkey] = key
+		}
+	}
+	for hexPubkey := range idx.HexToUser {
+		if _, exists := current[hexPubkey]; !exists {
+			idx.remove(hexPubkey)
+			removed = append(removed, hexPubkey)
+		}
+	}
+	for hexPubkey, key := range current {
+		if _, exists := idx.HexToUser[hexPubkey]; !exists {
+			added = append(added, hexPubkey)
+		}
+		idx.add(hexPubkey, key)
+	}
+	return added, removed
+}
+
+// Update indexes the current version of a user with an ID, e.g. from a
+// change stream, and returns the hex pubkeys added and removed. A user
+// without valid npubs is removed.
+func (idx *UserIndex) Update(user User) (added, removed []string) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	keys := indexKeys(user)
+	for _, hexPubkey := range idx.keysByID[user.ID] {
+		if _, kept := keys[hexPubkey]; !kept {
+			idx.remove(hexPubkey)
+			removed = append(removed, hexPubkey)
+		}
+	}
+	for hexPubkey, key := range keys {
+		if _, exists := idx.HexToUser[hexPubkey]; !exists {
+			added = append(added, hexPubkey)
+		}
+		idx.add(hexPubkey, key)
+	}
+	return added, removed
+}
+
+// Remove drops a deleted user by ID and returns their hex pubkeys
+func (idx *UserIndex) Remove(id string) (removed []string) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	for _, hexPubkey := range idx.keysByID[id] {
+		idx.remove(hexPubkey)
+		removed = append(removed, hexPubkey)
+	}
+	return removed
+}
+
+// add indexes one key of a user, usersMu must be held
+func (idx *UserIndex) add(hexPubkey string, key User) {
+	// Forget the previous version of the key, e.g. under an old username; of
+	// users linking the same npub the last one loaded gets it
+	idx.remove(hexPubkey)
+	idx.NpubToUser[key.NostrNpub] = key
+	idx.HexToUser[hexPubkey] = key
+
+	name := strings.ToLower(key.Username)
+	if indexed, exists := idx.byUsername[name]; name != "" && (!exists || indexed.NostrNpub == key.NostrNpub) {
+		idx.byUsername[name] = key
+	}
+	if key.ID != "" && !slices.Contains(idx.keysByID[key.ID], hexPubkey) {
+		idx.keysByID[key.ID] = append(idx.keysByID[key.ID], hexPubkey)
+	}
+}
+
+// remove drops one key, usersMu must be held
+func (idx *UserIndex) remove(hexPubkey string) {
+	key, exists := idx.HexToUser[hexPubkey]
+	if !exists {
+		return
+	}
+	delete(idx.NpubToUser, key.NostrNpub)
+	delete(idx.HexToUser, hexPubkey)
+
+	name := strings.ToLower(key.Username)
+	if indexed, exists := idx.byUsername[name]; exists && indexed.NostrNpub == key.NostrNpub {
+		delete(idx.byUsername, name)
+		// Fall back to another key of the user
+		for _, other := range idx.HexToUser {
+			if strings.ToLower(other.Username) == name {
+				idx.byUsername[name] = other
+				break
+			}
+		}
+	}
+
+	var remaining []string
+	for _, other := range idx.keysByID[key.ID] {
+		if other != hexPubkey {
+			remaining = append(remaining, other)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(idx.keysByID, key.ID)
+	} else {
+		idx.keysByID[key.ID] = remaining
+	}
+}
+
+// indexKeys returns the keys of a user (see userKeys) by hex pubkey
+func indexKeys(user User) map[string]User {
+	keys := make(map[string]User)
+	for _, key := range userKeys(user) {
+		hexPubkey, err := npubToHex(key.NostrNpub)
+		if err != nil {
+			fmt.Printf("⚠️  Warning: Failed to convert npub %s to hex: %v\n", key.NostrNpub, err)
+			continue
+		}
+		keys[hexPubkey] = key
+	}
+	return keys
+}
+
+// userByEmail returns the user with an email address among users by hex
+// pubkey, which are read under usersMu
+func userByEmail(users map[string]User, email string) (User, bool) {
+	email = normalizeEmail(email)
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	for _, user := range users {
+		if normalizeEmail(user.Email) == email {
+			return user, true
+		}
+	}
+	return User{}, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// User list formats of --list-users
+const (
+	userListTable = "table"
+	userListJSON  = "json"
+	userListCSV   = "csv"
+)
+
+// userListEntry is a user in the machine-readable --list-users output
+type userListEntry struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// Category is valid, invalid or empty, as in the table
+	Category string   `json:"category"`
+	Npubs    []string `json:"npubs"`
+	// Errors says why each invalid npub of the user was rejected
+	Errors []string `json:"errors"`
+	// AccountStatus is why the user gets no email (see account.go), "" when they do
+	AccountStatus string `json:"accountStatus"`
+}
+
+// parseUserListFormat checks the --format of --list-users
+func parseUserListFormat(value string) (string, error) {
+	switch value {
+	case userListTable, userListJSON, userListCSV:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid format %q, expected table, json or csv", value)
+}
+
+// userListEntries lists the categorized users with the validation errors of
+// their npubs
+func userListEntries(validNpubs, invalidNpubs, emptyNpubs []User) []userListEntry {
+	entries := []userListEntry{}
+	for _, category := range []struct {
+		name  string
+		users []User
+	}{{"valid", validNpubs}, {"invalid", invalidNpubs}, {"empty", emptyNpubs}} {
+		for _, user := range category.users {
+			entry := userListEntry{
+				Username:      user.Username,
+				Email:         user.Email,
+				Category:      category.name,
+				Npubs:         user.Npubs(),
+				Errors:        []string{},
+				AccountStatus: user.accountStatus(),
+			}
+			if entry.Npubs == nil {
+				entry.Npubs = []string{}
+			}
+			for _, npub := range entry.Npubs {
+				if _, err := npubToHex(npub); err != nil {
+					entry.Errors = append(entry.Errors, fmt.Sprintf("%s: %v", npub, err))
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// writeUserList writes the categorized users as a JSON array or as CSV with a
+// header row; npubs are separated by spaces and errors by "; " in CSV
+func writeUserList(w io.Writer, format string, validNpubs, invalidNpubs, emptyNpubs []User) error {
+	entries := userListEntries(validNpubs, invalidNpubs, emptyNpubs)
+	if format == userListJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"username", "email", "category", "npubs", "errors", "accountStatus"})
+	for _, entry := range entries {
+		writer.Write([]string{entry.Username, entry.Email, entry.Category,
+			strings.Join(entry.Npubs, " "), strings.Join(entry.Errors, "; "), entry.AccountStatus})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// userSourceTimeout bounds fetching the users from a REST endpoint
+const userSourceTimeout = 30 * time.Second
+
+// UserSource loads the users who may be notified. MongoDB holds the users of
+// Trustroots; other hospitality communities can list theirs in a file or
+// serve them from a REST endpoint.
+type UserSource interface {
+	Users() ([]User, error)
+}
+
+// parseUserSource parses NOSTREMAIL_USER_SOURCE: mongodb (the default), a
+// path to a .json or .csv file, or an http(s) URL
+func parseUserSource(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "" || value == "mongodb":
+		return "mongodb", nil
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		return value, nil
+	}
+	switch strings.ToLower(filepath.Ext(value)) {
+	case ".json", ".csv":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid user source %q, expected mongodb, a .json or .csv file or an http(s) URL", value)
+}
+
+// newUserSource opens the user source of the config; client is only used for
+// mongodb
+func newUserSource(config *Config, client *mongo.Client) UserSource {
+	switch source := config.UserSource; {
+	case source == "mongodb":
+		return &MongoUserSource{Client: client, Config: config}
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		return &HTTPUserSource{URL: source, Token: config.UserSourceToken}
+	default:
+		return &FileUserSource{Path: source}
+	}
+}
+
+// MongoUserSource loads the Trustroots users with an npub from MongoDB
+type MongoUserSource struct {
+	Client *mongo.Client
+	Config *Config
+}
+
+func (s *MongoUserSource) Users() ([]User, error) {
+	return getUsersFromDB(s.Client, s.Config)
+}
+
+// User loads one user by document ID, found is false when the user was
+// deleted; change streams report which users to load
+func (s *MongoUserSource) User(id string) (user User, found bool, err error) {
+	var key interface{} = id
+	if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+		key = objectID
+	}
+	collection := s.Client.Database(s.Config.MongoDB.Database).Collection("users")
+	err = retryMongo("load user "+id, func() error {
+		return collection.FindOne(context.TODO(), bson.M{"_id": key}).Decode(&user)
+	})
+	if err == mongo.ErrNoDocuments {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, fmt.Errorf("failed to load user %s: %v", id, err)
+	}
+	return user, true, nil
+}
+
+// userRecord is a user in a user file or REST response, with the field names
+// of the Trustroots users collection
+type userRecord struct {
+	ID             string   `json:"id"`
+	Username       string   `json:"username"`
+	Email          string   `json:"email"`
+	NostrNpub      string   `json:"nostrNpub"`
+	NostrNpubs     []string `json:"nostrNpubs"`
+	Locale         string   `json:"locale"`
+	MentionAliases []string `json:"nostrMentionAliases"`
+	QuietHours     string   `json:"nostrQuietHours"`
+	Timezone       string   `json:"nostrTimezone"`
+	Digest         string   `json:"nostrDigest"`
+	PlainText      bool     `json:"nostrPlainText"`
+	Roles          []string `json:"roles"`
+	Public         *bool    `json:"public"`
+}
+
+func (r userRecord) user() User {
+	return User{
+		ID:             r.ID,
+		Username:       r.Username,
+		Email:          r.Email,
+		NostrNpub:      r.NostrNpub,
+		NostrNpubs:     r.NostrNpubs,
+		Locale:         r.Locale,
+		MentionAliases: r.MentionAliases,
+		QuietHours:     r.QuietHours,
+		Timezone:       r.Timezone,
+		Digest:         r.Digest,
+		PlainText:      r.PlainText,
+		Roles:          r.Roles,
+		Public:         r.Public,
+	}
+}
+
+// decodeUserRecords reads a JSON array of users
+func decodeUserRecords(reader io.Reader) ([]User, error) {
+	var records []userRecord
+	if err := json.NewDecoder(reader).Decode(&records); err != nil {
+		return nil, fmt.Errorf("invalid user list: %v", err)
+	}
+	users := make([]User, 0, len(records))
+	for _, record := range records {
+		users = append(users, record.user())
+	}
+	return users, nil
+}
+
+// FileUserSource reads the users from a JSON file (an array of users) or a CSV
+// file with a header row naming the columns. The file is read on every load,
+// so edits are picked up by the periodic reload.
+type FileUserSource struct {
+	Path string
+}
+
+func (s *FileUserSource) Users() ([]User, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user file: %v", err)
+	}
+	defer file.Close()
+
+	var users []User
+	if strings.ToLower(filepath.Ext(s.Path)) == ".csv" {
+		users, err = decodeUserCSV(file)
+	} else {
+		users, err = decodeUserRecords(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	fmt.Printf("Found %d users in %s\n", len(users), s.Path)
+	return users, nil
+}
+
+// decodeUserCSV reads users from CSV with the column names of userRecord.
+// nostrNpubs, nostrMentionAliases and roles hold several values separated by
+// spaces; users listed in a CSV file count as confirmed.
+func decodeUserCSV(reader io.Reader) ([]User, error) {
+	rows, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, exists := columns["username"]; !exists {
+		return nil, fmt.Errorf("missing username column")
+	}
+	field := func(row []string, name string) string {
+		if i, exists := columns[name]; exists && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var users []User
+	for _, row := range rows[1:] {
+		plainText, _ := strconv.ParseBool(field(row, "nostrPlainText"))
+		users = append(users, userRecord{
+			ID:             field(row, "id"),
+			Username:       field(row, "username"),
+			Email:          field(row, "email"),
+			NostrNpub:      field(row, "nostrNpub"),
+			NostrNpubs:     strings.Fields(field(row, "nostrNpubs")),
+			Locale:         field(row, "locale"),
+			MentionAliases: strings.Fields(field(row, "nostrMentionAliases")),
+			QuietHours:     field(row, "nostrQuietHours"),
+			Timezone:       field(row, "nostrTimezone"),
+			Digest:         field(row, "nostrDigest"),
+			PlainText:      plainText,
+			Roles:          strings.Fields(field(row, "roles")),
+		}.user())
+	}
+	return users, nil
+}
+
+// HTTPUserSource fetches the users as a JSON array from a REST endpoint, with
+// Token as bearer token when set
+type HTTPUserSource struct {
+	URL   string
+	Token string
+}
+
+func (s *HTTPUserSource) Users() ([]User, error) {
+	request, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user source URL: %v", err)
+	}
+	request.Header.Set("Accept", "application/json")
+	if s.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	client := &http.Client{Timeout: userSourceTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch users: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch users: %s returned %s", s.URL, response.Status)
+	}
+
+	users, err := decodeUserRecords(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Found %d users at %s\n", len(users), s.URL)
+	return users, nil
+}
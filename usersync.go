@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// userChangeRetryDelay is how long we wait before reopening a failed change stream
+const userChangeRetryDelay = 10 * time.Second
+
+// defaultUserRefreshInterval is how often users are reloaded without change streams
+const defaultUserRefreshInterval = 5 * time.Minute
+
+// userListFetchTimeout bounds how long we wait for relays when loading the
+// lists of users who linked their npub while the daemon runs
+const userListFetchTimeout = 30 * time.Second
+
+// usersMu guards the user maps: the event loop updates them when users change
+// (see UserIndex), background jobs such as follower summaries read them
+var usersMu sync.RWMutex
+
+// userChangePipeline keeps the changes to users that matter for notifications:
+// new and deleted users, and changes of their npubs, email, username or
+// account status.
+// Changes of single nostrNpubs entries are reported as "nostrNpubs.<index>".
+var userChangePipeline = mongo.Pipeline{
+	{{Key: "$match", Value: bson.M{"$or": bson.A{
+		bson.M{"operationType": bson.M{"$in": bson.A{"insert", "replace", "delete"}}},
+		bson.M{"updateDescription.updatedFields.nostrNpub": bson.M{"$exists": true}},
+		bson.M{"updateDescription.updatedFields.email": bson.M{"$exists": true}},
+		bson.M{"updateDescription.updatedFields.username": bson.M{"$exists": true}},
+		bson.M{"updateDescription.updatedFields.public": bson.M{"$exists": true}},
+		bson.M{"updateDescription.updatedFields.roles": bson.M{"$exists": true}},
+		bson.M{"updateDescription.removedFields": bson.M{"$in": bson.A{"nostrNpub", "nostrNpubs", "email", "roles"}}},
+		bson.M{"updateDescription.truncatedArrays.field": "nostrNpubs"},
+		bson.M{"$expr": bson.M{"$gt": bson.A{
+			bson.M{"$size": bson.M{"$filter": bson.M{
+				"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$updateDescription.updatedFields", bson.M{}}}},
+				"cond":  bson.M{"$regexMatch": bson.M{"input": "$$this.k", "regex": "^nostrNpubs(\\.|$)"}},
+			}}},
+			0,
+		}}},
+	}}}},
+}
+
+// UserChanges collects the IDs of users who changed since the event loop last
+// took them, and signals on C when there are some. Several changes in a row
+// are one signal.
+type UserChanges struct {
+	C <-chan struct{}
+
+	signal chan struct{}
+	mu     sync.Mutex
+	ids    map[string]bool
+	full   bool // everyone is reloaded, e.g. when polling
+}
+
+func newUserChanges() *UserChanges {
+	signal := make(chan struct{}, 1)
+	return &UserChanges{C: signal, signal: signal, ids: make(map[string]bool)}
+}
+
+// add records a changed user, "" when any user may have changed
+func (c *UserChanges) add(id string) {
+	c.mu.Lock()
+	if id == "" {
+		c.full = true
+	} else {
+		c.ids[id] = true
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Take returns the changed user IDs and whether all users need reloading,
+// and starts collecting anew
+func (c *UserChanges) Take() (ids []string, full bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.ids {
+		ids = append(ids, id)
+	}
+	full = c.full
+	c.ids = make(map[string]bool)
+	c.full = false
+	return ids, full
+}
+
+// watchUserChanges watches the users collection with a change stream and
+// collects the IDs of changed users. Change streams need a replica set,
+// standalone servers fail here, as do other user sources (client is nil).
+func watchUserChanges(client *mongo.Client, database string) (*UserChanges, error) {
+	if client == nil {
+		return nil, fmt.Errorf("users are not loaded from MongoDB")
+	}
+	collection := client.Database(database).Collection("users")
+	stream, err := collection.Watch(context.Background(), userChangePipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch users: %v", err)
+	}
+
+	changes := newUserChanges()
+	go func() {
+		for {
+			for stream.Next(context.Background()) {
+				changes.add(changedUserID(stream.Current))
+			}
+			fmt.Printf("⚠️  Users change stream stopped: %v\n", stream.Err())
+			resumeToken := stream.ResumeToken()
+			stream.Close(context.Background())
+
+			// Resume where the stream stopped, users changed meanwhile are not
+			// missed; without a resume token everyone is reloaded
+			for {
+				time.Sleep(userChangeRetryDelay)
+				opts := options.ChangeStream()
+				if resumeToken != nil {
+					opts.SetResumeAfter(resumeToken)
+				}
+				stream, err = collection.Watch(context.Background(), userChangePipeline, opts)
+				if err == nil {
+					break
+				}
+				fmt.Printf("⚠️  Failed to reopen users change stream: %v\n", err)
+			}
+			if resumeToken == nil {
+				changes.add("")
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// changedUserID returns the ID of the user a change event is about, as hex
+// for ObjectIDs, or "" when it has none
+func changedUserID(change bson.Raw) string {
+	id, err := change.LookupErr("documentKey", "_id")
+	if err != nil {
+		return ""
+	}
+	if objectID, ok := id.ObjectIDOK(); ok {
+		return objectID.Hex()
+	}
+	if value, ok := id.StringValueOK(); ok {
+		return value
+	}
+	return ""
+}
+
+// pollUserChanges asks for reloading everyone every interval, for MongoDB
+// servers without change streams and other user sources; reloadUsers finds
+// out whether users actually changed
+func pollUserChanges(interval time.Duration) *UserChanges {
+	changes := newUserChanges()
+	go func() {
+		for range time.Tick(interval) {
+			changes.add("")
+		}
+	}()
+	return changes
+}
+
+// loadNewUserLists fetches the mute and follow lists of users who linked
+// their npub while the daemon runs, the subscription only sees later changes
+func loadNewUserLists(pool *nostr.SimplePool, relays []string, hexPubkeys []string, emailService *EmailService) {
+	if emailService.Mutes == nil && emailService.Trust == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), userListFetchTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{Kinds: []int{nostr.KindMuteList, nostr.KindFollowList}, Authors: hexPubkeys}
+	for evt := range pool.SubManyEose(ctx, relays, nostr.Filters{filter}) {
+		switch {
+		case evt.Event.Kind == nostr.KindMuteList && emailService.Mutes != nil:
+			emailService.Mutes.Update(evt.Event)
+		case evt.Event.Kind == nostr.KindFollowList && emailService.Trust != nil:
+			emailService.Trust.Graph.Update(evt.Event)
+		}
+	}
+}
+
+// reloadUsers updates the user index: users changed according to a change
+// stream are loaded one by one, everyone is reloaded when full is set or the
+// user source cannot load single users. It reports whether users linked or
+// removed npubs, so the subscription needs renewing.
+func reloadUsers(userSource UserSource, ids []string, full bool, index *UserIndex, config *Config, pool *nostr.SimplePool, emailService *EmailService) (bool, error) {
+	var added, removed []string
+	mongoSource, incremental := userSource.(*MongoUserSource)
+	if full || !incremental {
+		users, err := userSource.Users()
+		if err != nil {
+			return false, err
+		}
+		validNpubs, _, _ := categorizeUsers(users)
+		added, removed = index.Replace(validNpubs)
+	} else {
+		for _, id := range ids {
+			user, found, err := mongoSource.User(id)
+			if err != nil {
+				return false, err
+			}
+			if !found {
+				removed = append(removed, index.Remove(id)...)
+				continue
+			}
+			userAdded, userRemoved := index.Update(user)
+			added = append(added, userAdded...)
+			removed = append(removed, userRemoved...)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return false, nil
+	}
+
+	fmt.Printf("👥 Users changed: %d npubs added, %d removed, monitoring %d\n", len(added), len(removed), len(index.HexToUser))
+	if len(added) > 0 {
+		loadNewUserLists(pool, config.Relays, added, emailService)
+	}
+	return true, nil
+}
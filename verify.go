@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SenderVerifier decides whether the author of an event is a verified sender
+// and how they are named in emails
+type SenderVerifier interface {
+	// Verify returns the NIP-05 identifier of a sender and whether they are
+	// verified; unverified senders may still have an identifier to name them
+	Verify(hexPubkey string) (identifier string, ok bool)
+}
+
+// mongoLookupTimeout bounds a live user lookup
+const mongoLookupTimeout = 5 * time.Second
+
+// MongoVerifier verifies Trustroots users by their npub: the users loaded at
+// startup, and with a client users who linked their npub since
+type MongoVerifier struct {
+	Users    map[string]User // by npub
+	Client   *mongo.Client
+	Database string
+
+	mu     sync.Mutex
+	lookup map[string]nip05Result // live lookups by npub, "" identifier for misses
+}
+
+// NewMongoVerifier creates a verifier for the given users; client may be nil
+func NewMongoVerifier(npubToUser map[string]User, client *mongo.Client, database string) *MongoVerifier {
+	return &MongoVerifier{
+		Users:    npubToUser,
+		Client:   client,
+		Database: database,
+		lookup:   make(map[string]nip05Result),
+	}
+}
+
+// Verify names Trustroots users by their trustroots.org address
+func (v *MongoVerifier) Verify(hexPubkey string) (string, bool) {
+	npub, err := hexToNpub(hexPubkey)
+	if err != nil {
+		return "", false
+	}
+	if user, exists := v.Users[npub]; exists {
+		return fmt.Sprintf("%s@%s", user.Username, trustrootsDomain), true
+	}
+	if v.Client == nil {
+		return "", false
+	}
+
+	v.mu.Lock()
+	result, cached := v.lookup[npub]
+	v.mu.Unlock()
+	if cached && time.Since(result.CheckedAt) < nip05CacheTTL {
+		return result.Identifier, result.Identifier != ""
+	}
+
+	result = nip05Result{CheckedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoLookupTimeout)
+	defer cancel()
+	var user User
+	err = v.Client.Database(v.Database).Collection("users").FindOne(ctx, bson.M{"$or": bson.A{bson.M{"nostrNpub": npub}, bson.M{"nostrNpubs": npub}}}).Decode(&user)
+	switch {
+	case err == nil && user.Username != "":
+		result.Identifier = fmt.Sprintf("%s@%s", user.Username, trustrootsDomain)
+	case err != nil && err != mongo.ErrNoDocuments:
+		// Not cached, the next event tries again
+		fmt.Printf("⚠️  Failed to look up sender %s: %v\n", npub, err)
+		return "", false
+	}
+
+	v.mu.Lock()
+	v.lookup[npub] = result
+	v.mu.Unlock()
+	return result.Identifier, result.Identifier != ""
+}
+
+// ChainVerifier asks its verifiers in order; the first that verifies a sender
+// names them, else the first identifier found
+type ChainVerifier []SenderVerifier
+
+// Verify returns the result of the first verifier that verifies the sender
+func (c ChainVerifier) Verify(hexPubkey string) (string, bool) {
+	var name string
+	for _, verifier := range c {
+		identifier, ok := verifier.Verify(hexPubkey)
+		if ok {
+			return identifier, true
+		}
+		if name == "" {
+			name = identifier
+		}
+	}
+	return name, false
+}
+
+// newSenderVerifier chains the verifiers a configuration enables: Trustroots
+// users, then NIP-05 over HTTP
+func newSenderVerifier(npubToUser map[string]User, client *mongo.Client, config *Config, nip05 *NIP05Verifier) SenderVerifier {
+	chain := ChainVerifier{NewMongoVerifier(npubToUser, client, config.MongoDB.Database)}
+	if nip05 != nil {
+		chain = append(chain, nip05)
+	}
+	return chain
+}
+
+// verifySender returns how a sender is named and whether they are verified,
+// and records it in the sender's reputation
+func (es *EmailService) verifySender(hexPubkey string) (string, bool) {
+	if es.Senders == nil {
+		return "", false
+	}
+	identifier, verified := es.Senders.Verify(hexPubkey)
+	if es.Reputation != nil {
+		if err := es.Reputation.RecordVerification(hexPubkey, identifier, verified); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+	}
+	return identifier, verified
+}
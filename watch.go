@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Where watched notes go
+const (
+	watchDeliveryEmail  = "email"
+	watchDeliveryDigest = "digest"
+)
+
+// WatchConfig routes notes with watched hashtags or keywords to a monitoring
+// address, e.g. the moderators, for community monitoring
+type WatchConfig struct {
+	Hashtags []string // lowercase, without "#"
+	Keywords []string
+	Email    string
+	Delivery string // watchDeliveryEmail or watchDeliveryDigest
+}
+
+// Enabled reports whether anything is watched, and where matches go
+func (w WatchConfig) Enabled() bool {
+	return w.Email != "" && (len(w.Hashtags) > 0 || len(w.Keywords) > 0)
+}
+
+// parseWatchList parses a comma-separated list of hashtags or keywords
+func parseWatchList(value string) []string {
+	var list []string
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(entry), "#"))
+		if entry == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		list = append(list, entry)
+	}
+	return list
+}
+
+// parseWatchDelivery parses where watched notes go, email when empty
+func parseWatchDelivery(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "":
+		return watchDeliveryEmail, nil
+	case watchDeliveryEmail, watchDeliveryDigest:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid delivery %q, expected email or digest", value)
+}
+
+// Matches returns the watched hashtags (as "#tag") and keywords a note contains
+func (w WatchConfig) Matches(event *nostr.Event) []string {
+	var matches []string
+	for _, hashtag := range w.Hashtags {
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "t" && strings.ToLower(tag[1]) == hashtag {
+				matches = append(matches, "#"+hashtag)
+				break
+			}
+		}
+	}
+	for _, keyword := range w.Keywords {
+		if mentionsAlias(event.Content, []string{keyword}) {
+			matches = append(matches, keyword)
+		}
+	}
+	return matches
+}
+
+// watchFilters subscribes to watched hashtags, and to keywords through NIP-50
+// search on relays that support it; relays ignoring the search send notes that
+// are dropped when they do not match
+func watchFilters(kinds []int, hexPubkeys []string, hexToUser map[string]User, config *Config, since nostr.Timestamp, until *nostr.Timestamp) []nostr.Filter {
+	if !config.Watch.Enabled() {
+		return nil
+	}
+	var filters []nostr.Filter
+	if len(config.Watch.Hashtags) > 0 {
+		filters = append(filters, nostr.Filter{
+			Kinds: kinds,
+			Tags:  nostr.TagMap{"t": config.Watch.Hashtags},
+			Since: &since,
+			Until: until,
+		})
+	}
+	for _, keyword := range config.Watch.Keywords {
+		filters = append(filters, nostr.Filter{
+			Kinds:  kinds,
+			Search: keyword,
+			Since:  &since,
+			Until:  until,
+		})
+	}
+	return filters
+}
+
+// processWatchedNote routes a note with watched hashtags or keywords to the
+// monitoring address, once per note
+func processWatchedNote(event *nostr.Event, npubToUser map[string]User, config *Config, sqliteDB *sql.DB, emailService *EmailService) {
+	if !config.Watch.Enabled() {
+		return
+	}
+	matches := config.Watch.Matches(event)
+	if len(matches) == 0 {
+		return
+	}
+
+	notified, err := emailService.Notes.IsNotificationProcessed(event.ID, config.Watch.Email)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return
+	}
+	if notified {
+		return
+	}
+
+	fmt.Printf("🔭 Watched note %s matches %s\n", event.ID, strings.Join(matches, ", "))
+	if err := emailService.ProcessNostrWatchedNote(event, matches, npubToUser, config.Watch); err != nil {
+		fmt.Printf("❌ Failed to route watched note: %v\n", err)
+	}
+
+	if err := emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", config.Watch.Email); err != nil {
+		fmt.Printf("⚠️  Error marking watched note as processed: %v\n", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// followListFetchTimeout bounds how long we wait for relays when loading follow lists
+const followListFetchTimeout = 30 * time.Second
+
+// Web-of-trust policy actions
+const (
+	trustActionEmail  = "email"
+	trustActionDigest = "digest"
+	trustActionDrop   = "drop"
+)
+
+// FollowGraph holds the follow lists (kind 3) of monitored users by hex pubkey
+type FollowGraph struct {
+	mu        sync.RWMutex
+	follows   map[string]map[string]bool
+	updatedAt map[string]nostr.Timestamp
+}
+
+// NewFollowGraph creates an empty follow graph
+func NewFollowGraph() *FollowGraph {
+	return &FollowGraph{
+		follows:   make(map[string]map[string]bool),
+		updatedAt: make(map[string]nostr.Timestamp),
+	}
+}
+
+// Update stores a follow list event if it is newer than the one we have
+func (g *FollowGraph) Update(event *nostr.Event) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if updatedAt, exists := g.updatedAt[event.PubKey]; exists && updatedAt >= event.CreatedAt {
+		return
+	}
+	follows := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			follows[tag[1]] = true
+		}
+	}
+	g.follows[event.PubKey] = follows
+	g.updatedAt[event.PubKey] = event.CreatedAt
+}
+
+// Distance returns the social distance from a user to an author: 1 when the
+// user follows the author, 2 when someone the user follows does, and 0 when
+// the author is unknown. Only follow lists of monitored users are known, so
+// the second hop goes through followed Trustroots users.
+func (g *FollowGraph) Distance(userHexPubkey, authorHexPubkey string) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	follows := g.follows[userHexPubkey]
+	if follows[authorHexPubkey] {
+		return 1
+	}
+	for followed := range follows {
+		if g.follows[followed][authorHexPubkey] {
+			return 2
+		}
+	}
+	return 0
+}
+
+// loadFollowGraph fetches the current follow lists of the given users
+func loadFollowGraph(pool *nostr.SimplePool, relays []string, hexPubkeys []string) *FollowGraph {
+	graph := NewFollowGraph()
+
+	ctx, cancel := context.WithTimeout(context.Background(), followListFetchTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{Kinds: []int{nostr.KindFollowList}, Authors: hexPubkeys}
+	for evt := range pool.SubManyEose(ctx, relays, nostr.Filters{filter}) {
+		graph.Update(evt.Event)
+	}
+
+	fmt.Printf("🕸️  Loaded follow lists of %d users\n", len(graph.follows))
+	return graph
+}
+
+// TrustPolicy maps a social distance (1, 2 or 0 for unknown) to an action
+type TrustPolicy map[int]string
+
+// parseTrustPolicy parses a policy such as "1=email,2=digest,unknown=drop".
+// Distances without an entry are emailed.
+func parseTrustPolicy(value string) (TrustPolicy, error) {
+	policy := make(TrustPolicy)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		distanceStr, action, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid policy %q, expected distance=action", entry)
+		}
+
+		var distance int
+		switch strings.TrimSpace(distanceStr) {
+		case "1":
+			distance = 1
+		case "2":
+			distance = 2
+		case "unknown":
+			distance = 0
+		default:
+			return nil, fmt.Errorf("invalid distance %q, expected 1, 2 or unknown", distanceStr)
+		}
+
+		action = strings.TrimSpace(action)
+		if action != trustActionEmail && action != trustActionDigest && action != trustActionDrop {
+			return nil, fmt.Errorf("invalid action %q, expected email, digest or drop", action)
+		}
+		policy[distance] = action
+	}
+	return policy, nil
+}
+
+// WebOfTrust decides how to deliver a notification based on how close its
+// author is to the recipient in the follow graph
+type WebOfTrust struct {
+	Graph  *FollowGraph
+	Policy TrustPolicy
+}
+
+// Action returns the policy action for a notification from author to user
+func (w *WebOfTrust) Action(userHexPubkey, authorHexPubkey string) string {
+	if action, exists := w.Policy[w.Graph.Distance(userHexPubkey, authorHexPubkey)]; exists {
+		return action
+	}
+	return trustActionEmail
+}
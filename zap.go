@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ZapReceipt holds the parts of a NIP-57 zap receipt (kind 9735) used in emails
+type ZapReceipt struct {
+	AmountMsats  int64
+	ZapperPubkey string // author of the embedded zap request, not the LNURL server
+	Comment      string
+	Emoji        map[string]string // custom emoji (NIP-30) of the comment
+	ZappedNoteID string
+}
+
+// parseZapReceipt extracts amount, zapper and comment from a zap receipt and
+// checks it as far as NIP-57 Appendix F allows without the LNURL server (see
+// checkZapProvider): the embedded zap request must be signed by the zapper,
+// for the recipient and note of the receipt, and ask for the amount the
+// invoice is for.
+func parseZapReceipt(event *nostr.Event) (*ZapReceipt, error) {
+	descriptionTag := event.Tags.Find("description")
+	if descriptionTag == nil {
+		return nil, fmt.Errorf("zap receipt has no description tag")
+	}
+
+	var zapRequest nostr.Event
+	if err := json.Unmarshal([]byte(descriptionTag[1]), &zapRequest); err != nil {
+		return nil, fmt.Errorf("invalid zap request in description: %v", err)
+	}
+	if zapRequest.Kind != nostr.KindZapRequest {
+		return nil, fmt.Errorf("description is kind %d, not a zap request", zapRequest.Kind)
+	}
+	if zapRequest.GetID() != zapRequest.ID {
+		return nil, fmt.Errorf("zap request ID does not match its content")
+	}
+	if valid, _ := zapRequest.CheckSignature(); !valid {
+		return nil, fmt.Errorf("zap request is not signed by %s", zapRequest.PubKey)
+	}
+
+	// The zap request names the recipient and the zapped note
+	receiptRecipient, requestRecipient := event.Tags.Find("p"), zapRequest.Tags.Find("p")
+	if receiptRecipient == nil || requestRecipient == nil || !strings.EqualFold(receiptRecipient[1], requestRecipient[1]) {
+		return nil, fmt.Errorf("zap request is for another recipient")
+	}
+	receipt := &ZapReceipt{
+		ZapperPubkey: zapRequest.PubKey,
+		Comment:      zapRequest.Content,
+		Emoji:        customEmoji(&zapRequest),
+	}
+	if eTag := event.Tags.Find("e"); eTag != nil {
+		receipt.ZappedNoteID = eTag[1]
+	}
+	requestedNoteID := ""
+	if eTag := zapRequest.Tags.Find("e"); eTag != nil {
+		requestedNoteID = eTag[1]
+	}
+	if requestedNoteID != receipt.ZappedNoteID {
+		return nil, fmt.Errorf("zap request is for another note")
+	}
+
+	// The invoice is what was paid, it must be for the amount asked for
+	bolt11Tag := event.Tags.Find("bolt11")
+	if bolt11Tag == nil {
+		return nil, fmt.Errorf("zap receipt has no bolt11 invoice")
+	}
+	amount, err := parseBolt11Amount(bolt11Tag[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bolt11 invoice: %v", err)
+	}
+	if amountTag := zapRequest.Tags.Find("amount"); amountTag != nil {
+		if requested, err := strconv.ParseInt(amountTag[1], 10, 64); err != nil || requested != amount {
+			return nil, fmt.Errorf("invoice of %d msats does not pay the requested %s msats", amount, amountTag[1])
+		}
+	}
+	receipt.AmountMsats = amount
+
+	return receipt, nil
+}
+
+// parseBolt11Amount returns the amount of a BOLT-11 invoice in millisatoshis.
+// The amount is encoded in the human readable part, e.g. "lnbc2500u1..." is 2500 µBTC.
+func parseBolt11Amount(invoice string) (int64, error) {
+	invoice = strings.TrimPrefix(strings.ToLower(invoice), "lightning:")
+	separator := strings.LastIndex(invoice, "1")
+	if !strings.HasPrefix(invoice, "ln") || separator < 0 {
+		return 0, fmt.Errorf("not a bolt11 invoice")
+	}
+	hrp := invoice[2:separator]
+
+	// Skip the currency prefix (bc, tb, bcrt, ...)
+	amountStart := strings.IndexAny(hrp, "0123456789")
+	if amountStart < 0 {
+		return 0, fmt.Errorf("invoice has no amount")
+	}
+	amountPart := hrp[amountStart:]
+
+	// Millisatoshis per unit of the multiplier, 1 BTC = 1e11 msat; pico-BTC
+	// are a tenth of a millisatoshi
+	multipliers := map[byte]int64{'m': 100_000_000, 'u': 100_000, 'n': 100, 'p': 0}
+	unit := amountPart[len(amountPart)-1]
+	digits := amountPart
+	multiplier, hasUnit := multipliers[unit]
+	if hasUnit {
+		digits = amountPart[:len(amountPart)-1]
+	} else {
+		multiplier = 100_000_000_000
+	}
+	// Only digits, ParseInt would take a sign
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", amountPart)
+	}
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: %v", err)
+	}
+
+	var amount int64
+	switch {
+	case unit == 'p':
+		amount = value / 10
+	case value > math.MaxInt64/multiplier:
+		return 0, fmt.Errorf("invoice amount %q is too large", amountPart)
+	default:
+		amount = value * multiplier
+	}
+	if amount == 0 {
+		return 0, fmt.Errorf("invoice amount %q is less than a millisatoshi", amountPart)
+	}
+	return amount, nil
+}
+
+// processZapReceipt notifies users about zaps they received. Anyone can make
+// up a zap receipt, so only receipts signed by the recipient's LNURL server
+// (see checkZapProvider) are emailed from any zapper; other receipts are only
+// emailed from Trustroots users and verified zappers, like DMs.
+func processZapReceipt(event *nostr.Event, npubToUser map[string]User, hexToUser map[string]User, sqliteDB *sql.DB, emailService *EmailService) {
+	pTag := event.Tags.Find("p")
+	if pTag == nil {
+		return
+	}
+	recipientUser, exists := hexToUser[pTag[1]]
+	if !exists {
+		return
+	}
+
+	receipt, err := parseZapReceipt(event)
+	if err != nil {
+		fmt.Printf("⚠️  Skipping zap receipt %s: %v\n", event.ID, err)
+		return
+	}
+
+	zapperNpub, err := hexToNpub(receipt.ZapperPubkey)
+	if err != nil {
+		fmt.Printf("⚠️  Warning: Failed to convert zapper pubkey to npub: %v\n", err)
+		zapperNpub = receipt.ZapperPubkey // fallback to hex
+	}
+	zapperNIP5, verified := emailService.verifySender(receipt.ZapperPubkey)
+	_, isUser := hexToUser[receipt.ZapperPubkey]
+	if err := emailService.checkZapProvider(event, pTag[1]); err != nil && !verified && !isUser {
+		fmt.Printf("⚠️  Skipping zap receipt %s from unverified zapper %s: %v\n", event.ID, zapperNpub, err)
+		return
+	}
+
+	fmt.Printf("⚡ Zap of %d sats for %s from %s\n", receipt.AmountMsats/1000, recipientUser.Username, zapperNpub)
+
+	err = emailService.ProcessNostrZap(event, receipt, recipientUser, zapperNIP5, zapperNpub)
+	if err != nil {
+		fmt.Printf("❌ Failed to send email to %s: %v\n", recipientUser.Username, err)
+	} else {
+		fmt.Printf("📧 Email sent to %s\n", recipientUser.Username)
+	}
+
+	err = emailService.Notes.MarkNoteProcessed(event.ID, event.PubKey, "relay", recipientUser.Email)
+	if err != nil {
+		fmt.Printf("⚠️  Error marking zap receipt as processed: %v\n", err)
+	}
+	if err := emailService.Notes.RecordThreadID(event.ID, recipientUser.Email, threadID(event)); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
+
+// checkZapProvider checks that a zap receipt is signed by the LNURL server of
+// its recipient, which issued and saw the invoice paid (NIP-57 Appendix F)
+func (es *EmailService) checkZapProvider(event *nostr.Event, recipientHex string) error {
+	if es.ZapProviders == nil {
+		return fmt.Errorf("LNURL servers are not looked up")
+	}
+	providerPubkey, err := es.ZapProviders.Pubkey(recipientHex)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(event.PubKey, providerPubkey) {
+		return fmt.Errorf("receipt signed by %s, not by the LNURL server of the recipient", event.PubKey)
+	}
+	return nil
+}
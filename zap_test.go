@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseBolt11Amount(t *testing.T) {
+	tests := []struct {
+		invoice string
+		want    int64 // msats, 0 for an error
+	}{
+		{"lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqf", 250_000_000},
+		{"LNBC2500U1PVJLUEZPP5QQQSYQCYQ5RQWZQF", 250_000_000},
+		{"lightning:lnbc2500u1pvjluez", 250_000_000},
+		{"lnbc20m1pvjluezpp5qqqsyqcyq5rqwzqf", 2_000_000_000},
+		{"lnbc210n1pvjluez", 21_000},
+		{"lnbc10p1pvjluez", 1},
+		{"lnbc25001pvjluez", 2_500 * 100_000_000_000},
+		{"lntb2500u1pvjluez", 250_000_000},
+		{"lnbcrt2500u1pvjluez", 250_000_000},
+		{"lnbc1pvjluezpp5qqqsyqcyq5rqwzqf", 0},  // no amount
+		{"lnbc5p1pvjluez", 0},                   // less than a millisatoshi
+		{"lnbc0u1pvjluez", 0},                   // zero
+		{"lnbcu1pvjluez", 0},                    // multiplier without digits
+		{"lnbc2x5u1pvjluez", 0},                 // not a number
+		{"lnbc92233720369m1pvjluez", 0},         // overflows int64
+		{"lnbc9223372036854775807u1pvjluez", 0}, // overflows int64
+		{"lnbc99999999999999999999n1pvjluez", 0},
+		{"bc2500u1pvjluez", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		got, err := parseBolt11Amount(tt.invoice)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("parseBolt11Amount(%q) = %d, want an error", tt.invoice, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseBolt11Amount(%q) = %d, %v, want %d", tt.invoice, got, err, tt.want)
+		}
+	}
+}
+
+// zapFixture makes signed zap receipts to a recipient
+type zapFixture struct {
+	t                                    *testing.T
+	zapperSecret, providerSecret         string
+	zapperPubkey, providerPubkey, noteID string
+	recipient                            string
+}
+
+func newZapFixture(t *testing.T) *zapFixture {
+	f := &zapFixture{t: t, zapperSecret: nostr.GeneratePrivateKey(), providerSecret: nostr.GeneratePrivateKey()}
+	f.zapperPubkey, _ = nostr.GetPublicKey(f.zapperSecret)
+	f.providerPubkey, _ = nostr.GetPublicKey(f.providerSecret)
+	f.recipient, _ = nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	f.noteID = testEventID
+	return f
+}
+
+// request returns a zap request of the zapper for 21 sats, changed by modify
+// before it is signed
+func (f *zapFixture) request(modify func(*nostr.Event)) nostr.Event {
+	request := nostr.Event{
+		Kind:      nostr.KindZapRequest,
+		CreatedAt: nostr.Now(),
+		Content:   "Great post!",
+		Tags: nostr.Tags{
+			{"p", f.recipient},
+			{"e", f.noteID},
+			{"amount", "21000"},
+			{"relays", "wss://relay.example.org"},
+		},
+	}
+	if modify != nil {
+		modify(&request)
+	}
+	if err := request.Sign(f.zapperSecret); err != nil {
+		f.t.Fatal(err)
+	}
+	return request
+}
+
+// receipt returns a receipt of the provider for a zap request, changed by
+// modify before it is signed
+func (f *zapFixture) receipt(request nostr.Event, modify func(*nostr.Event)) *nostr.Event {
+	description, err := json.Marshal(request)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	receipt := &nostr.Event{
+		Kind:      nostr.KindZap,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", f.recipient},
+			{"e", f.noteID},
+			{"bolt11", "lnbc210n1pvjluezpp5qqqsyqcyq5rqwzqf"},
+			{"description", string(description)},
+		},
+	}
+	if modify != nil {
+		modify(receipt)
+	}
+	if err := receipt.Sign(f.providerSecret); err != nil {
+		f.t.Fatal(err)
+	}
+	return receipt
+}
+
+// setTag replaces the value of the first tag with a name
+func setTag(event *nostr.Event, name, value string) {
+	for _, tag := range event.Tags {
+		if tag[0] == name {
+			tag[1] = value
+		}
+	}
+}
+
+func TestParseZapReceipt(t *testing.T) {
+	f := newZapFixture(t)
+	receipt, err := parseZapReceipt(f.receipt(f.request(nil), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.AmountMsats != 21_000 || receipt.ZapperPubkey != f.zapperPubkey || receipt.Comment != "Great post!" || receipt.ZappedNoteID != f.noteID {
+		t.Errorf("receipt = %+v", receipt)
+	}
+
+	// Profile zaps are for no note, and may leave the amount to the invoice
+	request := f.request(func(request *nostr.Event) {
+		request.Tags = nostr.Tags{{"p", f.recipient}}
+	})
+	receipt, err = parseZapReceipt(f.receipt(request, func(receipt *nostr.Event) {
+		receipt.Tags = append(nostr.Tags{}, receipt.Tags[0], receipt.Tags[2], receipt.Tags[3])
+	}))
+	if err != nil || receipt.AmountMsats != 21_000 || receipt.ZappedNoteID != "" {
+		t.Errorf("profile zap = %+v, %v", receipt, err)
+	}
+}
+
+func TestParseZapReceiptRejectsForgeries(t *testing.T) {
+	f := newZapFixture(t)
+	otherPubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	// A zap request changed after it was signed
+	tampered := f.request(nil)
+	tampered.Content = "Send me your password"
+	// A zap request claiming another author
+	impersonated := f.request(nil)
+	impersonated.PubKey = otherPubkey
+	// A zap request with the signature of another one
+	resigned := f.request(nil)
+	resigned.Sig = f.request(func(request *nostr.Event) { request.Content = "other" }).Sig
+
+	tests := []struct {
+		name    string
+		receipt *nostr.Event
+	}{
+		{"tampered request", f.receipt(tampered, nil)},
+		{"impersonated zapper", f.receipt(impersonated, nil)},
+		{"signature of another request", f.receipt(resigned, nil)},
+		{"unsigned request", f.receipt(f.request(nil), func(receipt *nostr.Event) {
+			var request nostr.Event
+			json.Unmarshal([]byte(receipt.Tags.Find("description")[1]), &request)
+			request.Sig = ""
+			description, _ := json.Marshal(request)
+			setTag(receipt, "description", string(description))
+		})},
+		{"request for another recipient", f.receipt(f.request(func(request *nostr.Event) { setTag(request, "p", otherPubkey) }), nil)},
+		{"request for another note", f.receipt(f.request(func(request *nostr.Event) { setTag(request, "e", otherPubkey) }), nil)},
+		{"invoice for less than requested", f.receipt(f.request(nil), func(receipt *nostr.Event) {
+			setTag(receipt, "bolt11", "lnbc10n1pvjluez")
+		})},
+		{"invoice for more than requested", f.receipt(f.request(func(request *nostr.Event) { setTag(request, "amount", "1000") }), nil)},
+		{"overflowing invoice", f.receipt(f.request(nil), func(receipt *nostr.Event) {
+			setTag(receipt, "bolt11", "lnbc92233720369m1pvjluez")
+		})},
+		{"no invoice", f.receipt(f.request(nil), func(receipt *nostr.Event) {
+			receipt.Tags = append(nostr.Tags{}, receipt.Tags[0], receipt.Tags[1], receipt.Tags[3])
+		})},
+		{"no zap request", f.receipt(f.request(nil), func(receipt *nostr.Event) {
+			receipt.Tags = receipt.Tags[:3]
+		})},
+		{"invalid zap request", f.receipt(f.request(nil), func(receipt *nostr.Event) {
+			setTag(receipt, "description", "{not json")
+		})},
+		{"other kind", f.receipt(f.request(func(request *nostr.Event) { request.Kind = nostr.KindTextNote }), nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if receipt, err := parseZapReceipt(tt.receipt); err == nil {
+				t.Errorf("parseZapReceipt = %+v, want an error", receipt)
+			}
+		})
+	}
+}
+
+// newTestZapProviders returns LNURL lookups answered by an LNURL server that
+// announces a zap key, for a recipient whose profile has its lightning address
+func newTestZapProviders(t *testing.T, recipient, providerPubkey string) *ZapProviders {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/lnurlp/alice" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"tag": "payRequest", "allowsNostr": true, "nostrPubkey": %q}`, providerPubkey)
+	}))
+	t.Cleanup(server.Close)
+
+	// Profiles are only looked up with a pool, the cache answers before it is used
+	names := NewProfileNames(nil, nostr.NewSimplePool(context.Background()), nil)
+	names.profiles[recipient] = profileContent{LUD16: "alice@" + strings.TrimPrefix(server.URL, "https://")}
+	providers := NewZapProviders(names)
+	providers.Client = server.Client()
+	return providers
+}
+
+func TestCheckZapProvider(t *testing.T) {
+	f := newZapFixture(t)
+	es := NewEmailService("localhost", 25, "user", "password", "from@example.org", "From")
+	receipt := f.receipt(f.request(nil), nil)
+
+	if err := es.checkZapProvider(receipt, f.recipient); err == nil {
+		t.Error("receipt checked without LNURL lookups")
+	}
+
+	es.ZapProviders = newTestZapProviders(t, f.recipient, f.providerPubkey)
+	if err := es.checkZapProvider(receipt, f.recipient); err != nil {
+		t.Errorf("receipt of the LNURL server: %v", err)
+	}
+
+	// Receipts made up by anyone else
+	forger := nostr.GeneratePrivateKey()
+	if err := receipt.Sign(forger); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.checkZapProvider(receipt, f.recipient); err == nil {
+		t.Error("accepted a receipt not signed by the LNURL server")
+	}
+
+	// Recipients without a lightning address get no receipts checked
+	otherRecipient, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	es.ZapProviders.Profiles.profiles[otherRecipient] = profileContent{Name: "bob"}
+	if err := es.checkZapProvider(receipt, otherRecipient); err == nil {
+		t.Error("accepted a receipt for a recipient without a lightning address")
+	}
+}
+
+func TestProcessZapReceiptRejectsForgedReceipts(t *testing.T) {
+	f := newZapFixture(t)
+	db, err := initSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	es := NewEmailService("localhost", 25, "user", "password", "from@example.org", "From")
+	es.DryRun = true
+	es.Notes = &SQLiteNoteStore{DB: db}
+	es.ZapProviders = newTestZapProviders(t, f.recipient, f.providerPubkey)
+
+	alice := testUser(t, "alice", "alice@example.org", f.recipient)
+	index := NewUserIndex([]User{alice})
+
+	// Made up by the zapper, who is no Trustroots user
+	forged := f.receipt(f.request(nil), nil)
+	if err := forged.Sign(f.zapperSecret); err != nil {
+		t.Fatal(err)
+	}
+	processZapReceipt(forged, index.NpubToUser, index.HexToUser, db, es)
+	if len(es.DryRunJobs) != 0 {
+		t.Fatalf("emailed a forged receipt: %+v", es.DryRunJobs)
+	}
+
+	processZapReceipt(f.receipt(f.request(nil), nil), index.NpubToUser, index.HexToUser, db, es)
+	if len(es.DryRunJobs) != 1 || es.DryRunJobs[0].To != alice.Email {
+		t.Fatalf("jobs = %+v, want one email about the zap", es.DryRunJobs)
+	}
+	if !strings.Contains(es.DryRunJobs[0].Subject, "21 sats") {
+		t.Errorf("subject = %q", es.DryRunJobs[0].Subject)
+	}
+}